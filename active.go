@@ -5,12 +5,17 @@
 package lackey
 
 import (
+	"context"
+	"fmt"
 	"os"
-	"os/exec"
-	"strconv"
+	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/cassava/lackey/audio/codec"
 	"github.com/cassava/lackey/audio/mp3"
+	"github.com/cassava/lackey/audio/ogg"
+	"github.com/cassava/lackey/filetype"
 	"github.com/goulash/audio"
 	"github.com/goulash/color"
 	"github.com/goulash/osutil"
@@ -23,8 +28,13 @@ type ExecError struct {
 
 func (err *ExecError) Error() string { return err.Err.Error() }
 
+// Encoder encodes the file src to the file dst. The Runner uses encoders
+// through StreamEncoder, which all encoders in this package implement;
+// others are adapted with NewStreamEncoder.
 type Encoder interface {
 	Ext() string
+	// CanCopy returns true if src should be copied instead of transcoded.
+	// The destination dst may be nil if it is not known yet.
 	CanCopy(src, dst Audio) bool
 	Encode(src, dst string, md Audio) error
 }
@@ -32,8 +42,60 @@ type Encoder interface {
 type Runner struct {
 	Color *color.Colorizer
 
+	// Context stops any encoding when it is done. If it is nil,
+	// encoding is not stopped.
+	Context context.Context
+
 	Encoder        Encoder
+	Policy         Policy
 	ForceTranscode bool
+
+	// Spoken is the profile of spoken-word sources, which are encoded with
+	// its encoder instead of Encoder. If it is nil, they are music.
+	Spoken *SpokenWord
+
+	// MinSavings is the fraction of the size of a source that transcoding
+	// must save, or else the source is copied instead. This is remembered
+	// in State, if it is not nil, so that it is not transcoded again.
+	MinSavings float64
+	State      *State
+
+	// ID3Version is the version of the ID3v2 tags, 3 or 4, that MP3 files
+	// are given when they are encoded or copied, which normalizes their
+	// tags. If it is 0, their tags are left as they are.
+	ID3Version byte
+
+	// ReplayGain selects how the loudness of the outputs is normalized,
+	// with the gain of each track and of the album directory it is in.
+	ReplayGain ReplayGain
+	albumsMu   sync.Mutex
+	albums     map[string]*albumGains
+
+	// EmbedCover embeds a cover in every output: the picture embedded in
+	// its source, or else the best of CoverSources in the directory of the
+	// source, as Planner ranks them. Covers larger than EmbedCoverSize
+	// pixels are scaled down. Copied files are only given a cover if they
+	// have none.
+	EmbedCover     bool
+	EmbedCoverSize int
+	CoverSources   []string
+
+	// EmbeddedArt strips or shrinks the pictures embedded in outputs that
+	// are copied or transcoded, before any cover is embedded.
+	EmbeddedArt EmbeddedArt
+
+	// EmbedLyrics embeds the sidecar lyrics of sources, which share their
+	// name and end in .lrc, .lyrics, or .txt, in outputs without lyrics.
+	EmbedLyrics bool
+
+	// CoverSize is the maximum width and height of covers that are
+	// downscaled or extracted, or 0 to keep their size, and CoverQuality
+	// the quality of those that are encoded as JPEG, from 1 to 100, or 0
+	// for imaging.DefaultQuality. They are encoded in the format of their
+	// destination name.
+	CoverSize    int
+	CoverQuality int
+
 	CopyExtensions []string
 
 	DryRun    bool
@@ -41,6 +103,11 @@ type Runner struct {
 	Strip     bool
 	SrcPrefix string
 	DstPrefix string
+
+	// UnpackPrefix is the directory that the archives of the source library
+	// are unpacked into, as Database.UnpackDir returns it, where sources
+	// have the same key as in the library.
+	UnpackPrefix string
 }
 
 func (o *Runner) WhichExt(src Audio) string {
@@ -51,16 +118,72 @@ func (o *Runner) WhichExt(src Audio) string {
 			return ext
 		}
 	}
-	return o.Encoder.Ext()
+	if o.kept(src) {
+		return filepath.Ext(name)
+	}
+	// Files that are copied keep their extension, such as AAC files
+	// that are copied instead of being transcoded to MP3.
+	e := o.encoder(src)
+	if ext := strings.ToLower(filepath.Ext(name)); ext != e.Ext() && o.canCopy(src, nil) {
+		return ext
+	}
+	return e.Ext()
 }
 
 // canEncode returns true if this runner can encode the codec.
 func (o *Runner) canEncode(c audio.Codec) bool {
-	return c == audio.FLAC || c == audio.MP3 || c == audio.M4A || c == audio.OGG
+	switch c {
+	case audio.FLAC, audio.MP3, audio.M4A, audio.OGG, codec.Opus:
+		return true
+	case audio.ALAC, audio.AAC, audio.M4B:
+		return true
+	case audio.WAV, codec.AIFF, audio.WV, audio.APE, codec.DSF:
+		// These are decoded by ffmpeg.
+		return true
+	}
+	return false
+}
+
+// canCopy returns true if src should be copied instead of transcoded,
+// according to the policy or otherwise the encoder.
+func (o *Runner) canCopy(src, dst Audio) bool {
+	if o.kept(src) {
+		return true
+	}
+	if o.Spoken.Is(src) {
+		return o.Spoken.Encoder.CanCopy(src, dst)
+	}
+	if op, ok := o.Policy.Decide(src); ok {
+		return op == CopyAudio
+	}
+	return o.Encoder.CanCopy(src, dst)
+}
+
+// kept returns true if src was copied before because transcoding it
+// did not save enough space.
+func (o *Runner) kept(src Audio) bool {
+	return o.MinSavings > 0 && o.State != nil && o.State.IsKept(o.srcKey(src.AbsPath()), src.FileInfo(), o.encoder(src).Ext())
+}
+
+// srcKey returns the key of a source in the state.
+func (o *Runner) srcKey(src string) string {
+	if o.UnpackPrefix != "" && strings.HasPrefix(src, o.UnpackPrefix) {
+		return strings.TrimPrefix(src, o.UnpackPrefix)
+	}
+	return strings.TrimPrefix(src, o.SrcPrefix)
+}
+
+// ignore returns true if src is neither copied nor transcoded.
+func (o *Runner) ignore(src Audio) bool {
+	op, ok := o.Policy.Decide(src)
+	if ok && op == IgnoreAudio {
+		return true
+	}
+	return !o.canEncode(src.Encoding()) && !o.canCopy(src, nil)
 }
 
 func (o *Runner) transcodeOrCopy(src, dst Audio) AudioOperation {
-	if o.Encoder.CanCopy(src, dst) {
+	if o.canCopy(src, dst) {
 		return CopyAudio
 	}
 	return TranscodeAudio
@@ -85,11 +208,11 @@ func (o *Runner) Which(src, dst Audio) AudioOperation {
 		}
 	}
 
-	if !o.canEncode(src.Encoding()) {
+	if o.ignore(src) {
 		return IgnoreAudio
 	}
 
-	if o.ForceTranscode {
+	if o.ForceTranscode && o.canEncode(src.Encoding()) {
 		return TranscodeAudio
 	}
 
@@ -101,11 +224,49 @@ func (o *Runner) Which(src, dst Audio) AudioOperation {
 		return o.transcodeOrCopy(src, dst)
 	}
 	if sfi.ModTime().After(dfi.ModTime()) {
+		if o.canCopy(src, dst) {
+			return CopyAudio
+		}
+		if o.knownAudio(src) {
+			return RetagAudio
+		}
 		return UpdateAudio
 	}
 	return SkipAudio
 }
 
+// knownAudio returns true if the audio hash of src was remembered when it
+// was last transcoded, so that Retag can tell whether only its tags have
+// changed. Hashing the audio reads all of it, which is left to Retag.
+func (o *Runner) knownAudio(src Audio) bool {
+	return o.State != nil && o.State.Hash(o.srcKey(src.AbsPath())) != ""
+}
+
+// sameAudio returns true if the audio of src has not changed since it was
+// last transcoded, so that only its tags need to be written again.
+func (o *Runner) sameAudio(src Audio) bool {
+	if o.State == nil {
+		return false
+	}
+	old := o.State.Hash(o.srcKey(src.AbsPath()))
+	if old == "" {
+		return false
+	}
+	h, err := AudioHash(src.AbsPath(), src.Encoding())
+	return err == nil && h == old
+}
+
+// rememberAudio records the audio hash of src in the state, if possible.
+func (o *Runner) rememberAudio(src string, md Audio) {
+	if o.State == nil {
+		return
+	}
+	h, err := AudioHash(src, md.Encoding())
+	if err == nil && h != "" {
+		o.State.SetHash(o.srcKey(src), h)
+	}
+}
+
 func (o *Runner) Ok(dst string) error {
 	if o.Strip {
 		dst = strings.TrimPrefix(dst, o.DstPrefix)
@@ -126,7 +287,7 @@ func (o *Runner) Ignore(dst string) error {
 
 func (o *Runner) Error(err error) error {
 	o.Color.Fprintf(os.Stderr, "@rerror:@|    %s\n", err)
-	if e, ok := err.(*ExecError); ok {
+	if e, ok := err.(*ExecError); ok && e.Output != "" {
 		o.Color.Fprintf(os.Stderr, "@routput:@|\n%s\n", e.Output)
 	}
 	return err
@@ -134,7 +295,7 @@ func (o *Runner) Error(err error) error {
 
 func (o *Runner) Warn(err error) error {
 	o.Color.Fprintf(os.Stderr, "@rwarning:@|  %s\n", err)
-	if e, ok := err.(*ExecError); ok {
+	if e, ok := err.(*ExecError); ok && e.Output != "" {
 		o.Color.Fprintf(os.Stderr, "@routput:@|\n%s\n", e.Output)
 	}
 	return nil
@@ -189,7 +350,59 @@ func (o *Runner) CopyFile(src, dst string) error {
 		return nil
 	}
 
-	return osutil.CopyFile(src, path)
+	err := osutil.CopyFile(src, path)
+	if err == nil && o.ID3Version != 0 && isMP3(path) {
+		err = o.convertID3(path)
+	}
+	if err == nil && filetype.Identify(path) == filetype.Audio {
+		err = o.finishCopy(src, path)
+	}
+	return err
+}
+
+// finishCopy gives the copy of the audio file src at path the gain, the
+// embedded art, and the cover that the runner gives outputs.
+func (o *Runner) finishCopy(src, path string) error {
+	ctx := o.context()
+	if o.ReplayGain != NoReplayGain {
+		if err := o.tagGain(ctx, src, path, nil); err != nil {
+			return err
+		}
+	}
+	if err := o.applyArt(path); err != nil {
+		return err
+	}
+	if o.EmbedLyrics {
+		if err := o.embedLyrics(ctx, src, path); err != nil {
+			return err
+		}
+	}
+	if o.EmbedCover {
+		return o.embedCover(ctx, src, path, false)
+	}
+	return nil
+}
+
+// context returns the context of the runner, or the background context.
+func (o *Runner) context() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
+}
+
+// convertID3 rewrites the ID3v2 tag of the MP3 file at path in ID3Version.
+func (o *Runner) convertID3(path string) error {
+	t, err := mp3.ReadTag(path)
+	if err != nil {
+		return err
+	}
+	t.ConvertTo(o.ID3Version)
+	return t.Write(path)
+}
+
+func isMP3(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".mp3")
 }
 
 func (o *Runner) Transcode(src, dst string, md Audio) error {
@@ -203,13 +416,112 @@ func (o *Runner) Transcode(src, dst string, md Audio) error {
 		return nil
 	}
 
-	if ex, _ := osutil.FileExists(path); ex {
-		err := os.Remove(path)
-		if err != nil {
+	ctx := o.context()
+	e := o.encoder(md)
+	job := &Job{
+		Source: src,
+		Audio:  md,
+	}
+	var gain *Gain
+	if o.appliesGain(e) {
+		var err error
+		if gain, err = o.gain(ctx, src); err != nil {
+			return err
+		}
+		if !encodesOpus(e) {
+			job.Gain = gain.Applied()
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	job.Output = f
+	settings, err := NewStreamEncoder(e).EncodeStream(ctx, job)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if o.Verbose && len(settings.Command) != 0 {
+		o.Color.Printf("@.settings:@| %s\n", settings)
+	}
+	if o.ID3Version != 0 && isMP3(path) {
+		if err := o.convertID3(path); err != nil {
 			return err
 		}
 	}
-	return o.Encoder.Encode(src, path, md)
+	if err := o.writeGain(ctx, e, src, path, gain); err != nil {
+		return err
+	}
+	if err := copyChapters(ctx, src, md.Encoding(), path); err != nil {
+		return err
+	}
+	if err := o.applyArt(path); err != nil {
+		return err
+	}
+	if o.EmbedLyrics {
+		if err := o.embedLyrics(ctx, src, path); err != nil {
+			return err
+		}
+	}
+	if o.EmbedCover {
+		if err := o.embedCover(ctx, src, path, true); err != nil {
+			return err
+		}
+	}
+	o.rememberAudio(src, md)
+	if o.MinSavings > 0 {
+		return o.checkSavings(src, path, dst, e)
+	}
+	return nil
+}
+
+// checkSavings replaces the file at path, which e transcoded from src,
+// with a copy of src, if transcoding did not save at least MinSavings of
+// the size of src. The copy keeps the extension of src.
+func (o *Runner) checkSavings(src, path, name string, e Encoder) error {
+	sfi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	dfi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	savings := 1 - float64(dfi.Size())/float64(sfi.Size())
+	key := o.srcKey(src)
+	if savings >= o.MinSavings {
+		if o.State != nil {
+			o.State.Forget(key)
+		}
+		return nil
+	}
+
+	ext := filepath.Ext(src)
+	name = strings.TrimSuffix(name, filepath.Ext(name)) + ext
+	o.Color.Printf("@gkeep:@|     %s (saves %.0f%%)\n", name, 100*savings)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	path = strings.TrimSuffix(path, filepath.Ext(path)) + ext
+	if err := osutil.CopyFile(src, path); err != nil {
+		return err
+	}
+	if err := o.finishCopy(src, path); err != nil {
+		return err
+	}
+	if o.State != nil {
+		o.State.Keep(key, &KeptSource{
+			Size:    sfi.Size(),
+			ModTime: sfi.ModTime(),
+			Ext:     e.Ext(),
+			Savings: savings,
+		})
+	}
+	return nil
 }
 
 func (o *Runner) DownscaleCover(src, dst string) error {
@@ -223,12 +535,29 @@ func (o *Runner) DownscaleCover(src, dst string) error {
 		return nil
 	}
 
-	bs, err := exec.Command("convert", src, "-resize", "500x500", "-quality", "60%", path).CombinedOutput()
-	if err != nil {
-		return &ExecError{
-			Err:    err,
-			Output: string(bs),
-		}
+	return scaleCover(src, path, o.CoverSize, o.CoverQuality)
+}
+
+// ExtractCover writes the picture embedded in the audio file src to dst,
+// which is the cover of its album, as DownscaleCover does. Nothing is
+// written if src has no picture.
+func (o *Runner) ExtractCover(src, dst string) error {
+	p, err := embeddedPicture(src)
+	if err != nil || p == nil {
+		return err
+	}
+
+	path := dst
+	if o.Strip {
+		dst = strings.TrimPrefix(dst, o.DstPrefix)
+	}
+	o.Color.Printf("@gextract:@|  %s\n", dst)
+
+	if o.DryRun {
+		return nil
+	}
+	if err := writeCover(p.Data, path, o.CoverSize, o.CoverQuality); err != nil {
+		return fmt.Errorf("cannot write cover of %s: %s", src, err)
 	}
 	return nil
 }
@@ -251,74 +580,79 @@ func (o *Runner) Update(src, dst string, md Audio) error {
 	return o.Transcode(src, path, md)
 }
 
-type MP3Encoder struct {
-	TargetQuality    int
-	BitrateThreshold int
-}
-
-func (e *MP3Encoder) Ext() string { return ".mp3" }
+// Retag replaces the tags and pictures of dst with those of src, without
+// transcoding the audio again, as described by WriteTags. If the audio of
+// src has changed after all, dst is updated instead.
+func (o *Runner) Retag(src, dst string, md Audio) error {
+	if !o.sameAudio(md) {
+		return o.Update(src, dst, md)
+	}
+	path := dst
+	if o.Strip {
+		dst = strings.TrimPrefix(dst, o.DstPrefix)
+	}
+	o.Color.Printf("@gretag:@|    %s\n", dst)
+	if o.DryRun {
+		return nil
+	}
 
-func (e *MP3Encoder) CanCopy(src, dst Audio) bool {
-	if src.Encoding() != audio.MP3 {
-		return false
+	// The gain of the output is kept, since its audio is the same.
+	ctx := o.context()
+	var prev *Gain
+	if o.ReplayGain != NoReplayGain {
+		prev = o.outputGain(path)
 	}
-	sm := src.Metadata()
-	if sm.EncodingBitrate() > e.BitrateThreshold {
-		return false
+	if err := copyTags(ctx, src, md.Encoding(), path); err != nil {
+		return err
 	}
-	return true
-}
-
-func (e *MP3Encoder) Encode(src, dst string, md Audio) error {
-	q := strconv.FormatInt(int64(e.TargetQuality), 10)
-	var bs []byte
-	var err error
-	if md.Encoding() == audio.MP3 {
-		// We are much more reliable using lame directly than over ffmpeg when downsampling
-		// MP3 files directly.
-		bs, err = exec.Command("lame", "--mp3input", "-h", "-V"+q, src, dst).CombinedOutput()
-	} else if md.Encoding() == audio.FLAC {
-		// Because ffmpeg is having some bugs, we avoid using it when possible.
-		enc := mp3.NewEncoder()
-		enc.Quality = e.TargetQuality
-		dec := exec.Command("flac", "-c", "-d", src)
-		bs, err = enc.EncodeFromStdin(dec, dst, md.Metadata())
-	} else {
-		bs, err = exec.Command("ffmpeg", "-i", src, "-vn", "-qscale:a", q, dst).CombinedOutput()
+	if o.ID3Version != 0 && isMP3(path) {
+		if err := o.convertID3(path); err != nil {
+			return err
+		}
 	}
-	if err != nil {
-		return &ExecError{
-			Err:    err,
-			Output: string(bs),
+	if err := copyPictures(src, path); err != nil {
+		return err
+	}
+	if err := copyChapters(ctx, src, md.Encoding(), path); err != nil {
+		return err
+	}
+	if err := o.applyArt(path); err != nil {
+		return err
+	}
+	if o.EmbedLyrics {
+		// The tags of src replaced the lyrics that were embedded.
+		if err := o.embedLyrics(ctx, src, path); err != nil {
+			return err
 		}
 	}
+	if o.EmbedCover {
+		if err := o.embedCover(ctx, src, path, true); err != nil {
+			return err
+		}
+	}
+	switch {
+	case o.appliesGain(o.encoder(md)):
+		return o.removeGain(ctx, path)
+	case o.ReplayGain != NoReplayGain:
+		return o.tagGain(ctx, src, path, prev)
+	}
 	return nil
 }
 
-type OPUSEncoder struct {
-	Extension     string
-	TargetBitrate string
-}
-
-func (e *OPUSEncoder) Ext() string {
-	if e.Extension == "" {
-		return ".opus"
+// writeGain normalizes the loudness of the output at path, which e encoded
+// from src. If gain is not nil, it has been applied to the audio already,
+// or is set in the header of Opus files, and gain tags are removed.
+func (o *Runner) writeGain(ctx context.Context, e Encoder, src, path string, gain *Gain) error {
+	switch {
+	case o.ReplayGain == NoReplayGain:
+		return nil
+	case gain == nil:
+		return o.tagGain(ctx, src, path, nil)
 	}
-	return e.Extension
-}
-
-func (e *OPUSEncoder) CanCopy(src, dst Audio) bool {
-	return false
-}
-
-func (e *OPUSEncoder) Encode(src, dst string, md Audio) error {
-	bs, err := exec.Command("ffmpeg", "-i", src, "-vn", "-acodec", "libopus", "-vbr", "on",
-		"-compression_level", "10", "-b:a", e.TargetBitrate, dst).CombinedOutput()
-	if err != nil {
-		return &ExecError{
-			Err:    err,
-			Output: string(bs),
+	if encodesOpus(e) {
+		if err := ogg.SetOutputGain(path, q78(gain.Applied())); err != nil {
+			return err
 		}
 	}
-	return nil
+	return o.removeGain(ctx, path)
 }
@@ -0,0 +1,316 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/filetype"
+	"github.com/goulash/audio"
+)
+
+// archiveExts are the extensions of the archives that are read as
+// directories, where those of compressed tar files come first.
+var archiveExts = []string{".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar", ".zip"}
+
+// archiveName returns the name of the archive file without its extension,
+// and false if it is not an archive that can be read.
+func archiveName(name string) (string, bool) {
+	lower := strings.ToLower(name)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(lower, ext) && len(name) > len(ext) {
+			return name[:len(name)-len(ext)], true
+		}
+	}
+	return "", false
+}
+
+// archiveInfo describes an archive as the directory it is read as, and
+// the directories in it.
+type archiveInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi *archiveInfo) Name() string      { return fi.name }
+func (fi *archiveInfo) IsDir() bool       { return true }
+func (fi *archiveInfo) Mode() os.FileMode { return fi.FileInfo.Mode() | os.ModeDir }
+
+// memberInfo describes a file in an archive, as it is listed in its index.
+type memberInfo struct {
+	name string
+	size int64
+	mod  time.Time
+}
+
+func (fi *memberInfo) Name() string       { return fi.name }
+func (fi *memberInfo) Size() int64        { return fi.size }
+func (fi *memberInfo) Mode() os.FileMode  { return 0644 }
+func (fi *memberInfo) ModTime() time.Time { return fi.mod }
+func (fi *memberInfo) IsDir() bool        { return false }
+func (fi *memberInfo) Sys() interface{}   { return nil }
+
+// archiveMember is a regular file in an archive.
+type archiveMember struct {
+	a    *archive
+	name string // name in the archive
+	rel  string // slash-separated path below the directory of the archive
+	info *memberInfo
+
+	codec    audio.Codec
+	certain  bool // whether the codec is certain, or only guessed by name
+	identify sync.Once
+	unpacked bool
+}
+
+// isAudio returns true if the member is an audio file, judging by its name.
+func (m *archiveMember) isAudio() bool {
+	return m.codec != audio.Unknown
+}
+
+// isVideo returns true if the member is a video, judging by its name.
+func (m *archiveMember) isVideo() bool {
+	return filetype.IdentifyName(m.rel) == filetype.Video
+}
+
+// archive is an archive that is read as a directory. Its members are read
+// from its index, and are only unpacked into dir when they are needed.
+type archive struct {
+	file    string
+	dir     string
+	mod     time.Time
+	members []*archiveMember
+
+	mu sync.Mutex
+}
+
+// readArchive reads the index of the archive file, whose modification time
+// is mod, to be unpacked into dir. Members are given the modification time
+// of the archive, unless theirs is later, so that they change whenever the
+// archive does. If all members are in a single directory, its content is
+// read as that of the archive instead.
+func readArchive(file, dir string, mod time.Time) (*archive, error) {
+	a := &archive{file: file, dir: dir, mod: mod}
+	seen := make(map[string]bool)
+	err := a.scan(func(name string, size int64, modified time.Time, _ io.Reader) error {
+		// Only the first member of a name is read, as it is unpacked.
+		rel := memberPath(name)
+		if rel == "" || seen[name] {
+			return nil
+		}
+		seen[name] = true
+		if modified.Before(mod) {
+			modified = mod
+		}
+		m := &archiveMember{
+			a:    a,
+			name: name,
+			rel:  rel,
+			info: &memberInfo{name: path.Base(rel), size: size, mod: modified},
+		}
+		m.codec, m.certain = codec.IdentifyName(rel)
+		a.members = append(a.members, m)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s", file, err)
+	}
+
+	if top := a.top(); top != "" {
+		for _, m := range a.members {
+			m.rel = strings.TrimPrefix(m.rel, top+"/")
+		}
+	}
+	sort.Slice(a.members, func(i, j int) bool { return a.members[i].rel < a.members[j].rel })
+	return a, nil
+}
+
+// top returns the directory that all members of the archive are in, or "".
+func (a *archive) top() string {
+	var top string
+	for _, m := range a.members {
+		i := strings.Index(m.rel, "/")
+		if i < 0 || top != "" && m.rel[:i] != top {
+			return ""
+		}
+		top = m.rel[:i]
+	}
+	return top
+}
+
+// memberPath returns the slash-separated path of the member name, which
+// cannot point outside of the archive, or "" if it is skipped, such as the
+// resource forks that macOS adds to zip files.
+func memberPath(name string) string {
+	name = path.Clean("/" + strings.Replace(name, "\\", "/", -1))
+	if name == "/" || strings.HasPrefix(name, "/__MACOSX/") {
+		return ""
+	}
+	return name[1:]
+}
+
+// scan calls fn for each regular file in the archive, in the order they
+// are stored. The content r is only valid until fn returns.
+func (a *archive) scan(fn func(name string, size int64, modified time.Time, r io.Reader) error) error {
+	lower := strings.ToLower(a.file)
+	if strings.HasSuffix(lower, ".zip") {
+		zr, err := zip.OpenReader(a.file)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			err := fn(f.Name, int64(f.UncompressedSize64), f.Modified, &zipMember{f: f})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(a.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(lower, ".gz"), strings.HasSuffix(lower, ".tgz"):
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case strings.HasSuffix(lower, ".bz2"), strings.HasSuffix(lower, ".tbz2"):
+		r = bzip2.NewReader(f)
+	}
+
+	// Tar files have no index, so their headers are scanned instead.
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if err := fn(hdr.Name, hdr.Size, hdr.ModTime, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// zipMember opens a file in a zip archive when it is first read, so that
+// listing the archive does not decompress anything.
+type zipMember struct {
+	f  *zip.File
+	rc io.ReadCloser
+}
+
+func (z *zipMember) Read(p []byte) (int, error) {
+	if z.rc == nil {
+		rc, err := z.f.Open()
+		if err != nil {
+			return 0, err
+		}
+		z.rc = rc
+	}
+	return z.rc.Read(p)
+}
+
+func (z *zipMember) Close() error {
+	if z.rc == nil {
+		return nil
+	}
+	return z.rc.Close()
+}
+
+// unpack unpacks the member m, if it has not been unpacked yet, and with
+// it the other members that operations on it read, which are all members
+// that are neither audio nor video, such as covers and the markers in the
+// directories above it. If album is true, the other tracks in the directory
+// of m are unpacked too, whose album gain is measured together.
+func (a *archive) unpack(m *archiveMember, album bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	dir := path.Dir(m.rel)
+	want := make(map[string]*archiveMember)
+	for _, x := range a.members {
+		if x.unpacked {
+			continue
+		}
+		if x == m || !x.isVideo() && (!x.isAudio() || album && path.Dir(x.rel) == dir) {
+			want[x.name] = x
+		}
+	}
+	if len(want) == 0 {
+		return nil
+	}
+	err := a.scan(func(name string, _ int64, _ time.Time, r io.Reader) error {
+		x := want[name]
+		if x == nil {
+			return nil
+		}
+		delete(want, name)
+		err := unpackMember(a.dir, x.rel, r, x.info.mod)
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+		if err != nil {
+			return err
+		}
+		x.unpacked = true
+		if len(want) == 0 {
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("cannot unpack %s from %s: %s", m.rel, a.file, err)
+	}
+	return nil
+}
+
+// unpackMember writes the member at rel below dir, whose content is r, and
+// gives it the modification time mod.
+func unpackMember(dir, rel string, r io.Reader, mod time.Time) error {
+	file := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(file, mod, mod)
+}
@@ -0,0 +1,419 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// member is a file in a test archive.
+type member struct {
+	name    string
+	data    string
+	mod     time.Time
+	symlink bool
+}
+
+// writeZip writes the members to the zip archive file.
+func writeZip(t *testing.T, file string, ms ...member) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, m := range ms {
+		h := &zip.FileHeader{Name: m.name, Method: zip.Deflate, Modified: m.mod}
+		h.SetMode(0644)
+		if m.symlink {
+			h.SetMode(os.ModeSymlink | 0777)
+		}
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, m.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTar writes the members to the tar archive file, which is compressed
+// with gzip if gz is true.
+func writeTar(t *testing.T, file string, gz bool, ms ...member) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if gz {
+		zw := gzip.NewWriter(f)
+		defer zw.Close()
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for _, m := range ms {
+		h := &tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.data)), ModTime: m.mod, Typeflag: tar.TypeReg}
+		if m.symlink {
+			h = &tar.Header{Name: m.name, Linkname: m.data, ModTime: m.mod, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if !m.symlink {
+			io.WriteString(tw, m.data)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// filesBelow returns the contents of the files below dir by their
+// slash-separated paths.
+func filesBelow(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestArchiveName(t *testing.T) {
+	tests := map[string]string{
+		"Album.zip":         "Album",
+		"Album.ZIP":         "Album",
+		"Album.tar":         "Album",
+		"Album.tar.gz":      "Album",
+		"Album.TGZ":         "Album",
+		"Album.tar.bz2":     "Album",
+		"Album.tbz2":        "Album",
+		"Album (2001).zip":  "Album (2001)",
+		"Album.v2.tar.gz":   "Album.v2",
+		"Album.zip.tar.bz2": "Album.zip",
+	}
+	for name, want := range tests {
+		if got, ok := archiveName(name); !ok || got != want {
+			t.Errorf("%s: name is %q, %v, want %q", name, got, ok, want)
+		}
+	}
+	for _, name := range []string{".zip", ".tar.gz", "Album.rar", "Album.gz", "Album.7z", "Album", "zip"} {
+		if got, ok := archiveName(name); ok {
+			t.Errorf("%s: name is %q, want that it is no archive", name, got)
+		}
+	}
+}
+
+func TestMemberPath(t *testing.T) {
+	tests := map[string]string{
+		"Album/01.flac":           "Album/01.flac",
+		"./Album//01.flac":        "Album/01.flac",
+		"../escape.txt":           "escape.txt",
+		"Album/../../escape.txt":  "escape.txt",
+		"/abs/file.txt":           "abs/file.txt",
+		`win\path.txt`:            "win/path.txt",
+		"__MACOSX/Album/._01.mp3": "",
+		"/":                       "",
+		"..":                      "",
+	}
+	for name, want := range tests {
+		if got := memberPath(name); got != want {
+			t.Errorf("%q: path is %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReadArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Members are given the time of the archive, unless theirs is later,
+	// and only the first of a name is read.
+	mod := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	old := mod.Add(-time.Hour)
+	later := mod.Add(time.Hour)
+	ms := []member{
+		{name: "Album/CD2/01.txt", data: "two", mod: later},
+		{name: "Album/01.txt", data: "one", mod: old},
+		{name: "Album/01.txt", data: "duplicate", mod: old},
+		{name: "__MACOSX/Album/._01.txt", data: "fork", mod: old},
+		{name: "Album/link.txt", data: "01.txt", mod: old, symlink: true},
+	}
+
+	files := map[string]func(string){
+		"a.zip":    func(f string) { writeZip(t, f, ms...) },
+		"a.tar":    func(f string) { writeTar(t, f, false, ms...) },
+		"a.tar.gz": func(f string) { writeTar(t, f, true, ms...) },
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		file := filepath.Join(dir, name)
+		files[name](file)
+		out := filepath.Join(dir, name+".d")
+		a, err := readArchive(file, out, mod)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		// The single directory of the archive is left out.
+		if len(a.members) != 2 {
+			t.Errorf("%s: %d members, want 2", name, len(a.members))
+			continue
+		}
+		for i, want := range []struct {
+			rel string
+			mod time.Time
+		}{
+			{"01.txt", mod},
+			{"CD2/01.txt", later},
+		} {
+			m := a.members[i]
+			if m.rel != want.rel || m.info.Size() != 3 || !m.info.ModTime().Equal(want.mod) || m.isAudio() {
+				t.Errorf("%s: member %d is %s of %d bytes at %v, want %s of 3 at %v", name, i, m.rel, m.info.Size(), m.info.ModTime(), want.rel, want.mod)
+			}
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("%s: reading the index unpacked the archive", name)
+		}
+
+		// Files that are no audio are all unpacked together.
+		if err := a.unpack(a.members[0], false); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		want := map[string]string{"01.txt": "one", "CD2/01.txt": "two"}
+		if got := filesBelow(t, out); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: files are %v, want %v", name, got, want)
+		}
+		for rel, want := range map[string]time.Time{"01.txt": mod, "CD2/01.txt": later} {
+			fi, err := os.Stat(filepath.Join(out, filepath.FromSlash(rel)))
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+			} else if !fi.ModTime().Equal(want) {
+				t.Errorf("%s: %s was modified at %v, want %v", name, rel, fi.ModTime(), want)
+			}
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.tar.gz")
+	if err := ioutil.WriteFile(bad, []byte("not gzip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readArchive(bad, filepath.Join(dir, "bad"), mod); err == nil {
+		t.Error("reading an invalid archive succeeded")
+	}
+	if _, err := readArchive(filepath.Join(dir, "missing.zip"), filepath.Join(dir, "missing"), mod); err == nil {
+		t.Error("reading a missing archive succeeded")
+	}
+}
+
+func TestReadLibraryArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The single directory in Album.zip is read as the archive, Other.zip
+	// is ignored since Other exists, and archives in archives are not read.
+	mod := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	inner := filepath.Join(dir, ".inner.zip")
+	writeZip(t, inner, member{name: "deep.txt", data: "deep", mod: mod})
+	nested, err := ioutil.ReadFile(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeZip(t, filepath.Join(dir, "Album.zip"),
+		member{name: "Album/notes.txt", data: "notes", mod: mod},
+		member{name: "Album/Disc 2/notes.txt", data: "disc", mod: mod},
+		member{name: "Album/Extra.zip", data: string(nested), mod: mod},
+	)
+	writeTar(t, filepath.Join(dir, "Loose.tar"), false,
+		member{name: "a.txt", data: "a", mod: mod},
+		member{name: "b.txt", data: "b", mod: mod},
+	)
+	writeZip(t, filepath.Join(dir, "Other.zip"), member{name: "zipped.txt", data: "zipped", mod: mod})
+	if err := os.Mkdir(filepath.Join(dir, "Other"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "Other", "notes.txt"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := LibraryReader{IgnoreHidden: true, Archives: true}.ReadLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for key, want := range map[string]string{
+		"Album/notes.txt":        "notes",
+		"Album/Disc 2/notes.txt": "disc",
+		"Loose/a.txt":            "a",
+		"Loose/b.txt":            "b",
+		"Other/notes.txt":        "other",
+	} {
+		e := db.Get(key)
+		if e == nil {
+			t.Errorf("%s is not in the library", key)
+			continue
+		}
+		if err := e.unpack(); err != nil {
+			t.Errorf("%s: %s", key, err)
+		}
+		if b, err := ioutil.ReadFile(e.AbsPath()); err != nil || string(b) != want {
+			t.Errorf("%s is %q with error %v, want %q", key, b, err, want)
+		}
+	}
+	if e := db.Get("Album"); e == nil || !e.IsDir() || e.FileInfo().Name() != "Album" {
+		t.Error("Album is not a directory")
+	}
+	for _, key := range []string{"Album.zip", "Album/Extra", "Other/zipped.txt"} {
+		if db.Get(key) != nil {
+			t.Errorf("%s is in the library", key)
+		}
+	}
+	if db.Get("Album/Extra.zip") == nil {
+		t.Error("archive in an archive is not in the library as a file")
+	}
+
+	unpack := db.UnpackDir()
+	if unpack == "" {
+		t.Fatal("no unpack directory")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(unpack); !os.IsNotExist(err) {
+		t.Errorf("unpack directory is kept: %v", err)
+	}
+
+	// Without the option, archives are files.
+	db, err = LibraryReader{IgnoreHidden: true}.ReadLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Get("Album/notes.txt") != nil || db.Get("Album.zip") == nil || db.UnpackDir() != "" {
+		t.Error("archives are read without the option")
+	}
+}
+
+// unpacked returns the files below dir.
+func unpacked(dir string) []string {
+	var files []string
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+func TestArchiveUnpackedWhenRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	track := filepath.Join(dir, ".track.opus")
+	writeOpus(t, track)
+	opus, err := ioutil.ReadFile(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "Album.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"Album/01.opus", "Album/02.opus", "Album/CD2/01.opus", "Album/cover.jpg"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Ext(name) == ".opus" {
+			w.Write(opus)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err := LibraryReader{IgnoreHidden: true, Archives: true}.ReadLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"Album/01.opus", "Album/02.opus", "Album/CD2/01.opus", "Album/cover.jpg"} {
+		if db.Get(key) == nil {
+			t.Errorf("%s is not in the library", key)
+		}
+	}
+	if e := db.Get("Album/01.opus"); e == nil || !e.IsMusic() {
+		t.Fatal("Album/01.opus is not music")
+	}
+	if got := unpacked(db.UnpackDir()); len(got) != 0 {
+		t.Errorf("unpacked %v after reading the library, want nothing", got)
+	}
+
+	if db.Get("Album/CD2/01.opus").Metadata() == nil {
+		t.Fatal("cannot read the metadata of Album/CD2/01.opus")
+	}
+	want := []string{"Album/CD2/01.opus", "Album/cover.jpg"}
+	if got := unpacked(db.UnpackDir()); !equalStrings(got, want) {
+		t.Errorf("unpacked %v after reading a track, want %v", got, want)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EmbeddedArt selects what happens to the pictures embedded in outputs.
+// If it is the zero value, they are kept as they are.
+type EmbeddedArt struct {
+	// Strip removes all pictures.
+	Strip bool
+	// Shrink scales pictures down to at most Shrink pixels wide and
+	// high, if it is not 0.
+	Shrink int
+}
+
+// ParseEmbeddedArt parses "keep", "strip", or "shrink:N", where N is the
+// size in pixels, or the empty string.
+func ParseEmbeddedArt(s string) (EmbeddedArt, error) {
+	switch {
+	case s == "" || s == "keep":
+		return EmbeddedArt{}, nil
+	case s == "strip":
+		return EmbeddedArt{Strip: true}, nil
+	case strings.HasPrefix(s, "shrink:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(s, "shrink:"))
+		if err == nil && n > 0 {
+			return EmbeddedArt{Shrink: n}, nil
+		}
+	}
+	return EmbeddedArt{}, fmt.Errorf("invalid embedded art %q: must be keep, strip, or shrink:SIZE", s)
+}
+
+// applyArt strips or shrinks the pictures embedded in the output at path,
+// according to EmbeddedArt. Only the tags of the output are rewritten,
+// and only if its pictures change.
+func (o *Runner) applyArt(path string) error {
+	art := o.EmbeddedArt
+	if !art.Strip && art.Shrink <= 0 {
+		return nil
+	}
+	pics, err := ReadPictures(path)
+	if err == ErrNoPictureWriter {
+		return nil
+	} else if err != nil || len(pics) == 0 {
+		return err
+	}
+	if art.Strip {
+		return EmbedPictures(path, nil)
+	}
+
+	changed := false
+	for i, p := range pics {
+		if p.Width == 0 {
+			// Pictures that cannot be decoded are kept as they are.
+			continue
+		}
+		q, err := scalePicture(p, art.Shrink, o.CoverQuality)
+		if err != nil {
+			return err
+		}
+		changed = changed || q != p
+		pics[i] = q
+	}
+	if !changed {
+		return nil
+	}
+	return EmbedPictures(path, pics)
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cassava/lackey/audio/tags"
+)
+
+func TestParseEmbeddedArt(t *testing.T) {
+	tests := map[string]EmbeddedArt{
+		"":           {},
+		"keep":       {},
+		"strip":      {Strip: true},
+		"shrink:300": {Shrink: 300},
+	}
+	for s, want := range tests {
+		if got, err := ParseEmbeddedArt(s); err != nil || got != want {
+			t.Errorf("%q: art is %+v with error %v, want %+v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"shrink", "shrink:", "shrink:0", "shrink:-5", "shrink:big", "Strip"} {
+		if _, err := ParseEmbeddedArt(s); err == nil {
+			t.Errorf("%q: parsing succeeded", s)
+		}
+	}
+}
+
+func TestApplyArt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	large := newPicture(pngImage(8, 4), "Front")
+	small := newPicture(pngImage(2, 2), "")
+	small.Type = 4
+	odd := &tags.Picture{MIMEType: "image/x-unknown", Type: 5, Data: []byte("no image")}
+	files := map[string][]byte{
+		"song.mp3":  mp3File(),
+		"song.flac": flacFile(1),
+		"song.m4a":  mp4File(),
+		"song.opus": opusFile(),
+	}
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		reset := func() {
+			if err := ioutil.WriteFile(file, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := EmbedPictures(file, []*tags.Picture{large, small, odd}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Outputs are left alone by default.
+		reset()
+		before, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o := &Runner{}
+		if err := o.applyArt(file); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+		if after, _ := ioutil.ReadFile(file); !bytes.Equal(after, before) {
+			t.Errorf("%s: file changed without any embedded art option", name)
+		}
+
+		o.EmbeddedArt = EmbeddedArt{Shrink: 4}
+		if err := o.applyArt(file); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		pics, err := ReadPictures(file)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		// MPEG-4 files only hold JPEG and PNG covers.
+		want := 3
+		if name == "song.m4a" {
+			want = 2
+		}
+		if len(pics) != want {
+			t.Errorf("%s: %d pictures, want %d", name, len(pics), want)
+			continue
+		}
+		if p := pics[0]; p.MIMEType != "image/jpeg" || p.Width != 4 || p.Height != 2 {
+			t.Errorf("%s: shrunk picture is %s of %dx%d, want image/jpeg of 4x2", name, p.MIMEType, p.Width, p.Height)
+		}
+		if !bytes.Equal(pics[1].Data, small.Data) {
+			t.Errorf("%s: small picture changed", name)
+		}
+		if want == 3 && !bytes.Equal(pics[2].Data, odd.Data) {
+			t.Errorf("%s: picture that is no image changed", name)
+		}
+		if name == "song.flac" || name == "song.mp3" {
+			if pics[0].Type != tags.FrontCover || pics[1].Type != 4 {
+				t.Errorf("%s: picture types are %d and %d, want them kept", name, pics[0].Type, pics[1].Type)
+			}
+		}
+
+		o.EmbeddedArt = EmbeddedArt{Strip: true}
+		if err := o.applyArt(file); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+		if pics, err := ReadPictures(file); err != nil || len(pics) != 0 {
+			t.Errorf("%s: pictures are %v with error %v, want none", name, pics, err)
+		}
+	}
+
+	// Formats without pictures are skipped.
+	wav := filepath.Join(dir, "song.wav")
+	if err := ioutil.WriteFile(wav, wavFile(make([]byte, 16), ""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o := &Runner{EmbeddedArt: EmbeddedArt{Strip: true}}
+	if err := o.applyArt(wav); err != nil {
+		t.Errorf("wav: %s", err)
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package ape reads metadata from Monkey's Audio and WavPack files,
+// which both use APEv2 tags at the end of the file.
+//
+// Reference
+//
+//  https://wiki.hydrogenaud.io/index.php?title=APEv2_specification
+//  https://www.wavpack.com/WavPack5FileFormat.pdf
+//  https://github.com/FFmpeg/FFmpeg/blob/master/libavformat/ape.c
+package ape
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cassava/lackey/audio/bitrate"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/dhowden/tag"
+	"github.com/goulash/audio"
+	"github.com/goulash/stat"
+)
+
+var (
+	ErrNotAPE     = errors.New("file is not a Monkey's Audio or WavPack file")
+	ErrInvalidAPE = errors.New("invalid Monkey's Audio or WavPack header")
+	ErrInvalidTag = errors.New("invalid APEv2 tag")
+)
+
+// The tag package does not define these file types.
+const (
+	APE     tag.FileType = "APE"
+	WavPack tag.FileType = "WV"
+)
+
+var Stats struct {
+	ReadMetadata stat.Run
+}
+
+func init() {
+	reader := func(file string) (audio.Metadata, error) {
+		return ReadMetadata(file)
+	}
+	audio.MetadataReaders[audio.APE] = reader
+	audio.MetadataReaders[audio.WV] = reader
+}
+
+// ReadMetadata {{{
+
+// Stream describes the audio stream of a Monkey's Audio or WavPack file.
+type Stream struct {
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+	TotalSamples  int64
+
+	// Lossless is false for WavPack files in hybrid (lossy) mode.
+	Lossless bool
+}
+
+// Duration returns the length of the stream.
+func (s *Stream) Duration() time.Duration {
+	if s.SampleRate == 0 {
+		return 0
+	}
+	return time.Duration(s.TotalSamples) * time.Second / time.Duration(s.SampleRate)
+}
+
+// ReadMetadata reads the APEv2 tag and the stream header of a Monkey's Audio
+// or WavPack file. An ID3v2 tag in front of the stream is skipped.
+func ReadMetadata(file string) (*Metadata, error) {
+	start := time.Now()
+	defer func() { Stats.ReadMetadata.Add(float64(time.Since(start))) }()
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := skipID3(f)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 64)
+	if _, err := f.ReadAt(hdr, offset); err != nil {
+		return nil, ErrNotAPE
+	}
+
+	m := &Metadata{}
+	switch string(hdr[:4]) {
+	case "MAC ":
+		m.codec, m.fileType = audio.APE, APE
+		m.stream, err = readAPEHeader(f, offset)
+	case "wvpk":
+		m.codec, m.fileType = audio.WV, WavPack
+		m.stream, err = readWavPackHeader(hdr)
+	default:
+		return nil, ErrNotAPE
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t, size, err := ReadTag(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	m.Metadata = tags.NewMetadata(tags.APEv2, m.fileType, t.Tags, t.Pictures)
+	m.bitrate = bitrate.Average(fi.Size()-offset-size, m.stream.Duration())
+	return m, nil
+}
+
+// skipID3 returns the offset after an ID3v2 tag, if there is one.
+func skipID3(f io.ReaderAt) (int64, error) {
+	h := make([]byte, 10)
+	if _, err := f.ReadAt(h, 0); err != nil {
+		return 0, ErrNotAPE
+	}
+	if string(h[:3]) != "ID3" {
+		return 0, nil
+	}
+	n := int64(h[6])<<21 | int64(h[7])<<14 | int64(h[8])<<7 | int64(h[9])
+	n += 10
+	if h[5]&0x10 != 0 {
+		n += 10
+	}
+	return n, nil
+}
+
+// readAPEHeader reads the header of a Monkey's Audio file at offset.
+func readAPEHeader(f io.ReaderAt, offset int64) (*Stream, error) {
+	b := make([]byte, 76)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		return nil, ErrInvalidAPE
+	}
+	le := binary.LittleEndian
+	version := le.Uint16(b[4:6])
+
+	var (
+		s                = &Stream{Lossless: true, BitsPerSample: 16}
+		compression      uint16
+		flags            uint16
+		blocksPerFrame   int64
+		finalFrameBlocks int64
+		totalFrames      int64
+	)
+	if version >= 3980 {
+		// The descriptor is followed by the header.
+		//  descriptor: "MAC "(4) version(2) padding(2) descriptor bytes(4) ...
+		//  header: compression(2) flags(2) blocks per frame(4) final frame blocks(4)
+		//          total frames(4) bits per sample(2) channels(2) sample rate(4)
+		n := int64(le.Uint32(b[8:12]))
+		h := make([]byte, 24)
+		if _, err := f.ReadAt(h, offset+n); err != nil {
+			return nil, ErrInvalidAPE
+		}
+		compression = le.Uint16(h[0:2])
+		flags = le.Uint16(h[2:4])
+		blocksPerFrame = int64(le.Uint32(h[4:8]))
+		finalFrameBlocks = int64(le.Uint32(h[8:12]))
+		totalFrames = int64(le.Uint32(h[12:16]))
+		s.BitsPerSample = int(le.Uint16(h[16:18]))
+		s.Channels = int(le.Uint16(h[18:20]))
+		s.SampleRate = int(le.Uint32(h[20:24]))
+	} else {
+		//  "MAC "(4) version(2) compression(2) flags(2) channels(2) sample rate(4)
+		//  header bytes(4) terminating bytes(4) total frames(4) final frame blocks(4)
+		compression = le.Uint16(b[6:8])
+		flags = le.Uint16(b[8:10])
+		s.Channels = int(le.Uint16(b[10:12]))
+		s.SampleRate = int(le.Uint32(b[12:16]))
+		totalFrames = int64(le.Uint32(b[24:28]))
+		finalFrameBlocks = int64(le.Uint32(b[28:32]))
+		switch {
+		case version >= 3950:
+			blocksPerFrame = 73728 * 4
+		case version >= 3900 || (version >= 3800 && compression == 4000):
+			blocksPerFrame = 73728
+		default:
+			blocksPerFrame = 9216
+		}
+		switch {
+		case flags&0x1 != 0:
+			s.BitsPerSample = 8
+		case flags&0x8 != 0:
+			s.BitsPerSample = 24
+		}
+	}
+	if totalFrames > 0 {
+		s.TotalSamples = (totalFrames-1)*blocksPerFrame + finalFrameBlocks
+	}
+	return s, nil
+}
+
+var wavpackRates = []int{
+	6000, 8000, 9600, 11025, 12000, 16000, 22050, 24000,
+	32000, 44100, 48000, 64000, 88200, 96000, 192000,
+}
+
+// readWavPackHeader reads the header of the first WavPack block.
+func readWavPackHeader(b []byte) (*Stream, error) {
+	//  "wvpk"(4) size(4) version(2) index high(1) total high(1) total samples(4)
+	//  block index(4) block samples(4) flags(4) crc(4)
+	if len(b) < 32 {
+		return nil, ErrInvalidAPE
+	}
+	le := binary.LittleEndian
+	total := int64(le.Uint32(b[12:16]))
+	flags := le.Uint32(b[24:28])
+
+	s := &Stream{
+		BitsPerSample: int(flags&0x3+1) * 8,
+		Channels:      2,
+		Lossless:      flags&0x8 == 0,
+	}
+	if total != 0xFFFFFFFF {
+		s.TotalSamples = int64(b[11])<<32 | total
+	}
+	if flags&0x4 != 0 {
+		s.Channels = 1
+	}
+	if i := int(flags>>23) & 0xF; i < len(wavpackRates) {
+		s.SampleRate = wavpackRates[i]
+	}
+	return s, nil
+}
+
+// }}}
+
+// APEv2 {{{
+
+const footerSize = 32
+
+// ReadTag reads the APEv2 tag at the end of the file, which may be followed
+// by an ID3v1 tag. It also returns the size of the tag in bytes, including
+// any ID3v1 tag. If there is no tag, it returns empty metadata.
+func ReadTag(f io.ReaderAt, size int64) (*tags.Metadata, int64, error) {
+	t := tags.NewMetadata(tags.APEv2, "", nil, nil)
+
+	end := size
+	b := make([]byte, 128)
+	if size >= 128 {
+		if _, err := f.ReadAt(b, size-128); err != nil {
+			return nil, 0, err
+		}
+		if string(b[:3]) == "TAG" {
+			end -= 128
+		}
+	}
+
+	footer := make([]byte, footerSize)
+	if end < footerSize {
+		return t, size - end, nil
+	}
+	if _, err := f.ReadAt(footer, end-footerSize); err != nil {
+		return nil, 0, err
+	}
+	if string(footer[:8]) != "APETAGEX" {
+		return t, size - end, nil
+	}
+
+	//  "APETAGEX"(8) version(4) size(4) items(4) flags(4) reserved(8)
+	// The size includes the footer and the items, but not the header.
+	le := binary.LittleEndian
+	n := int64(le.Uint32(footer[12:16]))
+	count := int(le.Uint32(footer[16:20]))
+	flags := le.Uint32(footer[20:24])
+	if n < footerSize || n > end {
+		return nil, 0, ErrInvalidTag
+	}
+	items := make([]byte, n-footerSize)
+	if _, err := f.ReadAt(items, end-n); err != nil {
+		return nil, 0, err
+	}
+	tagSize := size - end + n
+	if flags&0x80000000 != 0 {
+		tagSize += footerSize
+	}
+
+	text := make(map[string][]string)
+	for i := 0; i < count && len(items) >= 8; i++ {
+		vlen := int(le.Uint32(items[0:4]))
+		iflags := le.Uint32(items[4:8])
+		items = items[8:]
+		k := bytes.IndexByte(items, 0)
+		if k < 0 || k+1+vlen > len(items) {
+			return nil, 0, ErrInvalidTag
+		}
+		key := string(items[:k])
+		value := items[k+1 : k+1+vlen]
+		items = items[k+1+vlen:]
+
+		switch (iflags >> 1) & 0x3 {
+		case 0: // UTF-8 text, multiple values are separated by null bytes
+			text[key] = append(text[key], strings.Split(string(value), "\x00")...)
+		case 1: // binary
+			if p := readPicture(key, value); p != nil {
+				t.Pictures = append(t.Pictures, p)
+			}
+		}
+	}
+	t.Tags = tags.FromAPE(text)
+	return t, tagSize, nil
+}
+
+// readPicture reads a "Cover Art (...)" item, which contains a filename
+// followed by a null byte and the image data.
+func readPicture(key string, value []byte) *tag.Picture {
+	const prefix = "cover art ("
+	if !strings.HasPrefix(strings.ToLower(key), prefix) {
+		return nil
+	}
+	i := bytes.IndexByte(value, 0)
+	if i < 0 {
+		return nil
+	}
+	name := string(value[:i])
+	p := &tag.Picture{
+		Ext:         strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), "."),
+		Description: name,
+		Data:        value[i+1:],
+	}
+	switch p.Ext {
+	case "jpg", "jpeg":
+		p.Ext, p.MIMEType = "jpg", "image/jpeg"
+	case "png":
+		p.MIMEType = "image/png"
+	}
+	if strings.EqualFold(key, "Cover Art (Front)") {
+		p.Type = "Cover (front)"
+	} else {
+		p.Type = strings.TrimSuffix(key[len(prefix):], ")")
+	}
+	return p
+}
+
+// }}}
+
+// Metadata {{{
+
+var _ = audio.Metadata(new(Metadata))
+
+type Metadata struct {
+	*tags.Metadata
+
+	codec    audio.Codec
+	fileType tag.FileType
+	stream   *Stream
+	bitrate  int
+}
+
+func (m *Metadata) Length() time.Duration { return m.stream.Duration() }
+func (m *Metadata) Encoding() audio.Codec { return m.codec }
+func (m *Metadata) EncodingBitrate() int  { return m.bitrate }
+
+// Stream returns information on the audio stream.
+func (m *Metadata) Stream() *Stream { return m.stream }
+
+func (m *Metadata) SampleRate() int { return m.stream.SampleRate }
+func (m *Metadata) BitDepth() int   { return m.stream.BitsPerSample }
+func (m *Metadata) Channels() int   { return m.stream.Channels }
+func (m *Metadata) Lossless() bool  { return m.stream.Lossless }
+
+// }}}
@@ -0,0 +1,176 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ape
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goulash/audio"
+)
+
+type item struct {
+	key    string
+	value  string
+	binary bool
+}
+
+// apeTag returns an APEv2 tag of the items with a header and a footer.
+func apeTag(items ...item) []byte {
+	var body bytes.Buffer
+	le := binary.LittleEndian
+	for _, it := range items {
+		var flags uint32
+		if it.binary {
+			flags = 1 << 1
+		}
+		binary.Write(&body, le, uint32(len(it.value)))
+		binary.Write(&body, le, flags)
+		body.WriteString(it.key)
+		body.WriteByte(0)
+		body.WriteString(it.value)
+	}
+	frame := func(flags uint32) []byte {
+		b := make([]byte, footerSize)
+		copy(b, "APETAGEX")
+		le.PutUint32(b[8:], 2000)
+		le.PutUint32(b[12:], uint32(body.Len()+footerSize))
+		le.PutUint32(b[16:], uint32(len(items)))
+		le.PutUint32(b[20:], flags)
+		return b
+	}
+	b := frame(1<<31 | 1<<29) // has header, is header
+	b = append(b, body.Bytes()...)
+	return append(b, frame(1<<31)...)
+}
+
+func readFile(t *testing.T, data ...[]byte) (*Metadata, error) {
+	dir, err := ioutil.TempDir("", "ape-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(file, bytes.Join(data, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ReadMetadata(file)
+}
+
+func TestReadMetadataWavPack(t *testing.T) {
+	le := binary.LittleEndian
+	block := make([]byte, 32)
+	copy(block, "wvpk")
+	le.PutUint32(block[12:], 88200)
+	le.PutUint32(block[24:], 9<<23|0x1|0x8) // 44.1 kHz, 16 bits, hybrid
+	audioData := append(block, make([]byte, 4000-len(block))...)
+
+	tag := apeTag(
+		item{key: "Title", value: "Song"},
+		item{key: "ARTIST", value: "Band"},
+		item{key: "Genre", value: "Rock\x00Pop"},
+		item{key: "Track", value: "3/12"},
+		item{key: "Cover Art (Front)", value: "cover.jpg\x00JPEG", binary: true},
+	)
+	id3v1 := append([]byte("TAG"), make([]byte, 125)...)
+	id3v2 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x05"), make([]byte, 5)...)
+
+	m, err := readFile(t, id3v2, audioData, tag, id3v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Encoding() != audio.WV {
+		t.Errorf("codec is %s, want WV", m.Encoding())
+	}
+	s := m.Stream()
+	if s.Channels != 2 || s.SampleRate != 44100 || s.BitsPerSample != 16 || s.Lossless {
+		t.Errorf("stream is %+v, want lossy 16-bit stereo at 44.1 kHz", s)
+	}
+	if m.Length() != 2*time.Second {
+		t.Errorf("length is %s, want 2s", m.Length())
+	}
+	// The bitrate excludes the tags at the end, but not the one in front.
+	if want := (len(id3v2) + len(audioData)) * 8 / 2000; m.EncodingBitrate() != want {
+		t.Errorf("bitrate is %d, want %d", m.EncodingBitrate(), want)
+	}
+	if m.Title() != "Song" || m.Artist() != "Band" {
+		t.Errorf("title and artist are %q and %q, want %q and %q", m.Title(), m.Artist(), "Song", "Band")
+	}
+	if g := m.Tags["GENRE"]; len(g) != 2 || g[0] != "Rock" || g[1] != "Pop" {
+		t.Errorf("genre is %q, want [Rock Pop]", g)
+	}
+	if n, total := m.Track(); n != 3 || total != 12 {
+		t.Errorf("track is %d of %d, want 3 of 12", n, total)
+	}
+	p := m.Picture()
+	if p == nil || p.Type != "Cover (front)" || p.MIMEType != "image/jpeg" || string(p.Data) != "JPEG" {
+		t.Errorf("picture is %+v, want the front cover", p)
+	}
+}
+
+func TestReadMetadataAPE(t *testing.T) {
+	le := binary.LittleEndian
+
+	// Since version 3.98 a descriptor precedes the header.
+	desc := make([]byte, 52)
+	copy(desc, "MAC ")
+	le.PutUint16(desc[4:], 3990)
+	le.PutUint32(desc[8:], 52)
+	hdr := make([]byte, 24)
+	le.PutUint32(hdr[4:], 73728*4)
+	le.PutUint32(hdr[8:], 1000)
+	le.PutUint32(hdr[12:], 2)
+	le.PutUint16(hdr[16:], 24)
+	le.PutUint16(hdr[18:], 2)
+	le.PutUint32(hdr[20:], 96000)
+	m, err := readFile(t, desc, hdr, make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := m.Stream()
+	if m.Encoding() != audio.APE || s.Channels != 2 || s.SampleRate != 96000 || s.BitsPerSample != 24 || !s.Lossless {
+		t.Errorf("stream is %+v, want lossless 24-bit stereo at 96 kHz", s)
+	}
+	if s.TotalSamples != 73728*4+1000 {
+		t.Errorf("total samples are %d, want %d", s.TotalSamples, 73728*4+1000)
+	}
+
+	// Older versions only have a header, without bits per sample.
+	old := make([]byte, 32)
+	copy(old, "MAC ")
+	le.PutUint16(old[4:], 3950)
+	le.PutUint16(old[6:], 2000)
+	le.PutUint16(old[8:], 0x8)
+	le.PutUint16(old[10:], 1)
+	le.PutUint32(old[12:], 44100)
+	le.PutUint32(old[24:], 3)
+	le.PutUint32(old[28:], 100)
+	m, err = readFile(t, old, make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = m.Stream()
+	if s.Channels != 1 || s.SampleRate != 44100 || s.BitsPerSample != 24 || s.TotalSamples != 2*73728*4+100 {
+		t.Errorf("old stream is %+v, want 24-bit mono at 44.1 kHz of %d samples", s, 2*73728*4+100)
+	}
+}
+
+func TestReadMetadataInvalid(t *testing.T) {
+	tag := apeTag(item{key: "Title", value: "Song"})
+	binary.LittleEndian.PutUint32(tag[len(tag)-footerSize+12:], 1<<20) // larger than the file
+	block := append([]byte("wvpk"), make([]byte, 60)...)
+
+	if _, err := readFile(t, []byte("fLaC"), make([]byte, 100)); err != ErrNotAPE {
+		t.Errorf("flac: error is %v, want %v", err, ErrNotAPE)
+	}
+	if _, err := readFile(t, block, tag); err != ErrInvalidTag {
+		t.Errorf("tag size: error is %v, want %v", err, ErrInvalidTag)
+	}
+}
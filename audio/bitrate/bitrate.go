@@ -0,0 +1,22 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package bitrate calculates the average bitrate of audio streams.
+//
+// It is separate from the codec package, so that the metadata readers
+// that codec itself uses, such as mp4, can use it as well.
+package bitrate
+
+import "time"
+
+// Average returns the average bitrate in kbps of n bytes of audio that
+// play for d. Streams shorter than a millisecond have no meaningful
+// bitrate, and 0 is returned for them.
+func Average(n int64, d time.Duration) int {
+	ms := int64(d / time.Millisecond)
+	if ms <= 0 {
+		return 0
+	}
+	return int(n * 8 / ms)
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package bitrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAverage(t *testing.T) {
+	tests := []struct {
+		n    int64
+		d    time.Duration
+		want int
+	}{
+		{24000, time.Second, 192},
+		{176400, time.Second, 1411},
+		{16000, 500 * time.Millisecond, 256},
+		{0, time.Minute, 0},
+		{4, 999 * time.Microsecond, 0},
+		{4, 0, 0},
+		{4, -time.Second, 0},
+	}
+	for _, tt := range tests {
+		if got := Average(tt.n, tt.d); got != tt.want {
+			t.Errorf("%d bytes in %v: bitrate is %d, want %d", tt.n, tt.d, got, tt.want)
+		}
+	}
+}
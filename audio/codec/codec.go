@@ -0,0 +1,232 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package codec extends the codec identification of the
+// github.com/goulash/audio package.
+//
+// The audio package only identifies what github.com/dhowden/tag can
+// identify, which means that an Ogg file is always Vorbis, that MP4
+// files are only recognized when their major brand happens to be "M4A "
+// and are never identified as AAC, and that containers without tags,
+// such as WAV, are not recognized at all.
+// The functions here refine that by looking at the magic bytes of the file,
+// and provide codecs for which the audio package does not define a constant.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cassava/lackey/audio/mp4"
+	"github.com/cassava/lackey/filetype"
+	"github.com/goulash/audio"
+	"github.com/goulash/stat"
+)
+
+var Stats struct {
+	Identify     stat.Run
+	ReadMetadata stat.Run
+}
+
+const (
+	// Opus is the Opus codec, which is always in an Ogg container.
+	// The audio package treats all Ogg files as Vorbis (audio.OGG).
+	Opus audio.Codec = 64 + iota
+	// AIFF is the Audio Interchange File Format.
+	AIFF
+	// DSF is the DSD Stream File format by Sony.
+	DSF
+)
+
+// String returns the name of the codec, including codecs that
+// are not known to the audio package.
+func String(c audio.Codec) string {
+	switch c {
+	case Opus:
+		return "OPUS"
+	case AIFF:
+		return "AIFF"
+	case DSF:
+		return "DSF"
+	default:
+		return c.String()
+	}
+}
+
+// Parse returns the codec with the name, as returned by String.
+// The name is case-insensitive, and "vorbis" is accepted for audio.OGG.
+func Parse(name string) (audio.Codec, error) {
+	if strings.EqualFold(name, "vorbis") {
+		return audio.OGG, nil
+	}
+	for c := audio.WAV; c <= audio.WMA; c++ {
+		if strings.EqualFold(name, c.String()) {
+			return c, nil
+		}
+	}
+	for _, c := range []audio.Codec{Opus, AIFF, DSF} {
+		if strings.EqualFold(name, String(c)) {
+			return c, nil
+		}
+	}
+	return audio.Unknown, fmt.Errorf("unknown codec: %s", name)
+}
+
+// magic returns the codec of the container that starts with buf,
+// or audio.Unknown if the container is not one of those that we
+// identify ourselves.
+func magic(buf []byte) audio.Codec {
+	if len(buf) < 12 {
+		return audio.Unknown
+	}
+	switch {
+	case (string(buf[:4]) == "RIFF" || string(buf[:4]) == "RF64") && string(buf[8:12]) == "WAVE":
+		return audio.WAV
+	case string(buf[:4]) == "FORM" && (string(buf[8:12]) == "AIFF" || string(buf[8:12]) == "AIFC"):
+		return AIFF
+	case string(buf[:4]) == "wvpk":
+		return audio.WV
+	case string(buf[:4]) == "MAC ":
+		return audio.APE
+	case string(buf[:4]) == "DSD ":
+		return DSF
+	}
+	return audio.Unknown
+}
+
+// id3Size returns the size of the ID3v2 tag that buf starts with, or 0.
+func id3Size(buf []byte) int64 {
+	if len(buf) < 10 || string(buf[:3]) != "ID3" {
+		return 0
+	}
+	// The size is a 28-bit synchsafe integer, which excludes the header
+	// and the optional footer.
+	n := int64(buf[6])<<21 | int64(buf[7])<<14 | int64(buf[8])<<7 | int64(buf[9])
+	n += 10
+	if buf[5]&0x10 != 0 {
+		n += 10
+	}
+	return n
+}
+
+// extensions maps the extensions of audio files to their codec, where the
+// extension alone determines it.
+var extensions = map[string]audio.Codec{
+	".flac": audio.FLAC,
+	".mp3":  audio.MP3,
+	".oga":  audio.OGG,
+	".opus": Opus,
+	".m4b":  audio.M4B,
+	".wav":  audio.WAV,
+	".aif":  AIFF,
+	".aifc": AIFF,
+	".aiff": AIFF,
+	".wv":   audio.WV,
+	".ape":  audio.APE,
+	".dsf":  DSF,
+}
+
+// IdentifyName returns the codec of a file with the given name, judging by
+// its extension alone, and whether that is certain. Ogg files may be Vorbis
+// or Opus and M4A files AAC or ALAC, which only their content tells.
+func IdentifyName(name string) (audio.Codec, bool) {
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".ogg":
+		return audio.OGG, false
+	case ".m4a":
+		return audio.M4A, false
+	default:
+		c, ok := extensions[ext]
+		return c, ok
+	}
+}
+
+// Identify returns the codec of the file, similar to audio.Identify.
+func Identify(file string) (audio.Codec, error) {
+	start := time.Now()
+	defer func() { Stats.Identify.Add(float64(time.Since(start))) }()
+
+	f, err := os.Open(file)
+	if err != nil {
+		return audio.Unknown, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 64)
+	n, _ := io.ReadFull(f, buf)
+	buf = buf[:n]
+	if c := magic(buf); c != audio.Unknown {
+		return c, nil
+	}
+	if n := id3Size(buf); n != 0 {
+		// Some containers, APE in particular, may be preceded by an ID3v2 tag,
+		// which would make them look like MP3 to the tag package.
+		hdr := make([]byte, 12)
+		if _, err := f.ReadAt(hdr, n); err == nil {
+			if c := magic(hdr); c != audio.Unknown {
+				return c, nil
+			}
+		}
+	}
+
+	c, err := audio.Identify(file)
+	switch {
+	case c == audio.OGG && isOpus(buf):
+		return Opus, nil
+	case c == audio.M4A || c == audio.ALAC:
+		return identifyMP4(file, c), nil
+	case c == audio.Unknown && len(buf) >= 8 && string(buf[4:8]) == "ftyp":
+		// The major brand of MP4 audio files is often "mp42" or "isom",
+		// which is also used by video files.
+		if filetype.Identify(file) != filetype.Video {
+			return identifyMP4(file, audio.M4A), nil
+		}
+	}
+	return c, err
+}
+
+// identifyMP4 returns audio.ALAC or audio.AAC according to the audio track
+// of the MPEG-4 file, or c if that cannot be determined.
+//
+// Audio books (M4B) and protected files (M4P) are left as they are,
+// since their brand is more meaningful than their codec.
+func identifyMP4(file string, c audio.Codec) audio.Codec {
+	x, err := mp4.Identify(file)
+	if err != nil || x == audio.M4A {
+		return c
+	}
+	return x
+}
+
+// isOpus returns true if the first packet of the Ogg page in buf
+// is an Opus identification header.
+func isOpus(buf []byte) bool {
+	if len(buf) < 27 || string(buf[:4]) != "OggS" {
+		return false
+	}
+	i := 27 + int(buf[26])
+	return len(buf) >= i+8 && string(buf[i:i+8]) == "OpusHead"
+}
+
+// ReadMetadata reads the metadata of the file with the reader that is
+// registered in audio.MetadataReaders, similar to audio.ReadMetadata.
+func ReadMetadata(file string) (audio.Metadata, error) {
+	start := time.Now()
+	defer func() { Stats.ReadMetadata.Add(float64(time.Since(start))) }()
+
+	c, err := Identify(file)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := audio.MetadataReaders[c]
+	if !ok {
+		return nil, errors.New("reading metadata for this codec unsupported")
+	}
+	return f(file)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/goulash/audio"
+)
+
+func TestIsOpus(t *testing.T) {
+	page := func(segs int, packet string) []byte {
+		b := append([]byte("OggS"), make([]byte, 22)...)
+		b = append(b, byte(segs))
+		b = append(b, bytes.Repeat([]byte{1}, segs)...)
+		return append(b, packet...)
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+		want bool
+	}{
+		{"opus", page(1, "OpusHead\x01\x02"), true},
+		{"opus after segments", page(3, "OpusHead"), true},
+		{"vorbis", page(1, "\x01vorbis\x00\x00"), false},
+		{"truncated", page(1, "Opus"), false},
+		{"not ogg", append([]byte("RIFF"), page(1, "OpusHead")[4:]...), false},
+	}
+	for _, tt := range tests {
+		if got := isOpus(tt.buf); got != tt.want {
+			t.Errorf("%s: isOpus is %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMagic(t *testing.T) {
+	tests := []struct {
+		buf  string
+		want audio.Codec
+	}{
+		{"RIFF\x00\x00\x00\x00WAVEfmt ", audio.WAV},
+		{"RF64\xff\xff\xff\xffWAVEds64", audio.WAV},
+		{"RIFF\x00\x00\x00\x00AVI LIST", audio.Unknown},
+		{"FORM\x00\x00\x00\x00AIFFCOMM", AIFF},
+		{"FORM\x00\x00\x00\x00AIFCFVER", AIFF},
+		{"wvpk\x00\x00\x00\x00\x10\x04\x00\x00", audio.WV},
+		{"MAC \x96\x0f\x00\x00\x34\x00\x00\x00", audio.APE},
+		{"DSD \x1c\x00\x00\x00\x00\x00\x00\x00", DSF},
+		{"DSD ", audio.Unknown},
+	}
+	for _, tt := range tests {
+		if got := magic([]byte(tt.buf)); got != tt.want {
+			t.Errorf("magic(%q) = %s, want %s", tt.buf, String(got), String(tt.want))
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		want audio.Codec
+	}{
+		{"flac", audio.FLAC},
+		{"MP3", audio.MP3},
+		{"vorbis", audio.OGG},
+		{"ogg", audio.OGG},
+		{"Opus", Opus},
+		{"aiff", AIFF},
+		{"dsf", DSF},
+	}
+	for _, tt := range tests {
+		c, err := Parse(tt.name)
+		if err != nil || c != tt.want {
+			t.Errorf("Parse(%q) = %s, %v, want %s", tt.name, String(c), err, String(tt.want))
+		}
+	}
+	if _, err := Parse("mp5"); err == nil {
+		t.Error("Parse(\"mp5\") succeeded")
+	}
+}
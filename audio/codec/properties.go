@@ -0,0 +1,109 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goulash/audio"
+	"github.com/goulash/audio/flac"
+)
+
+// Properties contains the technical properties of an audio stream.
+// Fields that are unknown are zero.
+type Properties struct {
+	Codec      audio.Codec
+	SampleRate int // in Hz
+	BitDepth   int // in bits per sample; zero for lossy codecs
+	Channels   int
+	Lossless   bool
+	Bitrate    int // average, in kbps
+	Length     time.Duration
+}
+
+// IsHiRes returns true if the stream has a sample rate above 48 kHz
+// or a bit depth above 16 bits.
+func (p *Properties) IsHiRes() bool {
+	return p.SampleRate > 48000 || p.BitDepth > 16
+}
+
+// String returns a short description such as "FLAC 24/96 2ch".
+func (p *Properties) String() string {
+	s := []string{String(p.Codec)}
+	switch {
+	case p.BitDepth != 0 && p.SampleRate != 0:
+		s = append(s, fmt.Sprintf("%d/%s", p.BitDepth, khz(p.SampleRate)))
+	case p.SampleRate != 0:
+		s = append(s, khz(p.SampleRate)+"kHz")
+	}
+	if p.Channels != 0 {
+		s = append(s, fmt.Sprintf("%dch", p.Channels))
+	}
+	if !p.Lossless && p.Bitrate != 0 {
+		s = append(s, fmt.Sprintf("%dkbps", p.Bitrate))
+	}
+	return strings.Join(s, " ")
+}
+
+func khz(hz int) string {
+	if hz%1000 == 0 {
+		return fmt.Sprintf("%d", hz/1000)
+	}
+	return fmt.Sprintf("%.1f", float64(hz)/1000)
+}
+
+// IsLossless returns true if the codec is always lossless.
+// WavPack can be lossy as well, which PropertiesOf takes into account.
+func IsLossless(c audio.Codec) bool {
+	switch c {
+	case audio.WAV, audio.ALAC, audio.FLAC, audio.APE, audio.OFR, audio.TAK,
+		audio.WV, audio.TTA, audio.WMAL, AIFF, DSF:
+		return true
+	default:
+		return false
+	}
+}
+
+// The metadata readers implement some of these interfaces to provide
+// the properties that audio.Metadata does not.
+type (
+	sampleRater interface{ SampleRate() int }
+	bitDepther  interface{ BitDepth() int }
+	channeler   interface{ Channels() int }
+	losslesser  interface{ Lossless() bool }
+)
+
+// PropertiesOf returns the technical properties of the metadata.
+func PropertiesOf(md audio.Metadata) *Properties {
+	p := &Properties{
+		Codec:    md.Encoding(),
+		Bitrate:  md.EncodingBitrate(),
+		Length:   md.Length(),
+		Lossless: IsLossless(md.Encoding()),
+	}
+
+	if m, ok := md.(*flac.Metadata); ok {
+		si := m.StreamInfo()
+		p.SampleRate = int(si.SampleRate)
+		p.BitDepth = int(si.BitsPerSample)
+		p.Channels = int(si.NumChannels)
+		return p
+	}
+	if m, ok := md.(sampleRater); ok {
+		p.SampleRate = m.SampleRate()
+	}
+	if m, ok := md.(bitDepther); ok {
+		p.BitDepth = m.BitDepth()
+	}
+	if m, ok := md.(channeler); ok {
+		p.Channels = m.Channels()
+	}
+	if m, ok := md.(losslesser); ok {
+		p.Lossless = m.Lossless()
+	}
+	return p
+}
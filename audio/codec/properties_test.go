@@ -0,0 +1,101 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goulash/audio"
+)
+
+func TestPropertiesString(t *testing.T) {
+	tests := []struct {
+		p    Properties
+		want string
+	}{
+		{Properties{Codec: audio.FLAC, SampleRate: 96000, BitDepth: 24, Channels: 2, Lossless: true, Bitrate: 3000}, "FLAC 24/96 2ch"},
+		{Properties{Codec: audio.ALAC, SampleRate: 44100, BitDepth: 16, Channels: 2, Lossless: true}, "ALAC 16/44.1 2ch"},
+		{Properties{Codec: audio.MP3, SampleRate: 44100, Channels: 1, Bitrate: 128}, "MP3 44.1kHz 1ch 128kbps"},
+		{Properties{Codec: Opus, SampleRate: 48000, Bitrate: 96}, "OPUS 48kHz 96kbps"},
+		{Properties{Codec: DSF, SampleRate: 2822400, BitDepth: 1, Channels: 2, Lossless: true}, "DSF 1/2822.4 2ch"},
+		{Properties{Codec: audio.AAC}, "AAC"},
+	}
+	for _, tt := range tests {
+		if got := tt.p.String(); got != tt.want {
+			t.Errorf("String of %+v = %q, want %q", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestIsHiRes(t *testing.T) {
+	tests := []struct {
+		rate, depth int
+		want        bool
+	}{
+		{44100, 16, false},
+		{48000, 16, false},
+		{48000, 24, true},
+		{88200, 16, true},
+		{44100, 0, false},
+	}
+	for _, tt := range tests {
+		p := &Properties{SampleRate: tt.rate, BitDepth: tt.depth}
+		if got := p.IsHiRes(); got != tt.want {
+			t.Errorf("IsHiRes of %d/%d = %v, want %v", tt.depth, tt.rate, got, tt.want)
+		}
+	}
+}
+
+// wavPack is the metadata of a WavPack file in hybrid mode, which
+// implements the optional interfaces of the metadata readers.
+type wavPack struct {
+	audio.Metadata
+}
+
+func (wavPack) Encoding() audio.Codec { return audio.WV }
+func (wavPack) EncodingBitrate() int  { return 400 }
+func (wavPack) Length() time.Duration { return time.Minute }
+func (wavPack) SampleRate() int       { return 44100 }
+func (wavPack) BitDepth() int         { return 16 }
+func (wavPack) Channels() int         { return 2 }
+func (wavPack) Lossless() bool        { return false }
+
+// vorbis is the metadata of a stream that only provides its sample rate.
+type vorbis struct {
+	audio.Metadata
+}
+
+func (vorbis) Encoding() audio.Codec { return audio.OGG }
+func (vorbis) EncodingBitrate() int  { return 160 }
+func (vorbis) Length() time.Duration { return time.Second }
+func (vorbis) SampleRate() int       { return 48000 }
+
+func TestPropertiesOf(t *testing.T) {
+	got := PropertiesOf(wavPack{})
+	want := Properties{Codec: audio.WV, SampleRate: 44100, BitDepth: 16, Channels: 2, Lossless: false, Bitrate: 400, Length: time.Minute}
+	if *got != want {
+		t.Errorf("PropertiesOf WavPack = %+v, want %+v", *got, want)
+	}
+
+	got = PropertiesOf(vorbis{})
+	want = Properties{Codec: audio.OGG, SampleRate: 48000, Bitrate: 160, Length: time.Second}
+	if *got != want {
+		t.Errorf("PropertiesOf Vorbis = %+v, want %+v", *got, want)
+	}
+}
+
+func TestIsLossless(t *testing.T) {
+	for _, c := range []audio.Codec{audio.FLAC, audio.ALAC, audio.WAV, audio.WV, AIFF, DSF} {
+		if !IsLossless(c) {
+			t.Errorf("%s is not lossless", String(c))
+		}
+	}
+	for _, c := range []audio.Codec{audio.MP3, audio.AAC, audio.OGG, Opus, audio.M4A} {
+		if IsLossless(c) {
+			t.Errorf("%s is lossless", String(c))
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package cue reads CUE sheets, which describe the tracks of an album that
+// is stored as a single audio file, such as the image of a CD.
+//
+// Reference
+//
+//  https://wiki.hydrogenaud.io/index.php?title=Cue_sheet
+package cue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cassava/lackey/audio/tags"
+)
+
+var (
+	ErrNoTracks      = errors.New("CUE sheet has no audio tracks")
+	ErrMultipleFiles = errors.New("CUE sheet describes more than one file")
+)
+
+// FramesPerSecond is the number of CD frames in a second, which is the
+// unit of the times in a CUE sheet.
+const FramesPerSecond = 75
+
+// Sheet is a CUE sheet of a single audio file.
+type Sheet struct {
+	Title      string
+	Performer  string
+	Songwriter string
+	Catalog    string
+
+	// File is the name of the audio file, as the sheet refers to it, or
+	// empty if the sheet is embedded in the file itself.
+	File string
+
+	// Rem contains the REM comments by upper-case name, such as GENRE.
+	Rem    map[string]string
+	Tracks []*Track
+}
+
+// Track is an audio track of a CUE sheet.
+type Track struct {
+	Number     int
+	Title      string
+	Performer  string
+	Songwriter string
+	ISRC       string
+	Rem        map[string]string
+
+	// Start is the position of index 01 of the track in the file, and End
+	// that of the next track, or 0 if the track lasts until the end of the
+	// file. The pregap of a track, from index 00, ends the previous track.
+	Start time.Duration
+	End   time.Duration
+}
+
+// ReadFile reads the CUE sheet in file.
+func ReadFile(file string) (*Sheet, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(bs)
+}
+
+// Parse parses a CUE sheet. Sheets that are not valid UTF-8 are taken to
+// be in ISO-8859-1, which is what older rippers write. Data tracks are
+// skipped.
+func Parse(data []byte) (*Sheet, error) {
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	if !utf8.ValidString(text) {
+		rs := make([]rune, len(data))
+		for i, b := range data {
+			rs[i] = rune(b)
+		}
+		text = string(rs)
+	}
+
+	s := &Sheet{Rem: make(map[string]string)}
+	var (
+		t     *Track
+		files int
+	)
+	for n, line := range strings.Split(text, "\n") {
+		args := fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		invalid := fmt.Errorf("invalid CUE sheet: line %d: %s", n+1, strings.TrimSpace(line))
+		arg := func(i int) string {
+			if i < len(args) {
+				return args[i]
+			}
+			return ""
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "FILE":
+			if files++; files > 1 {
+				return nil, ErrMultipleFiles
+			}
+			s.File = arg(1)
+		case "TRACK":
+			num, err := strconv.Atoi(arg(1))
+			if err != nil {
+				return nil, invalid
+			}
+			t = &Track{Number: num, Start: -1, Rem: make(map[string]string)}
+			if strings.EqualFold(arg(2), "AUDIO") {
+				s.Tracks = append(s.Tracks, t)
+			}
+		case "INDEX":
+			if t == nil {
+				return nil, invalid
+			}
+			pos, err := parseTime(arg(2))
+			if err != nil {
+				return nil, invalid
+			}
+			if num, _ := strconv.Atoi(arg(1)); num == 1 {
+				t.Start = pos
+			}
+		case "REM":
+			if len(args) < 3 {
+				continue
+			}
+			rem := s.Rem
+			if t != nil {
+				rem = t.Rem
+			}
+			rem[strings.ToUpper(args[1])] = strings.Join(args[2:], " ")
+		case "TITLE":
+			if t != nil {
+				t.Title = arg(1)
+			} else {
+				s.Title = arg(1)
+			}
+		case "PERFORMER":
+			if t != nil {
+				t.Performer = arg(1)
+			} else {
+				s.Performer = arg(1)
+			}
+		case "SONGWRITER":
+			if t != nil {
+				t.Songwriter = arg(1)
+			} else {
+				s.Songwriter = arg(1)
+			}
+		case "CATALOG":
+			s.Catalog = arg(1)
+		case "ISRC":
+			if t != nil {
+				t.ISRC = arg(1)
+			}
+		}
+	}
+
+	if len(s.Tracks) == 0 {
+		return nil, ErrNoTracks
+	}
+	for i, t := range s.Tracks {
+		if t.Start < 0 || (i > 0 && t.Start < s.Tracks[i-1].Start) {
+			return nil, fmt.Errorf("invalid CUE sheet: track %d has no valid index 01", t.Number)
+		}
+		if i > 0 {
+			s.Tracks[i-1].End = t.Start
+		}
+	}
+	return s, nil
+}
+
+// fields splits a line into its words, of which those in double quotes
+// may contain spaces.
+func fields(line string) []string {
+	var (
+		args []string
+		cur  strings.Builder
+		word bool
+		quot bool
+	)
+	for _, r := range strings.TrimSpace(line) {
+		switch {
+		case r == '"':
+			quot = !quot
+			word = true
+		case !quot && (r == ' ' || r == '\t'):
+			if word {
+				args = append(args, cur.String())
+				cur.Reset()
+				word = false
+			}
+		default:
+			cur.WriteRune(r)
+			word = true
+		}
+	}
+	if word {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+// parseTime parses a time of the form mm:ss:ff, where ff are CD frames.
+func parseTime(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	var n [3]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		n[i] = v
+	}
+	frames := (n[0]*60+n[1])*FramesPerSecond + n[2]
+	return time.Duration(frames) * time.Second / FramesPerSecond, nil
+}
+
+// Tags returns the tags of the track with index i, which are taken from
+// the track and from the sheet as a whole.
+func (s *Sheet) Tags(i int) tags.Tags {
+	t := s.Tracks[i]
+	tt := make(tags.Tags)
+	first := func(values ...string) string {
+		for _, v := range values {
+			if v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	tt.Set("ALBUM", s.Title)
+	tt.Set("ALBUMARTIST", s.Performer)
+	tt.Set("ARTIST", first(t.Performer, s.Performer))
+	tt.Set("TITLE", t.Title)
+	tt.Set("COMPOSER", first(t.Songwriter, t.Rem["COMPOSER"], s.Songwriter, s.Rem["COMPOSER"]))
+	tt.Set("TRACKNUMBER", strconv.Itoa(t.Number))
+	tt.Set("TRACKTOTAL", strconv.Itoa(len(s.Tracks)))
+	tt.Set("ISRC", t.ISRC)
+	tt.Set("BARCODE", s.Catalog)
+	tt.Set("GENRE", first(t.Rem["GENRE"], s.Rem["GENRE"]))
+	tt.Set("DATE", first(t.Rem["DATE"], s.Rem["DATE"]))
+	tt.Set("COMMENT", first(t.Rem["COMMENT"], s.Rem["COMMENT"]))
+	tt.Set("DISCNUMBER", s.Rem["DISCNUMBER"])
+	tt.Set("DISCTOTAL", s.Rem["TOTALDISCS"])
+	return tt
+}
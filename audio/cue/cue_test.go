@@ -0,0 +1,280 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package cue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cassava/lackey/audio/tags"
+)
+
+// frames returns the time of the position mm:ss:ff.
+func frames(mm, ss, ff int) time.Duration {
+	return time.Duration((mm*60+ss)*FramesPerSecond+ff) * time.Second / FramesPerSecond
+}
+
+const album = `REM GENRE "Progressive Rock"
+REM DATE 1973
+REM DISCID 2F0A5E04
+REM COMMENT "ExactAudioCopy v1.6"
+CATALOG 0724382975229
+PERFORMER "The Band"
+TITLE "An Album"
+FILE "The Band - An Album.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "Speak  Softly"
+    PERFORMER "The Band"
+    ISRC GBN9Y1100081
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE Breathe
+    PERFORMER "Guest Singer"
+    SONGWRITER "Writer, Other"
+    REM GENRE Rock
+    INDEX 00 01:05:70
+    INDEX 01 01:07:74
+  TRACK 03 AUDIO
+    TITLE "On the Run"
+    REM DATE 1972
+    INDEX 01 03:56:02
+    INDEX 02 04:00:00
+`
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]byte(album))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Sheet{
+		Title:     "An Album",
+		Performer: "The Band",
+		Catalog:   "0724382975229",
+		File:      "The Band - An Album.flac",
+		Rem: map[string]string{
+			"GENRE":   "Progressive Rock",
+			"DATE":    "1973",
+			"DISCID":  "2F0A5E04",
+			"COMMENT": "ExactAudioCopy v1.6",
+		},
+		Tracks: []*Track{
+			{
+				Number:    1,
+				Title:     "Speak  Softly",
+				Performer: "The Band",
+				ISRC:      "GBN9Y1100081",
+				Rem:       map[string]string{},
+				Start:     0,
+				End:       frames(1, 7, 74),
+			},
+			{
+				Number:     2,
+				Title:      "Breathe",
+				Performer:  "Guest Singer",
+				Songwriter: "Writer, Other",
+				Rem:        map[string]string{"GENRE": "Rock"},
+				Start:      frames(1, 7, 74),
+				End:        frames(3, 56, 2),
+			},
+			{
+				Number: 3,
+				Title:  "On the Run",
+				Rem:    map[string]string{"DATE": "1972"},
+				Start:  frames(3, 56, 2),
+			},
+		},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("sheet is %+v, want %+v", s, want)
+		for i := range s.Tracks {
+			t.Logf("track %d is %+v", i+1, s.Tracks[i])
+		}
+	}
+
+	// Index 01 of track 2 is 5099 frames in, which is 67.98666 seconds.
+	if got, want := s.Tracks[1].Start, 67*time.Second+986666666; got != want {
+		t.Errorf("start of track 2 is %v, want %v", got, want)
+	}
+
+	// The same sheet with a byte order mark, CRLF line endings, tabs,
+	// and lower-case commands.
+	crlf := "\ufeff" + strings.Replace(strings.Replace(album, "\n", "\r\n", -1), "    ", "\t", -1)
+	crlf = strings.Replace(crlf, "TITLE Breathe", "title Breathe", 1)
+	if s, err := Parse([]byte(crlf)); err != nil || !reflect.DeepEqual(s, want) {
+		t.Errorf("sheet with CRLF and a BOM is %+v with error %v", s, err)
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	sheet := "TITLE \"Caf\xe9 \xc0 la Carte\"\nFILE a.wav WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00:00\n"
+	s, err := Parse([]byte(sheet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Café À la Carte"; s.Title != want {
+		t.Errorf("title in ISO-8859-1 is %q, want %q", s.Title, want)
+	}
+
+	sheet = "\ufeffTITLE \"Café À la Carte\"\nFILE a.wav WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00:00\n"
+	if s, err := Parse([]byte(sheet)); err != nil || s.Title != "Café À la Carte" {
+		t.Errorf("title in UTF-8 is %q with error %v", s.Title, err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		sheet string
+		err   error
+	}{
+		{"two files", "FILE a.wav WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00:00\nFILE b.wav WAVE\nTRACK 02 AUDIO\nINDEX 01 00:00:00\n", ErrMultipleFiles},
+		{"no tracks", "TITLE Album\nFILE a.wav WAVE\n", ErrNoTracks},
+		{"only data", "FILE a.bin BINARY\nTRACK 01 MODE1/2352\nINDEX 01 00:00:00\n", ErrNoTracks},
+		{"empty", "", ErrNoTracks},
+		{"index before track", "FILE a.wav WAVE\nINDEX 01 00:00:00\n", nil},
+		{"short time", "FILE a.wav WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00\n", nil},
+		{"negative time", "FILE a.wav WAVE\nTRACK 01 AUDIO\nINDEX 01 00:-1:00\n", nil},
+		{"bad number", "FILE a.wav WAVE\nTRACK one AUDIO\n", nil},
+		{"no index 01", "FILE a.wav WAVE\nTRACK 01 AUDIO\nINDEX 00 00:00:00\n", nil},
+		{"backwards", "FILE a.wav WAVE\nTRACK 01 AUDIO\nINDEX 01 00:10:00\nTRACK 02 AUDIO\nINDEX 01 00:05:00\n", nil},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.sheet))
+		if err == nil || tt.err != nil && err != tt.err {
+			t.Errorf("%s: error is %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// Data tracks are skipped, and the audio tracks around them kept.
+	s, err := Parse([]byte("FILE a.wav WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00:00\nTRACK 02 MODE1/2352\nINDEX 01 01:00:00\nTRACK 03 AUDIO\nINDEX 01 02:00:00\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Tracks) != 2 || s.Tracks[1].Number != 3 || s.Tracks[0].End != 2*time.Minute {
+		t.Errorf("tracks are %+v, want 1 until 2:00 and 3", s.Tracks)
+	}
+}
+
+func TestFields(t *testing.T) {
+	tests := map[string][]string{
+		`TITLE "Two  Spaces"`:           {"TITLE", "Two  Spaces"},
+		"  PERFORMER\t Unquoted Name  ": {"PERFORMER", "Unquoted", "Name"},
+		`TITLE ""`:                      {"TITLE", ""},
+		`TITLE "Unterminated`:           {"TITLE", "Unterminated"},
+		`FILE "a b.wav" WAVE`:           {"FILE", "a b.wav", "WAVE"},
+		`REM COMMENT "x"y`:              {"REM", "COMMENT", "xy"},
+		`TITLE "Tab	inside" "and more"`: {"TITLE", "Tab\tinside", "and more"},
+		"":                              nil,
+	}
+	for line, want := range tests {
+		if got := fields(line); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: fields are %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := map[string]time.Duration{
+		"00:00:00":  0,
+		"00:00:01":  time.Second / 75,
+		"00:01:00":  time.Second,
+		"01:00:74":  time.Minute + 74*time.Second/75,
+		"99:59:74":  frames(99, 59, 74),
+		"120:00:00": 2 * time.Hour,
+	}
+	for s, want := range tests {
+		if got, err := parseTime(s); err != nil || got != want {
+			t.Errorf("%s: time is %v with error %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "00:00", "00:00:00:00", "aa:00:00", "00:-1:00"} {
+		if _, err := parseTime(s); err == nil {
+			t.Errorf("%q: parsing succeeded", s)
+		}
+	}
+}
+
+func TestSheetTags(t *testing.T) {
+	s, err := Parse([]byte("REM COMPOSER \"Sheet Composer\"\nREM DISCNUMBER 2\nREM TOTALDISCS 3\n" + album))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tags.Tags{
+		{
+			"ALBUM":       {"An Album"},
+			"ALBUMARTIST": {"The Band"},
+			"ARTIST":      {"The Band"},
+			"TITLE":       {"Speak  Softly"},
+			"COMPOSER":    {"Sheet Composer"},
+			"TRACKNUMBER": {"1"},
+			"TRACKTOTAL":  {"3"},
+			"ISRC":        {"GBN9Y1100081"},
+			"BARCODE":     {"0724382975229"},
+			"GENRE":       {"Progressive Rock"},
+			"DATE":        {"1973"},
+			"COMMENT":     {"ExactAudioCopy v1.6"},
+			"DISCNUMBER":  {"2"},
+			"DISCTOTAL":   {"3"},
+		},
+		{
+			"ALBUM":       {"An Album"},
+			"ALBUMARTIST": {"The Band"},
+			"ARTIST":      {"Guest Singer"},
+			"TITLE":       {"Breathe"},
+			"COMPOSER":    {"Writer, Other"},
+			"TRACKNUMBER": {"2"},
+			"TRACKTOTAL":  {"3"},
+			"BARCODE":     {"0724382975229"},
+			"GENRE":       {"Rock"},
+			"DATE":        {"1973"},
+			"COMMENT":     {"ExactAudioCopy v1.6"},
+			"DISCNUMBER":  {"2"},
+			"DISCTOTAL":   {"3"},
+		},
+		{
+			"ALBUM":       {"An Album"},
+			"ALBUMARTIST": {"The Band"},
+			"ARTIST":      {"The Band"},
+			"TITLE":       {"On the Run"},
+			"COMPOSER":    {"Sheet Composer"},
+			"TRACKNUMBER": {"3"},
+			"TRACKTOTAL":  {"3"},
+			"BARCODE":     {"0724382975229"},
+			"GENRE":       {"Progressive Rock"},
+			"DATE":        {"1972"},
+			"COMMENT":     {"ExactAudioCopy v1.6"},
+			"DISCNUMBER":  {"2"},
+			"DISCTOTAL":   {"3"},
+		},
+	}
+	for i := range s.Tracks {
+		if got := s.Tags(i); !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("track %d: tags are %v, want %v", i+1, got, want[i])
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cue-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "album.cue")
+	if err := ioutil.WriteFile(file, []byte(album), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := ReadFile(file); err != nil || len(s.Tracks) != 3 {
+		t.Errorf("sheet is %+v with error %v, want 3 tracks", s, err)
+	}
+	if _, err := ReadFile(filepath.Join(dir, "missing.cue")); !os.IsNotExist(err) {
+		t.Errorf("error is %v, want that the file does not exist", err)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package dsf reads metadata from DSD Stream Files (DSF).
+//
+// Reference
+//
+//  https://dsd-guide.com/sites/default/files/white-papers/DSFFileFormatSpec_E.pdf
+package dsf
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cassava/lackey/audio/bitrate"
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/dhowden/tag"
+	"github.com/goulash/audio"
+	"github.com/goulash/stat"
+)
+
+var (
+	ErrNotDSF     = errors.New("file is not a DSF file")
+	ErrInvalidDSF = errors.New("invalid DSF chunk")
+)
+
+var Stats struct {
+	ReadMetadata stat.Run
+}
+
+func init() {
+	audio.MetadataReaders[codec.DSF] = func(file string) (audio.Metadata, error) {
+		return ReadMetadata(file)
+	}
+}
+
+// ReadMetadata {{{
+
+// Format describes the DSD stream in a DSF file.
+type Format struct {
+	Channels      int
+	SampleRate    int // in Hz, such as 2822400 for DSD64
+	BitsPerSample int // 1 or 8
+	SampleCount   int64
+	DataSize      int64
+}
+
+// Duration returns the length of the stream.
+func (f *Format) Duration() time.Duration {
+	if f.SampleRate == 0 {
+		return 0
+	}
+	return time.Duration(f.SampleCount) * time.Second / time.Duration(f.SampleRate)
+}
+
+// ReadMetadata reads the format and the ID3v2 tag of a DSF file.
+func ReadMetadata(file string) (*Metadata, error) {
+	start := time.Now()
+	defer func() { Stats.ReadMetadata.Add(float64(time.Since(start))) }()
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The file starts with three chunks in a fixed order:
+	//  "DSD "(4) size(8) total size(8) metadata pointer(8)
+	//  "fmt "(4) size(8) version(4) format id(4) channel type(4) channels(4)
+	//        sample rate(4) bits per sample(4) sample count(8) block size(4) reserved(4)
+	//  "data"(4) size(8) samples...
+	b := make([]byte, 28+52+12)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return nil, ErrNotDSF
+	}
+	le := binary.LittleEndian
+	if string(b[0:4]) != "DSD " || string(b[28:32]) != "fmt " || string(b[80:84]) != "data" {
+		return nil, ErrNotDSF
+	}
+	pointer := int64(le.Uint64(b[20:28]))
+	format := &Format{
+		Channels:      int(le.Uint32(b[52:56])),
+		SampleRate:    int(le.Uint32(b[56:60])),
+		BitsPerSample: int(le.Uint32(b[60:64])),
+		SampleCount:   int64(le.Uint64(b[64:72])),
+		DataSize:      int64(le.Uint64(b[84:92])) - 12,
+	}
+
+	m := &Metadata{format: format}
+	m.bitrate = bitrate.Average(format.DataSize, format.Duration())
+	if pointer == 0 {
+		m.Metadata = tags.NewMetadata(tag.ID3v2_3, tag.DSF, nil, nil)
+		return m, nil
+	}
+
+	if _, err := f.Seek(pointer, io.SeekStart); err != nil {
+		return nil, ErrInvalidDSF
+	}
+	tm, err := tag.ReadID3v2Tags(f)
+	if err != nil {
+		return nil, err
+	}
+	var pics []*tag.Picture
+	if p := tm.Picture(); p != nil {
+		pics = append(pics, p)
+	}
+	m.Metadata = tags.NewMetadata(tm.Format(), tag.DSF, tags.FromID3(tm.Raw()), pics)
+	return m, nil
+}
+
+// }}}
+
+// Metadata {{{
+
+var _ = audio.Metadata(new(Metadata))
+
+type Metadata struct {
+	*tags.Metadata
+
+	format  *Format
+	bitrate int
+}
+
+func (m *Metadata) Length() time.Duration { return m.format.Duration() }
+func (m *Metadata) Encoding() audio.Codec { return codec.DSF }
+func (m *Metadata) EncodingBitrate() int  { return m.bitrate }
+
+// AudioFormat returns the format of the DSD stream.
+func (m *Metadata) AudioFormat() *Format { return m.format }
+
+func (m *Metadata) SampleRate() int { return m.format.SampleRate }
+func (m *Metadata) BitDepth() int   { return 1 }
+func (m *Metadata) Channels() int   { return m.format.Channels }
+
+// }}}
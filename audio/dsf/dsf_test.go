@@ -0,0 +1,99 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package dsf
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// dsfFile returns a DSF file of a second of DSD64 stereo, followed by the
+// ID3v2 tag id3 if it is not empty.
+func dsfFile(id3 []byte) []byte {
+	const samples = 2822400
+	data := make([]byte, 2*samples/8)
+	le := binary.LittleEndian
+
+	b := make([]byte, 28+52+12)
+	copy(b, "DSD ")
+	le.PutUint64(b[4:], 28)
+	le.PutUint64(b[12:], uint64(len(b)+len(data)+len(id3)))
+	if len(id3) != 0 {
+		le.PutUint64(b[20:], uint64(len(b)+len(data)))
+	}
+	copy(b[28:], "fmt ")
+	le.PutUint64(b[32:], 52)
+	le.PutUint32(b[40:], 1) // version
+	le.PutUint32(b[48:], 2) // channel type
+	le.PutUint32(b[52:], 2) // channels
+	le.PutUint32(b[56:], 2822400)
+	le.PutUint32(b[60:], 1)
+	le.PutUint64(b[64:], samples)
+	le.PutUint32(b[72:], 4096)
+	copy(b[80:], "data")
+	le.PutUint64(b[84:], uint64(12+len(data)))
+	b = append(b, data...)
+	return append(b, id3...)
+}
+
+func readFile(t *testing.T, data []byte) (*Metadata, error) {
+	dir, err := ioutil.TempDir("", "dsf-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "test.dsf")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ReadMetadata(file)
+}
+
+func TestReadMetadata(t *testing.T) {
+	tit2 := append([]byte("TIT2\x00\x00\x00\x05\x00\x00\x00"), "Song"...)
+	id3 := append([]byte("ID3\x03\x00\x00\x00\x00\x00"), byte(len(tit2)))
+	id3 = append(id3, tit2...)
+
+	m, err := readFile(t, dsfFile(id3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := m.AudioFormat()
+	if f.Channels != 2 || f.SampleRate != 2822400 || f.BitsPerSample != 1 || f.DataSize != 705600 {
+		t.Errorf("format is %+v, want DSD64 stereo", f)
+	}
+	if m.Length() != time.Second {
+		t.Errorf("length is %s, want 1s", m.Length())
+	}
+	if m.EncodingBitrate() != 5644 {
+		t.Errorf("bitrate is %d, want 5644", m.EncodingBitrate())
+	}
+	if m.Title() != "Song" {
+		t.Errorf("title is %q, want %q", m.Title(), "Song")
+	}
+
+	m, err = readFile(t, dsfFile(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Title() != "" || m.Length() != time.Second {
+		t.Errorf("untagged: title is %q and length %s, want none and 1s", m.Title(), m.Length())
+	}
+}
+
+func TestReadMetadataInvalid(t *testing.T) {
+	b := dsfFile(nil)
+	copy(b[28:], "abcd")
+	if _, err := readFile(t, b); err != ErrNotDSF {
+		t.Errorf("error is %v, want %v", err, ErrNotDSF)
+	}
+	if _, err := readFile(t, b[:40]); err != ErrNotDSF {
+		t.Errorf("truncated: error is %v, want %v", err, ErrNotDSF)
+	}
+}
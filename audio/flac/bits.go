@@ -0,0 +1,128 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package flac
+
+import (
+	"bufio"
+	"math/bits"
+)
+
+// bitReader reads a stream bit by bit, most significant bit first.
+// It keeps track of the offset in the stream and of the CRC-8 and CRC-16
+// of all bytes read, which the frame decoder resets at the start of each
+// frame.
+type bitReader struct {
+	r *bufio.Reader
+	x uint64 // bits that have been read, of which the lowest n are unused
+	n uint
+
+	off   int64
+	crc8  uint8
+	crc16 uint16
+}
+
+func (br *bitReader) fill() error {
+	b, err := br.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	br.x = br.x<<8 | uint64(b)
+	br.n += 8
+	br.off++
+	br.crc8 = crc8Table[br.crc8^b]
+	br.crc16 = br.crc16<<8 ^ crc16Table[byte(br.crc16>>8)^b]
+	return nil
+}
+
+// bits reads an unsigned integer of n bits, where n is at most 56.
+func (br *bitReader) bits(n uint) (uint64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	for br.n < n {
+		if err := br.fill(); err != nil {
+			return 0, err
+		}
+	}
+	br.n -= n
+	return br.x >> br.n & (1<<n - 1), nil
+}
+
+// signed reads a two's complement integer of n bits.
+func (br *bitReader) signed(n uint) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	v, err := br.bits(n)
+	if err != nil {
+		return 0, err
+	}
+	return int64(v<<(64-n)) >> (64 - n), nil
+}
+
+// unary reads the number of zero bits before the next one bit.
+func (br *bitReader) unary() (uint64, error) {
+	var q uint64
+	for {
+		if br.n == 0 {
+			if err := br.fill(); err != nil {
+				return 0, err
+			}
+		}
+		v := br.x & (1<<br.n - 1)
+		if v == 0 {
+			q += uint64(br.n)
+			br.n = 0
+			continue
+		}
+		z := uint(bits.LeadingZeros64(v)) - (64 - br.n)
+		br.n -= z + 1
+		return q + uint64(z), nil
+	}
+}
+
+// align skips the bits up to the next byte boundary.
+func (br *bitReader) align() {
+	br.n -= br.n % 8
+}
+
+// reset discards any unused bits and resets the checksums.
+func (br *bitReader) reset() {
+	br.n = 0
+	br.crc8 = 0
+	br.crc16 = 0
+}
+
+// The CRCs of FLAC frames use the polynomials x^8 + x^2 + x + 1 for the
+// header and x^16 + x^15 + x^2 + 1 for the whole frame.
+var (
+	crc8Table  [256]uint8
+	crc16Table [256]uint16
+)
+
+func init() {
+	for i := range crc8Table {
+		c := uint8(i)
+		for j := 0; j < 8; j++ {
+			if c&0x80 != 0 {
+				c = c<<1 ^ 0x07
+			} else {
+				c <<= 1
+			}
+		}
+		crc8Table[i] = c
+	}
+	for i := range crc16Table {
+		c := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if c&0x8000 != 0 {
+				c = c<<1 ^ 0x8005
+			} else {
+				c <<= 1
+			}
+		}
+		crc16Table[i] = c
+	}
+}
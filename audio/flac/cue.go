@@ -0,0 +1,114 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package flac
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cassava/lackey/audio/cue"
+	"github.com/cassava/lackey/audio/tags"
+)
+
+var ErrInvalidCueSheet = errors.New("invalid CUESHEET block")
+
+// ReadCueSheet reads the CUE sheet embedded in a FLAC file, from its
+// CUESHEET comment or else from its CUESHEET block, or returns nil if it
+// has none. Sheets from the block have no titles, since it only stores the
+// positions and ISRCs of the tracks.
+func ReadCueSheet(file string) (*cue.Sheet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, blocks, _, err := readBlocks(f)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		if b.Type != blockVorbisComment {
+			continue
+		}
+		if _, cs, err := tags.ParseVorbisComment(b.Data); err == nil {
+			if s := tags.FromVorbis(cs).Get("CUESHEET"); s != "" {
+				return cue.Parse([]byte(s))
+			}
+		}
+	}
+	for _, b := range blocks {
+		if b.Type == blockCueSheet && len(blocks[0].Data) >= 13 {
+			si := blocks[0].Data
+			rate := int(si[10])<<12 | int(si[11])<<4 | int(si[12])>>4
+			return parseCueSheet(b.Data, rate)
+		}
+	}
+	return nil, nil
+}
+
+// parseCueSheet parses a CUESHEET block of a stream with the sample rate.
+func parseCueSheet(b []byte, rate int) (*cue.Sheet, error) {
+	if len(b) < 396 || rate == 0 {
+		return nil, ErrInvalidCueSheet
+	}
+	at := func(samples uint64) time.Duration {
+		return time.Duration(samples) * time.Second / time.Duration(rate)
+	}
+	s := &cue.Sheet{
+		Catalog: strings.TrimRight(string(b[:128]), "\x00"),
+		Rem:     make(map[string]string),
+	}
+	n := int(b[395])
+	b = b[396:]
+
+	var leadOut time.Duration
+	for i := 0; i < n; i++ {
+		if len(b) < 36 {
+			return nil, ErrInvalidCueSheet
+		}
+		offset := binary.BigEndian.Uint64(b)
+		t := &cue.Track{
+			Number: int(b[8]),
+			ISRC:   string(bytes.TrimRight(b[9:21], "\x00")),
+			Start:  -1,
+			Rem:    make(map[string]string),
+		}
+		audio := b[21]&0x80 == 0
+		indexes := int(b[35])
+		b = b[36:]
+		if len(b) < 12*indexes {
+			return nil, ErrInvalidCueSheet
+		}
+		for j := 0; j < indexes; j++ {
+			if b[8] == 1 {
+				t.Start = at(offset + binary.BigEndian.Uint64(b))
+			}
+			b = b[12:]
+		}
+
+		switch {
+		case t.Number == 170 || t.Number == 255:
+			leadOut = at(offset)
+		case audio && t.Start >= 0:
+			s.Tracks = append(s.Tracks, t)
+		}
+	}
+
+	if len(s.Tracks) == 0 {
+		return nil, cue.ErrNoTracks
+	}
+	for i, t := range s.Tracks {
+		if i+1 < len(s.Tracks) {
+			t.End = s.Tracks[i+1].Start
+		} else {
+			t.End = leadOut
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package flac
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cassava/lackey/audio/cue"
+)
+
+// withBlock returns the stream b, which must come from stream, with a
+// metadata block of the type after STREAMINFO.
+func withBlock(b []byte, typ byte, data []byte) []byte {
+	var out []byte
+	out = append(out, b[:42]...) // fLaC and STREAMINFO
+	out = append(out, typ, byte(len(data)>>16), byte(len(data)>>8), byte(len(data)))
+	out = append(out, data...)
+	return append(out, b[42:]...)
+}
+
+// cueTrack is a track of a CUESHEET block, with its indexes by number.
+type cueTrack struct {
+	offset  uint64
+	number  byte
+	isrc    string
+	data    bool
+	indexes map[byte]uint64
+}
+
+// cueSheet returns a CUESHEET block of the catalog number and tracks.
+func cueSheet(catalog string, tracks ...cueTrack) []byte {
+	b := make([]byte, 396)
+	copy(b, catalog)
+	binary.BigEndian.PutUint64(b[128:], 88200) // lead-in
+	b[136] = 0x80                              // CD-DA
+	b[395] = byte(len(tracks))
+	for _, t := range tracks {
+		tb := make([]byte, 36)
+		binary.BigEndian.PutUint64(tb, t.offset)
+		tb[8] = t.number
+		copy(tb[9:21], t.isrc)
+		if t.data {
+			tb[21] = 0x80
+		}
+		tb[35] = byte(len(t.indexes))
+		for i := byte(0); i < 100; i++ {
+			if x, ok := t.indexes[i]; ok {
+				ib := make([]byte, 12)
+				binary.BigEndian.PutUint64(ib, x)
+				ib[8] = i
+				tb = append(tb, ib...)
+			}
+		}
+		b = append(b, tb...)
+	}
+	return b
+}
+
+func TestReadCueSheet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flac-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "image.flac")
+	write := func(data []byte) {
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := func(samples int64) time.Duration {
+		return time.Duration(samples) * time.Second / 44100
+	}
+
+	image := verbatimFLAC(16, []int64{1, 2})
+	write(image)
+	if s, err := ReadCueSheet(file); err != nil || s != nil {
+		t.Errorf("sheet of an image without one is %+v with error %v", s, err)
+	}
+
+	// The block only has the positions of the tracks, which are in
+	// samples. Track 2 has a pregap, and track 3 is data.
+	block := cueSheet("1234567890123",
+		cueTrack{offset: 0, number: 1, isrc: "GBN9Y1100081", indexes: map[byte]uint64{1: 0}},
+		cueTrack{offset: 44100 * 60, number: 2, indexes: map[byte]uint64{0: 0, 1: 588 * 150}},
+		cueTrack{offset: 44100 * 180, number: 3, data: true, indexes: map[byte]uint64{1: 0}},
+		cueTrack{offset: 44100 * 240, number: 170},
+	)
+	write(withBlock(image, blockCueSheet, block))
+	s, err := ReadCueSheet(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Catalog != "1234567890123" || len(s.Tracks) != 2 {
+		t.Fatalf("sheet is %+v, want catalog 1234567890123 and 2 tracks", s)
+	}
+	t1, t2 := s.Tracks[0], s.Tracks[1]
+	if t1.Number != 1 || t1.ISRC != "GBN9Y1100081" || t1.Start != 0 || t1.End != t2.Start {
+		t.Errorf("track 1 is %+v", t1)
+	}
+	if want := at(44100*60 + 588*150); t2.Number != 2 || t2.Start != want {
+		t.Errorf("track 2 starts at %v, want %v", t2.Start, want)
+	}
+	if want := at(44100 * 240); t2.End != want {
+		t.Errorf("track 2 ends at %v, want the lead-out at %v", t2.End, want)
+	}
+
+	// A sheet in the comments is preferred over the block.
+	sheet := "TITLE Album\nFILE image.flac WAVE\nTRACK 01 AUDIO\nTITLE Song\nINDEX 01 00:00:00\n"
+	write(withComment(withBlock(image, blockCueSheet, block), "libFLAC", "cuesheet="+sheet))
+	if s, err := ReadCueSheet(file); err != nil || s.Title != "Album" || len(s.Tracks) != 1 || s.Tracks[0].Title != "Song" {
+		t.Errorf("sheet is %+v with error %v, want the one of the comments", s, err)
+	}
+
+	for name, b := range map[string][]byte{
+		"short":       block[:395],
+		"track":       block[:396+20],
+		"index":       block[:396+36+6],
+		"only data":   cueSheet("", cueTrack{number: 1, data: true, indexes: map[byte]uint64{1: 0}}, cueTrack{number: 170}),
+		"no index 01": cueSheet("", cueTrack{number: 1, indexes: map[byte]uint64{0: 0}}, cueTrack{number: 170}),
+	} {
+		write(withBlock(image, blockCueSheet, b))
+		if _, err := ReadCueSheet(file); err == nil {
+			t.Errorf("%s: reading the sheet succeeded", name)
+		}
+	}
+	write(withBlock(image, blockCueSheet, cueSheet("", cueTrack{number: 170})))
+	if _, err := ReadCueSheet(file); err != cue.ErrNoTracks {
+		t.Errorf("error is %v, want %v", err, cue.ErrNoTracks)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package flac decodes FLAC streams to PCM samples, without any external
+// program. The decoded samples are checked against the CRCs of each frame
+// and the MD5 signature of the stream, and errors are reported with the
+// frame in which they occur. The Vorbis comments of FLAC files can be
+// read and written as well.
+//
+// Reference
+//
+//	https://xiph.org/flac/format.html
+package flac
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cassava/lackey/audio/wav"
+)
+
+var (
+	ErrNotFLAC      = errors.New("file is not a FLAC file")
+	ErrNoStreamInfo = errors.New("missing STREAMINFO block")
+	ErrMD5Mismatch  = errors.New("MD5 signature of decoded audio does not match")
+)
+
+// StreamInfo {{{
+
+// StreamInfo describes the audio in a FLAC stream.
+type StreamInfo struct {
+	MinBlockSize  int
+	MaxBlockSize  int
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	// TotalSamples is the number of samples per channel, or 0 if unknown.
+	TotalSamples int64
+	// MD5 is the signature of the decoded samples, or all zeros if unknown.
+	MD5 [16]byte
+}
+
+// Duration returns the length of the stream, if it is known.
+func (si *StreamInfo) Duration() time.Duration {
+	if si.SampleRate == 0 {
+		return 0
+	}
+	return time.Duration(si.TotalSamples) * time.Second / time.Duration(si.SampleRate)
+}
+
+// Format returns the format of the decoded samples in a WAV stream.
+func (si *StreamInfo) Format() *wav.Format {
+	f := &wav.Format{
+		Tag:           1,
+		Channels:      si.Channels,
+		SampleRate:    si.SampleRate,
+		BitsPerSample: si.BitsPerSample,
+		Frames:        si.TotalSamples,
+		DataSize:      si.TotalSamples * int64(si.Channels*si.sampleBytes()),
+	}
+	if si.TotalSamples == 0 {
+		// The header says that the data extends to the end of the stream.
+		f.DataSize = 1 << 32
+	}
+	return f
+}
+
+func (si *StreamInfo) sampleBytes() int { return (si.BitsPerSample + 7) / 8 }
+
+// ReadStreamInfo reads the stream info of a FLAC file.
+func ReadStreamInfo(file string) (*StreamInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readStreamInfo(&bitReader{r: bufio.NewReader(f)})
+}
+
+// readStreamInfo reads the signature and the metadata blocks of a FLAC
+// stream, skipping all blocks except STREAMINFO, and an ID3v2 tag in
+// front of it, which some programs add.
+func readStreamInfo(br *bitReader) (*StreamInfo, error) {
+	sig := make([]byte, 4)
+	if _, err := io.ReadFull(br.r, sig); err != nil {
+		return nil, ErrNotFLAC
+	}
+	br.off += 4
+	if string(sig[:3]) == "ID3" {
+		hdr := make([]byte, 6)
+		if _, err := io.ReadFull(br.r, hdr); err != nil {
+			return nil, ErrNotFLAC
+		}
+		size := int64(hdr[2])<<21 | int64(hdr[3])<<14 | int64(hdr[4])<<7 | int64(hdr[5])
+		if hdr[1]&0x10 != 0 {
+			size += 10 // footer
+		}
+		if _, err := br.r.Discard(int(size)); err != nil {
+			return nil, ErrNotFLAC
+		}
+		if _, err := io.ReadFull(br.r, sig); err != nil {
+			return nil, ErrNotFLAC
+		}
+		br.off += 10 + size + 4
+	}
+	if string(sig) != "fLaC" {
+		return nil, ErrNotFLAC
+	}
+
+	var si *StreamInfo
+	for last := false; !last; {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(br.r, hdr); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		last = hdr[0]&0x80 != 0
+		size := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+		br.off += 4 + int64(size)
+		if hdr[0]&0x7F != 0 {
+			if _, err := br.r.Discard(size); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			continue
+		}
+
+		// STREAMINFO:
+		//  min block size(16) max block size(16) min frame size(24) max frame size(24)
+		//  sample rate(20) channels-1(3) bits per sample-1(5) total samples(36) md5(128)
+		b := make([]byte, size)
+		if size < 34 {
+			return nil, ErrNoStreamInfo
+		}
+		if _, err := io.ReadFull(br.r, b); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		be := binary.BigEndian
+		x := be.Uint64(b[10:18])
+		si = &StreamInfo{
+			MinBlockSize:  int(be.Uint16(b[0:2])),
+			MaxBlockSize:  int(be.Uint16(b[2:4])),
+			SampleRate:    int(x >> 44),
+			Channels:      int(x>>41&0x7) + 1,
+			BitsPerSample: int(x>>36&0x1F) + 1,
+			TotalSamples:  int64(x & (1<<36 - 1)),
+		}
+		copy(si.MD5[:], b[18:34])
+	}
+	if si == nil {
+		return nil, ErrNoStreamInfo
+	}
+	return si, nil
+}
+
+// }}}
+
+// Decoder {{{
+
+// FrameError describes where in a stream decoding failed.
+type FrameError struct {
+	Frame  int   // number of the frame, starting at 0
+	Offset int64 // offset of the frame in the stream
+	Sample int64 // first sample of the frame
+	Err    error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("frame %d at byte %d (sample %d): %s", e.Frame, e.Offset, e.Sample, e.Err)
+}
+
+// Decoder decodes a FLAC stream to interleaved little-endian PCM samples,
+// which is the layout of the data in a WAV file. Samples of 8 bits are
+// unsigned, all others are signed.
+type Decoder struct {
+	Info *StreamInfo
+
+	br      bitReader
+	md5     hash.Hash
+	frames  int
+	samples int64
+
+	buf []int64 // samples of one channel after another
+	pcm []byte  // interleaved samples of the last frame
+	out []byte  // the part of pcm that has not been read
+	err error
+}
+
+// NewDecoder reads the metadata of the FLAC stream in r and returns
+// a decoder of its samples.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	d := &Decoder{
+		br:  bitReader{r: bufio.NewReaderSize(r, 64*1024)},
+		md5: md5.New(),
+	}
+	si, err := readStreamInfo(&d.br)
+	if err != nil {
+		return nil, err
+	}
+	if si.BitsPerSample < 4 || si.BitsPerSample > 32 || si.SampleRate == 0 {
+		return nil, fmt.Errorf("unsupported FLAC stream: %d bits at %d Hz", si.BitsPerSample, si.SampleRate)
+	}
+	d.Info = si
+	return d, nil
+}
+
+// Read reads decoded samples. At the end of the stream, the number of
+// samples and the MD5 signature are checked against the stream info.
+func (d *Decoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.next()
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// next decodes the next frame into out, or checks the stream at its end.
+func (d *Decoder) next() error {
+	si := d.Info
+	if si.TotalSamples != 0 && d.samples >= si.TotalSamples {
+		// Anything after the last frame, such as an ID3v1 tag, is ignored.
+		return d.verify()
+	}
+	offset := d.br.off
+	n, err := d.frame()
+	if err == io.EOF && d.br.off == offset {
+		return d.verify()
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return &FrameError{Frame: d.frames, Offset: offset, Sample: d.samples, Err: err}
+	}
+	d.frames++
+	d.samples += int64(n)
+
+	// Interleave the channels, and sign the MD5 before the samples are
+	// left-justified, as WAV stores 12-bit samples in the upper bits of
+	// 16 for example, and before 8-bit samples are made unsigned.
+	width := si.sampleBytes()
+	d.pcm = d.interleave(d.pcm[:0], n, 0)
+	d.md5.Write(d.pcm)
+	if shift := uint(8*width - si.BitsPerSample); shift != 0 {
+		d.pcm = d.interleave(d.pcm[:0], n, shift)
+	}
+	if width == 1 {
+		for i := range d.pcm {
+			d.pcm[i] ^= 0x80
+		}
+	}
+	d.out = d.pcm
+	return nil
+}
+
+// interleave appends the n samples of each channel in buf to pcm, one
+// after another, shifted left by shift bits.
+func (d *Decoder) interleave(pcm []byte, n int, shift uint) []byte {
+	width := d.Info.sampleBytes()
+	for i := 0; i < n; i++ {
+		for c := 0; c < d.Info.Channels; c++ {
+			x := d.buf[c*n+i] << shift
+			for j := 0; j < width; j++ {
+				pcm = append(pcm, byte(x>>uint(8*j)))
+			}
+		}
+	}
+	return pcm
+}
+
+// verify checks the number of samples and the MD5 signature of the stream.
+func (d *Decoder) verify() error {
+	si := d.Info
+	if si.TotalSamples != 0 && d.samples != si.TotalSamples {
+		return fmt.Errorf("stream ends after %d of %d samples", d.samples, si.TotalSamples)
+	}
+	if si.MD5 != [16]byte{} && !bytes.Equal(d.md5.Sum(nil), si.MD5[:]) {
+		return ErrMD5Mismatch
+	}
+	return io.EOF
+}
+
+// }}}
+
+// NewReader {{{
+
+// NewReader returns a WAV stream of the samples in a FLAC file.
+// Errors that occur while decoding are returned by both Read and Close,
+// and include the path of the file.
+func NewReader(file string) (io.ReadCloser, *StreamInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := NewDecoder(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, &os.PathError{Op: "decode", Path: file, Err: err}
+	}
+	var hdr bytes.Buffer
+	if err := wav.WriteHeader(&hdr, d.Info.Format()); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	r := &reader{Reader: io.MultiReader(&hdr, d), d: d, f: f}
+	return r, d.Info, nil
+}
+
+type reader struct {
+	io.Reader
+	d *Decoder
+	f *os.File
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = &os.PathError{Op: "decode", Path: r.f.Name(), Err: err}
+	}
+	return n, err
+}
+
+// Close closes the file, and returns the error that stopped decoding, if any.
+func (r *reader) Close() error {
+	err := r.f.Close()
+	if r.d.err != nil && r.d.err != io.EOF {
+		return &os.PathError{Op: "decode", Path: r.f.Name(), Err: r.d.err}
+	}
+	return err
+}
+
+// }}}
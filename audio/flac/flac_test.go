@@ -0,0 +1,381 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package flac
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cassava/lackey/audio/wav"
+)
+
+// bitWriter writes bits most significant first.
+type bitWriter struct {
+	buf []byte
+	n   uint // bits used in the last byte
+}
+
+func (bw *bitWriter) write(x uint64, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		if bw.n%8 == 0 {
+			bw.buf = append(bw.buf, 0)
+			bw.n = 0
+		}
+		bw.buf[len(bw.buf)-1] |= byte(x>>uint(i)&1) << (7 - bw.n)
+		bw.n++
+	}
+}
+
+// rice writes the residuals in one partition with Rice parameter k.
+func (bw *bitWriter) rice(k uint, residuals ...int64) {
+	bw.write(0, 2) // method
+	bw.write(0, 4) // partition order
+	bw.write(uint64(k), 4)
+	for _, r := range residuals {
+		u := uint64(r<<1 ^ r>>63)
+		bw.write(1, uint(u>>k)+1)
+		bw.write(u, k)
+	}
+}
+
+// subframe writes one subframe to a frame of samples with the given depth.
+type subframe func(bw *bitWriter, depth uint)
+
+func constant(x int64) subframe {
+	return func(bw *bitWriter, depth uint) {
+		bw.write(0x00, 8)
+		bw.write(uint64(x), depth)
+	}
+}
+
+func verbatim(samples ...int64) subframe {
+	return func(bw *bitWriter, depth uint) {
+		bw.write(0x02, 8)
+		for _, x := range samples {
+			bw.write(uint64(x), depth)
+		}
+	}
+}
+
+// fixed writes a fixed predictor subframe with Rice parameter 2.
+func fixed(warmup []int64, residuals ...int64) subframe {
+	return func(bw *bitWriter, depth uint) {
+		bw.write(uint64(8+len(warmup))<<1, 8)
+		for _, x := range warmup {
+			bw.write(uint64(x), depth)
+		}
+		bw.rice(2, residuals...)
+	}
+}
+
+// lpc writes a linear predictor subframe with coefficients of 8 bits.
+func lpc(warmup []int64, shift uint, coeffs []int64, residuals ...int64) subframe {
+	return func(bw *bitWriter, depth uint) {
+		bw.write(uint64(31+len(warmup))<<1, 8)
+		for _, x := range warmup {
+			bw.write(uint64(x), depth)
+		}
+		bw.write(7, 4) // precision - 1
+		bw.write(uint64(shift), 5)
+		for _, c := range coeffs {
+			bw.write(uint64(c), 8)
+		}
+		bw.rice(2, residuals...)
+	}
+}
+
+// frame returns a frame of n samples at 44.1 kHz with the channel
+// assignment and the subframes.
+func frame(bits, n int, assign uint64, subframes ...subframe) []byte {
+	sizes := map[int]uint64{8: 1, 12: 2, 16: 4, 20: 5, 24: 6}
+	var fr bitWriter
+	fr.write(0xfff8, 16)
+	fr.write(6, 4) // block size - 1 follows in 8 bits
+	fr.write(9, 4) // 44.1 kHz
+	fr.write(assign, 4)
+	fr.write(sizes[bits], 3)
+	fr.write(0, 1)
+	fr.write(0, 8) // frame number
+	fr.write(uint64(n-1), 8)
+	var crc8 uint8
+	for _, b := range fr.buf {
+		crc8 = crc8Table[crc8^b]
+	}
+	fr.write(uint64(crc8), 8)
+	for c, sf := range subframes {
+		depth := uint(bits)
+		if (assign == leftSide || assign == midSide) && c == 1 || assign == sideRight && c == 0 {
+			depth++
+		}
+		sf(&fr, depth)
+	}
+	var crc16 uint16
+	for _, b := range fr.buf {
+		crc16 = crc16<<8 ^ crc16Table[byte(crc16>>8)^b]
+	}
+	fr.n = 8
+	fr.write(uint64(crc16), 16)
+	return fr.buf
+}
+
+// stream returns a FLAC stream at 44.1 kHz with the frames, whose
+// samples are given interleaved for the STREAMINFO block.
+func stream(channels, bits int, samples []int64, frames ...[]byte) []byte {
+	width := (bits + 7) / 8
+	sum := md5.New()
+	for _, x := range samples {
+		for j := 0; j < width; j++ {
+			sum.Write([]byte{byte(x >> uint(8*j))})
+		}
+	}
+
+	var si bitWriter
+	si.write(256, 16) // minimum block size
+	si.write(256, 16) // maximum block size
+	si.write(0, 24)   // minimum frame size
+	si.write(0, 24)   // maximum frame size
+	si.write(44100, 20)
+	si.write(uint64(channels-1), 3)
+	si.write(uint64(bits-1), 5)
+	si.write(uint64(len(samples)/channels), 36)
+	si.buf = append(si.buf, sum.Sum(nil)...)
+
+	// A PADDING block follows to check that other blocks are skipped.
+	b := []byte("fLaC")
+	b = append(b, 0x00, 0, 0, byte(len(si.buf)))
+	b = append(b, si.buf...)
+	b = append(b, 0x81, 0, 0, 4, 0, 0, 0, 0)
+	for _, fr := range frames {
+		b = append(b, fr...)
+	}
+	return b
+}
+
+// verbatimFLAC returns a mono FLAC stream at 44.1 kHz of samples with
+// the given bit depth in a single frame of verbatim samples.
+func verbatimFLAC(bits int, samples []int64) []byte {
+	return stream(1, bits, samples, frame(bits, len(samples), 0, verbatim(samples...)))
+}
+
+// pcm returns interleaved little-endian samples of the given width.
+func pcm(width int, samples ...int64) []byte {
+	var b []byte
+	for _, x := range samples {
+		for j := 0; j < width; j++ {
+			b = append(b, byte(x>>uint(8*j)))
+		}
+	}
+	return b
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		channels int
+		bits     int
+		samples  []int64 // interleaved
+		frames   [][]byte
+	}{
+		{"constant", 1, 16, []int64{-7, -7, -7, -7}, [][]byte{
+			frame(16, 4, 0, constant(-7)),
+		}},
+		{"verbatim", 1, 24, []int64{1, -1, 1<<23 - 1, -1 << 23}, [][]byte{
+			frame(24, 4, 0, verbatim(1, -1, 1<<23-1, -1<<23)),
+		}},
+		{"fixed", 1, 16, []int64{10, 20, 30, 40, 35}, [][]byte{
+			frame(16, 5, 0, fixed([]int64{10, 20}, 0, 0, -15)),
+		}},
+		{"lpc", 1, 16, []int64{100, 101, 99, 99}, [][]byte{
+			frame(16, 4, 0, lpc([]int64{100}, 1, []int64{2}, 1, -2, 0)),
+		}},
+		{"independent", 2, 16, []int64{1, -1, 2, -2}, [][]byte{
+			frame(16, 2, 1, verbatim(1, 2), verbatim(-1, -2)),
+		}},
+		{"left side", 2, 16, []int64{5, 3, -4, 4}, [][]byte{
+			frame(16, 2, leftSide, verbatim(5, -4), verbatim(2, -8)),
+		}},
+		{"side right", 2, 16, []int64{5, 3, -4, 4}, [][]byte{
+			frame(16, 2, sideRight, verbatim(2, -8), verbatim(3, 4)),
+		}},
+		{"mid side", 2, 16, []int64{5, 2, -4, 4}, [][]byte{
+			frame(16, 2, midSide, verbatim(3, 0), verbatim(3, -8)),
+		}},
+		{"frames", 1, 16, []int64{1, 2, 3, 4, 5}, [][]byte{
+			frame(16, 2, 0, verbatim(1, 2)),
+			frame(16, 3, 0, verbatim(3, 4, 5)),
+		}},
+	}
+	for _, tt := range tests {
+		d, err := NewDecoder(bytes.NewReader(stream(tt.channels, tt.bits, tt.samples, tt.frames...)))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(d)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if want := pcm(tt.bits/8, tt.samples...); !bytes.Equal(got, want) {
+			t.Errorf("%s: decoded % x, want % x", tt.name, got, want)
+		}
+	}
+
+	// Samples of 8 bits are unsigned in WAV files.
+	d, err := NewDecoder(bytes.NewReader(verbatimFLAC(8, []int64{0, 127, -128, -1})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(d)
+	if want := []byte{0x80, 0xff, 0x00, 0x7f}; err != nil || !bytes.Equal(got, want) {
+		t.Errorf("8 bits: decoded % x, %v, want % x", got, err, want)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	samples := []int64{1, 2, 3, 4}
+	valid := verbatimFLAC(16, samples)
+
+	frameCRC := append([]byte(nil), valid...)
+	frameCRC[len(frameCRC)-3] ^= 1
+	headerCRC := append([]byte(nil), valid...)
+	headerCRC[len(valid)-len(frame(16, 4, 0, verbatim(samples...)))+2] ^= 0x01
+	badMD5 := append([]byte(nil), valid...)
+	badMD5[41] ^= 1 // last byte of the MD5 signature
+	badSubframe := stream(1, 16, samples, frame(16, 4, 0, func(bw *bitWriter, depth uint) {
+		bw.write(0x04, 8) // reserved type
+	}))
+	short := stream(1, 16, append(samples, 5), frame(16, 4, 0, verbatim(samples...)))
+
+	tests := []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"frame crc", frameCRC, ErrFrameCRC},
+		{"header crc", headerCRC, ErrHeaderCRC},
+		{"truncated", valid[:len(valid)-4], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		d, err := NewDecoder(bytes.NewReader(tt.stream))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		_, err = ioutil.ReadAll(d)
+		if fe, ok := err.(*FrameError); !ok || fe.Err != tt.err {
+			t.Errorf("%s: error is %v, want a FrameError of %v", tt.name, err, tt.err)
+		} else if fe.Frame != 0 || fe.Offset != 50 {
+			t.Errorf("%s: error is in frame %d at %d, want frame 0 at 50", tt.name, fe.Frame, fe.Offset)
+		}
+	}
+
+	for _, s := range []struct {
+		name   string
+		stream []byte
+	}{{"subframe", badSubframe}, {"short", short}} {
+		d, err := NewDecoder(bytes.NewReader(s.stream))
+		if err != nil {
+			t.Fatalf("%s: %s", s.name, err)
+		}
+		if _, err := ioutil.ReadAll(d); err == nil {
+			t.Errorf("%s: decoding succeeded", s.name)
+		}
+	}
+
+	d, err := NewDecoder(bytes.NewReader(badMD5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(d); err != ErrMD5Mismatch {
+		t.Errorf("md5: error is %v, want %v", err, ErrMD5Mismatch)
+	}
+
+	for _, b := range [][]byte{nil, []byte("OggS"), []byte("RIFF\x00\x00\x00\x00WAVE")} {
+		if _, err := NewDecoder(bytes.NewReader(b)); err != ErrNotFLAC {
+			t.Errorf("%q: error is %v, want %v", b, err, ErrNotFLAC)
+		}
+	}
+	if _, err := NewDecoder(bytes.NewReader([]byte("fLaC\x81\x00\x00\x00"))); err != ErrNoStreamInfo {
+		t.Errorf("no STREAMINFO: error is %v, want %v", err, ErrNoStreamInfo)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flac-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Some programs put an ID3v2 tag in front of the stream.
+	samples := []int64{1, -1, 2, -2}
+	data := append([]byte("ID3\x03\x00\x00\x00\x00\x00\x04TAG!"), verbatimFLAC(16, samples)...)
+	file := filepath.Join(dir, "track.flac")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, si, err := NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if si.Channels != 1 || si.SampleRate != 44100 || si.BitsPerSample != 16 || si.TotalSamples != 4 {
+		t.Errorf("stream info is %+v, want 4 samples of 16-bit mono at 44.1 kHz", si)
+	}
+	f, wr, err := wav.ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Channels != 1 || f.SampleRate != 44100 || f.BitsPerSample != 16 || f.DataSize != 8 {
+		t.Errorf("format is %+v, want 8 bytes of 16-bit mono at 44.1 kHz", f)
+	}
+	b, err := ioutil.ReadAll(wr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := pcm(2, samples...); !bytes.HasSuffix(b, want) {
+		t.Errorf("stream ends with % x, want % x", b[len(b)-8:], want)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("close: %s", err)
+	}
+
+	if _, _, err := NewReader(filepath.Join(dir, "missing.flac")); !os.IsNotExist(err) {
+		t.Errorf("error of a missing file is %v, want it not to exist", err)
+	}
+}
+
+func TestDecodeJustified(t *testing.T) {
+	for _, bits := range []int{12, 20} {
+		max := int64(1)<<uint(bits-1) - 1
+		samples := []int64{1, -1, max, -max - 1}
+		d, err := NewDecoder(bytes.NewReader(verbatimFLAC(bits, samples)))
+		if err != nil {
+			t.Fatalf("%d bits: %s", bits, err)
+		}
+		got, err := ioutil.ReadAll(d)
+		if err != nil {
+			t.Fatalf("%d bits: %s", bits, err)
+		}
+
+		// WAV samples are left-justified in their container.
+		width := (bits + 7) / 8
+		var want []byte
+		for _, x := range samples {
+			x <<= uint(8*width - bits)
+			for j := 0; j < width; j++ {
+				want = append(want, byte(x>>uint(8*j)))
+			}
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%d bits: decoded % x, want % x", bits, got, want)
+		}
+	}
+}
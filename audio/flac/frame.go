@@ -0,0 +1,402 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package flac
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+var (
+	ErrSync      = errors.New("lost frame sync")
+	ErrHeader    = errors.New("invalid frame header")
+	ErrHeaderCRC = errors.New("frame header CRC mismatch")
+	ErrFrameCRC  = errors.New("frame CRC mismatch")
+	ErrSubframe  = errors.New("invalid subframe")
+	ErrResidual  = errors.New("invalid residual")
+)
+
+// Channel assignments that are not independent channels.
+const (
+	leftSide  = 8
+	sideRight = 9
+	midSide   = 10
+)
+
+// Frame {{{
+
+// frame decodes the next frame into buf and returns its block size.
+func (d *Decoder) frame() (int, error) {
+	br := &d.br
+	si := d.Info
+	br.reset()
+
+	// The header of a frame consists of:
+	//  sync(14) reserved(1) blocking strategy(1)
+	//  block size(4) sample rate(4) channel assignment(4) sample size(3) reserved(1)
+	//  frame or sample number(8-56) [block size(8/16)] [sample rate(8/16)] crc-8(8)
+	x, err := br.bits(16)
+	if err != nil {
+		return 0, err
+	}
+	if x>>2 != 0x3FFE || x&2 != 0 {
+		return 0, ErrSync
+	}
+	x, err = br.bits(16)
+	if err != nil {
+		return 0, err
+	}
+	sizeCode, rateCode, assign, depthCode := x>>12, x>>8&0xF, x>>4&0xF, x>>1&0x7
+	if x&1 != 0 {
+		return 0, ErrHeader
+	}
+
+	// The frame or sample number is coded like UTF-8, and we only skip it.
+	b, err := br.bits(8)
+	if err != nil {
+		return 0, err
+	}
+	if n := bits.LeadingZeros8(^uint8(b)); n != 0 {
+		if n == 1 || n > 7 {
+			return 0, ErrHeader
+		}
+		for i := 1; i < n; i++ {
+			if b, err = br.bits(8); err != nil {
+				return 0, err
+			} else if b&0xC0 != 0x80 {
+				return 0, ErrHeader
+			}
+		}
+	}
+
+	var blockSize int
+	switch {
+	case sizeCode == 0:
+		return 0, ErrHeader
+	case sizeCode == 1:
+		blockSize = 192
+	case sizeCode <= 5:
+		blockSize = 576 << (sizeCode - 2)
+	case sizeCode == 6 || sizeCode == 7:
+		v, err := br.bits(8 * uint(sizeCode-5))
+		if err != nil {
+			return 0, err
+		}
+		blockSize = int(v) + 1
+	default:
+		blockSize = 256 << (sizeCode - 8)
+	}
+
+	// The sample rate is only used by the player, so we skip it as well.
+	switch rateCode {
+	case 12:
+		_, err = br.bits(8)
+	case 13, 14:
+		_, err = br.bits(16)
+	case 15:
+		return 0, ErrHeader
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	depth := si.BitsPerSample
+	if depthCode != 0 {
+		depth = [...]int{0, 8, 12, 0, 16, 20, 24, 32}[depthCode]
+	}
+	if depth != si.BitsPerSample {
+		return 0, fmt.Errorf("frame has %d bits per sample instead of %d", depth, si.BitsPerSample)
+	}
+
+	channels := int(assign) + 1
+	if assign >= leftSide {
+		if assign > midSide {
+			return 0, ErrHeader
+		}
+		channels = 2
+	}
+	if channels != si.Channels {
+		return 0, fmt.Errorf("frame has %d channels instead of %d", channels, si.Channels)
+	}
+
+	crc := br.crc8
+	if x, err = br.bits(8); err != nil {
+		return 0, err
+	} else if uint8(x) != crc {
+		return 0, ErrHeaderCRC
+	}
+
+	// Subframes follow, one for each channel, and the side channel has
+	// an extra bit.
+	if cap(d.buf) < channels*blockSize {
+		d.buf = make([]int64, channels*blockSize)
+	}
+	d.buf = d.buf[:channels*blockSize]
+	for c := 0; c < channels; c++ {
+		depth := uint(si.BitsPerSample)
+		if (assign == leftSide || assign == midSide) && c == 1 || assign == sideRight && c == 0 {
+			depth++
+		}
+		err := d.subframe(d.buf[c*blockSize:(c+1)*blockSize], depth)
+		if err == io.EOF {
+			return 0, err
+		} else if err != nil {
+			return 0, fmt.Errorf("subframe %d: %s", c, err)
+		}
+	}
+	decorrelate(d.buf, blockSize, assign)
+
+	// The footer contains the CRC-16 of the whole frame.
+	br.align()
+	crc16 := br.crc16
+	if x, err = br.bits(16); err != nil {
+		return 0, err
+	} else if uint16(x) != crc16 {
+		return 0, ErrFrameCRC
+	}
+	return blockSize, nil
+}
+
+// decorrelate restores the left and right channels of stereo frames
+// that store a side channel.
+func decorrelate(buf []int64, n int, assign uint64) {
+	a, b := buf[:n], buf[n:]
+	switch assign {
+	case leftSide:
+		for i := range a {
+			b[i] = a[i] - b[i]
+		}
+	case sideRight:
+		for i := range a {
+			a[i] += b[i]
+		}
+	case midSide:
+		for i := range a {
+			mid := a[i]<<1 | b[i]&1
+			a[i], b[i] = (mid+b[i])>>1, (mid-b[i])>>1
+		}
+	}
+}
+
+// }}}
+
+// Subframe {{{
+
+// subframe decodes the samples of one channel, which have depth bits.
+func (d *Decoder) subframe(s []int64, depth uint) error {
+	br := &d.br
+
+	// The header consists of:
+	//  zero(1) type(6) wasted bits flag(1) [wasted bits-1 (unary)]
+	x, err := br.bits(8)
+	if err != nil {
+		return err
+	}
+	if x&0x80 != 0 {
+		return ErrSubframe
+	}
+	kind := x >> 1 & 0x3F
+	var wasted uint
+	if x&1 != 0 {
+		k, err := br.unary()
+		if err != nil {
+			return err
+		}
+		wasted = uint(k) + 1
+		if wasted >= depth {
+			return ErrSubframe
+		}
+		depth -= wasted
+	}
+
+	switch {
+	case kind == 0:
+		v, err := br.signed(depth)
+		if err != nil {
+			return err
+		}
+		for i := range s {
+			s[i] = v
+		}
+	case kind == 1:
+		for i := range s {
+			if s[i], err = br.signed(depth); err != nil {
+				return err
+			}
+		}
+	case kind >= 8 && kind <= 12:
+		err = d.fixed(s, int(kind-8), depth)
+	case kind >= 32:
+		err = d.lpc(s, int(kind-31), depth)
+	default:
+		return ErrSubframe
+	}
+	if err != nil {
+		return err
+	}
+
+	if wasted > 0 {
+		for i := range s {
+			s[i] <<= wasted
+		}
+	}
+	return nil
+}
+
+// warmup reads the unencoded samples that a predictor starts with.
+func (d *Decoder) warmup(s []int64, order int, depth uint) error {
+	if order > len(s) {
+		return ErrSubframe
+	}
+	for i := 0; i < order; i++ {
+		v, err := d.br.signed(depth)
+		if err != nil {
+			return err
+		}
+		s[i] = v
+	}
+	return nil
+}
+
+// fixed decodes a subframe with one of the fixed polynomial predictors.
+func (d *Decoder) fixed(s []int64, order int, depth uint) error {
+	if err := d.warmup(s, order, depth); err != nil {
+		return err
+	}
+	if err := d.residual(s, order); err != nil {
+		return err
+	}
+	switch order {
+	case 1:
+		for i := 1; i < len(s); i++ {
+			s[i] += s[i-1]
+		}
+	case 2:
+		for i := 2; i < len(s); i++ {
+			s[i] += 2*s[i-1] - s[i-2]
+		}
+	case 3:
+		for i := 3; i < len(s); i++ {
+			s[i] += 3*s[i-1] - 3*s[i-2] + s[i-3]
+		}
+	case 4:
+		for i := 4; i < len(s); i++ {
+			s[i] += 4*s[i-1] - 6*s[i-2] + 4*s[i-3] - s[i-4]
+		}
+	}
+	return nil
+}
+
+// lpc decodes a subframe with a linear predictor.
+func (d *Decoder) lpc(s []int64, order int, depth uint) error {
+	br := &d.br
+	if err := d.warmup(s, order, depth); err != nil {
+		return err
+	}
+
+	// precision-1(4) shift(5) coefficients(precision each)
+	x, err := br.bits(4)
+	if err != nil {
+		return err
+	}
+	if x == 0xF {
+		return ErrSubframe
+	}
+	precision := uint(x) + 1
+	shift, err := br.signed(5)
+	if err != nil {
+		return err
+	}
+	if shift < 0 {
+		return ErrSubframe
+	}
+	coeffs := make([]int64, order)
+	for i := range coeffs {
+		if coeffs[i], err = br.signed(precision); err != nil {
+			return err
+		}
+	}
+
+	if err := d.residual(s, order); err != nil {
+		return err
+	}
+	for i := order; i < len(s); i++ {
+		var sum int64
+		for j, c := range coeffs {
+			sum += c * s[i-1-j]
+		}
+		s[i] += sum >> uint(shift)
+	}
+	return nil
+}
+
+// residual reads the Rice coded residual of a predictor into s[order:].
+func (d *Decoder) residual(s []int64, order int) error {
+	br := &d.br
+
+	// method(2) partition order(4), and for each partition:
+	//  parameter(4/5) [bits(5) if escaped] residuals
+	method, err := br.bits(2)
+	if err != nil {
+		return err
+	}
+	if method > 1 {
+		return ErrResidual
+	}
+	paramBits := uint(4 + method)
+	escape := uint64(1)<<paramBits - 1
+	x, err := br.bits(4)
+	if err != nil {
+		return err
+	}
+	partOrder := uint(x)
+	size := len(s) >> partOrder
+	if size<<partOrder != len(s) || size < order {
+		return ErrResidual
+	}
+
+	i := order
+	for p := 0; p < 1<<partOrder; p++ {
+		n := size
+		if p == 0 {
+			n -= order
+		}
+		k, err := br.bits(paramBits)
+		if err != nil {
+			return err
+		}
+		if k == escape {
+			w, err := br.bits(5)
+			if err != nil {
+				return err
+			}
+			for j := 0; j < n; j++ {
+				if s[i], err = br.signed(uint(w)); err != nil {
+					return err
+				}
+				i++
+			}
+			continue
+		}
+		for j := 0; j < n; j++ {
+			q, err := br.unary()
+			if err != nil {
+				return err
+			}
+			r, err := br.bits(uint(k))
+			if err != nil {
+				return err
+			}
+			u := q<<k | r
+			s[i] = int64(u>>1) ^ -int64(u&1)
+			i++
+		}
+	}
+	return nil
+}
+
+// }}}
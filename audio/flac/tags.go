@@ -0,0 +1,301 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package flac
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cassava/lackey/audio/tags"
+)
+
+// Padding is the size of the PADDING block that is written when the
+// metadata of a file does not fit into its old space, so that it can
+// grow the next time without rewriting the file.
+var Padding = 4096
+
+// Metadata block types.
+const (
+	blockStreamInfo    = 0
+	blockPadding       = 1
+	blockVorbisComment = 4
+	blockCueSheet      = 5
+	blockPicture       = 6
+)
+
+var ErrBlockTooLarge = errors.New("metadata block too large")
+
+type block struct {
+	Type byte
+	Data []byte
+}
+
+// readBlocks reads the metadata blocks of a FLAC file. It returns the
+// offset of the fLaC marker, which may follow an ID3v2 tag, and the
+// offset at which the frames start.
+func readBlocks(f io.ReaderAt) (start int64, blocks []*block, end int64, err error) {
+	h := make([]byte, 10)
+	if _, err := f.ReadAt(h, 0); err != nil {
+		return 0, nil, 0, ErrNotFLAC
+	}
+	if string(h[:3]) == "ID3" {
+		start = 10 + (int64(h[6])<<21 | int64(h[7])<<14 | int64(h[8])<<7 | int64(h[9]))
+		if h[5]&0x10 != 0 {
+			start += 10 // footer
+		}
+		if _, err := f.ReadAt(h[:4], start); err != nil {
+			return 0, nil, 0, ErrNotFLAC
+		}
+	}
+	if string(h[:4]) != "fLaC" {
+		return 0, nil, 0, ErrNotFLAC
+	}
+
+	end = start + 4
+	for last := false; !last; {
+		if _, err := f.ReadAt(h[:4], end); err != nil {
+			return 0, nil, 0, io.ErrUnexpectedEOF
+		}
+		last = h[0]&0x80 != 0
+		b := &block{
+			Type: h[0] & 0x7F,
+			Data: make([]byte, int(h[1])<<16|int(h[2])<<8|int(h[3])),
+		}
+		if _, err := f.ReadAt(b.Data, end+4); err != nil {
+			return 0, nil, 0, io.ErrUnexpectedEOF
+		}
+		blocks = append(blocks, b)
+		end += 4 + int64(len(b.Data))
+	}
+	return start, blocks, end, nil
+}
+
+// encodeBlocks encodes the blocks, and marks the last one.
+func encodeBlocks(blocks []*block) ([]byte, error) {
+	var b []byte
+	for i, bl := range blocks {
+		if len(bl.Data) >= 1<<24 {
+			return nil, ErrBlockTooLarge
+		}
+		t := bl.Type
+		if i == len(blocks)-1 {
+			t |= 0x80
+		}
+		n := len(bl.Data)
+		b = append(b, t, byte(n>>16), byte(n>>8), byte(n))
+		b = append(b, bl.Data...)
+	}
+	return b, nil
+}
+
+// ReadTags reads the Vorbis comments of a FLAC file.
+func ReadTags(file string) (tags.Tags, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, blocks, _, err := readBlocks(f)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		if b.Type == blockVorbisComment {
+			_, cs, err := tags.ParseVorbisComment(b.Data)
+			if err != nil {
+				return nil, err
+			}
+			return tags.FromVorbis(cs), nil
+		}
+	}
+	return make(tags.Tags), nil
+}
+
+// WriteTags replaces the Vorbis comments of a FLAC file with t, keeping
+// the vendor string and any comments with pictures. If the metadata fits
+// into the space of the old metadata and its padding, without leaving more
+// than Padding bytes unused, the file is changed in place; otherwise it is
+// rewritten with Padding bytes of padding.
+func WriteTags(file string, t tags.Tags) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start, blocks, end, err := readBlocks(f)
+	if err != nil {
+		return err
+	}
+
+	comment := &block{Type: blockVorbisComment}
+	vendor, comments := "lackey", t.Vorbis()
+	var bs []*block
+	for i, b := range blocks {
+		switch b.Type {
+		case blockPadding:
+			continue
+		case blockVorbisComment:
+			v, cs, err := tags.ParseVorbisComment(b.Data)
+			if err == nil {
+				vendor = v
+				for _, c := range cs {
+					if tags.IsPictureComment(c) {
+						comments = append(comments, c)
+					}
+				}
+			}
+			bs = append(bs, comment)
+			continue
+		}
+		bs = append(bs, b)
+		if i == 0 && b.Type == blockStreamInfo && !hasComment(blocks) {
+			bs = append(bs, comment)
+		}
+	}
+	comment.Data = tags.EncodeVorbisComment(vendor, comments)
+	return writeBlocks(f, file, start, bs, end)
+}
+
+// ReadPictures reads the pictures of a FLAC file, from its PICTURE blocks
+// and from METADATA_BLOCK_PICTURE comments. Invalid pictures are skipped.
+func ReadPictures(file string) ([]*tags.Picture, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, blocks, _, err := readBlocks(f)
+	if err != nil {
+		return nil, err
+	}
+	var pics []*tags.Picture
+	for _, b := range blocks {
+		switch b.Type {
+		case blockPicture:
+			if p, err := tags.ParsePicture(b.Data); err == nil {
+				pics = append(pics, p)
+			}
+		case blockVorbisComment:
+			if _, cs, err := tags.ParseVorbisComment(b.Data); err == nil {
+				pics = append(pics, tags.PicturesOf(cs)...)
+			}
+		}
+	}
+	return pics, nil
+}
+
+// WritePictures replaces the pictures of a FLAC file with pics, which are
+// written as PICTURE blocks, as WriteTags writes the comments. Pictures
+// in comments are removed.
+func WritePictures(file string, pics []*tags.Picture) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start, blocks, end, err := readBlocks(f)
+	if err != nil {
+		return err
+	}
+
+	var bs []*block
+	for _, b := range blocks {
+		switch b.Type {
+		case blockPadding, blockPicture:
+			continue
+		case blockVorbisComment:
+			if v, cs, err := tags.ParseVorbisComment(b.Data); err == nil {
+				var keep []string
+				for _, c := range cs {
+					if !tags.IsPictureComment(c) {
+						keep = append(keep, c)
+					}
+				}
+				b = &block{Type: blockVorbisComment, Data: tags.EncodeVorbisComment(v, keep)}
+			}
+		}
+		bs = append(bs, b)
+	}
+	for _, p := range pics {
+		bs = append(bs, &block{Type: blockPicture, Data: p.Encode()})
+	}
+	return writeBlocks(f, file, start, bs, end)
+}
+
+// writeBlocks replaces the metadata blocks of f, which are between start
+// and end, with bs. If they fit into the old space and leave no more than
+// Padding bytes of it unused, the file is changed in place; otherwise it is
+// rewritten with Padding bytes of padding.
+func writeBlocks(f *os.File, file string, start int64, bs []*block, end int64) error {
+	meta, err := encodeBlocks(bs)
+	if err != nil {
+		return err
+	}
+	space := int(end - start - 4)
+	if len(meta) == space || (len(meta)+4 <= space && space-len(meta)-4 <= Padding) {
+		if len(meta) < space {
+			bs = append(bs, &block{Type: blockPadding, Data: make([]byte, space-len(meta)-4)})
+			if meta, err = encodeBlocks(bs); err != nil {
+				return err
+			}
+		}
+		_, err = f.WriteAt(meta, start+4)
+		return err
+	}
+
+	bs = append(bs, &block{Type: blockPadding, Data: make([]byte, Padding)})
+	if meta, err = encodeBlocks(bs); err != nil {
+		return err
+	}
+	return rewrite(f, file, start+4, meta, end)
+}
+
+func hasComment(blocks []*block) bool {
+	for _, b := range blocks {
+		if b.Type == blockVorbisComment {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite writes a new file next to file with the bytes of f before start,
+// then meta, and then the bytes of f from end, which replaces file.
+func rewrite(f *os.File, file string, start int64, meta []byte, end int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".flactag-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	_, err = io.Copy(w, io.NewSectionReader(f, 0, start))
+	if err == nil {
+		_, err = w.Write(meta)
+	}
+	if err == nil {
+		_, err = io.Copy(w, io.NewSectionReader(f, end, fi.Size()-end))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(fi.Mode())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
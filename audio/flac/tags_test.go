@@ -0,0 +1,260 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package flac
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cassava/lackey/audio/tags"
+)
+
+// withComment returns the stream b, which must come from stream, with a
+// VORBIS_COMMENT block of the vendor and the comments after STREAMINFO.
+func withComment(b []byte, vendor string, comments ...string) []byte {
+	c := tags.EncodeVorbisComment(vendor, comments)
+	var out []byte
+	out = append(out, b[:42]...) // fLaC and STREAMINFO
+	out = append(out, blockVorbisComment, byte(len(c)>>16), byte(len(c)>>8), byte(len(c)))
+	out = append(out, c...)
+	return append(out, b[42:]...)
+}
+
+func TestWriteTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flac-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	samples := []int64{1, -1, 2, -2}
+	data := withComment(verbatimFLAC(16, samples), "reference libFLAC", "TITLE=Old", "METADATA_BLOCK_PICTURE=AAAA")
+	file := filepath.Join(dir, "track.flac")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new comments do not fit into the old block and its padding.
+	want := tags.Tags{"TITLE": {"New Song"}, "ARTIST": {"A", "B"}, "TRACKNUMBER": {"3"}}
+	if err := WriteTags(file, want); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() < int64(len(data)+Padding) {
+		t.Errorf("size after rewrite is %d, want at least %d of padding", fi.Size(), Padding)
+	}
+	got, err := ReadTags(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tags are %v, want %v", got, want)
+	}
+
+	// Now the comments fit into the padding, and the file keeps its size.
+	size := fi.Size()
+	want["TITLE"] = []string{"Other"}
+	want["ALBUM"] = []string{"Album"}
+	if err := WriteTags(file, want); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Stat(file); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != size {
+		t.Errorf("size after writing in place is %d, want %d", fi.Size(), size)
+	}
+	if got, err = ReadTags(file); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("tags are %v, want %v", got, want)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, blocks, _, err := readBlocks(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 || blocks[0].Type != blockStreamInfo || blocks[1].Type != blockVorbisComment || blocks[2].Type != blockPadding {
+		t.Errorf("blocks are %v, want STREAMINFO, VORBIS_COMMENT, and PADDING", blocks)
+	}
+	vendor, cs, err := tags.ParseVorbisComment(blocks[1].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vendor != "reference libFLAC" {
+		t.Errorf("vendor is %q, want it kept", vendor)
+	}
+	if len(cs) != 6 || cs[5] != "METADATA_BLOCK_PICTURE=AAAA" {
+		t.Errorf("comments are %q, want the picture kept", cs)
+	}
+
+	// The audio is left as it was.
+	r, _, err := NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := pcm(2, samples...); !bytes.HasSuffix(b, want) {
+		t.Errorf("audio ends with % x, want % x", b[len(b)-8:], want)
+	}
+}
+
+func TestWriteTagsNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flac-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file without comments behind an ID3v2 tag, which is kept.
+	id3 := []byte("ID3\x03\x00\x00\x00\x00\x00\x04TAG!")
+	data := append(id3, verbatimFLAC(16, []int64{5, 6})...)
+	file := filepath.Join(dir, "track.flac")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadTags(file); err != nil || len(got) != 0 {
+		t.Errorf("tags are %v with error %v, want none", got, err)
+	}
+	want := tags.Tags{"ALBUM": {"Record"}}
+	if err := WriteTags(file, want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadTags(file); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("tags are %v, want %v", got, want)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, id3) {
+		t.Errorf("file starts with %q, want the ID3v2 tag kept", b[:len(id3)])
+	}
+	if r, si, err := NewReader(file); err != nil {
+		t.Error(err)
+	} else {
+		r.Close()
+		if si.TotalSamples != 2 {
+			t.Errorf("total samples are %d, want 2", si.TotalSamples)
+		}
+	}
+
+	other := filepath.Join(dir, "track.wav")
+	if err := ioutil.WriteFile(other, []byte("RIFF\x00\x00\x00\x00WAVE"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTags(other, want); err != ErrNotFLAC {
+		t.Errorf("wav: error is %v, want %v", err, ErrNotFLAC)
+	}
+	if _, err := ReadTags(other); err != ErrNotFLAC {
+		t.Errorf("wav: error of reading is %v, want %v", err, ErrNotFLAC)
+	}
+}
+
+func TestWritePictures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flac-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "track.flac")
+	if err := ioutil.WriteFile(file, withComment(verbatimFLAC(16, []int64{1, 2}), "libFLAC", "TITLE=Song"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	front := &tags.Picture{MIMEType: "image/jpeg", Type: tags.FrontCover, Data: []byte{0xff, 0xd8}}
+	back := &tags.Picture{MIMEType: "image/png", Type: 4, Data: []byte("\x89PNG")}
+	for _, pics := range [][]*tags.Picture{{front, back}, {back}, nil} {
+		if err := WritePictures(file, pics); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, blocks, _, err := readBlocks(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []*tags.Picture
+		for _, b := range blocks {
+			if b.Type == blockPicture {
+				p, err := tags.ParsePicture(b.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, p)
+			}
+		}
+		if !reflect.DeepEqual(got, pics) {
+			t.Errorf("pictures are %v, want %v", got, pics)
+		}
+		if tt, err := ReadTags(file); err != nil || tt.Get("TITLE") != "Song" {
+			t.Errorf("tags are %v with error %v, want them kept", tt, err)
+		}
+	}
+}
+
+func TestReadPictures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flac-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "track.flac")
+	back := &tags.Picture{MIMEType: "image/png", Type: 4, Data: []byte("\x89PNG")}
+	data := withComment(verbatimFLAC(16, []int64{1, 2}), "libFLAC", "TITLE=Song", back.VorbisComment(), "METADATA_BLOCK_PICTURE=!")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pics, err := ReadPictures(file); err != nil || !reflect.DeepEqual(pics, []*tags.Picture{back}) {
+		t.Errorf("pictures are %v with error %v, want %v", pics, err, back)
+	}
+
+	// Pictures in comments are replaced by PICTURE blocks.
+	front := &tags.Picture{MIMEType: "image/jpeg", Type: tags.FrontCover, Data: make([]byte, 2*Padding)}
+	if err := WritePictures(file, []*tags.Picture{front}); err != nil {
+		t.Fatal(err)
+	}
+	if pics, err := ReadPictures(file); err != nil || !reflect.DeepEqual(pics, []*tags.Picture{front}) {
+		t.Errorf("pictures are %v with error %v, want %v", pics, err, front)
+	}
+	if tt, err := ReadTags(file); err != nil || !reflect.DeepEqual(tt, tags.Tags{"TITLE": {"Song"}}) {
+		t.Errorf("tags are %v with error %v, want only the title", tt, err)
+	}
+
+	// Removing a large picture makes the file smaller.
+	if err := WritePictures(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max := int64(len(data) + Padding + 4); fi.Size() > max {
+		t.Errorf("size without pictures is %d, want at most %d", fi.Size(), max)
+	}
+	if pics, err := ReadPictures(file); err != nil || len(pics) != 0 {
+		t.Errorf("pictures are %v with error %v, want none", pics, err)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package loudness measures the loudness of audio as defined by EBU R128,
+// from which ReplayGain and Opus output gains are derived, and applies
+// gains to WAV streams.
+//
+// Reference
+//
+//	https://www.itu.int/rec/R-REC-BS.1770
+//	https://tech.ebu.ch/docs/tech/tech3341.pdf
+package loudness
+
+import (
+	"math"
+)
+
+const (
+	// ReplayGainReference is the loudness in LUFS that ReplayGain 2.0
+	// gains are relative to.
+	ReplayGainReference = -18.0
+
+	// R128Reference is the loudness in LUFS that the R128 gains of Opus
+	// files are relative to.
+	R128Reference = -23.0
+
+	absoluteGate = -70.0 // LUFS
+	relativeGate = -10.0 // LU below the loudness above the absolute gate
+)
+
+// Meter measures the integrated loudness and the sample peak of audio
+// with the given sample rate and number of channels.
+type Meter struct {
+	channels int
+	weights  []float64
+	filters  []kFilter
+
+	// Blocks of 400 ms overlap by 75%, so they are made of four steps of
+	// 100 ms, of which the last three are kept in steps.
+	step   int
+	n      int
+	sum    float64
+	steps  []float64
+	blocks []float64
+
+	peak float64
+}
+
+// NewMeter returns a meter for audio with the sample rate and channels.
+func NewMeter(rate, channels int) *Meter {
+	m := &Meter{
+		channels: channels,
+		weights:  weights(channels),
+		filters:  make([]kFilter, channels),
+		step:     rate / 10,
+	}
+	for i := range m.filters {
+		m.filters[i] = newKFilter(float64(rate))
+	}
+	if m.step == 0 {
+		m.step = 1
+	}
+	return m
+}
+
+// weights returns the weight of each channel, which are in the order of
+// WAV files. Surround channels of 5.0 and 5.1 audio are weighted more,
+// and the LFE channel is ignored.
+func weights(channels int) []float64 {
+	w := make([]float64, channels)
+	for i := range w {
+		w[i] = 1
+	}
+	switch channels {
+	case 5:
+		w[3], w[4] = 1.41, 1.41
+	case 6:
+		w[3], w[4], w[5] = 0, 1.41, 1.41
+	}
+	return w
+}
+
+// Add measures one frame, which contains a sample for every channel,
+// where 1 is full scale.
+func (m *Meter) Add(frame []float64) {
+	for i, x := range frame[:m.channels] {
+		if a := math.Abs(x); a > m.peak {
+			m.peak = a
+		}
+		y := m.filters[i].filter(x)
+		m.sum += m.weights[i] * y * y
+	}
+	m.n++
+	if m.n < m.step {
+		return
+	}
+	if len(m.steps) == 3 {
+		energy := m.sum
+		for _, s := range m.steps {
+			energy += s
+		}
+		m.blocks = append(m.blocks, energy/float64(4*m.step))
+		copy(m.steps, m.steps[1:])
+		m.steps = m.steps[:2]
+	}
+	m.steps = append(m.steps, m.sum)
+	m.n, m.sum = 0, 0
+}
+
+// Loudness returns the integrated loudness in LUFS, which is negative
+// infinity for audio that is silent or shorter than 400 ms.
+func (m *Meter) Loudness() float64 {
+	return Loudness(m)
+}
+
+// Peak returns the largest absolute sample, where 1 is full scale.
+func (m *Meter) Peak() float64 {
+	return m.peak
+}
+
+// Loudness returns the integrated loudness in LUFS of the audio measured
+// by all meters, as if it were played in a row, which is the loudness of
+// an album.
+func Loudness(meters ...*Meter) float64 {
+	gate := energy(absoluteGate)
+	var sum float64
+	var n int
+	for _, m := range meters {
+		for _, e := range m.blocks {
+			if e > gate {
+				sum += e
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return math.Inf(-1)
+	}
+
+	gate = energy(lufs(sum/float64(n)) + relativeGate)
+	sum, n = 0, 0
+	for _, m := range meters {
+		for _, e := range m.blocks {
+			if e > gate {
+				sum += e
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return math.Inf(-1)
+	}
+	return lufs(sum / float64(n))
+}
+
+// Peak returns the largest peak of all meters.
+func Peak(meters ...*Meter) float64 {
+	var peak float64
+	for _, m := range meters {
+		peak = math.Max(peak, m.peak)
+	}
+	return peak
+}
+
+func lufs(energy float64) float64 { return -0.691 + 10*math.Log10(energy) }
+func energy(lufs float64) float64 { return math.Pow(10, (lufs+0.691)/10) }
+
+// kFilter is the K-weighting filter, which consists of a shelving filter
+// that models the head and a high-pass filter. The coefficients of both
+// are derived for the sample rate as in libebur128.
+type kFilter struct {
+	shelf, highpass biquad
+}
+
+func newKFilter(rate float64) kFilter {
+	var f kFilter
+
+	const (
+		f0 = 1681.974450955533
+		g  = 3.999843853973347
+		q  = 0.7071752369554196
+	)
+	k := math.Tan(math.Pi * f0 / rate)
+	vh := math.Pow(10, g/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	f.shelf = biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	const (
+		hf0 = 38.13547087602444
+		hq  = 0.5003270373238773
+	)
+	k = math.Tan(math.Pi * hf0 / rate)
+	a0 = 1 + k/hq + k*k
+	f.highpass = biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/hq + k*k) / a0,
+	}
+	return f
+}
+
+func (f *kFilter) filter(x float64) float64 {
+	return f.highpass.filter(f.shelf.filter(x))
+}
+
+// biquad is a second-order IIR filter in direct form II.
+type biquad struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+	z1, z2     float64
+}
+
+func (f *biquad) filter(x float64) float64 {
+	w := x - f.a1*f.z1 - f.a2*f.z2
+	y := f.b0*w + f.b1*f.z1 + f.b2*f.z2
+	f.z2, f.z1 = f.z1, w
+	return y
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package loudness
+
+import (
+	"math"
+	"testing"
+)
+
+// sine adds a sine of 1 kHz in all channels to m, with an amplitude of
+// dbfs and the length of the given seconds.
+func sine(m *Meter, rate, channels int, dbfs, seconds float64) {
+	amp := math.Pow(10, dbfs/20)
+	frame := make([]float64, channels)
+	for i := 0; i < int(seconds*float64(rate)); i++ {
+		x := amp * math.Sin(2*math.Pi*1000*float64(i)/float64(rate))
+		for c := range frame {
+			frame[c] = x
+		}
+		m.Add(frame)
+	}
+}
+
+func TestMeter(t *testing.T) {
+	// The test cases of EBU Tech 3341, which allow an error of 0.1 LU.
+	tests := []struct {
+		name   string
+		rate   int
+		parts  []float64 // pairs of dBFS and seconds
+		lufs   float64
+		stereo bool
+	}{
+		{"-23 dBFS", 48000, []float64{-23, 20}, -23, true},
+		{"-33 dBFS", 48000, []float64{-33, 20}, -33, true},
+		{"relative gate", 48000, []float64{-36, 10, -23, 60, -36, 10}, -23, true},
+		{"absolute gate", 48000, []float64{-72, 10, -36, 10, -23, 60, -36, 10, -72, 10}, -23, true},
+		{"44.1 kHz", 44100, []float64{-23, 20}, -23, true},
+		// A mono sine has half the energy of a stereo one.
+		{"mono", 48000, []float64{-20, 10}, -23, false},
+	}
+	for _, tt := range tests {
+		channels := 1
+		if tt.stereo {
+			channels = 2
+		}
+		m := NewMeter(tt.rate, channels)
+		for i := 0; i < len(tt.parts); i += 2 {
+			sine(m, tt.rate, channels, tt.parts[i], tt.parts[i+1])
+		}
+		if got := m.Loudness(); math.Abs(got-tt.lufs) > 0.1 {
+			t.Errorf("%s: loudness is %.2f LUFS, want %.1f", tt.name, got, tt.lufs)
+		}
+	}
+}
+
+func TestMeterSilence(t *testing.T) {
+	m := NewMeter(48000, 2)
+	sine(m, 48000, 2, -23, 0.3)
+	if l := m.Loudness(); !math.IsInf(l, -1) {
+		t.Errorf("loudness of 300 ms is %.2f, want negative infinity", l)
+	}
+	m = NewMeter(48000, 2)
+	for i := 0; i < 48000; i++ {
+		m.Add([]float64{0, 0})
+	}
+	if l := m.Loudness(); !math.IsInf(l, -1) {
+		t.Errorf("loudness of silence is %.2f, want negative infinity", l)
+	}
+	if m.Peak() != 0 {
+		t.Errorf("peak of silence is %f, want 0", m.Peak())
+	}
+}
+
+func TestMeterPeak(t *testing.T) {
+	m := NewMeter(48000, 2)
+	m.Add([]float64{0.25, -0.5})
+	m.Add([]float64{0.1, 0.2})
+	if m.Peak() != 0.5 {
+		t.Errorf("peak is %f, want 0.5", m.Peak())
+	}
+	n := NewMeter(48000, 1)
+	n.Add([]float64{0.75})
+	if p := Peak(m, n); p != 0.75 {
+		t.Errorf("peak of both meters is %f, want 0.75", p)
+	}
+}
+
+func TestLoudnessAlbum(t *testing.T) {
+	loud, quiet := NewMeter(48000, 2), NewMeter(48000, 2)
+	sine(loud, 48000, 2, -23, 20)
+	sine(quiet, 48000, 2, -33, 20)
+	one := NewMeter(48000, 2)
+	sine(one, 48000, 2, -23, 20)
+	sine(one, 48000, 2, -33, 20)
+
+	// An album is as loud as its tracks played in a row.
+	if a, b := Loudness(loud, quiet), one.Loudness(); math.Abs(a-b) > 0.01 {
+		t.Errorf("loudness of the album is %.2f, want %.2f", a, b)
+	}
+	if a := Loudness(loud, loud); math.Abs(a-loud.Loudness()) > 0.01 {
+		t.Errorf("loudness of two equal tracks is %.2f, want %.2f", a, loud.Loudness())
+	}
+	if l := Loudness(); !math.IsInf(l, -1) {
+		t.Errorf("loudness of no tracks is %.2f, want negative infinity", l)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	tests := []struct {
+		channels int
+		want     []float64
+	}{
+		{1, []float64{1}},
+		{2, []float64{1, 1}},
+		{5, []float64{1, 1, 1, 1.41, 1.41}},
+		{6, []float64{1, 1, 1, 0, 1.41, 1.41}},
+	}
+	for _, tt := range tests {
+		w := weights(tt.channels)
+		for i := range w {
+			if w[i] != tt.want[i] {
+				t.Errorf("%d channels: weights are %v, want %v", tt.channels, w, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package loudness
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/cassava/lackey/audio/wav"
+)
+
+// ErrFormat is returned for WAV streams whose samples are neither integers
+// of 8 to 32 bits nor floats of 32 or 64 bits.
+var ErrFormat = errors.New("unsupported WAV sample format")
+
+// Measure measures the loudness of a WAV stream, which is read to the end.
+func Measure(r io.Reader) (*Meter, error) {
+	format, r, err := wav.ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSamples(format)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, format.DataOffset); err != nil {
+		return nil, err
+	}
+
+	m := NewMeter(format.SampleRate, format.Channels)
+	size := s.width * format.Channels
+	buf := make([]byte, 4096*size)
+	frame := make([]float64, format.Channels)
+	for {
+		n, err := io.ReadFull(r, buf)
+		for i := 0; i+size <= n; i += size {
+			for c := range frame {
+				frame[c] = s.get(buf[i+c*s.width:])
+			}
+			m.Add(frame)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return m, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Amplify returns the WAV stream r with a gain in dB applied to its
+// samples. Integer samples are rounded and clipped to full scale.
+func Amplify(r io.Reader, gain float64) (io.Reader, error) {
+	format, r, err := wav.ReadHeader(r)
+	if err != nil {
+		return r, err
+	}
+	s, err := newSamples(format)
+	if err != nil {
+		return r, err
+	}
+	return io.MultiReader(io.LimitReader(r, format.DataOffset), &gainReader{
+		r:      r,
+		s:      s,
+		factor: math.Pow(10, gain/20),
+		buf:    make([]byte, 4096*s.width),
+	}), nil
+}
+
+// gainReader multiplies the samples that it reads by factor.
+type gainReader struct {
+	r      io.Reader
+	s      samples
+	factor float64
+	buf    []byte
+	out    []byte
+}
+
+func (g *gainReader) Read(p []byte) (int, error) {
+	if len(g.out) == 0 {
+		n, err := io.ReadFull(g.r, g.buf)
+		n -= n % g.s.width
+		if n == 0 {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		g.out = g.buf[:n]
+		for i := 0; i < n; i += g.s.width {
+			g.s.put(g.out[i:], g.factor*g.s.get(g.out[i:]))
+		}
+	}
+	n := copy(p, g.out)
+	g.out = g.out[n:]
+	return n, nil
+}
+
+// samples converts little-endian samples to and from floats, where 1 is
+// full scale. Integer samples of 8 bits are unsigned.
+type samples struct {
+	width int
+	float bool
+	scale float64
+}
+
+func newSamples(f *wav.Format) (samples, error) {
+	s := samples{width: (f.BitsPerSample + 7) / 8}
+	switch {
+	case f.Channels == 0 || f.SampleRate == 0:
+		return s, ErrFormat
+	case f.Tag == 1 && s.width >= 1 && s.width <= 4:
+		s.scale = float64(uint32(1) << (8*s.width - 1))
+	case f.Tag == 3 && (s.width == 4 || s.width == 8):
+		s.float = true
+	default:
+		return s, ErrFormat
+	}
+	return s, nil
+}
+
+func (s samples) get(b []byte) float64 {
+	le := binary.LittleEndian
+	switch {
+	case s.float && s.width == 4:
+		return float64(math.Float32frombits(le.Uint32(b)))
+	case s.float:
+		return math.Float64frombits(le.Uint64(b))
+	case s.width == 1:
+		return float64(int(b[0])-128) / s.scale
+	case s.width == 2:
+		return float64(int16(le.Uint16(b))) / s.scale
+	case s.width == 3:
+		return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / s.scale
+	default:
+		return float64(int32(le.Uint32(b))) / s.scale
+	}
+}
+
+func (s samples) put(b []byte, x float64) {
+	le := binary.LittleEndian
+	if s.float {
+		if s.width == 4 {
+			le.PutUint32(b, math.Float32bits(float32(x)))
+		} else {
+			le.PutUint64(b, math.Float64bits(x))
+		}
+		return
+	}
+
+	v := math.Round(x * s.scale)
+	v = math.Max(-s.scale, math.Min(s.scale-1, v))
+	i := int32(v)
+	switch s.width {
+	case 1:
+		b[0] = byte(i + 128)
+	case 2:
+		le.PutUint16(b, uint16(i))
+	case 3:
+		b[0], b[1], b[2] = byte(i), byte(i>>8), byte(i>>16)
+	default:
+		le.PutUint32(b, uint32(i))
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package loudness
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/cassava/lackey/audio/wav"
+)
+
+// stream returns a WAV stream of the samples in the format.
+func stream(tag uint16, channels, bits int, samples []byte) []byte {
+	var b bytes.Buffer
+	wav.WriteHeader(&b, &wav.Format{
+		Tag:           tag,
+		Channels:      channels,
+		SampleRate:    48000,
+		BitsPerSample: bits,
+		DataSize:      int64(len(samples)),
+	})
+	b.Write(samples)
+	return b.Bytes()
+}
+
+func TestMeasure(t *testing.T) {
+	// A sine of -23 dBFS in 16-bit stereo.
+	var samples bytes.Buffer
+	amp := math.Pow(10, -23.0/20)
+	for i := 0; i < 10*48000; i++ {
+		x := int16(math.Round(amp * 32768 * math.Sin(2*math.Pi*1000*float64(i)/48000)))
+		binary.Write(&samples, binary.LittleEndian, []int16{x, x})
+	}
+	m, err := Measure(bytes.NewReader(stream(1, 2, 16, samples.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := m.Loudness(); math.Abs(l+23) > 0.1 {
+		t.Errorf("loudness is %.2f LUFS, want -23", l)
+	}
+	if p := m.Peak(); math.Abs(p-amp) > 0.001 {
+		t.Errorf("peak is %f, want %f", p, amp)
+	}
+
+	for _, s := range [][]byte{
+		[]byte("not a WAV stream"),
+		stream(2, 1, 4, nil), // ADPCM
+		stream(3, 1, 16, nil),
+	} {
+		if _, err := Measure(bytes.NewReader(s)); err == nil {
+			t.Errorf("measuring %.20q succeeded", s)
+		}
+	}
+}
+
+func TestAmplify(t *testing.T) {
+	le := binary.LittleEndian
+	f32 := func(xs ...float32) []byte {
+		b := make([]byte, 4*len(xs))
+		for i, x := range xs {
+			le.PutUint32(b[4*i:], math.Float32bits(x))
+		}
+		return b
+	}
+	double := 20 * math.Log10(2)
+
+	tests := []struct {
+		name     string
+		tag      uint16
+		bits     int
+		gain     float64
+		in, want []byte
+	}{
+		{"8 bits", 1, 8, double, []byte{128, 138, 118, 250}, []byte{128, 148, 108, 255}},
+		{"16 bits", 1, 16, double, []byte{0x00, 0x01, 0x00, 0xff, 0x00, 0x70}, []byte{0x00, 0x02, 0x00, 0xfe, 0xff, 0x7f}},
+		{"24 bits", 1, 24, -double, []byte{0x02, 0x00, 0x00, 0xfc, 0xff, 0xff}, []byte{0x01, 0x00, 0x00, 0xfe, 0xff, 0xff}},
+		{"32 bits", 1, 32, double, []byte{0, 0, 0, 0xc0}, []byte{0, 0, 0, 0x80}},
+		{"float", 3, 32, double, f32(0.25, -0.75), f32(0.5, -1.5)},
+		{"no gain", 1, 16, 0, []byte{0x34, 0x12}, []byte{0x34, 0x12}},
+	}
+	for _, tt := range tests {
+		r, err := Amplify(bytes.NewReader(stream(tt.tag, 1, tt.bits, tt.in)), tt.gain)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if want := stream(tt.tag, 1, tt.bits, tt.want); !bytes.Equal(got, want) {
+			t.Errorf("%s: samples are % x, want % x", tt.name, got[len(got)-len(tt.in):], tt.want)
+		}
+	}
+
+	// The stream is read as it is after an error.
+	in := []byte("not a WAV stream")
+	r, err := Amplify(bytes.NewReader(in), 1)
+	if err == nil {
+		t.Error("amplifying a stream that is not WAV succeeded")
+	}
+	if got, _ := ioutil.ReadAll(r); !bytes.Equal(got, in) {
+		t.Errorf("stream after the error is %q, want %q", got, in)
+	}
+}
@@ -0,0 +1,1118 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package mp3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/goulash/audio"
+)
+
+// Padding is the number of bytes that are reserved after the frames of
+// a new tag, so that it can grow without rewriting the whole file.
+var Padding = 1024
+
+// AudioSection {{{
+
+// AudioSection returns the part of an MP3 file that contains the audio
+// frames, which excludes the ID3v2 tag at the start and any APEv2 and
+// ID3v1 tags at the end.
+func AudioSection(f *os.File) (*io.SectionReader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	start, err := id3v2Size(f)
+	if err != nil {
+		return nil, err
+	}
+	end := fi.Size()
+
+	b := make([]byte, 32)
+	if end-start >= 128 {
+		if _, err := f.ReadAt(b[:3], end-128); err != nil {
+			return nil, err
+		}
+		if string(b[:3]) == "TAG" {
+			end -= 128
+		}
+	}
+	if end-start >= 32 {
+		if _, err := f.ReadAt(b, end-32); err != nil {
+			return nil, err
+		}
+		if string(b[:8]) == "APETAGEX" {
+			size := int64(binary.LittleEndian.Uint32(b[12:16]))
+			if binary.LittleEndian.Uint32(b[20:24])&(1<<31) != 0 {
+				size += 32 // header
+			}
+			if size <= end-start {
+				end -= size
+			}
+		}
+	}
+	return io.NewSectionReader(f, start, end-start), nil
+}
+
+// id3v2Size returns the size of the ID3v2 tag at the start of the file,
+// or 0 if there is none.
+func id3v2Size(f io.ReaderAt) (int64, error) {
+	h := make([]byte, 10)
+	if _, err := f.ReadAt(h, 0); err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if string(h[:3]) != "ID3" {
+		return 0, nil
+	}
+	size := 10 + int64(syncsafe(h[6:10]))
+	if h[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+	return size, nil
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+func putSyncsafe(b []byte, x uint32) {
+	b[0], b[1], b[2], b[3] = byte(x>>21&0x7F), byte(x>>14&0x7F), byte(x>>7&0x7F), byte(x&0x7F)
+}
+
+// }}}
+
+// Tag {{{
+
+// Text encodings of ID3v2 frames.
+const (
+	encLatin1  = 0
+	encUTF16   = 1
+	encUTF16BE = 2
+	encUTF8    = 3
+)
+
+// FrontCover is the picture type of the front cover in an APIC frame.
+const FrontCover = 3
+
+// Tag is an ID3v2.3 or ID3v2.4 tag, which consists of frames.
+type Tag struct {
+	// Version is the minor version of the tag, 3 or 4.
+	Version byte
+	Frames  []*Frame
+}
+
+// Frame is a frame of an ID3v2 tag, whose data is neither compressed
+// nor unsynchronised.
+type Frame struct {
+	ID   string
+	Data []byte
+}
+
+// Picture is a picture attached to a tag by an APIC frame.
+type Picture struct {
+	MIMEType    string
+	Type        byte
+	Description string
+	Data        []byte
+}
+
+// NewTag returns an empty tag of version 3 or 4.
+func NewTag(version byte) *Tag {
+	return &Tag{Version: version}
+}
+
+// ReadTag reads the ID3v2 tag of an MP3 file. If the file has no tag, or
+// one of a version other than 2.3 or 2.4, an empty ID3v2.4 tag is returned,
+// which replaces the existing one when it is written. Compressed and
+// encrypted frames are dropped.
+func ReadTag(file string) (*Tag, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readTag(f)
+}
+
+func readTag(r io.ReaderAt) (*Tag, error) {
+	h := make([]byte, 10)
+	if _, err := r.ReadAt(h, 0); err == io.EOF {
+		return NewTag(4), nil
+	} else if err != nil {
+		return nil, err
+	}
+	if string(h[:3]) != "ID3" || h[3] < 3 || h[3] > 4 {
+		return NewTag(4), nil
+	}
+	t := NewTag(h[3])
+	flags := h[5]
+	body := make([]byte, syncsafe(h[6:10]))
+	if _, err := r.ReadAt(body, 10); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	if t.Version == 3 && flags&0x80 != 0 {
+		body = resync(body)
+	}
+	if flags&0x40 != 0 && len(body) >= 4 {
+		// The size of the extended header excludes itself in ID3v2.3.
+		n := int(syncsafe(body[:4]))
+		if t.Version == 3 {
+			n = 4 + int(binary.BigEndian.Uint32(body[:4]))
+		}
+		if n > len(body) {
+			n = len(body)
+		}
+		body = body[n:]
+	}
+	t.readFrames(body, flags&0x80 != 0)
+	return t, nil
+}
+
+// readFrames appends the frames in body to the tag. If unsync is true,
+// the tag is unsynchronised as a whole.
+func (t *Tag) readFrames(body []byte, unsync bool) {
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		n := int(syncsafe(body[4:8]))
+		if t.Version == 3 {
+			n = int(binary.BigEndian.Uint32(body[4:8]))
+		}
+		ff := binary.BigEndian.Uint16(body[8:10])
+		if n > len(body)-10 {
+			break
+		}
+		data := body[10 : 10+n]
+		body = body[10+n:]
+
+		if t.Version == 3 {
+			if ff&0x00C0 != 0 {
+				continue
+			}
+			if ff&0x0020 != 0 && len(data) > 0 {
+				data = data[1:]
+			}
+		} else {
+			if ff&0x000C != 0 {
+				continue
+			}
+			if ff&0x0040 != 0 && len(data) > 0 {
+				data = data[1:]
+			}
+			if ff&0x0001 != 0 && len(data) >= 4 {
+				data = data[4:]
+			}
+			if ff&0x0002 != 0 || unsync {
+				data = resync(data)
+			}
+		}
+		t.Frames = append(t.Frames, &Frame{ID: id, Data: append([]byte(nil), data...)})
+	}
+}
+
+// resync undoes the unsynchronisation of b, which inserts a zero byte
+// after every 0xFF byte.
+func resync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xFF && i+1 < len(b) && b[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
+
+// Frame returns the first frame with id, or nil if there is none.
+func (t *Tag) Frame(id string) *Frame {
+	for _, f := range t.Frames {
+		if f.ID == id {
+			return f
+		}
+	}
+	return nil
+}
+
+// Remove removes all frames with id.
+func (t *Tag) Remove(id string) {
+	t.removeIf(func(f *Frame) bool { return f.ID == id })
+}
+
+func (t *Tag) removeIf(fn func(*Frame) bool) {
+	fs := t.Frames[:0]
+	for _, f := range t.Frames {
+		if !fn(f) {
+			fs = append(fs, f)
+		}
+	}
+	t.Frames = fs
+}
+
+// set replaces the first frame for which same returns true with f,
+// and removes the others. If there is none, f is appended.
+func (t *Tag) set(f *Frame, same func(*Frame) bool) {
+	for i, g := range t.Frames {
+		if same(g) {
+			t.Frames[i] = f
+			rest := &Tag{Frames: t.Frames[i+1:]}
+			rest.removeIf(same)
+			t.Frames = append(t.Frames[:i+1], rest.Frames...)
+			return
+		}
+	}
+	t.Frames = append(t.Frames, f)
+}
+
+// Text returns the values of the text frame with id.
+func (t *Tag) Text(id string) []string {
+	f := t.Frame(id)
+	if f == nil || len(f.Data) == 0 {
+		return nil
+	}
+	return decodeStrings(f.Data[0], f.Data[1:])
+}
+
+// SetText sets the text frame with id to values, or removes it if there
+// are none. Multiple values are separated by zero bytes in ID3v2.4, and
+// joined by a slash in ID3v2.3, which has no other way to store them.
+func (t *Tag) SetText(id string, values ...string) {
+	values = nonEmpty(values)
+	if len(values) == 0 {
+		t.Remove(id)
+		return
+	}
+	t.set(&Frame{ID: id, Data: t.encodeText(nil, nil, values)}, func(f *Frame) bool { return f.ID == id })
+}
+
+// UserText returns the values of the TXXX frame with the description desc.
+func (t *Tag) UserText(desc string) []string {
+	for _, f := range t.Frames {
+		if f.ID == "TXXX" && len(f.Data) > 0 {
+			ss := decodeStrings(f.Data[0], f.Data[1:])
+			if len(ss) > 0 && strings.EqualFold(ss[0], desc) {
+				return ss[1:]
+			}
+		}
+	}
+	return nil
+}
+
+// SetUserText sets the TXXX frame with the description desc to values,
+// or removes it if there are none.
+func (t *Tag) SetUserText(desc string, values ...string) {
+	same := func(f *Frame) bool {
+		if f.ID != "TXXX" || len(f.Data) == 0 {
+			return false
+		}
+		d, _ := decodeString(f.Data[0], f.Data[1:])
+		return strings.EqualFold(d, desc)
+	}
+	values = nonEmpty(values)
+	if len(values) == 0 {
+		t.removeIf(same)
+		return
+	}
+	t.set(&Frame{ID: "TXXX", Data: t.encodeText(nil, []string{desc}, values)}, same)
+}
+
+// Comment returns the text of the first COMM frame with the description desc.
+func (t *Tag) Comment(desc string) string {
+	for _, f := range t.Frames {
+		if f.ID == "COMM" && len(f.Data) >= 4 {
+			d, rest := decodeString(f.Data[0], f.Data[4:])
+			if d == desc {
+				s, _ := decodeString(f.Data[0], rest)
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// SetComment sets the COMM frame with the description desc to text in the
+// language lang, such as "eng", or removes it if text is empty.
+func (t *Tag) SetComment(lang, desc, text string) {
+	same := func(f *Frame) bool {
+		if f.ID != "COMM" || len(f.Data) < 4 {
+			return false
+		}
+		d, _ := decodeString(f.Data[0], f.Data[4:])
+		return d == desc
+	}
+	if text == "" {
+		t.removeIf(same)
+		return
+	}
+	lb := []byte((lang + "XXX")[:3])
+	t.set(&Frame{ID: "COMM", Data: t.encodeText(lb, []string{desc}, []string{text})}, same)
+}
+
+// SetLyrics sets the USLT frame with the description desc to the lyrics
+// text in the language lang, or removes it if text is empty.
+func (t *Tag) SetLyrics(lang, desc, text string) {
+	same := func(f *Frame) bool {
+		if f.ID != "USLT" || len(f.Data) < 4 {
+			return false
+		}
+		d, _ := decodeString(f.Data[0], f.Data[4:])
+		return d == desc
+	}
+	if text == "" {
+		t.removeIf(same)
+		return
+	}
+	lb := []byte((lang + "XXX")[:3])
+	t.set(&Frame{ID: "USLT", Data: t.encodeText(lb, []string{desc}, []string{text})}, same)
+}
+
+// SetSyncedLyrics sets the SYLT frame with the description desc to the
+// lines of lyrics in the language lang, with their times in milliseconds,
+// or removes it if there are no lines.
+func (t *Tag) SetSyncedLyrics(lang, desc string, lines []tags.Line) {
+	same := func(f *Frame) bool {
+		if f.ID != "SYLT" || len(f.Data) < 6 {
+			return false
+		}
+		d, _ := decodeString(f.Data[0], f.Data[6:])
+		return d == desc
+	}
+	if len(lines) == 0 {
+		t.removeIf(same)
+		return
+	}
+	texts := []string{desc}
+	for _, l := range lines {
+		texts = append(texts, l.Text)
+	}
+	enc := t.encoding(texts...)
+	// The time stamps are in milliseconds and the content is lyrics.
+	data := append([]byte{enc}, (lang + "XXX")[:3]...)
+	data = append(data, 2, 1)
+	data = append(data, encodeString(enc, desc, true)...)
+	for _, l := range lines {
+		data = append(data, encodeString(enc, l.Text, true)...)
+		var ms [4]byte
+		binary.BigEndian.PutUint32(ms[:], uint32(l.Time/time.Millisecond))
+		data = append(data, ms[:]...)
+	}
+	t.set(&Frame{ID: "SYLT", Data: data}, same)
+}
+
+// Chapters returns the chapters of the CHAP frames in the order of their
+// start times, with the titles of their TIT2 subframes.
+func (t *Tag) Chapters() []tags.Chapter {
+	var chs []tags.Chapter
+	for _, f := range t.Frames {
+		i := subframes(f)
+		if f.ID != "CHAP" || i < 0 {
+			continue
+		}
+		// The element ID is followed by the start and end time in
+		// milliseconds, and the start and end byte offset.
+		ms := binary.BigEndian.Uint32(f.Data[i-16:])
+		c := tags.Chapter{Start: time.Duration(ms) * time.Millisecond}
+		sub := NewTag(t.Version)
+		sub.readFrames(f.Data[i:], false)
+		if title := sub.Text("TIT2"); len(title) > 0 {
+			c.Title = title[0]
+		}
+		chs = append(chs, c)
+	}
+	sort.SliceStable(chs, func(i, j int) bool { return chs[i].Start < chs[j].Start })
+	return chs
+}
+
+// SetChapters replaces the CHAP and CTOC frames with a CHAP frame for each
+// chapter, which ends where the next one starts or at length, and a table
+// of contents that lists them in order. Since the table can only list 255
+// chapters, any further chapters are not in it.
+func (t *Tag) SetChapters(chs []tags.Chapter, length time.Duration) {
+	t.Remove("CHAP")
+	t.Remove("CTOC")
+	if len(chs) == 0 {
+		return
+	}
+
+	toc := append(encodeString(encLatin1, "toc", true), 0x03, 0)
+	for i, c := range chs {
+		id := fmt.Sprintf("ch%d", i)
+		end := length
+		if i+1 < len(chs) {
+			end = chs[i+1].Start
+		}
+		if end < c.Start {
+			end = c.Start
+		}
+		data := encodeString(encLatin1, id, true)
+		for _, x := range []uint32{uint32(c.Start / time.Millisecond), uint32(end / time.Millisecond), 0xFFFFFFFF, 0xFFFFFFFF} {
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], x)
+			data = append(data, b[:]...)
+		}
+		if c.Title != "" {
+			sub := NewTag(t.Version)
+			sub.SetText("TIT2", c.Title)
+			data = append(data, sub.encodeFrames()...)
+		}
+		t.Frames = append(t.Frames, &Frame{ID: "CHAP", Data: data})
+
+		if i < 255 {
+			toc[5]++
+			toc = append(toc, encodeString(encLatin1, id, true)...)
+		}
+	}
+	t.Frames = append(t.Frames, &Frame{ID: "CTOC", Data: toc})
+}
+
+// subframes returns the offset of the subframes in a CHAP or CTOC frame,
+// or -1 if it is neither or invalid.
+func subframes(f *Frame) int {
+	i := bytes.IndexByte(f.Data, 0) + 1
+	if i == 0 {
+		return -1
+	}
+	switch f.ID {
+	case "CHAP":
+		if i += 16; i > len(f.Data) {
+			return -1
+		}
+		return i
+	case "CTOC":
+		if i+2 > len(f.Data) {
+			return -1
+		}
+		n := int(f.Data[i+1])
+		for i += 2; n > 0; n-- {
+			j := bytes.IndexByte(f.Data[i:], 0)
+			if j < 0 {
+				return -1
+			}
+			i += j + 1
+		}
+		return i
+	}
+	return -1
+}
+
+// recodeSubframes encodes the subframes of a CHAP or CTOC frame, which
+// were encoded for the version old, for the version of the tag, whose
+// frame headers differ in how they store the size.
+func (t *Tag) recodeSubframes(f *Frame, old byte) {
+	i := subframes(f)
+	if i < 0 {
+		return
+	}
+	sub := NewTag(old)
+	sub.readFrames(f.Data[i:], false)
+	sub.Version = t.Version
+	if t.Version < 4 {
+		for _, s := range sub.Frames {
+			t.recode(s)
+		}
+	}
+	f.Data = append(f.Data[:i:i], sub.encodeFrames()...)
+}
+
+// SetUniqueID sets the UFID frame of the owner to id, or removes it
+// if id is empty.
+func (t *Tag) SetUniqueID(owner, id string) {
+	same := func(f *Frame) bool {
+		o, _ := decodeString(encLatin1, f.Data)
+		return f.ID == "UFID" && o == owner
+	}
+	if id == "" {
+		t.removeIf(same)
+		return
+	}
+	data := append(encodeString(encLatin1, owner, true), id...)
+	t.set(&Frame{ID: "UFID", Data: data}, same)
+}
+
+// SetUserURL sets the WXXX frame with the description desc to url,
+// or removes it if url is empty.
+func (t *Tag) SetUserURL(desc, url string) {
+	same := func(f *Frame) bool {
+		if f.ID != "WXXX" || len(f.Data) == 0 {
+			return false
+		}
+		d, _ := decodeString(f.Data[0], f.Data[1:])
+		return d == desc
+	}
+	if url == "" {
+		t.removeIf(same)
+		return
+	}
+	enc := t.encoding(desc)
+	data := append([]byte{enc}, encodeString(enc, desc, true)...)
+	data = append(data, encodeString(encLatin1, url, false)...)
+	t.set(&Frame{ID: "WXXX", Data: data}, same)
+}
+
+// Pictures returns the pictures of all APIC frames.
+func (t *Tag) Pictures() []*Picture {
+	var ps []*Picture
+	for _, f := range t.Frames {
+		if f.ID != "APIC" || len(f.Data) == 0 {
+			continue
+		}
+		mime, rest := decodeString(encLatin1, f.Data[1:])
+		if len(rest) == 0 {
+			continue
+		}
+		p := &Picture{MIMEType: mime, Type: rest[0]}
+		p.Description, p.Data = decodeString(f.Data[0], rest[1:])
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// AddPicture adds p in an APIC frame, which replaces any picture
+// with the same type and description.
+func (t *Tag) AddPicture(p *Picture) {
+	same := func(f *Frame) bool {
+		if f.ID != "APIC" || len(f.Data) == 0 {
+			return false
+		}
+		_, rest := decodeString(encLatin1, f.Data[1:])
+		if len(rest) == 0 {
+			return false
+		}
+		d, _ := decodeString(f.Data[0], rest[1:])
+		return rest[0] == p.Type && d == p.Description
+	}
+	enc := t.encoding(p.Description)
+	data := append([]byte{enc}, encodeString(encLatin1, p.MIMEType, true)...)
+	data = append(data, p.Type)
+	data = append(data, encodeString(enc, p.Description, true)...)
+	data = append(data, p.Data...)
+	t.set(&Frame{ID: "APIC", Data: data}, same)
+}
+
+// SetMetadata sets the frames for the fields of m, and removes the frames
+// of fields that m does not have. The frames that describe the encoder
+// are left as they are, since they belong to the file and not the song.
+func (t *Tag) SetMetadata(m audio.Metadata) {
+	slash := func(i, n int) string {
+		switch {
+		case i == 0:
+			return ""
+		case n == 0:
+			return fmt.Sprint(i)
+		default:
+			return fmt.Sprintf("%d/%d", i, n)
+		}
+	}
+	year := ""
+	if m.Year() != 0 {
+		year = fmt.Sprint(m.Year())
+	}
+
+	t.SetText("TIT2", m.Title())
+	t.SetText("TPE1", m.Artist())
+	t.SetText("TPE2", m.AlbumArtist())
+	t.SetText("TALB", m.Album())
+	t.SetText("TCOM", m.Composer())
+	t.SetText("TCON", m.Genre())
+	t.SetText("TRCK", slash(m.Track()))
+	t.SetText("TPOS", slash(m.Disc()))
+	if t.Version >= 4 {
+		t.SetText("TDRC", year)
+	} else {
+		t.SetText("TYER", year)
+	}
+	t.SetText("TCOP", m.Copyright())
+	t.SetText("TOFN", m.OriginalFilename())
+	t.SetComment("eng", "", m.Comment())
+	t.SetUserURL("", m.Website())
+}
+
+// Tags returns the fields of all frames that hold one, with the names
+// of tags.Fields.
+func (t *Tag) Tags() tags.Tags {
+	tt := make(tags.Tags)
+	for _, f := range t.Frames {
+		if name, values := fieldOf(f); name != "" {
+			tt.Add(name, values...)
+		}
+	}
+	tt.SplitTotals()
+	return tt
+}
+
+// fieldOf returns the canonical name and the values of the field
+// that the frame holds, or "" if it holds none.
+func fieldOf(f *Frame) (string, []string) {
+	if len(f.Data) == 0 {
+		return "", nil
+	}
+	byID3 := func(id string) string {
+		if fl := tags.ByID3(id); fl != nil {
+			return fl.Name
+		}
+		return ""
+	}
+
+	switch {
+	case f.ID == "TXXX":
+		ss := decodeStrings(f.Data[0], f.Data[1:])
+		if len(ss) == 0 {
+			return "", nil
+		}
+		name := byID3("TXXX:" + ss[0])
+		if name == "" {
+			name = strings.ToUpper(ss[0])
+		}
+		return name, ss[1:]
+	case f.ID == "UFID":
+		owner, id := decodeString(encLatin1, f.Data)
+		return byID3("UFID:" + owner), []string{string(id)}
+	case f.ID == "COMM" || f.ID == "USLT":
+		// Comments with a description are used by programs for their
+		// own data, such as iTunNORM.
+		if len(f.Data) < 4 {
+			return "", nil
+		}
+		desc, rest := decodeString(f.Data[0], f.Data[4:])
+		if desc != "" {
+			return "", nil
+		}
+		text, _ := decodeString(f.Data[0], rest)
+		return byID3(f.ID), []string{text}
+	case f.ID[0] == 'W' && f.ID != "WXXX":
+		url, _ := decodeString(encLatin1, f.Data)
+		return byID3(f.ID), []string{url}
+	case f.ID[0] == 'T':
+		id := f.ID
+		switch id {
+		case "TYER":
+			id = "TDRC"
+		case "TORY":
+			id = "TDOR"
+		}
+		return byID3(id), decodeStrings(f.Data[0], f.Data[1:])
+	}
+	return "", nil
+}
+
+// SetTags replaces the frames that hold fields with the fields of tt,
+// which are stored in the frames given by tags.Fields or otherwise in TXXX
+// frames by name. Frames that hold none of the fields, such as pictures,
+// and frames of the fields in tags.FileFields are kept.
+func (t *Tag) SetTags(tt tags.Tags) {
+	t.removeIf(func(f *Frame) bool {
+		name, _ := fieldOf(f)
+		return name != "" && !tags.FileFields[name]
+	})
+
+	total := func(n, total string) string {
+		if n == "" || total == "" {
+			return n
+		}
+		return n + "/" + total
+	}
+	for _, k := range tt.Keys() {
+		values := tt[k]
+		switch k {
+		case "TRACKTOTAL", "DISCTOTAL":
+			continue
+		case "TRACKNUMBER":
+			values = []string{total(tt.Get(k), tt.Get("TRACKTOTAL"))}
+		case "DISCNUMBER":
+			values = []string{total(tt.Get(k), tt.Get("DISCTOTAL"))}
+		}
+		if tags.FileFields[k] || len(values) == 0 {
+			continue
+		}
+
+		id := "TXXX:" + k
+		if f := tags.ByName(k); f != nil && f.ID3 != "" {
+			id = f.ID3
+		}
+		if t.Version < 4 {
+			// These frames are new in ID3v2.4.
+			switch id {
+			case "TDRC", "TDOR":
+				id = map[string]string{"TDRC": "TYER", "TDOR": "TORY"}[id]
+				if len(values[0]) < 4 {
+					continue
+				}
+				values = []string{values[0][:4]}
+			case "TDEN", "TDRL", "TDTG", "TMOO", "TPRO", "TSST", "TIPL", "TMCL":
+				id = "TXXX:" + k
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(id, "TXXX:"):
+			t.SetUserText(id[5:], values...)
+		case strings.HasPrefix(id, "UFID:"):
+			t.SetUniqueID(id[5:], values[0])
+		case id == "COMM":
+			t.SetComment("eng", "", strings.Join(values, "\n"))
+		case id == "USLT":
+			t.SetLyrics("eng", "", values[0])
+		case id[0] == 'W':
+			t.set(&Frame{ID: id, Data: encodeString(encLatin1, values[0], false)},
+				func(f *Frame) bool { return f.ID == id })
+		default:
+			t.SetText(id, values...)
+		}
+	}
+}
+
+// ConvertTo changes the version of the tag to 3 or 4, and converts the
+// frames that differ between them. Frames that the new version does not
+// have are dropped.
+func (t *Tag) ConvertTo(version byte) {
+	if version == t.Version {
+		return
+	}
+	old := t.Version
+	t.Version = version
+	fs := t.Frames
+	t.Frames = nil
+	for _, f := range fs {
+		if f.ID == "CHAP" || f.ID == "CTOC" {
+			t.recodeSubframes(f, old)
+		}
+		if version >= 4 {
+			switch f.ID {
+			case "TYER":
+				f.ID = "TDRC"
+			case "TORY":
+				f.ID = "TDOR"
+			case "IPLS":
+				f.ID = "TIPL"
+			case "TDAT", "TIME", "TRDA", "TSIZ", "EQUA", "RVAD":
+				continue
+			}
+		} else {
+			switch f.ID {
+			case "TDRC", "TDOR":
+				if len(f.Data) == 0 {
+					continue
+				}
+				ss := decodeStrings(f.Data[0], f.Data[1:])
+				if len(ss) == 0 || len(ss[0]) < 4 {
+					continue
+				}
+				id := map[string]string{"TDRC": "TYER", "TDOR": "TORY"}[f.ID]
+				f = &Frame{ID: id, Data: append([]byte{encLatin1}, ss[0][:4]...)}
+			case "TIPL":
+				f.ID = "IPLS"
+			case "ASPI", "EQU2", "RVA2", "SEEK", "SIGN", "TDEN", "TDRL", "TDTG", "TMCL", "TMOO", "TPRO", "TSST":
+				continue
+			}
+			t.recode(f)
+		}
+		t.Frames = append(t.Frames, f)
+	}
+}
+
+// recode encodes the text of a frame for the version of the tag, which
+// for ID3v2.3 joins multiple values and replaces UTF-8 and UTF-16BE.
+func (t *Tag) recode(f *Frame) {
+	if len(f.Data) == 0 {
+		return
+	}
+	enc, rest := f.Data[0], f.Data[1:]
+	if f.ID[0] == 'T' {
+		ss := decodeStrings(enc, rest)
+		if f.ID == "TXXX" && len(ss) > 0 {
+			f.Data = t.encodeText(nil, ss[:1], ss[1:])
+		} else {
+			f.Data = t.encodeText(nil, nil, ss)
+		}
+		return
+	}
+	if enc != encUTF8 && enc != encUTF16BE {
+		return
+	}
+	var prefix []byte
+	n := -1 // number of strings, or -1 for all
+	switch {
+	case f.ID == "COMM" || f.ID == "USLT":
+		if len(rest) < 3 {
+			return
+		}
+		prefix, rest = rest[:3], rest[3:]
+	case f.ID == "WXXX":
+		n = 1
+	case f.ID == "APIC":
+		i := bytes.IndexByte(rest, 0)
+		if i < 0 || i+2 > len(rest) {
+			return
+		}
+		prefix, rest = rest[:i+2], rest[i+2:]
+		n = 1
+	case f.ID == "IPLS":
+	default:
+		return
+	}
+
+	data := append([]byte{encUTF16}, prefix...)
+	for ; n != 0 && len(rest) > 0; n-- {
+		var s string
+		s, rest = decodeString(enc, rest)
+		data = append(data, encodeString(encUTF16, s, n > 0 || len(rest) > 0)...)
+	}
+	f.Data = append(data, rest...)
+}
+
+// encoding returns the text encoding for a frame with the strings ss,
+// which is UTF-8 in ID3v2.4, and ISO-8859-1 or else UTF-16 in ID3v2.3.
+func (t *Tag) encoding(ss ...string) byte {
+	if t.Version >= 4 {
+		return encUTF8
+	}
+	for _, s := range ss {
+		for _, r := range s {
+			if r > 0xFF {
+				return encUTF16
+			}
+		}
+	}
+	return encLatin1
+}
+
+// encodeText returns the data of a text frame, which consists of the
+// encoding, the prefix, the terminated strings fields, and the values.
+func (t *Tag) encodeText(prefix []byte, fields []string, values []string) []byte {
+	if t.Version < 4 && len(values) > 1 {
+		values = []string{strings.Join(values, "/")}
+	}
+	enc := t.encoding(append(fields, values...)...)
+	data := append([]byte{enc}, prefix...)
+	for _, s := range fields {
+		data = append(data, encodeString(enc, s, true)...)
+	}
+	for i, s := range values {
+		data = append(data, encodeString(enc, s, i < len(values)-1)...)
+	}
+	return data
+}
+
+func encodeString(enc byte, s string, term bool) []byte {
+	var b []byte
+	switch enc {
+	case encLatin1:
+		for _, r := range s {
+			b = append(b, byte(r))
+		}
+	case encUTF16, encUTF16BE:
+		if enc == encUTF16 {
+			b = append(b, 0xFF, 0xFE)
+		}
+		for _, u := range utf16.Encode([]rune(s)) {
+			if enc == encUTF16 {
+				b = append(b, byte(u), byte(u>>8))
+			} else {
+				b = append(b, byte(u>>8), byte(u))
+			}
+		}
+		if term {
+			// UTF-16 strings end in two zero bytes.
+			b = append(b, 0)
+		}
+	default:
+		b = append(b, s...)
+	}
+	if term {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// decodeString decodes a string that ends at a terminator or at the end
+// of b, and returns the rest of b after the terminator.
+func decodeString(enc byte, b []byte) (string, []byte) {
+	switch enc {
+	case encUTF16, encUTF16BE:
+		i := 0
+		for i+1 < len(b) && (b[i] != 0 || b[i+1] != 0) {
+			i += 2
+		}
+		s, rest := b[:i], []byte(nil)
+		if i+2 <= len(b) {
+			rest = b[i+2:]
+		}
+		bigEndian := enc == encUTF16BE
+		if len(s) >= 2 && s[0] == 0xFE && s[1] == 0xFF {
+			bigEndian, s = true, s[2:]
+		} else if len(s) >= 2 && s[0] == 0xFF && s[1] == 0xFE {
+			bigEndian, s = false, s[2:]
+		}
+		u := make([]uint16, len(s)/2)
+		for j := range u {
+			if bigEndian {
+				u[j] = uint16(s[2*j])<<8 | uint16(s[2*j+1])
+			} else {
+				u[j] = uint16(s[2*j+1])<<8 | uint16(s[2*j])
+			}
+		}
+		return string(utf16.Decode(u)), rest
+	default:
+		s, rest := b, []byte(nil)
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			s, rest = b[:i], b[i+1:]
+		}
+		if enc == encLatin1 {
+			rs := make([]rune, len(s))
+			for j, c := range s {
+				rs[j] = rune(c)
+			}
+			return string(rs), rest
+		}
+		return string(s), rest
+	}
+}
+
+// decodeStrings decodes all strings in b.
+func decodeStrings(enc byte, b []byte) []string {
+	var ss []string
+	for len(b) > 0 {
+		var s string
+		s, b = decodeString(enc, b)
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+func nonEmpty(ss []string) []string {
+	var out []string
+	for _, s := range ss {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// }}}
+
+// Write {{{
+
+// WriteMetadata sets the fields of m in the ID3v2 tag of an MP3 file and
+// writes it. An existing tag keeps its version and other frames, and
+// a new tag is an ID3v2.4 tag. The audio frames are not changed.
+func WriteMetadata(file string, m audio.Metadata) error {
+	t, err := ReadTag(file)
+	if err != nil {
+		return err
+	}
+	t.SetMetadata(m)
+	return t.Write(file)
+}
+
+// encode encodes the tag with padding bytes to spare.
+func (t *Tag) encode(padding int) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{'I', 'D', '3', t.Version, 0, 0, 0, 0, 0, 0})
+	b.Write(t.encodeFrames())
+	b.Write(make([]byte, padding))
+	tag := b.Bytes()
+	putSyncsafe(tag[6:10], uint32(len(tag)-10))
+	return tag
+}
+
+// encodeFrames encodes the frames of the tag with their headers.
+func (t *Tag) encodeFrames() []byte {
+	var b bytes.Buffer
+	for _, f := range t.Frames {
+		h := make([]byte, 10)
+		copy(h, f.ID)
+		if t.Version >= 4 {
+			putSyncsafe(h[4:8], uint32(len(f.Data)))
+		} else {
+			binary.BigEndian.PutUint32(h[4:8], uint32(len(f.Data)))
+		}
+		b.Write(h)
+		b.Write(f.Data)
+	}
+	return b.Bytes()
+}
+
+// Write writes the tag to the start of an MP3 file, replacing its ID3v2 tag.
+// If the tag fits into the space of the existing tag and its padding, and
+// leaves no more than Padding bytes of it unused, it is written in place.
+// Otherwise the file is rewritten, with Padding bytes to spare for the next
+// time, so that removing large frames such as pictures makes it smaller.
+func (t *Tag) Write(file string) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	old, err := id3v2Size(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	tag := t.encode(0)
+	if old > 0 && int64(len(tag)) <= old && old-int64(len(tag)) <= int64(Padding) {
+		_, err := f.WriteAt(t.encode(int(old)-len(tag)), 0)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	f.Close()
+	return writeTag(file, t.encode(Padding))
+}
+
+// writeTag replaces the ID3v2 tag of the file with tag, by writing a new
+// file next to it, which then replaces the original.
+func writeTag(file string, tag []byte) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	start, err := id3v2Size(f)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".mp3tag-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(tag); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := io.Copy(tmp, io.NewSectionReader(f, start, fi.Size()-start)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// }}}
@@ -0,0 +1,725 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package mp3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/goulash/audio"
+)
+
+// id3Tag returns an ID3v2 tag header with the flags, followed by body.
+func id3Tag(version, flags byte, body []byte) []byte {
+	h := []byte{'I', 'D', '3', version, 0, flags, 0, 0, 0, 0}
+	putSyncsafe(h[6:10], uint32(len(body)))
+	return append(h, body...)
+}
+
+// apeTag returns an APEv2 tag without items, with a header if header is true.
+func apeTag(header bool) []byte {
+	var b []byte
+	flags := uint32(0)
+	if header {
+		flags = 1 << 31
+	}
+	for i := 0; i < 2; i++ {
+		if i == 0 && !header {
+			continue
+		}
+		h := make([]byte, 32)
+		copy(h, "APETAGEX")
+		binary.LittleEndian.PutUint32(h[8:], 2000)
+		binary.LittleEndian.PutUint32(h[12:], 32) // footer and items
+		binary.LittleEndian.PutUint32(h[20:], flags)
+		b = append(b, h...)
+	}
+	return b
+}
+
+// writeFile writes data to a temporary file and opens it.
+func writeFile(t *testing.T, dir string, data []byte) *os.File {
+	file := filepath.Join(dir, "test.mp3")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestAudioSection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mp3-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	frames := bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x64}, 64)
+	id3v1 := append([]byte("TAG"), make([]byte, 125)...)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no tags", frames},
+		{"id3v2", append(id3Tag(3, 0, make([]byte, 20)), frames...)},
+		{"id3v2 footer", append(append(id3Tag(4, 0x10, make([]byte, 20)), "3DI\x04\x00\x10\x00\x00\x00\x14"...), frames...)},
+		{"id3v1", append(append([]byte(nil), frames...), id3v1...)},
+		{"ape", append(append([]byte(nil), frames...), apeTag(true)...)},
+		{"ape without header", append(append([]byte(nil), frames...), apeTag(false)...)},
+		{"all", bytes.Join([][]byte{id3Tag(4, 0, make([]byte, 5)), frames, apeTag(true), id3v1}, nil)},
+	}
+	for _, tt := range tests {
+		f := writeFile(t, dir, tt.data)
+		r, err := AudioSection(f)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			f.Close()
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if !bytes.Equal(got, frames) {
+			t.Errorf("%s: section has %d bytes, want the %d bytes of the frames", tt.name, len(got), len(frames))
+		}
+		f.Close()
+	}
+}
+
+func TestSyncsafe(t *testing.T) {
+	for _, x := range []uint32{0, 127, 128, 1024, 1<<28 - 1} {
+		b := make([]byte, 4)
+		putSyncsafe(b, x)
+		for _, c := range b {
+			if c&0x80 != 0 {
+				t.Errorf("%d: syncsafe integer % x has the high bit set", x, b)
+			}
+		}
+		if got := syncsafe(b); got != x {
+			t.Errorf("%d: syncsafe integer is read back as %d", x, got)
+		}
+	}
+}
+
+// testMetadata is metadata with a few fields.
+type testMetadata struct {
+	title, artist, comment string
+	year, track, tracks    int
+}
+
+func (m *testMetadata) Title() string            { return m.title }
+func (m *testMetadata) Album() string            { return "" }
+func (m *testMetadata) Artist() string           { return m.artist }
+func (m *testMetadata) AlbumArtist() string      { return "" }
+func (m *testMetadata) Composer() string         { return "" }
+func (m *testMetadata) Year() int                { return m.year }
+func (m *testMetadata) Genre() string            { return "" }
+func (m *testMetadata) Track() (int, int)        { return m.track, m.tracks }
+func (m *testMetadata) Disc() (int, int)         { return 0, 0 }
+func (m *testMetadata) Length() time.Duration    { return 0 }
+func (m *testMetadata) Comment() string          { return m.comment }
+func (m *testMetadata) Copyright() string        { return "" }
+func (m *testMetadata) Website() string          { return "" }
+func (m *testMetadata) EncodedBy() string        { return "" }
+func (m *testMetadata) EncoderSettings() string  { return "" }
+func (m *testMetadata) Encoding() audio.Codec    { return audio.MP3 }
+func (m *testMetadata) EncodingBitrate() int     { return -1 }
+func (m *testMetadata) OriginalFilename() string { return "" }
+
+// frameData returns the header and data of a frame in a tag of version.
+func frameData(version byte, id string, flags uint16, data []byte) []byte {
+	h := make([]byte, 10)
+	copy(h, id)
+	if version >= 4 {
+		putSyncsafe(h[4:8], uint32(len(data)))
+	} else {
+		binary.BigEndian.PutUint32(h[4:8], uint32(len(data)))
+	}
+	binary.BigEndian.PutUint16(h[8:], flags)
+	return append(h, data...)
+}
+
+// mp3File writes a file with the tag and frames, and returns its path.
+func mp3File(t *testing.T, dir string, tag, frames []byte) string {
+	file := filepath.Join(dir, "test.mp3")
+	if err := ioutil.WriteFile(file, append(append([]byte(nil), tag...), frames...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// audioOf returns the audio frames of the MP3 file.
+func audioOf(t *testing.T, file string) []byte {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := AudioSection(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestTagRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mp3-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	frames := bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x64}, 64)
+	cover := &Picture{MIMEType: "image/jpeg", Type: FrontCover, Description: "Front", Data: bytes.Repeat([]byte{0xff, 0xd8}, 100)}
+
+	tests := []struct {
+		version byte
+		artists []string // values of TPE1 read back
+		enc     byte     // encoding of TIT2
+		uenc    byte     // encoding of TPE2, which is not Latin-1
+	}{
+		{3, []string{"A/B"}, encLatin1, encUTF16},
+		{4, []string{"A", "B"}, encUTF8, encUTF8},
+	}
+	for _, tt := range tests {
+		file := mp3File(t, dir, nil, frames)
+		tag := NewTag(tt.version)
+		tag.SetText("TIT2", "Café")
+		tag.SetText("TPE1", "A", "B")
+		tag.SetText("TPE2", "Ансамбль")
+		tag.SetText("TALB", "")
+		tag.SetUserText("REPLAYGAIN_TRACK_GAIN", "-6.00 dB")
+		tag.SetUserText("Mood", "calm", "slow")
+		tag.SetComment("eng", "", "first")
+		tag.SetComment("eng", "", "nice")
+		tag.SetComment("deu", "note", "gut")
+		tag.AddPicture(cover)
+		tag.AddPicture(&Picture{MIMEType: "image/png", Type: 4, Data: []byte{1}})
+		if err := tag.Write(file); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ReadTag(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != tt.version {
+			t.Errorf("v2.%d: version read back is %d", tt.version, got.Version)
+		}
+		check := func(what string, got, want []string) {
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("v2.%d: %s is %q, want %q", tt.version, what, got, want)
+			}
+		}
+		check("TIT2", got.Text("TIT2"), []string{"Café"})
+		check("TPE1", got.Text("TPE1"), tt.artists)
+		check("TPE2", got.Text("TPE2"), []string{"Ансамбль"})
+		check("TALB", got.Text("TALB"), nil)
+		check("replaygain", got.UserText("replaygain_track_gain"), []string{"-6.00 dB"})
+		if tt.version >= 4 {
+			check("mood", got.UserText("MOOD"), []string{"calm", "slow"})
+		} else {
+			check("mood", got.UserText("MOOD"), []string{"calm/slow"})
+		}
+		if c := got.Comment(""); c != "nice" {
+			t.Errorf("v2.%d: comment is %q, want %q", tt.version, c, "nice")
+		}
+		if c := got.Comment("note"); c != "gut" {
+			t.Errorf("v2.%d: note is %q, want %q", tt.version, c, "gut")
+		}
+		if f := got.Frame("TIT2"); f.Data[0] != tt.enc {
+			t.Errorf("v2.%d: encoding of TIT2 is %d, want %d", tt.version, f.Data[0], tt.enc)
+		}
+		if f := got.Frame("TPE2"); f.Data[0] != tt.uenc {
+			t.Errorf("v2.%d: encoding of TPE2 is %d, want %d", tt.version, f.Data[0], tt.uenc)
+		}
+		if ps := got.Pictures(); len(ps) != 2 || !reflect.DeepEqual(ps[0], cover) {
+			t.Errorf("v2.%d: pictures are %v, want the cover and one other", tt.version, ps)
+		}
+		n := 0
+		for _, f := range got.Frames {
+			if f.ID == "COMM" {
+				n++
+			}
+		}
+		if n != 2 {
+			t.Errorf("v2.%d: tag has %d COMM frames, want 2", tt.version, n)
+		}
+		if !bytes.Equal(audioOf(t, file), frames) {
+			t.Errorf("v2.%d: audio frames changed", tt.version)
+		}
+	}
+}
+
+func TestTagFrameSize(t *testing.T) {
+	// Frame sizes are syncsafe only in ID3v2.4, which matters above 127.
+	for _, version := range []byte{3, 4} {
+		tag := NewTag(version)
+		tag.Frames = append(tag.Frames, &Frame{ID: "PRIV", Data: make([]byte, 200)})
+		b := tag.encode(0)
+		want := frameData(version, "PRIV", 0, make([]byte, 200))
+		if !bytes.Equal(b[10:], want) {
+			t.Errorf("v2.%d: frame is encoded as % x, want % x", version, b[10:20], want[:10])
+		}
+		got, err := readTag(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Frames) != 1 || len(got.Frames[0].Data) != 200 {
+			t.Errorf("v2.%d: frames read back are %v", version, got.Frames)
+		}
+	}
+}
+
+func TestReadTagUnsynchronisation(t *testing.T) {
+	text := append([]byte{encLatin1}, "a\xffb"...)
+	synced := []byte{encLatin1, 'a', 0xff, 0x00, 'b'}
+
+	// In ID3v2.3, the whole tag is unsynchronised, including the headers.
+	v3 := id3Tag(3, 0x80, bytes.Replace(frameData(3, "TIT2", 0, text), []byte{0xff}, []byte{0xff, 0}, -1))
+	// In ID3v2.4, each frame may be unsynchronised, or all by the tag flag.
+	v4 := id3Tag(4, 0, append(frameData(4, "TIT2", 0x0002, synced), frameData(4, "TPE1", 0, text)...))
+	v4all := id3Tag(4, 0x80, frameData(4, "TIT2", 0, synced))
+	// An extended header is skipped, and padding ends the frames.
+	ext := append([]byte{0, 0, 0, 6, 0, 0, 0, 0, 0, 0}, frameData(3, "TIT2", 0, text)...)
+	v3ext := id3Tag(3, 0x40, append(ext, make([]byte, 20)...))
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{{"v2.3", v3}, {"v2.4", v4}, {"v2.4 tag", v4all}, {"v2.3 extended", v3ext}} {
+		tag, err := readTag(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if f := tag.Frame("TIT2"); f == nil || !bytes.Equal(f.Data, text) {
+			t.Errorf("%s: TIT2 is %v, want % x", tt.name, f, text)
+		}
+		if f := tag.Frame("TPE1"); f != nil && !bytes.Equal(f.Data, text) {
+			t.Errorf("%s: TPE1 is % x, want % x", tt.name, f.Data, text)
+		}
+	}
+
+	// Compressed and encrypted frames are dropped.
+	tag, err := readTag(bytes.NewReader(id3Tag(4, 0, append(frameData(4, "TIT2", 0x0008, text), frameData(4, "TPE1", 0x0004, text)...))))
+	if err != nil || len(tag.Frames) != 0 {
+		t.Errorf("frames read are %v, %v, want none", tag, err)
+	}
+	// Tags of other versions are replaced by a new one.
+	tag, err = readTag(bytes.NewReader(id3Tag(2, 0, []byte("TT2\x00\x00\x02\x00a"))))
+	if err != nil || tag.Version != 4 || len(tag.Frames) != 0 {
+		t.Errorf("ID3v2.2 tag is read as %+v, %v, want an empty ID3v2.4 tag", tag, err)
+	}
+}
+
+func TestTagWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mp3-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	frames := bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x64}, 64)
+	size := func(file string) int64 {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+
+	// A tag that fits into the old one and its padding is written in place.
+	old := id3Tag(4, 0, append(frameData(4, "TIT2", 0, []byte("\x03Title")), make([]byte, 100)...))
+	file := mp3File(t, dir, old, frames)
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tag, err := ReadTag(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag.SetText("TIT2", "A longer title")
+	tag.SetText("TPE1", "Artist")
+	if err := tag.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := size(file); got != int64(len(old)+len(frames)) {
+		t.Errorf("size after writing in place is %d, want %d", got, len(old)+len(frames))
+	}
+	// The file is the same, not replaced by a new one.
+	if fi, _ := f.Stat(); fi.Size() != size(file) {
+		t.Error("file was replaced instead of written in place")
+	}
+	if !bytes.Equal(audioOf(t, file), frames) {
+		t.Error("audio frames changed after writing in place")
+	}
+
+	// A tag that does not fit is written to a new file with Padding.
+	tag.Frames = append(tag.Frames, &Frame{ID: "PRIV", Data: make([]byte, 200)})
+	if err := tag.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	want := int64(len(tag.encode(Padding)) + len(frames))
+	if got := size(file); got != want {
+		t.Errorf("size after rewriting is %d, want %d", got, want)
+	}
+	if !bytes.Equal(audioOf(t, file), frames) {
+		t.Error("audio frames changed after rewriting")
+	}
+	got, err := ReadTag(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Text("TIT2"), []string{"A longer title"}) || got.Frame("PRIV") == nil {
+		t.Errorf("frames read back are %v", got.Frames)
+	}
+
+	// Files without a tag get one.
+	file = mp3File(t, dir, nil, frames)
+	if err := tag.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := size(file); got != want {
+		t.Errorf("size of a new tag is %d, want %d", got, want)
+	}
+
+	// Removing a large frame makes the file smaller again.
+	tag.Frames = append(tag.Frames, &Frame{ID: "APIC", Data: make([]byte, 2*Padding)})
+	if err := tag.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	tag.Remove("APIC")
+	if err := tag.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := size(file); got != want {
+		t.Errorf("size after removing a frame is %d, want %d", got, want)
+	}
+	if !bytes.Equal(audioOf(t, file), frames) {
+		t.Error("audio frames changed after removing a frame")
+	}
+}
+
+func TestConvertTo(t *testing.T) {
+	tag := NewTag(4)
+	tag.SetText("TDRC", "2001-05-03")
+	tag.SetText("TDRL", "2002")
+	tag.SetText("TPE1", "A", "B")
+	tag.SetUserText("Mood", "calm", "slow")
+	tag.SetComment("eng", "", "Ансамбль")
+	tag.SetText("TIPL", "mix", "X")
+
+	tag.ConvertTo(3)
+	if tag.Version != 3 {
+		t.Errorf("version is %d, want 3", tag.Version)
+	}
+	tests := []struct {
+		id   string
+		want []string
+	}{
+		{"TYER", []string{"2001"}},
+		{"TDRC", nil},
+		{"TDRL", nil},
+		{"TPE1", []string{"A/B"}},
+		{"IPLS", []string{"mix", "X"}},
+	}
+	for _, tt := range tests {
+		if got := tag.Text(tt.id); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("v2.3: %s is %q, want %q", tt.id, got, tt.want)
+		}
+	}
+	if got := tag.UserText("mood"); !reflect.DeepEqual(got, []string{"calm/slow"}) {
+		t.Errorf("v2.3: mood is %q", got)
+	}
+	if f := tag.Frame("COMM"); f.Data[0] != encUTF16 || tag.Comment("") != "Ансамбль" {
+		t.Errorf("v2.3: comment in encoding %d is %q", f.Data[0], tag.Comment(""))
+	}
+	for _, f := range tag.Frames {
+		if f.Data[0] == encUTF8 {
+			t.Errorf("v2.3: frame %s is in UTF-8", f.ID)
+		}
+	}
+
+	tag.ConvertTo(4)
+	if got := tag.Text("TDRC"); !reflect.DeepEqual(got, []string{"2001"}) {
+		t.Errorf("v2.4: TDRC is %q", got)
+	}
+	if tag.Frame("TYER") != nil || tag.Frame("TIPL") == nil {
+		t.Errorf("v2.4: frames are not converted back: %v", tag.Frames)
+	}
+}
+
+func TestWriteMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mp3-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	frames := bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x64}, 64)
+
+	// An existing tag keeps its version and other frames.
+	old := id3Tag(3, 0, bytes.Join([][]byte{
+		frameData(3, "TIT2", 0, []byte("\x00Old")),
+		frameData(3, "TALB", 0, []byte("\x00Album")),
+		frameData(3, "TSSE", 0, []byte("\x00LAME")),
+	}, nil))
+	file := mp3File(t, dir, old, frames)
+	m := &testMetadata{title: "New", artist: "Artist", year: 1999, track: 3, tracks: 12}
+	if err := WriteMetadata(file, m); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := ReadTag(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id   string
+		want []string
+	}{
+		{"TIT2", []string{"New"}},
+		{"TPE1", []string{"Artist"}},
+		{"TALB", nil},
+		{"TRCK", []string{"3/12"}},
+		{"TYER", []string{"1999"}},
+		{"TSSE", []string{"LAME"}},
+	}
+	if tag.Version != 3 {
+		t.Errorf("version is %d, want 3", tag.Version)
+	}
+	for _, tt := range tests {
+		if got := tag.Text(tt.id); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s is %q, want %q", tt.id, got, tt.want)
+		}
+	}
+	if !bytes.Equal(audioOf(t, file), frames) {
+		t.Error("audio frames changed")
+	}
+
+	// A new tag is an ID3v2.4 tag.
+	file = mp3File(t, dir, nil, frames)
+	if err := WriteMetadata(file, m); err != nil {
+		t.Fatal(err)
+	}
+	if tag, err := ReadTag(file); err != nil || tag.Version != 4 || tag.Frame("TDRC") == nil {
+		t.Errorf("new tag is %+v, %v, want an ID3v2.4 tag with TDRC", tag, err)
+	}
+}
+
+func TestTagTags(t *testing.T) {
+	in := tags.Tags{
+		"TITLE":               {"Song"},
+		"ARTIST":              {"A", "B"},
+		"DATE":                {"2001-05-03"},
+		"TRACKNUMBER":         {"3"},
+		"TRACKTOTAL":          {"12"},
+		"COMMENT":             {"Nice"},
+		"LYRICS":              {"La la la"},
+		"CONTACT":             {"http://example.com"},
+		"MOOD":                {"calm"},
+		"MUSICBRAINZ_TRACKID": {"abc"},
+		"MUSICBRAINZ_ALBUMID": {"def"},
+		"MYFIELD":             {"x"},
+	}
+	tests := []struct {
+		version byte
+		frames  []string // IDs of some frames that must be written
+		want    tags.Tags
+	}{
+		{4, []string{"TIT2", "TDRC", "TMOO", "UFID", "USLT", "WOAR"}, in},
+		{3, []string{"TIT2", "TYER", "TXXX", "UFID", "USLT", "WOAR"}, tags.Tags{
+			"TITLE":               {"Song"},
+			"ARTIST":              {"A/B"},
+			"DATE":                {"2001"},
+			"TRACKNUMBER":         {"3"},
+			"TRACKTOTAL":          {"12"},
+			"COMMENT":             {"Nice"},
+			"LYRICS":              {"La la la"},
+			"CONTACT":             {"http://example.com"},
+			"MOOD":                {"calm"},
+			"MUSICBRAINZ_TRACKID": {"abc"},
+			"MUSICBRAINZ_ALBUMID": {"def"},
+			"MYFIELD":             {"x"},
+		}},
+	}
+	for _, tt := range tests {
+		tag := NewTag(tt.version)
+		tag.SetText("TSSE", "LAME 3.100")
+		tag.SetText("TALB", "Old")
+		tag.AddPicture(&Picture{MIMEType: "image/png", Type: FrontCover, Data: []byte{1}})
+		tag.SetTags(in)
+
+		got, err := readTag(bytes.NewReader(tag.encode(0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range tt.frames {
+			if got.Frame(id) == nil {
+				t.Errorf("v2.%d: there is no %s frame", tt.version, id)
+			}
+		}
+		// Frames of the file and pictures are kept, other fields are replaced.
+		want := tags.Tags{"ENCODER": {"LAME 3.100"}}
+		for k, v := range tt.want {
+			want[k] = v
+		}
+		if read := got.Tags(); !reflect.DeepEqual(read, want) {
+			t.Errorf("v2.%d: tags read back are %v, want %v", tt.version, read, want)
+		}
+		if len(got.Pictures()) != 1 {
+			t.Errorf("v2.%d: picture was not kept", tt.version)
+		}
+	}
+
+	// Comments with a description are not fields.
+	tag := NewTag(4)
+	tag.SetComment("eng", "iTunNORM", "0000")
+	tag.SetUserText("MusicBrainz Album Id", "def")
+	if read := tag.Tags(); !reflect.DeepEqual(read, tags.Tags{"MUSICBRAINZ_ALBUMID": {"def"}}) {
+		t.Errorf("tags are %v, want only MUSICBRAINZ_ALBUMID", read)
+	}
+}
+
+func TestSetSyncedLyrics(t *testing.T) {
+	lines := []tags.Line{{Time: 1500 * time.Millisecond, Text: "One"}, {Time: time.Minute, Text: "Two"}}
+	tag := NewTag(3)
+	tag.SetSyncedLyrics("eng", "", lines)
+	want := []byte("\x00eng\x02\x01\x00One\x00\x00\x00\x05\xdcTwo\x00\x00\x00\xea\x60")
+	if f := tag.Frame("SYLT"); f == nil || !bytes.Equal(f.Data, want) {
+		t.Errorf("frame is %v, want % x", f, want)
+	}
+
+	// Lyrics beyond Latin-1 are written in UTF-16 by ID3v2.3.
+	tag.SetSyncedLyrics("de", "", []tags.Line{{Text: "Ω"}})
+	want = []byte("\x01deX\x02\x01\xff\xfe\x00\x00\xff\xfe\xa9\x03\x00\x00\x00\x00\x00\x00")
+	if fs := tag.Frames; len(fs) != 1 || !bytes.Equal(fs[0].Data, want) {
+		t.Errorf("frames are %v, want one of % x", fs, want)
+	}
+
+	// Frames are replaced by their description, and written as UTF-8
+	// by ID3v2.4.
+	tag = NewTag(4)
+	tag.SetSyncedLyrics("eng", "", lines)
+	tag.SetSyncedLyrics("eng", "Karaoke", lines[:1])
+	tag.SetSyncedLyrics("eng", "", lines[1:])
+	if len(tag.Frames) != 2 || tag.Frames[0].Data[0] != encUTF8 {
+		t.Errorf("frames are %v, want two in UTF-8", tag.Frames)
+	}
+	got, err := readTag(bytes.NewReader(tag.encode(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Frames) != 2 || !bytes.Equal(got.Frames[0].Data, tag.Frames[0].Data) {
+		t.Errorf("frames read back are %v, want %v", got.Frames, tag.Frames)
+	}
+	tag.SetSyncedLyrics("eng", "Karaoke", nil)
+	tag.SetSyncedLyrics("eng", "", nil)
+	if len(tag.Frames) != 0 {
+		t.Errorf("frames are %v, want none", tag.Frames)
+	}
+}
+
+func TestChapters(t *testing.T) {
+	u32 := func(xs ...uint32) []byte {
+		b := make([]byte, 4*len(xs))
+		for i, x := range xs {
+			binary.BigEndian.PutUint32(b[4*i:], x)
+		}
+		return b
+	}
+	chs := []tags.Chapter{
+		{Start: 0, Title: "Intro"},
+		{Start: 90500 * time.Millisecond},
+		{Start: 2 * time.Minute, Title: strings.Repeat("Ω", 100)},
+	}
+	tag := NewTag(3)
+	tag.SetText("TIT2", "Book")
+	tag.SetChapters(chs, 3*time.Minute)
+	if len(tag.Frames) != 5 || tag.Frames[4].ID != "CTOC" {
+		t.Fatalf("frames are %v, want TIT2, three CHAP, and CTOC", tag.Frames)
+	}
+
+	// Each chapter ends where the next one starts, and the last one
+	// with the file.
+	ends := []uint32{90500, 120000, 180000}
+	for i, f := range tag.Frames[1:4] {
+		id := fmt.Sprintf("ch%d\x00", i)
+		want := append([]byte(id), u32(uint32(chs[i].Start/time.Millisecond), ends[i], 0xFFFFFFFF, 0xFFFFFFFF)...)
+		if f.ID != "CHAP" || !bytes.HasPrefix(f.Data, want) {
+			t.Errorf("chapter %d is %s % x, want CHAP starting with % x", i+1, f.ID, f.Data, want)
+		}
+	}
+	if f := tag.Frames[1]; !bytes.Equal(f.Data[20:], frameData(3, "TIT2", 0, []byte("\x00Intro"))) {
+		t.Errorf("subframes of chapter 1 are % x", f.Data[20:])
+	}
+	if f := tag.Frames[2]; len(f.Data) != 20 {
+		t.Errorf("chapter 2 without a title has subframes % x", f.Data[20:])
+	}
+	if want := []byte("toc\x00\x03\x03ch0\x00ch1\x00ch2\x00"); !bytes.Equal(tag.Frames[4].Data, want) {
+		t.Errorf("table of contents is % x, want % x", tag.Frames[4].Data, want)
+	}
+	if got := tag.Chapters(); !reflect.DeepEqual(got, chs) {
+		t.Errorf("chapters are %v, want %v", got, chs)
+	}
+
+	// The subframes are read back, and converted with the tag, whose
+	// versions store the size of frames differently.
+	for _, version := range []byte{4, 3} {
+		tag.ConvertTo(version)
+		got, err := readTag(bytes.NewReader(tag.encode(0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := got.Chapters(); !reflect.DeepEqual(got, chs) {
+			t.Errorf("v2.%d: chapters are %v, want %v", version, got, chs)
+		}
+	}
+
+	// Chapters are read in the order of their start times, and invalid
+	// frames are skipped.
+	tag = NewTag(4)
+	tag.SetChapters([]tags.Chapter{{Start: time.Minute, Title: "Later"}, {Start: 0, Title: "Earlier"}}, 0)
+	if f := tag.Frames[0]; !bytes.HasPrefix(f.Data[4:], u32(60000, 60000)) {
+		t.Errorf("chapter before an earlier one ends at %d, want at its start", binary.BigEndian.Uint32(f.Data[8:]))
+	}
+	tag.Frames = append(tag.Frames, &Frame{ID: "CHAP", Data: []byte("ch9\x00\x00\x00")}, &Frame{ID: "CHAP", Data: []byte("ch9")})
+	want := []tags.Chapter{{Start: 0, Title: "Earlier"}, {Start: time.Minute, Title: "Later"}}
+	if got := tag.Chapters(); !reflect.DeepEqual(got, want) {
+		t.Errorf("chapters are %v, want %v", got, want)
+	}
+
+	// The table of contents lists only 255 chapters.
+	many := make([]tags.Chapter, 300)
+	for i := range many {
+		many[i].Start = time.Duration(i) * time.Second
+	}
+	tag.SetChapters(many, 0)
+	if n := len(tag.Frames); n != 301 || tag.Frames[300].Data[5] != 255 {
+		t.Errorf("%d frames, want 300 CHAP and a CTOC of 255", n)
+	}
+	if f := tag.Frames[300]; subframes(f) != len(f.Data) {
+		t.Errorf("table of contents ends at %d of %d", subframes(f), len(f.Data))
+	}
+
+	tag.SetChapters(nil, 0)
+	if len(tag.Frames) != 0 {
+		t.Errorf("frames are %v, want none", tag.Frames)
+	}
+}
@@ -6,8 +6,10 @@ package mp3
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strconv"
@@ -108,11 +110,23 @@ func ReadMetadata(file string) (*Metadata, error) {
 	f.Seek(0, 0)
 	dec := mp3.NewDecoder(f)
 	var (
-		frame mp3.Frame
-		dur   time.Duration
-		bytes int64
+		frame    mp3.Frame
+		dur      time.Duration
+		bytes    int64
+		rate     int
+		channels int
 	)
 	for dec.Decode(&frame, &skipped) == nil {
+		if rate == 0 {
+			h := frame.Header()
+			if r := h.SampleRate(); r != mp3.ErrInvalidSampleRate {
+				rate = int(r)
+			}
+			channels = 2
+			if h.ChannelMode() == mp3.SingleChannel {
+				channels = 1
+			}
+		}
 		dur += frame.Duration()
 		bytes += int64(frame.Size())
 	}
@@ -127,6 +141,8 @@ func ReadMetadata(file string) (*Metadata, error) {
 		length:   dur,
 		bitrate:  int(kbps),
 		codec:    audio.MP3,
+		rate:     rate,
+		channels: channels,
 	}, nil
 }
 
@@ -194,14 +210,6 @@ func exiftool(_ string) (int, time.Duration, error) {
 
 // }}}
 
-// WriteMetadata {{{
-
-func WriteMetadata(file string, m audio.Metadata) error {
-	return errors.New("not implemented")
-}
-
-// }}}
-
 type Encoder struct {
 	Path    string
 	Quality int
@@ -224,29 +232,8 @@ func NewEncoder() *Encoder {
 //  bs, err = enc.EncodeFromStdin(dec, path, md.Metadata())
 //
 func (e *Encoder) EncodeFromStdin(dec *exec.Cmd, path string, md audio.Metadata) ([]byte, error) {
-	slash := func(a, b int) string { return fmt.Sprintf("%d/%d", a, b) }
-	q := strconv.FormatInt(int64(e.Quality), 10)
-	enc := exec.Command(e.Path,
-		"-h", "-V"+q,
-		"--add-id3v2", "--pad-id3v2",
-		"--tt", md.Title(),
-		"--ta", md.Artist(),
-		"--tv", fmt.Sprintf("TPE2=%s", md.AlbumArtist()),
-		"--tl", md.Album(),
-		"--tn", slash(md.Track()),
-		"--ty", fmt.Sprintf("%d", md.Year()),
-		"--tv", fmt.Sprintf("TPOS=%s", slash(md.Disc())),
-		"--tg", md.Genre(),
-		"--tc", md.Comment(),
-		"--tv", fmt.Sprintf("TCOM=%s", md.Composer()),
-		"--tv", fmt.Sprintf("WCOP=%s", md.Copyright()),
-		"--tv", fmt.Sprintf("WXXX=%s", md.Website()),
-		"--tv", fmt.Sprintf("TENC=%s", e.Path),
-		"--tv", fmt.Sprintf("TSSE=%s", "-h -V"+q),
-		"--tv", fmt.Sprintf("TOFN=%s", md.OriginalFilename()),
-		// input, output
-		"-", path,
-	)
+	enc := e.Command(context.Background(), path, md)
+
 	// Set up the pipe
 	var err error
 	enc.Stdin, err = dec.StdoutPipe()
@@ -270,6 +257,47 @@ func (e *Encoder) EncodeFromStdin(dec *exec.Cmd, path string, md audio.Metadata)
 	return b.Bytes(), enc.Wait()
 }
 
+// EncodeFrom encodes the WAV stream r to an MP3 file at path, and tags it
+// with the audio metadata received. It returns the output of the encoder.
+func (e *Encoder) EncodeFrom(r io.Reader, path string, md audio.Metadata) ([]byte, error) {
+	enc := e.Command(context.Background(), path, md)
+	enc.Stdin = r
+	return enc.CombinedOutput()
+}
+
+// Command returns the encoder command that reads a WAV stream from stdin and
+// writes the MP3 to path. The command is killed when ctx is done.
+// If md is nil, the MP3 is not tagged.
+func (e *Encoder) Command(ctx context.Context, path string, md audio.Metadata) *exec.Cmd {
+	q := strconv.FormatInt(int64(e.Quality), 10)
+	if md == nil {
+		return exec.CommandContext(ctx, e.Path, "-h", "-V"+q, "-", path)
+	}
+
+	slash := func(a, b int) string { return fmt.Sprintf("%d/%d", a, b) }
+	return exec.CommandContext(ctx, e.Path,
+		"-h", "-V"+q,
+		"--add-id3v2", "--pad-id3v2",
+		"--tt", md.Title(),
+		"--ta", md.Artist(),
+		"--tv", fmt.Sprintf("TPE2=%s", md.AlbumArtist()),
+		"--tl", md.Album(),
+		"--tn", slash(md.Track()),
+		"--ty", fmt.Sprintf("%d", md.Year()),
+		"--tv", fmt.Sprintf("TPOS=%s", slash(md.Disc())),
+		"--tg", md.Genre(),
+		"--tc", md.Comment(),
+		"--tv", fmt.Sprintf("TCOM=%s", md.Composer()),
+		"--tv", fmt.Sprintf("WCOP=%s", md.Copyright()),
+		"--tv", fmt.Sprintf("WXXX=%s", md.Website()),
+		"--tv", fmt.Sprintf("TENC=%s", e.Path),
+		"--tv", fmt.Sprintf("TSSE=%s", "-h -V"+q),
+		"--tv", fmt.Sprintf("TOFN=%s", md.OriginalFilename()),
+		// input, output
+		"-", path,
+	)
+}
+
 // Metadata {{{
 
 var _ = audio.Metadata(new(Metadata))
@@ -295,9 +323,11 @@ type Metadata struct {
 	//  Raw() map[string]interface{}
 	tag.Metadata
 
-	length  time.Duration
-	bitrate int
-	codec   audio.Codec
+	length   time.Duration
+	bitrate  int
+	codec    audio.Codec
+	rate     int
+	channels int
 }
 
 func (m *Metadata) Year() int {
@@ -328,6 +358,10 @@ func (m *Metadata) EncoderSettings() string  { return m.rawString("TSSE") }
 func (m *Metadata) OriginalFilename() string { return m.rawString("TOFN") }
 func (m *Metadata) PrivateData() []byte      { return m.rawBytes("PRIV") }
 
+// SampleRate and Channels are read from the first frame header.
+func (m *Metadata) SampleRate() int { return m.rate }
+func (m *Metadata) Channels() int   { return m.channels }
+
 func (m *Metadata) rawBytes(key string) []byte {
 	if v, ok := m.Raw()[key]; ok {
 		s, ok := v.([]byte)
@@ -0,0 +1,360 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package mp4
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/cassava/lackey/audio/tags"
+)
+
+// ReadChapters reads the chapters of an MPEG-4 file from the chpl atom,
+// which Nero and ffmpeg write, or else from the text track that the audio
+// track refers to as its chapters, as iTunes writes them for audiobooks.
+// It returns nil if the file has no chapters.
+func ReadChapters(file string) ([]tags.Chapter, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, _, moov, _, err := readMovie(f)
+	if err != nil {
+		return nil, err
+	}
+	as, err := parseAtoms(moov)
+	if err != nil {
+		return nil, err
+	}
+	if chpl := findPath(as, "udta", "chpl"); chpl != nil {
+		return parseChpl(chpl.Data)
+	}
+	return readChapterTrack(f, as)
+}
+
+// findPath returns the atom at the path of names below as, or nil.
+func findPath(as []*rawAtom, names ...string) *rawAtom {
+	var a *rawAtom
+	for i, name := range names {
+		if i > 0 {
+			var err error
+			if as, err = parseAtoms(a.Data); err != nil {
+				return nil
+			}
+		}
+		if a = findAtom(as, name); a == nil {
+			return nil
+		}
+	}
+	return a
+}
+
+// parseChpl parses the content of a chpl atom, whose times are in units
+// of 100 nanoseconds.
+func parseChpl(b []byte) ([]tags.Chapter, error) {
+	// version(1) flags(3) [reserved(4) in version 1] count(1)
+	// [start(8) length(1) title]...
+	i := 4
+	if len(b) > 0 && b[0] == 1 {
+		i += 4
+	}
+	if len(b) < i+1 {
+		return nil, ErrInvalidAtom
+	}
+	n := int(b[i])
+	b = b[i+1:]
+
+	var chs []tags.Chapter
+	for ; n > 0; n-- {
+		if len(b) < 9 || len(b) < 9+int(b[8]) {
+			return nil, ErrInvalidAtom
+		}
+		start := binary.BigEndian.Uint64(b)
+		title := b[9 : 9+int(b[8])]
+		chs = append(chs, tags.Chapter{
+			Start: time.Duration(start) * 100,
+			Title: decodeText(title),
+		})
+		b = b[9+len(title):]
+	}
+	return chs, nil
+}
+
+// readChapterTrack reads the chapters from the samples of the text track
+// that the chap atom of the audio track refers to.
+func readChapterTrack(f *os.File, moov []*rawAtom) ([]tags.Chapter, error) {
+	var ids []uint32
+	traks := make(map[uint32]*rawAtom)
+	for _, a := range moov {
+		if a.Name != "trak" {
+			continue
+		}
+		as, err := parseAtoms(a.Data)
+		if err != nil {
+			return nil, err
+		}
+		tkhd := findAtom(as, "tkhd")
+		if tkhd == nil || len(tkhd.Data) < 24 {
+			continue
+		}
+		// version(1) flags(3) creation modification id(4), where the
+		// times have 8 bytes in version 1 and 4 bytes otherwise.
+		if tkhd.Data[0] == 1 {
+			traks[binary.BigEndian.Uint32(tkhd.Data[20:24])] = a
+		} else {
+			traks[binary.BigEndian.Uint32(tkhd.Data[12:16])] = a
+		}
+		if chap := findPath(as, "tref", "chap"); chap != nil && ids == nil {
+			for b := chap.Data; len(b) >= 4; b = b[4:] {
+				ids = append(ids, binary.BigEndian.Uint32(b))
+			}
+		}
+	}
+
+	for _, id := range ids {
+		trak := traks[id]
+		if trak == nil {
+			continue
+		}
+		as, err := parseAtoms(trak.Data)
+		if err != nil {
+			return nil, err
+		}
+		var t Track
+		if mdhd := findPath(as, "mdia", "mdhd"); mdhd == nil {
+			continue
+		} else if err := t.readMDHD(mdhd.Data); err != nil {
+			return nil, err
+		}
+		stbl := findPath(as, "mdia", "minf", "stbl")
+		if stbl == nil || t.Timescale == 0 {
+			continue
+		}
+		samples, err := readSamples(stbl.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		chs := make([]tags.Chapter, 0, len(samples))
+		for _, s := range samples {
+			b := make([]byte, s.size)
+			if _, err := f.ReadAt(b, s.offset); err != nil {
+				return nil, ErrInvalidAtom
+			}
+			// Text samples start with the length of the text, which
+			// may be followed by atoms that style it.
+			var title string
+			if len(b) >= 2 {
+				n := int(binary.BigEndian.Uint16(b))
+				if n > len(b)-2 {
+					n = len(b) - 2
+				}
+				title = decodeText(b[2 : 2+n])
+			}
+			chs = append(chs, tags.Chapter{
+				Start: time.Duration(s.time) * time.Second / time.Duration(t.Timescale),
+				Title: title,
+			})
+		}
+		return chs, nil
+	}
+	return nil, nil
+}
+
+// sample is a sample of a track, with its time in units of the timescale
+// of the track, and where it is in the file.
+type sample struct {
+	time   uint64
+	offset int64
+	size   int64
+}
+
+// readSamples returns the samples that the atoms in the content of an stbl
+// atom describe.
+func readSamples(stbl []byte) ([]sample, error) {
+	as, err := parseAtoms(stbl)
+	if err != nil {
+		return nil, err
+	}
+	table := func(name string, width int) ([][]byte, error) {
+		a := findAtom(as, name)
+		if a == nil {
+			return nil, nil
+		}
+		// version(1) flags(3) entries(4) [entry]...
+		if len(a.Data) < 8 {
+			return nil, ErrInvalidAtom
+		}
+		n := int(binary.BigEndian.Uint32(a.Data[4:8]))
+		if len(a.Data) < 8+n*width {
+			return nil, ErrInvalidAtom
+		}
+		es := make([][]byte, n)
+		for i := range es {
+			es[i] = a.Data[8+i*width : 8+(i+1)*width]
+		}
+		return es, nil
+	}
+
+	stts, err := table("stts", 8)
+	if err != nil {
+		return nil, err
+	}
+	stsc, err := table("stsc", 12)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := table("stco", 4)
+	if err == nil && chunks == nil {
+		chunks, err = table("co64", 8)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stsz := findAtom(as, "stsz")
+	if stsz == nil || len(stsz.Data) < 12 {
+		return nil, ErrInvalidAtom
+	}
+
+	// The size of each sample is given, unless they all have the same.
+	fixed := int64(binary.BigEndian.Uint32(stsz.Data[4:8]))
+	count := int(binary.BigEndian.Uint32(stsz.Data[8:12]))
+	if fixed == 0 && len(stsz.Data) < 12+4*count {
+		return nil, ErrInvalidAtom
+	}
+	samples := make([]sample, count)
+	for i := range samples {
+		samples[i].size = fixed
+		if fixed == 0 {
+			samples[i].size = int64(binary.BigEndian.Uint32(stsz.Data[12+4*i:]))
+		}
+	}
+
+	var (
+		i  int
+		at uint64
+	)
+	for _, e := range stts {
+		n := binary.BigEndian.Uint32(e[0:4])
+		delta := uint64(binary.BigEndian.Uint32(e[4:8]))
+		for ; n > 0 && i < count; n-- {
+			samples[i].time = at
+			at += delta
+			i++
+		}
+	}
+
+	// Each entry of stsc gives the number of samples in the chunks from
+	// its first chunk, counted from 1, until the next entry.
+	i = 0
+	for j, e := range stsc {
+		first := int(binary.BigEndian.Uint32(e[0:4])) - 1
+		per := int(binary.BigEndian.Uint32(e[4:8]))
+		last := len(chunks)
+		if j+1 < len(stsc) {
+			last = int(binary.BigEndian.Uint32(stsc[j+1][0:4])) - 1
+		}
+		for c := first; c >= 0 && c < last && c < len(chunks); c++ {
+			var offset int64
+			if len(chunks[c]) == 8 {
+				offset = int64(binary.BigEndian.Uint64(chunks[c]))
+			} else {
+				offset = int64(binary.BigEndian.Uint32(chunks[c]))
+			}
+			for k := 0; k < per && i < count; k++ {
+				samples[i].offset = offset
+				offset += samples[i].size
+				i++
+			}
+		}
+	}
+	return samples[:i], nil
+}
+
+// decodeText decodes a title that is UTF-8, or UTF-16 if it starts with
+// a byte order mark.
+func decodeText(b []byte) string {
+	if len(b) >= 2 && (b[0] == 0xFE && b[1] == 0xFF || b[0] == 0xFF && b[1] == 0xFE) {
+		le := b[0] == 0xFF
+		u := make([]uint16, (len(b)-2)/2)
+		for i := range u {
+			if le {
+				u[i] = binary.LittleEndian.Uint16(b[2+2*i:])
+			} else {
+				u[i] = binary.BigEndian.Uint16(b[2+2*i:])
+			}
+		}
+		return string(utf16.Decode(u))
+	}
+	if !utf8.Valid(b) {
+		rs := make([]rune, len(b))
+		for i, c := range b {
+			rs[i] = rune(c)
+		}
+		return string(rs)
+	}
+	return string(b)
+}
+
+// WriteChapters replaces the chapters in the chpl atom of an MPEG-4 file
+// with chs, or removes the atom if there are none. Since the atom can hold
+// at most 255 chapters, any further chapters are dropped. Chapter tracks
+// are left as they are.
+func WriteChapters(file string, chs []tags.Chapter) error {
+	if len(chs) > 255 {
+		chs = chs[:255]
+	}
+	return writeMovie(file, func(moov []byte) ([]byte, error) {
+		as, err := parseAtoms(moov)
+		if err != nil {
+			return nil, err
+		}
+		udta := findAtom(as, "udta")
+		if udta == nil {
+			if len(chs) == 0 {
+				return moov, nil
+			}
+			udta = &rawAtom{Name: "udta"}
+			as = append(as, udta)
+		}
+		us, err := parseAtoms(udta.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		var children []*rawAtom
+		for _, a := range us {
+			if a.Name != "chpl" {
+				children = append(children, a)
+			}
+		}
+		if len(chs) > 0 {
+			// Nero writes version 1, with four reserved bytes.
+			b := []byte{1, 0, 0, 0, 0, 0, 0, 0, byte(len(chs))}
+			for _, c := range chs {
+				title := c.Title
+				if len(title) > 255 {
+					// The title is cut at a character.
+					title = title[:255]
+					for !utf8.ValidString(title) {
+						title = title[:len(title)-1]
+					}
+				}
+				var start [8]byte
+				binary.BigEndian.PutUint64(start[:], uint64(c.Start/100))
+				b = append(b, start[:]...)
+				b = append(b, byte(len(title)))
+				b = append(b, title...)
+			}
+			children = append(children, &rawAtom{Name: "chpl", Data: b})
+		}
+		udta.Data = encodeAtoms(children)
+		return encodeAtoms(as), nil
+	})
+}
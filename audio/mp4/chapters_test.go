@@ -0,0 +1,206 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cassava/lackey/audio/tags"
+)
+
+func u64(xs ...uint64) []byte {
+	b := make([]byte, 8*len(xs))
+	for i, x := range xs {
+		binary.BigEndian.PutUint64(b[8*i:], x)
+	}
+	return b
+}
+
+// chapterFile returns a file whose audio track refers to a text track
+// with the chapters Intro at 0, Hi at 5 s, and End at 10 s, whose chunks
+// are in stco, or in co64 if co64 is true.
+func chapterFile(co64 bool) []byte {
+	ftyp := box("ftyp", []byte("M4A "), u32(0))
+	// The first sample is followed by a style atom, the second is in
+	// UTF-16, and the third claims to be longer than it is.
+	s1 := append([]byte("\x00\x05Intro"), box("styl", u32(0))...)
+	s2 := []byte("\x00\x06\xfe\xff\x00H\x00i")
+	s3 := []byte("\x00\x09End")
+	mdat := box("mdat", s1, s2, []byte("junk"), s3)
+
+	// The first chunk has two samples, and the second one.
+	off1 := uint32(len(ftyp) + 8)
+	off2 := off1 + uint32(len(s1)+len(s2)+4)
+	chunks := box("stco", u32(0, 2, off1, off2))
+	if co64 {
+		chunks = box("co64", u32(0, 2), u64(uint64(off1), uint64(off2)))
+	}
+	text := box("trak",
+		box("tkhd", u32(0, 0, 0, 2, 0, 0)),
+		box("mdia",
+			box("mdhd", u32(0, 0, 0, 1000, 10000)),
+			box("minf",
+				box("stbl",
+					box("stts", u32(0, 2, 2, 5000, 1, 1000)),
+					box("stsc", u32(0, 2, 1, 2, 1, 2, 1, 1)),
+					chunks,
+					box("stsz", u32(0, 0, 3, uint32(len(s1)), uint32(len(s2)), uint32(len(s3))))))))
+
+	sound := insert(testTrack("soun", "mp4a", 10), []string{"trak"}, box("tkhd", u32(0, 0, 0, 1, 0, 0)))
+	sound = insert(sound, []string{"trak"}, box("tref", box("chap", u32(2))))
+	return bytes.Join([][]byte{ftyp, mdat, box("moov", sound, text, testItems())}, nil)
+}
+
+func TestReadChapterTrack(t *testing.T) {
+	want := []tags.Chapter{{Start: 0, Title: "Intro"}, {Start: 5 * time.Second, Title: "Hi"}, {Start: 10 * time.Second, Title: "End"}}
+	for _, co64 := range []bool{false, true} {
+		file := writeFile(t, chapterFile(co64))
+		defer os.RemoveAll(filepath.Dir(file))
+		if got, err := ReadChapters(file); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("co64 %v: chapters are %v with error %v, want %v", co64, got, err, want)
+		}
+
+		// The chpl atom is preferred over the track, which it leaves alone.
+		chpl := []tags.Chapter{{Start: 0, Title: "Other"}}
+		if err := WriteChapters(file, chpl); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ReadChapters(file); err != nil || !reflect.DeepEqual(got, chpl) {
+			t.Errorf("co64 %v: chapters are %v with error %v, want %v", co64, got, err, chpl)
+		}
+		if err := WriteChapters(file, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ReadChapters(file); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("co64 %v: chapters after removing chpl are %v with error %v, want %v", co64, got, err, want)
+		}
+	}
+
+	// A track that refers to a missing track has no chapters.
+	sound := insert(testTrack("soun", "mp4a", 10), []string{"trak"}, box("tkhd", u32(0, 0, 0, 1, 0, 0)))
+	sound = insert(sound, []string{"trak"}, box("tref", box("chap", u32(7))))
+	file := writeFile(t, box("ftyp", []byte("M4A "), u32(0)), box("moov", sound))
+	defer os.RemoveAll(filepath.Dir(file))
+	if got, err := ReadChapters(file); err != nil || got != nil {
+		t.Errorf("chapters are %v with error %v, want none", got, err)
+	}
+}
+
+func TestParseChpl(t *testing.T) {
+	title := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	tests := []struct {
+		name string
+		data []byte
+		want []tags.Chapter
+	}{
+		{"version 0", bytes.Join([][]byte{{0, 0, 0, 0, 2}, u64(0), title("One"), u64(600000000), title("Two")}, nil),
+			[]tags.Chapter{{Start: 0, Title: "One"}, {Start: time.Minute, Title: "Two"}}},
+		{"version 1", bytes.Join([][]byte{{1, 0, 0, 0, 0, 0, 0, 0, 1}, u64(15), title("")}, nil),
+			[]tags.Chapter{{Start: 1500, Title: ""}}},
+		{"UTF-16", bytes.Join([][]byte{{0, 0, 0, 0, 1}, u64(0), title("\xff\xfeO\x00n\x00e\x00")}, nil),
+			[]tags.Chapter{{Start: 0, Title: "One"}}},
+		{"Latin-1", bytes.Join([][]byte{{0, 0, 0, 0, 1}, u64(0), title("Caf\xe9")}, nil),
+			[]tags.Chapter{{Start: 0, Title: "Café"}}},
+		{"none", []byte{0, 0, 0, 0, 0}, nil},
+	}
+	for _, tt := range tests {
+		if got, err := parseChpl(tt.data); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: chapters are %v with error %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+
+	for name, b := range map[string][]byte{
+		"empty":     nil,
+		"no count":  {1, 0, 0, 0, 0, 0, 0, 0},
+		"no start":  {0, 0, 0, 0, 1, 0, 0},
+		"no title":  append([]byte{0, 0, 0, 0, 1}, append(u64(0), 5, 'a')...),
+		"too many":  append([]byte{0, 0, 0, 0, 2}, append(u64(0), title("One")...)...),
+		"truncated": {0, 0, 0, 0, 1},
+	} {
+		if _, err := parseChpl(b); err != ErrInvalidAtom {
+			t.Errorf("%s: error is %v, want %v", name, err, ErrInvalidAtom)
+		}
+	}
+}
+
+func TestWriteChapters(t *testing.T) {
+	file := writeFile(t, box("ftyp", []byte("M4A "), u32(0)), box("moov", testTrack("soun", "mp4a", 10), testItems()))
+	defer os.RemoveAll(filepath.Dir(file))
+	if got, err := ReadChapters(file); err != nil || got != nil {
+		t.Errorf("chapters are %v with error %v, want none", got, err)
+	}
+
+	// Titles are cut at a character to fit into 255 bytes.
+	long := strings.Repeat("a", 254)
+	chs := []tags.Chapter{
+		{Start: 0, Title: "Intro"},
+		{Start: 90*time.Second + 1234*time.Microsecond, Title: "Überleitung"},
+		{Start: time.Hour, Title: long + "é"},
+	}
+	if err := WriteChapters(file, chs); err != nil {
+		t.Fatal(err)
+	}
+	want := append(chs[:2:2], tags.Chapter{Start: time.Hour, Title: long})
+	if got, err := ReadChapters(file); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("chapters are %v with error %v, want %v", got, err, want)
+	}
+	if tt, err := ReadTags(file); err != nil || tt.Get("TITLE") != "Old" {
+		t.Errorf("tags are %v with error %v, want them kept", tt, err)
+	}
+
+	// Only 255 chapters fit into the atom.
+	many := make([]tags.Chapter, 300)
+	for i := range many {
+		many[i].Start = time.Duration(i) * time.Minute
+	}
+	if err := WriteChapters(file, many); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadChapters(file); err != nil || !reflect.DeepEqual(got, many[:255]) {
+		t.Errorf("%d chapters with error %v, want the first 255", len(got), err)
+	}
+
+	if err := WriteChapters(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadChapters(file); err != nil || got != nil {
+		t.Errorf("chapters are %v with error %v, want none", got, err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("chpl")) {
+		t.Error("chpl atom is kept")
+	}
+
+	// A file without udta only gets one for chapters.
+	bare := writeFile(t, box("ftyp", []byte("M4A "), u32(0)), box("moov", testTrack("soun", "mp4a", 10)))
+	defer os.RemoveAll(filepath.Dir(bare))
+	before, err := ioutil.ReadFile(bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteChapters(bare, nil); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := ioutil.ReadFile(bare); !bytes.Equal(after, before) {
+		t.Error("removing chapters of a file without any changed it")
+	}
+	if err := WriteChapters(bare, chs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadChapters(bare); err != nil || !reflect.DeepEqual(got, chs[:1]) {
+		t.Errorf("chapters are %v with error %v, want %v", got, err, chs[:1])
+	}
+}
@@ -0,0 +1,461 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package mp4 reads metadata from MPEG-4 audio files, such as those
+// containing AAC or ALAC, and writes their iTunes-style tags.
+//
+// Reference
+//
+//  https://developer.apple.com/library/archive/documentation/QuickTime/QTFF/
+//  ISO/IEC 14496-12 (ISO base media file format)
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cassava/lackey/audio/bitrate"
+	"github.com/dhowden/tag"
+	"github.com/goulash/audio"
+	"github.com/goulash/stat"
+)
+
+var (
+	ErrNotMP4       = errors.New("file is not an MPEG-4 file")
+	ErrInvalidAtom  = errors.New("invalid MPEG-4 atom")
+	ErrNoAudioTrack = errors.New("MPEG-4 file contains no audio track")
+)
+
+var Stats struct {
+	ReadMetadata stat.Run
+}
+
+func init() {
+	reader := func(file string) (audio.Metadata, error) {
+		return ReadMetadata(file)
+	}
+	for _, c := range []audio.Codec{audio.M4A, audio.M4B, audio.M4P, audio.ALAC, audio.AAC} {
+		audio.MetadataReaders[c] = reader
+	}
+}
+
+// ReadMetadata {{{
+
+// ReadMetadata reads the tags, the exact duration, and the average bitrate
+// of the first audio track in an MPEG-4 file.
+//
+// The duration is the sum of the sample durations in the stts atom, in the
+// timescale given by the mdhd atom. The bitrate is calculated from the sample
+// sizes in the stsz atom, or the size of the mdat atom if that is missing.
+func ReadMetadata(file string) (*Metadata, error) {
+	start := time.Now()
+	defer func() { Stats.ReadMetadata.Add(float64(time.Since(start))) }()
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	tr, mdat, err := readTracks(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if tr == nil {
+		return nil, ErrNoAudioTrack
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tm, err := tag.ReadAtoms(f)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{
+		Metadata: tm,
+		codec:    tr.Codec(),
+		track:    tr,
+	}
+	if tr.Timescale != 0 {
+		d := tr.Duration
+		if tr.SampleDuration != 0 {
+			d = tr.SampleDuration
+		}
+		m.length = time.Duration(d) * time.Second / time.Duration(tr.Timescale)
+	}
+	size := tr.SampleBytes
+	if size == 0 {
+		size = mdat
+	}
+	m.bitrate = bitrate.Average(size, m.length)
+	return m, nil
+}
+
+// Identify returns the codec of the first audio track in an MPEG-4 file,
+// which is audio.ALAC for Apple Lossless and audio.AAC for AAC.
+// The container alone, which is all that audio.Identify looks at,
+// does not tell the two apart.
+func Identify(file string) (audio.Codec, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return audio.Unknown, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return audio.Unknown, err
+	}
+	tr, _, err := readTracks(f, fi.Size())
+	if err != nil {
+		return audio.Unknown, err
+	}
+	if tr == nil {
+		return audio.Unknown, ErrNoAudioTrack
+	}
+	return tr.Codec(), nil
+}
+
+// }}}
+
+// Atoms {{{
+
+// Track contains the information we read from the atoms of an audio track.
+type Track struct {
+	// Format is the type of the sample description, such as "mp4a" or "alac".
+	Format string
+
+	Timescale      uint32 // mdhd: units per second
+	Duration       uint64 // mdhd: duration in timescale units
+	SampleDuration uint64 // stts: sum of all sample durations
+	SampleBytes    int64  // stsz: sum of all sample sizes
+
+	Channels   int // stsd: number of channels
+	SampleSize int // stsd: bits per sample
+	SampleRate int // stsd: sample rate in Hz
+}
+
+// Codec returns the codec of the track according to its sample description.
+// If the format is neither AAC nor ALAC, it returns audio.M4A.
+func (t *Track) Codec() audio.Codec {
+	switch t.Format {
+	case "alac":
+		return audio.ALAC
+	case "mp4a":
+		return audio.AAC
+	default:
+		return audio.M4A
+	}
+}
+
+type atom struct {
+	Name   string
+	Offset int64 // offset of the atom content
+	Size   int64 // size of the atom content
+}
+
+// readAtom reads an atom header at the current position of r,
+// which is at offset within the file.
+func readAtom(r io.Reader, offset, limit int64) (*atom, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	a := &atom{
+		Name:   string(h[4:8]),
+		Offset: offset + 8,
+		Size:   int64(binary.BigEndian.Uint32(h[:4])),
+	}
+	switch a.Size {
+	case 0:
+		// The atom extends to the end of the file.
+		a.Size = limit - a.Offset
+	case 1:
+		// The actual size is in the following 64 bits.
+		var x [8]byte
+		if _, err := io.ReadFull(r, x[:]); err != nil {
+			return nil, ErrInvalidAtom
+		}
+		a.Offset += 8
+		a.Size = int64(binary.BigEndian.Uint64(x[:])) - 16
+	default:
+		a.Size -= 8
+	}
+	if a.Size < 0 || a.Offset+a.Size > limit {
+		return nil, ErrInvalidAtom
+	}
+	return a, nil
+}
+
+// walkAtoms calls fn for each atom in the range [offset, limit).
+func walkAtoms(r io.ReadSeeker, offset, limit int64, fn func(a *atom) error) error {
+	for offset+8 <= limit {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		a, err := readAtom(r, offset, limit)
+		if err != nil {
+			return err
+		}
+		if err := fn(a); err != nil {
+			return err
+		}
+		offset = a.Offset + a.Size
+	}
+	return nil
+}
+
+func readAtomData(r io.ReadSeeker, a *atom) ([]byte, error) {
+	if _, err := r.Seek(a.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, a.Size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, ErrInvalidAtom
+	}
+	return b, nil
+}
+
+// readTracks returns the first audio track in the file and the size
+// of the mdat atom.
+func readTracks(r io.ReadSeeker, size int64) (*Track, int64, error) {
+	var (
+		first = true
+		track *Track
+		mdat  int64
+	)
+	err := walkAtoms(r, 0, size, func(a *atom) error {
+		if first && a.Name != "ftyp" {
+			return ErrNotMP4
+		}
+		first = false
+
+		switch a.Name {
+		case "mdat":
+			mdat += a.Size
+		case "moov":
+			return walkAtoms(r, a.Offset, a.Offset+a.Size, func(a *atom) error {
+				if a.Name != "trak" || track != nil {
+					return nil
+				}
+				t, err := readTrack(r, a)
+				if err != nil {
+					return err
+				}
+				track = t
+				return nil
+			})
+		}
+		return nil
+	})
+	return track, mdat, err
+}
+
+// readTrack reads a trak atom, returning nil if it is not an audio track.
+func readTrack(r io.ReadSeeker, trak *atom) (*Track, error) {
+	var (
+		t     Track
+		sound bool
+	)
+
+	var walk func(a *atom) error
+	walk = func(a *atom) error {
+		switch a.Name {
+		case "mdia", "minf", "stbl":
+			return walkAtoms(r, a.Offset, a.Offset+a.Size, walk)
+		case "hdlr":
+			b, err := readAtomData(r, a)
+			if err != nil {
+				return err
+			}
+			sound = len(b) >= 12 && string(b[8:12]) == "soun"
+		case "mdhd":
+			b, err := readAtomData(r, a)
+			if err != nil {
+				return err
+			}
+			return t.readMDHD(b)
+		case "stts":
+			b, err := readAtomData(r, a)
+			if err != nil {
+				return err
+			}
+			return t.readSTTS(b)
+		case "stsz":
+			b, err := readAtomData(r, a)
+			if err != nil {
+				return err
+			}
+			return t.readSTSZ(b)
+		case "stsd":
+			b, err := readAtomData(r, a)
+			if err != nil {
+				return err
+			}
+			return t.readSTSD(b)
+		}
+		return nil
+	}
+
+	if err := walkAtoms(r, trak.Offset, trak.Offset+trak.Size, walk); err != nil {
+		return nil, err
+	}
+	if !sound {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func (t *Track) readMDHD(b []byte) error {
+	if len(b) < 4 {
+		return ErrInvalidAtom
+	}
+	if b[0] == 1 {
+		// version(1) flags(3) creation(8) modification(8) timescale(4) duration(8)
+		if len(b) < 32 {
+			return ErrInvalidAtom
+		}
+		t.Timescale = binary.BigEndian.Uint32(b[20:24])
+		t.Duration = binary.BigEndian.Uint64(b[24:32])
+	} else {
+		// version(1) flags(3) creation(4) modification(4) timescale(4) duration(4)
+		if len(b) < 20 {
+			return ErrInvalidAtom
+		}
+		t.Timescale = binary.BigEndian.Uint32(b[12:16])
+		t.Duration = uint64(binary.BigEndian.Uint32(b[16:20]))
+	}
+	return nil
+}
+
+func (t *Track) readSTTS(b []byte) error {
+	// version(1) flags(3) entries(4) [count(4) delta(4)]...
+	if len(b) < 8 {
+		return ErrInvalidAtom
+	}
+	n := int(binary.BigEndian.Uint32(b[4:8]))
+	if len(b) < 8+8*n {
+		return ErrInvalidAtom
+	}
+	for i := 0; i < n; i++ {
+		e := b[8+8*i:]
+		count := uint64(binary.BigEndian.Uint32(e[0:4]))
+		delta := uint64(binary.BigEndian.Uint32(e[4:8]))
+		t.SampleDuration += count * delta
+	}
+	return nil
+}
+
+func (t *Track) readSTSZ(b []byte) error {
+	// version(1) flags(3) size(4) entries(4) [size(4)]...
+	if len(b) < 12 {
+		return ErrInvalidAtom
+	}
+	size := int64(binary.BigEndian.Uint32(b[4:8]))
+	n := int(binary.BigEndian.Uint32(b[8:12]))
+	if size != 0 {
+		t.SampleBytes = size * int64(n)
+		return nil
+	}
+	if len(b) < 12+4*n {
+		return ErrInvalidAtom
+	}
+	for i := 0; i < n; i++ {
+		t.SampleBytes += int64(binary.BigEndian.Uint32(b[12+4*i:]))
+	}
+	return nil
+}
+
+func (t *Track) readSTSD(b []byte) error {
+	// version(1) flags(3) entries(4), followed by the first sample description:
+	// size(4) format(4) reserved(6) index(2) version(2) revision(2) vendor(4)
+	// channels(2) samplesize(2) compression(2) packet(2) samplerate(4, 16.16)
+	if len(b) < 8+36 {
+		return ErrInvalidAtom
+	}
+	e := b[8:]
+	t.Format = string(e[4:8])
+	t.Channels = int(binary.BigEndian.Uint16(e[24:26]))
+	t.SampleSize = int(binary.BigEndian.Uint16(e[26:28]))
+	t.SampleRate = int(binary.BigEndian.Uint32(e[32:36]) >> 16)
+	return nil
+}
+
+// }}}
+
+// Metadata {{{
+
+var _ = audio.Metadata(new(Metadata))
+
+type Metadata struct {
+	// Metadata is an interface that already implements:
+	//
+	//  Format() tag.Format
+	//  FileType() tag.FileType
+	//
+	//  Title() string
+	//  Album() string
+	//  Artist() string
+	//  AlbumArtist() string
+	//  Composer() string
+	//  Year() int
+	//  Genre() string
+	//  Track() (int, int)
+	//  Disc() (int, int)
+	//  Comment() string
+	//
+	//  Picture() *tag.Picture
+	//  Lyrics() string
+	//  Raw() map[string]interface{}
+	tag.Metadata
+
+	codec   audio.Codec
+	length  time.Duration
+	bitrate int
+	track   *Track
+}
+
+func (m *Metadata) Length() time.Duration    { return m.length }
+func (m *Metadata) Website() string          { return "" }
+func (m *Metadata) Copyright() string        { return m.rawString("cprt") }
+func (m *Metadata) Encoding() audio.Codec    { return m.codec }
+func (m *Metadata) EncodedBy() string        { return "" }
+func (m *Metadata) EncodingBitrate() int     { return m.bitrate }
+func (m *Metadata) EncoderSettings() string  { return m.rawString("\xa9too") }
+func (m *Metadata) OriginalFilename() string { return "" }
+
+// AudioTrack returns the information read from the audio track.
+func (m *Metadata) AudioTrack() *Track { return m.track }
+
+func (m *Metadata) SampleRate() int { return m.track.SampleRate }
+func (m *Metadata) Channels() int   { return m.track.Channels }
+
+// BitDepth returns the bits per sample for ALAC. For AAC, the sample
+// size in the sample description is meaningless, so it returns 0.
+func (m *Metadata) BitDepth() int {
+	if m.codec != audio.ALAC {
+		return 0
+	}
+	return m.track.SampleSize
+}
+
+func (m *Metadata) rawString(key string) string {
+	if v, ok := m.Raw()[key]; ok {
+		s, _ := v.(string)
+		return s
+	}
+	return ""
+}
+
+// }}}
@@ -0,0 +1,167 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goulash/audio"
+)
+
+// box returns an atom with the name and the content of the children.
+func box(name string, children ...[]byte) []byte {
+	var b bytes.Buffer
+	for _, c := range children {
+		b.Write(c)
+	}
+	h := make([]byte, 8)
+	binary.BigEndian.PutUint32(h, uint32(8+b.Len()))
+	copy(h[4:], name)
+	return append(h, b.Bytes()...)
+}
+
+func u32(xs ...uint32) []byte {
+	b := make([]byte, 4*len(xs))
+	for i, x := range xs {
+		binary.BigEndian.PutUint32(b[4*i:], x)
+	}
+	return b
+}
+
+// testTrack returns a trak atom with the handler, the sample format, and
+// samples of a second each at 44.1 kHz, whose sizes are sizes.
+func testTrack(handler, format string, sizes ...uint32) []byte {
+	mdhd := append(u32(0, 0, 0, 44100), u32(90000)...) // padded duration
+	hdlr := append(u32(0, 0), handler...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	entry := append(u32(0), format...)
+	entry = append(entry, 0, 0, 0, 0, 0, 0, 0, 1)  // reserved, index
+	entry = append(entry, make([]byte, 8)...)      // version, revision, vendor
+	entry = append(entry, 0, 2, 0, 16, 0, 0, 0, 0) // channels, sample size, compression, packet
+	entry = append(entry, u32(44100<<16)...)
+	binary.BigEndian.PutUint32(entry, uint32(len(entry)))
+	stsd := append(u32(0, 1), entry...)
+	stts := u32(0, 1, uint32(len(sizes)), 44100)
+	stsz := append(u32(0, 0, uint32(len(sizes))), u32(sizes...)...)
+
+	return box("trak",
+		box("mdia",
+			box("mdhd", mdhd),
+			box("hdlr", hdlr),
+			box("minf",
+				box("stbl",
+					box("stsd", stsd),
+					box("stts", stts),
+					box("stsz", stsz)))))
+}
+
+// textItem returns an ilst item of UTF-8 text.
+func textItem(name, value string) []byte {
+	return box(name, box("data", u32(1, 0), []byte(value)))
+}
+
+func writeFile(t *testing.T, data ...[]byte) string {
+	dir, err := ioutil.TempDir("", "mp4-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "test.m4a")
+	if err := ioutil.WriteFile(file, bytes.Join(data, nil), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadMetadata(t *testing.T) {
+	udta := box("udta",
+		box("meta", u32(0),
+			box("ilst",
+				textItem("\xa9nam", "Song"),
+				textItem("\xa9ART", "Band"))))
+	file := writeFile(t,
+		box("ftyp", []byte("M4A "), u32(0)),
+		box("moov", testTrack("vide", "avc1", 9), testTrack("soun", "mp4a", 1000, 1500), udta),
+		box("mdat", make([]byte, 2509)))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	m, err := ReadMetadata(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := m.AudioTrack()
+	if tr.Format != "mp4a" || tr.Channels != 2 || tr.SampleSize != 16 || tr.SampleRate != 44100 {
+		t.Errorf("audio track is %+v, want the second track", tr)
+	}
+	// The duration of the samples wins over the padded duration.
+	if m.Length() != 2*time.Second {
+		t.Errorf("length is %s, want 2s", m.Length())
+	}
+	if m.EncodingBitrate() != 10 {
+		t.Errorf("bitrate is %d, want 10 from the sample sizes", m.EncodingBitrate())
+	}
+	if m.Title() != "Song" || m.Artist() != "Band" {
+		t.Errorf("title and artist are %q and %q, want %q and %q", m.Title(), m.Artist(), "Song", "Band")
+	}
+}
+
+func TestReadMetadataInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data [][]byte
+		err  error
+	}{
+		{"no ftyp", [][]byte{box("moov"), box("ftyp", []byte("M4A "), u32(0))}, ErrNotMP4},
+		{"no audio", [][]byte{box("ftyp", []byte("mp42"), u32(0)), box("moov", testTrack("vide", "avc1", 9))}, ErrNoAudioTrack},
+		{"truncated", [][]byte{box("ftyp", []byte("M4A "), u32(0)), box("moov", testTrack("soun", "mp4a", 9))[:40]}, ErrInvalidAtom},
+	}
+	for _, tt := range tests {
+		file := writeFile(t, tt.data...)
+		_, err := ReadMetadata(file)
+		os.RemoveAll(filepath.Dir(file))
+		if err != tt.err {
+			t.Errorf("%s: error is %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	tests := []struct {
+		format string
+		want   audio.Codec
+	}{
+		{"alac", audio.ALAC},
+		{"mp4a", audio.AAC},
+		{"samr", audio.M4A},
+	}
+	for _, tt := range tests {
+		file := writeFile(t,
+			box("ftyp", []byte("isom"), u32(0)),
+			box("moov", testTrack("soun", tt.format, 100)))
+		c, err := Identify(file)
+		if err != nil {
+			t.Errorf("%s: %s", tt.format, err)
+		} else if c != tt.want {
+			t.Errorf("%s: codec is %s, want %s", tt.format, c, tt.want)
+		}
+		m, err := ReadMetadata(file)
+		if err == nil && m.Encoding() != tt.want {
+			t.Errorf("%s: codec of metadata is %s, want %s", tt.format, m.Encoding(), tt.want)
+		}
+		os.RemoveAll(filepath.Dir(file))
+	}
+
+	file := writeFile(t, box("ftyp", []byte("isom"), u32(0)), box("moov"))
+	defer os.RemoveAll(filepath.Dir(file))
+	if _, err := Identify(file); err != ErrNoAudioTrack {
+		t.Errorf("no track: error is %v, want %v", err, ErrNoAudioTrack)
+	}
+}
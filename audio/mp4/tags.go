@@ -0,0 +1,567 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cassava/lackey/audio/tags"
+)
+
+var ErrNoMovie = errors.New("MPEG-4 file has no moov atom")
+
+// Types of the data in a data atom.
+const (
+	dataImplicit = 0
+	dataUTF8     = 1
+	dataJPEG     = 13
+	dataPNG      = 14
+	dataInt      = 21
+)
+
+// freeform is the mean of the freeform atoms of iTunes.
+const freeform = "com.apple.iTunes"
+
+// rawAtom is an atom whose content has been read into memory.
+type rawAtom struct {
+	Name string
+	Data []byte
+}
+
+// parseAtoms parses the atoms that make up b.
+func parseAtoms(b []byte) ([]*rawAtom, error) {
+	var as []*rawAtom
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, ErrInvalidAtom
+		}
+		size, hdr := uint64(binary.BigEndian.Uint32(b)), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return nil, ErrInvalidAtom
+			}
+			size, hdr = binary.BigEndian.Uint64(b[8:16]), 16
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return nil, ErrInvalidAtom
+		}
+		as = append(as, &rawAtom{Name: string(b[4:8]), Data: b[hdr:size]})
+		b = b[size:]
+	}
+	return as, nil
+}
+
+func encodeAtom(name string, content ...[]byte) []byte {
+	n := 8
+	for _, c := range content {
+		n += len(c)
+	}
+	b := make([]byte, 8, n)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	copy(b[4:], name)
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func encodeAtoms(as []*rawAtom) []byte {
+	var b []byte
+	for _, a := range as {
+		b = append(b, encodeAtom(a.Name, a.Data)...)
+	}
+	return b
+}
+
+func findAtom(as []*rawAtom, name string) *rawAtom {
+	for _, a := range as {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// readMovie returns the start and end of the moov atom, and its content.
+func readMovie(f *os.File) (start, end int64, moov []byte, last bool, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, nil, false, err
+	}
+	var (
+		offset int64
+		found  bool
+	)
+	err = walkAtoms(f, 0, fi.Size(), func(a *atom) error {
+		if a.Name == "moov" && !found {
+			start, end, found = offset, a.Offset+a.Size, true
+			moov, err = readAtomData(f, a)
+			if err != nil {
+				return err
+			}
+		}
+		offset = a.Offset + a.Size
+		return nil
+	})
+	if err != nil {
+		return 0, 0, nil, false, err
+	}
+	if !found {
+		return 0, 0, nil, false, ErrNoMovie
+	}
+	return start, end, moov, end == fi.Size(), nil
+}
+
+// ilst returns the items of the ilst atom in moov/udta/meta.
+func ilst(moov []byte) ([]*rawAtom, error) {
+	as, err := parseAtoms(moov)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range []string{"udta", "meta", "ilst"} {
+		a := findAtom(as, path)
+		if a == nil {
+			return nil, nil
+		}
+		data := a.Data
+		if path == "meta" {
+			// The meta atom is a full atom with a version and flags.
+			if len(data) < 4 {
+				return nil, ErrInvalidAtom
+			}
+			data = data[4:]
+		}
+		if as, err = parseAtoms(data); err != nil {
+			return nil, err
+		}
+	}
+	return as, nil
+}
+
+// item returns the key of an ilst item, which for freeform items is of the
+// form ----:mean:name, and the data atoms of the item.
+func item(a *rawAtom) (string, [][]byte) {
+	children, err := parseAtoms(a.Data)
+	if err != nil {
+		return "", nil
+	}
+	key := a.Name
+	var data [][]byte
+	for _, c := range children {
+		if len(c.Data) < 4 {
+			continue
+		}
+		switch c.Name {
+		case "mean":
+			key = "----:" + string(c.Data[4:])
+		case "name":
+			key += ":" + string(c.Data[4:])
+		case "data":
+			if len(c.Data) >= 8 {
+				data = append(data, c.Data)
+			}
+		}
+	}
+	return key, data
+}
+
+// fieldOf returns the canonical name of the field in the item with key,
+// or "" if it holds none.
+func fieldOf(key string) string {
+	if f := tags.ByMP4(key); f != nil {
+		return f.Name
+	}
+	if strings.HasPrefix(key, "----:"+freeform+":") {
+		return strings.ToUpper(key[len(freeform)+6:])
+	}
+	return ""
+}
+
+// ReadTags reads the iTunes tags of an MPEG-4 file, including freeform
+// tags, with the canonical names of tags.Fields.
+func ReadTags(file string) (tags.Tags, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, _, moov, _, err := readMovie(f)
+	if err != nil {
+		return nil, err
+	}
+	items, err := ilst(moov)
+	if err != nil {
+		return nil, err
+	}
+
+	t := make(tags.Tags)
+	for _, a := range items {
+		key, data := item(a)
+		name := fieldOf(key)
+		if name == "" {
+			continue
+		}
+		for _, d := range data {
+			typ, v := binary.BigEndian.Uint32(d)&0xFFFFFF, d[8:]
+			switch {
+			case (key == "trkn" || key == "disk") && len(v) >= 6:
+				total := map[string]string{"trkn": "TRACKTOTAL", "disk": "DISCTOTAL"}[key]
+				if n := binary.BigEndian.Uint16(v[2:4]); n != 0 {
+					t.Add(name, strconv.Itoa(int(n)))
+				}
+				if n := binary.BigEndian.Uint16(v[4:6]); n != 0 {
+					t.Add(total, strconv.Itoa(int(n)))
+				}
+			case typ == dataUTF8:
+				t.Add(name, string(v))
+			case typ == dataInt && len(v) <= 8:
+				var x int64
+				for _, c := range v {
+					x = x<<8 | int64(c)
+				}
+				t.Add(name, strconv.FormatInt(x, 10))
+			}
+		}
+	}
+	return t, nil
+}
+
+// encodeItems returns the ilst items for the fields of t.
+func encodeItems(t tags.Tags) []*rawAtom {
+	data := func(typ uint32, v []byte) []byte {
+		h := make([]byte, 8)
+		binary.BigEndian.PutUint32(h, typ)
+		return encodeAtom("data", h, v)
+	}
+	number := func(n, total string) []byte {
+		v := make([]byte, 8)
+		a, _ := strconv.Atoi(n)
+		b, _ := strconv.Atoi(total)
+		binary.BigEndian.PutUint16(v[2:4], uint16(a))
+		binary.BigEndian.PutUint16(v[4:6], uint16(b))
+		return v
+	}
+
+	var items []*rawAtom
+	for _, k := range t.Keys() {
+		if tags.FileFields[k] || k == "TRACKTOTAL" || k == "DISCTOTAL" {
+			continue
+		}
+		key := "----:" + freeform + ":" + k
+		if f := tags.ByName(k); f != nil && f.MP4 != "" {
+			key = f.MP4
+		}
+
+		var content [][]byte
+		switch key {
+		case "trkn":
+			content = append(content, data(dataImplicit, number(t.Get(k), t.Get("TRACKTOTAL"))))
+		case "disk":
+			content = append(content, data(dataImplicit, number(t.Get(k), t.Get("DISCTOTAL"))[:6]))
+		case "tmpo", "cpil":
+			x, err := strconv.Atoi(t.Get(k))
+			if err != nil {
+				continue
+			}
+			v := []byte{byte(x >> 8), byte(x)}
+			if key == "cpil" {
+				v = v[1:]
+			}
+			content = append(content, data(dataInt, v))
+		default:
+			for _, v := range t[k] {
+				content = append(content, data(dataUTF8, []byte(v)))
+			}
+		}
+
+		name := key
+		if strings.HasPrefix(key, "----:") {
+			parts := strings.SplitN(key, ":", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			zero := []byte{0, 0, 0, 0}
+			content = append([][]byte{
+				encodeAtom("mean", zero, []byte(parts[1])),
+				encodeAtom("name", zero, []byte(parts[2])),
+			}, content...)
+			name = "----"
+		} else if len(key) != 4 {
+			continue
+		}
+		items = append(items, &rawAtom{Name: name, Data: bytes.Join(content, nil)})
+	}
+	return items
+}
+
+// defaultHandler is the content of the hdlr atom of iTunes metadata.
+var defaultHandler = []byte("\x00\x00\x00\x00\x00\x00\x00\x00mdirappl\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+
+// WriteTags replaces the tags of an MPEG-4 file with t. Items that hold no
+// field, such as the cover, and those of tags.FileFields are kept.
+func WriteTags(file string, t tags.Tags) error {
+	return writeItems(file, func(old []*rawAtom) []*rawAtom {
+		var items []*rawAtom
+		for _, a := range old {
+			key, _ := item(a)
+			if name := fieldOf(key); name == "" || tags.FileFields[name] {
+				items = append(items, a)
+			}
+		}
+		return append(items, encodeItems(t)...)
+	})
+}
+
+// ReadPictures reads the covers of an MPEG-4 file, which are in the data
+// atoms of the covr item.
+func ReadPictures(file string) ([]*tags.Picture, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, _, moov, _, err := readMovie(f)
+	if err != nil {
+		return nil, err
+	}
+	items, err := ilst(moov)
+	if err != nil {
+		return nil, err
+	}
+
+	var pics []*tags.Picture
+	for _, a := range items {
+		if key, data := item(a); key == "covr" {
+			for _, d := range data {
+				p := &tags.Picture{Type: tags.FrontCover, Data: d[8:]}
+				switch binary.BigEndian.Uint32(d) & 0xFFFFFF {
+				case dataJPEG:
+					p.MIMEType = "image/jpeg"
+				case dataPNG:
+					p.MIMEType = "image/png"
+				}
+				pics = append(pics, p)
+			}
+		}
+	}
+	return pics, nil
+}
+
+// WritePictures replaces the covers of an MPEG-4 file with pics, which
+// must be JPEG or PNG images; other pictures are not written.
+func WritePictures(file string, pics []*tags.Picture) error {
+	var content [][]byte
+	for _, p := range pics {
+		h := make([]byte, 8)
+		switch p.MIMEType {
+		case "image/jpeg", "image/jpg":
+			binary.BigEndian.PutUint32(h, dataJPEG)
+		case "image/png":
+			binary.BigEndian.PutUint32(h, dataPNG)
+		default:
+			continue
+		}
+		content = append(content, encodeAtom("data", h, p.Data))
+	}
+	return writeItems(file, func(old []*rawAtom) []*rawAtom {
+		var items []*rawAtom
+		for _, a := range old {
+			if a.Name != "covr" {
+				items = append(items, a)
+			}
+		}
+		if len(content) != 0 {
+			items = append(items, &rawAtom{Name: "covr", Data: bytes.Join(content, nil)})
+		}
+		return items
+	})
+}
+
+// writeItems replaces the ilst items of the file with those that edit
+// returns for the old items. If the moov atom is at the end of the file,
+// only it is rewritten; otherwise the whole file is, and the chunk offsets
+// of all tracks are moved.
+func writeItems(file string, edit func(old []*rawAtom) []*rawAtom) error {
+	return writeMovie(file, func(moov []byte) ([]byte, error) {
+		old, err := ilst(moov)
+		if err != nil {
+			return nil, err
+		}
+		return replaceItems(moov, edit(old))
+	})
+}
+
+// writeMovie replaces the content of the moov atom of the file with what
+// edit returns for it, as writeItems describes.
+func writeMovie(file string, edit func(moov []byte) ([]byte, error)) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start, end, moov, last, err := readMovie(f)
+	if err != nil {
+		return err
+	}
+	children, err := edit(moov)
+	if err != nil {
+		return err
+	}
+	delta := int64(8+len(children)) - (end - start)
+	if !last && delta != 0 {
+		if err := moveChunks(children, start, delta); err != nil {
+			return err
+		}
+	}
+	newMoov := encodeAtom("moov", children)
+
+	if last {
+		if _, err := f.WriteAt(newMoov, start); err != nil {
+			return err
+		}
+		return f.Truncate(start + int64(len(newMoov)))
+	}
+	return rewrite(f, file, start, newMoov, end)
+}
+
+// replaceItems returns the content of moov with the items in its ilst,
+// creating udta, meta, and ilst if necessary.
+func replaceItems(moov []byte, items []*rawAtom) ([]byte, error) {
+	as, err := parseAtoms(moov)
+	if err != nil {
+		return nil, err
+	}
+	udta := findAtom(as, "udta")
+	if udta == nil {
+		udta = &rawAtom{Name: "udta"}
+		as = append(as, udta)
+	}
+	us, err := parseAtoms(udta.Data)
+	if err != nil {
+		return nil, err
+	}
+	meta := findAtom(us, "meta")
+	if meta == nil {
+		meta = &rawAtom{Name: "meta", Data: make([]byte, 4)}
+		us = append(us, meta)
+	}
+	if len(meta.Data) < 4 {
+		return nil, ErrInvalidAtom
+	}
+	ms, err := parseAtoms(meta.Data[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	var children []*rawAtom
+	if findAtom(ms, "hdlr") == nil {
+		children = append(children, &rawAtom{Name: "hdlr", Data: defaultHandler})
+	}
+	for _, a := range ms {
+		// The free space that iTunes leaves after ilst is dropped.
+		if a.Name != "ilst" && a.Name != "free" {
+			children = append(children, a)
+		}
+	}
+	children = append(children, &rawAtom{Name: "ilst", Data: encodeAtoms(items)})
+	meta.Data = append(append([]byte(nil), meta.Data[:4]...), encodeAtoms(children)...)
+	udta.Data = encodeAtoms(us)
+	return encodeAtoms(as), nil
+}
+
+// moveChunks adds delta to the chunk offsets in the stco and co64 atoms
+// of all tracks in the content of moov, that point after it.
+func moveChunks(moov []byte, start, delta int64) error {
+	as, err := parseAtoms(moov)
+	if err != nil {
+		return err
+	}
+	for _, a := range as {
+		switch a.Name {
+		case "trak", "mdia", "minf", "stbl":
+			if err := moveChunks(a.Data, start, delta); err != nil {
+				return err
+			}
+		case "stco", "co64":
+			if len(a.Data) < 8 {
+				return ErrInvalidAtom
+			}
+			n, size := int(binary.BigEndian.Uint32(a.Data[4:8])), 4
+			if a.Name == "co64" {
+				size = 8
+			}
+			if len(a.Data) < 8+n*size {
+				return ErrInvalidAtom
+			}
+			for i := 0; i < n; i++ {
+				b := a.Data[8+i*size:]
+				if size == 4 {
+					x := int64(binary.BigEndian.Uint32(b))
+					if x > start {
+						x += delta
+					}
+					if x < 0 || x > 0xFFFFFFFF {
+						return errors.New("chunk offset out of range of stco atom")
+					}
+					binary.BigEndian.PutUint32(b, uint32(x))
+				} else {
+					x := int64(binary.BigEndian.Uint64(b))
+					if x > start {
+						x += delta
+					}
+					binary.BigEndian.PutUint64(b, uint64(x))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// rewrite writes a new file next to file with the bytes of f before start,
+// then moov, and then the bytes of f from end, which replaces file.
+func rewrite(f *os.File, file string, start int64, moov []byte, end int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".mp4tag-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	_, err = io.Copy(w, io.NewSectionReader(f, 0, start))
+	if err == nil {
+		_, err = w.Write(moov)
+	}
+	if err == nil {
+		_, err = io.Copy(w, io.NewSectionReader(f, end, fi.Size()-end))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(fi.Mode())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
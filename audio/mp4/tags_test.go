@@ -0,0 +1,271 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cassava/lackey/audio/tags"
+)
+
+// insert returns the atoms of data with child appended to the content of
+// the atom at path.
+func insert(data []byte, path []string, child []byte) []byte {
+	as, _ := parseAtoms(data)
+	var b []byte
+	for _, a := range as {
+		content := a.Data
+		if len(path) > 0 && a.Name == path[0] {
+			if len(path) == 1 {
+				content = append(content[:len(content):len(content)], child...)
+			} else {
+				content = insert(content, path[1:], child)
+			}
+		}
+		b = append(b, box(a.Name, content)...)
+	}
+	return b
+}
+
+// chunkTrack returns an audio track with one chunk at offset.
+func chunkTrack(offset uint32) []byte {
+	stco := box("stco", u32(0, 1, offset))
+	return insert(testTrack("soun", "mp4a", 1000), []string{"trak", "mdia", "minf", "stbl"}, stco)
+}
+
+func testItems() []byte {
+	return box("udta",
+		box("meta", u32(0),
+			box("hdlr", defaultHandler),
+			box("ilst",
+				textItem("\xa9nam", "Old"),
+				textItem("\xa9too", "iTunes 12"),
+				box("covr", box("data", u32(13, 0), []byte("\xff\xd8\xff")))),
+			box("free", make([]byte, 16))))
+}
+
+// chunkOffset returns the offset of the first chunk of the first track.
+func chunkOffset(t *testing.T, file string) int64 {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, _, moov, _, err := readMovie(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, _ := parseAtoms(moov)
+	for _, name := range []string{"trak", "mdia", "minf", "stbl", "stco"} {
+		a := findAtom(as, name)
+		if a == nil {
+			t.Fatalf("no %s atom", name)
+		}
+		if name == "stco" {
+			return int64(binary.BigEndian.Uint32(a.Data[8:]))
+		}
+		as, _ = parseAtoms(a.Data)
+	}
+	return 0
+}
+
+func TestWriteTags(t *testing.T) {
+	tests := []struct {
+		name  string
+		first bool
+	}{
+		{"moov last", false},
+		{"moov first", true},
+	}
+	payload := []byte("0123456789abcdef")
+	ftyp := box("ftyp", []byte("M4A "), u32(0))
+	mdat := box("mdat", payload)
+	for _, tt := range tests {
+		var data [][]byte
+		if tt.first {
+			moov := box("moov", chunkTrack(0), testItems())
+			offset := uint32(len(ftyp) + len(moov) + 8)
+			data = [][]byte{ftyp, box("moov", chunkTrack(offset), testItems()), mdat}
+		} else {
+			data = [][]byte{ftyp, mdat, box("moov", chunkTrack(uint32(len(ftyp)+8)), testItems())}
+		}
+		file := writeFile(t, data...)
+		defer os.RemoveAll(filepath.Dir(file))
+
+		in := tags.Tags{
+			"TITLE":                 {"Song"},
+			"ARTIST":                {"A", "B"},
+			"TRACKNUMBER":           {"3"},
+			"TRACKTOTAL":            {"12"},
+			"DISCNUMBER":            {"1"},
+			"BPM":                   {"120"},
+			"COMPILATION":           {"1"},
+			"REPLAYGAIN_TRACK_GAIN": {"-3.20 dB"},
+			"ENCODER":               {"lackey"},
+		}
+		if err := WriteTags(file, in); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		got, err := ReadTags(file)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		// The encoder of the file is kept, and not replaced.
+		want := tags.Tags{
+			"TITLE":                 {"Song"},
+			"ARTIST":                {"A", "B"},
+			"TRACKNUMBER":           {"3"},
+			"TRACKTOTAL":            {"12"},
+			"DISCNUMBER":            {"1"},
+			"BPM":                   {"120"},
+			"COMPILATION":           {"1"},
+			"REPLAYGAIN_TRACK_GAIN": {"-3.20 dB"},
+			"ENCODER":               {"iTunes 12"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: tags are %v, want %v", tt.name, got, want)
+		}
+
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := chunkOffset(t, file)
+		if offset+int64(len(payload)) > int64(len(b)) || !bytes.Equal(b[offset:offset+int64(len(payload))], payload) {
+			t.Errorf("%s: chunk offset %d does not point to the audio", tt.name, offset)
+		}
+		if !bytes.Contains(b, []byte("covr")) {
+			t.Errorf("%s: cover is not kept", tt.name)
+		}
+		if bytes.Contains(b, []byte("free")) {
+			t.Errorf("%s: free atom in meta is kept", tt.name)
+		}
+
+		m, err := ReadMetadata(file)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if m.Title() != "Song" {
+			t.Errorf("%s: title is %q, want %q", tt.name, m.Title(), "Song")
+		}
+	}
+}
+
+func TestWriteTagsNew(t *testing.T) {
+	// A file without udta gets one with a handler.
+	file := writeFile(t, box("ftyp", []byte("M4A "), u32(0)), box("moov", testTrack("soun", "alac", 10)))
+	defer os.RemoveAll(filepath.Dir(file))
+	if got, err := ReadTags(file); err != nil || len(got) != 0 {
+		t.Errorf("tags are %v with error %v, want none", got, err)
+	}
+	want := tags.Tags{"ALBUM": {"Record"}, "DISCNUMBER": {"2"}, "DISCTOTAL": {"3"}}
+	if err := WriteTags(file, want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadTags(file); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("tags are %v, want %v", got, want)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("mdirappl")) {
+		t.Error("meta atom has no handler")
+	}
+
+	other := writeFile(t, box("ftyp", []byte("M4A "), u32(0)), box("mdat"))
+	defer os.RemoveAll(filepath.Dir(other))
+	if err := WriteTags(other, want); err != ErrNoMovie {
+		t.Errorf("no moov: error is %v, want %v", err, ErrNoMovie)
+	}
+}
+
+func TestWritePictures(t *testing.T) {
+	file := writeFile(t, box("ftyp", []byte("M4A "), u32(0)), box("moov", testTrack("soun", "mp4a", 10), testItems()))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	jpeg := &tags.Picture{MIMEType: "image/jpeg", Type: tags.FrontCover, Data: []byte{0xff, 0xd8}}
+	png := &tags.Picture{MIMEType: "image/png", Type: tags.FrontCover, Data: []byte("\x89PNG")}
+	gif := &tags.Picture{MIMEType: "image/gif", Type: tags.FrontCover, Data: []byte("GIF89a")}
+	if err := WritePictures(file, []*tags.Picture{jpeg, gif, png}); err != nil {
+		t.Fatal(err)
+	}
+	covers := func() [][]byte {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		_, _, moov, _, err := readMovie(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items, err := ilst(moov)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data [][]byte
+		for _, a := range items {
+			if a.Name == "covr" {
+				_, d := item(a)
+				data = append(data, d...)
+			}
+		}
+		return data
+	}
+	want := [][]byte{
+		append(u32(dataJPEG, 0), jpeg.Data...),
+		append(u32(dataPNG, 0), png.Data...),
+	}
+	if got := covers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("covers are %q, want %q", got, want)
+	}
+	if tt, err := ReadTags(file); err != nil || tt.Get("TITLE") != "Old" {
+		t.Errorf("tags are %v with error %v, want them kept", tt, err)
+	}
+
+	if err := WritePictures(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := covers(); len(got) != 0 {
+		t.Errorf("covers are %q, want none", got)
+	}
+}
+
+func TestReadPictures(t *testing.T) {
+	file := writeFile(t, box("ftyp", []byte("M4A "), u32(0)), box("moov", testTrack("soun", "mp4a", 10), testItems()))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	pics, err := ReadPictures(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &tags.Picture{MIMEType: "image/jpeg", Type: tags.FrontCover, Data: []byte("\xff\xd8\xff")}
+	if !reflect.DeepEqual(pics, []*tags.Picture{want}) {
+		t.Errorf("pictures are %+v, want %+v", pics, want)
+	}
+
+	jpeg := &tags.Picture{MIMEType: "image/jpeg", Type: tags.FrontCover, Data: []byte{0xff, 0xd8}}
+	png := &tags.Picture{MIMEType: "image/png", Type: tags.FrontCover, Data: []byte("\x89PNG")}
+	if err := WritePictures(file, []*tags.Picture{jpeg, png}); err != nil {
+		t.Fatal(err)
+	}
+	if pics, err := ReadPictures(file); err != nil || !reflect.DeepEqual(pics, []*tags.Picture{jpeg, png}) {
+		t.Errorf("pictures are %v with error %v, want %v", pics, err, []*tags.Picture{jpeg, png})
+	}
+	if err := WritePictures(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	if pics, err := ReadPictures(file); err != nil || len(pics) != 0 {
+		t.Errorf("pictures are %v with error %v, want none", pics, err)
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package ogg reads metadata from Ogg Vorbis and Ogg Opus files, and
+// writes their comments.
+//
+// Reference
+//
+//  https://xiph.org/ogg/doc/framing.html
+//  https://xiph.org/vorbis/doc/Vorbis_I_spec.html
+//  https://datatracker.ietf.org/doc/html/rfc7845
+package ogg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cassava/lackey/audio/bitrate"
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/dhowden/tag"
+	"github.com/goulash/audio"
+	"github.com/goulash/stat"
+)
+
+var (
+	ErrNotOgg       = errors.New("file is not an Ogg stream")
+	ErrInvalidPage  = errors.New("invalid Ogg page")
+	ErrUnknownCodec = errors.New("Ogg stream contains neither Vorbis nor Opus")
+)
+
+var Stats struct {
+	ReadMetadata stat.Run
+}
+
+func init() {
+	reader := func(file string) (audio.Metadata, error) {
+		return ReadMetadata(file)
+	}
+	audio.MetadataReaders[audio.OGG] = reader
+	audio.MetadataReaders[codec.Opus] = reader
+}
+
+// ReadMetadata {{{
+
+// ReadMetadata reads the tags, the exact duration, and the average bitrate
+// of an Ogg Vorbis or Ogg Opus file.
+//
+// The duration is taken from the granule position of the last page, and the
+// bitrate is calculated from the size of the audio pages, so that large
+// embedded pictures in the comment header do not distort it.
+func ReadMetadata(file string) (*Metadata, error) {
+	start := time.Now()
+	defer func() { Stats.ReadMetadata.Add(float64(time.Since(start))) }()
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	pr := newPacketReader(f)
+	id, err := pr.Next()
+	if err != nil {
+		if err == ErrInvalidPage {
+			return nil, ErrNotOgg
+		}
+		return nil, err
+	}
+
+	m := &Metadata{}
+	var nheaders int
+	var comment []byte
+	switch {
+	case bytes.HasPrefix(id, []byte("\x01vorbis")):
+		// Vorbis has three header packets: identification, comment, and setup.
+		if len(id) < 30 {
+			return nil, ErrInvalidPage
+		}
+		m.codec = audio.OGG
+		m.channels = int(id[11])
+		m.sampleRate = int(binary.LittleEndian.Uint32(id[12:16]))
+		nheaders = 3
+	case bytes.HasPrefix(id, []byte("OpusHead")):
+		// Opus has two header packets: identification and comment.
+		// The granule position always runs at 48 kHz, regardless of
+		// the input sample rate recorded in the header.
+		if len(id) < 19 {
+			return nil, ErrInvalidPage
+		}
+		m.codec = codec.Opus
+		m.channels = int(id[9])
+		m.preSkip = int64(binary.LittleEndian.Uint16(id[10:12]))
+		m.sampleRate = int(binary.LittleEndian.Uint32(id[12:16]))
+		nheaders = 2
+	default:
+		return nil, ErrUnknownCodec
+	}
+
+	for i := 1; i < nheaders; i++ {
+		p, err := pr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if i == 1 {
+			comment = p
+		}
+	}
+	audioStart := pr.Offset()
+
+	switch m.codec {
+	case audio.OGG:
+		if !bytes.HasPrefix(comment, []byte("\x03vorbis")) {
+			return nil, ErrInvalidPage
+		}
+		comment = comment[7:]
+	case codec.Opus:
+		if !bytes.HasPrefix(comment, []byte("OpusTags")) {
+			return nil, ErrInvalidPage
+		}
+		comment = comment[8:]
+	}
+	m.Metadata, err = readVorbisComment(comment)
+	if err != nil {
+		return nil, err
+	}
+
+	granule, err := lastGranule(f, fi.Size(), pr.Serial())
+	if err != nil {
+		return nil, err
+	}
+	if m.codec == codec.Opus {
+		m.samples = granule - m.preSkip
+		m.length = time.Duration(m.samples) * time.Second / 48000
+	} else if m.sampleRate != 0 {
+		m.samples = granule
+		m.length = time.Duration(m.samples) * time.Second / time.Duration(m.sampleRate)
+	}
+	m.bitrate = bitrate.Average(fi.Size()-audioStart, m.length)
+	return m, nil
+}
+
+// readVorbisComment reads the comment header that Vorbis and Opus share.
+//
+// The tag package only exposes its Vorbis comment parser through its FLAC
+// reader, so we wrap the comment into a minimal FLAC stream consisting of
+// a single VORBIS_COMMENT metadata block.
+func readVorbisComment(b []byte) (tag.Metadata, error) {
+	if len(b) >= 1<<24 {
+		return nil, ErrInvalidPage
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(b)+8))
+	buf.WriteString("fLaC")
+	buf.Write([]byte{0x80 | 4, byte(len(b) >> 16), byte(len(b) >> 8), byte(len(b))})
+	buf.Write(b)
+	return tag.ReadFLACTags(bytes.NewReader(buf.Bytes()))
+}
+
+// lastGranule returns the granule position of the last page in the
+// logical stream serial that has one.
+func lastGranule(f io.ReaderAt, size int64, serial uint32) (int64, error) {
+	// Pages are at most 65307 bytes, so we read the file backwards in
+	// chunks that are slightly larger than that.
+	const chunk = 1 << 16
+	end := size
+	for end > 0 {
+		start := end - chunk - maxHeaderSize
+		if start < 0 {
+			start = 0
+		}
+		buf := make([]byte, end-start)
+		if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := len(buf) - headerSize; i >= 0; i-- {
+			if buf[i] != 'O' || string(buf[i:i+4]) != "OggS" {
+				continue
+			}
+			h := buf[i : i+headerSize]
+			granule := int64(binary.LittleEndian.Uint64(h[6:14]))
+			if binary.LittleEndian.Uint32(h[14:18]) == serial && granule != -1 {
+				return granule, nil
+			}
+		}
+		end = start + maxHeaderSize
+		if start == 0 {
+			break
+		}
+	}
+	return 0, ErrInvalidPage
+}
+
+// }}}
+
+// Pages and Packets {{{
+
+const (
+	headerSize    = 27
+	maxHeaderSize = headerSize + 255
+)
+
+// page is an Ogg page, without the capture pattern and checksum.
+type page struct {
+	HeaderType byte
+	Granule    int64
+	Serial     uint32
+	Sequence   uint32
+	Segments   []byte
+	Data       []byte
+}
+
+// readPage reads the next page from r.
+func readPage(r io.Reader) (*page, int64, error) {
+	h := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, h); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, ErrInvalidPage
+		}
+		return nil, 0, err
+	}
+	if string(h[:4]) != "OggS" || h[4] != 0 {
+		return nil, 0, ErrInvalidPage
+	}
+
+	p := &page{
+		HeaderType: h[5],
+		Granule:    int64(binary.LittleEndian.Uint64(h[6:14])),
+		Serial:     binary.LittleEndian.Uint32(h[14:18]),
+		Sequence:   binary.LittleEndian.Uint32(h[18:22]),
+		Segments:   make([]byte, h[26]),
+	}
+	if _, err := io.ReadFull(r, p.Segments); err != nil {
+		return nil, 0, ErrInvalidPage
+	}
+	var n int
+	for _, s := range p.Segments {
+		n += int(s)
+	}
+	p.Data = make([]byte, n)
+	if _, err := io.ReadFull(r, p.Data); err != nil {
+		return nil, 0, ErrInvalidPage
+	}
+	return p, int64(headerSize + len(p.Segments) + n), nil
+}
+
+// packetReader reads the packets of the first logical stream in r.
+type packetReader struct {
+	r       io.Reader
+	offset  int64
+	serial  uint32
+	started bool
+	packets [][]byte
+	partial []byte
+}
+
+func newPacketReader(r io.Reader) *packetReader {
+	return &packetReader{r: r}
+}
+
+// Offset returns the number of bytes read so far, which is always
+// at the end of a page.
+func (pr *packetReader) Offset() int64 { return pr.offset }
+
+// Serial returns the serial number of the logical stream being read.
+func (pr *packetReader) Serial() uint32 { return pr.serial }
+
+// Next returns the next complete packet.
+func (pr *packetReader) Next() ([]byte, error) {
+	for len(pr.packets) == 0 {
+		p, n, err := readPage(pr.r)
+		if err != nil {
+			return nil, err
+		}
+		pr.offset += n
+		if !pr.started {
+			pr.serial = p.Serial
+			pr.started = true
+		} else if p.Serial != pr.serial {
+			continue
+		}
+
+		var i int
+		for _, s := range p.Segments {
+			pr.partial = append(pr.partial, p.Data[i:i+int(s)]...)
+			i += int(s)
+			if s < 255 {
+				pr.packets = append(pr.packets, pr.partial)
+				pr.partial = nil
+			}
+		}
+	}
+	packet := pr.packets[0]
+	pr.packets = pr.packets[1:]
+	return packet, nil
+}
+
+// }}}
+
+// Metadata {{{
+
+var _ = audio.Metadata(new(Metadata))
+
+type Metadata struct {
+	// Metadata is an interface that already implements:
+	//
+	//  Format() tag.Format
+	//  FileType() tag.FileType
+	//
+	//  Title() string
+	//  Album() string
+	//  Artist() string
+	//  AlbumArtist() string
+	//  Composer() string
+	//  Year() int
+	//  Genre() string
+	//  Track() (int, int)
+	//  Disc() (int, int)
+	//  Comment() string
+	//
+	//  Picture() *tag.Picture
+	//  Lyrics() string
+	//  Raw() map[string]interface{}
+	tag.Metadata
+
+	codec      audio.Codec
+	length     time.Duration
+	bitrate    int
+	samples    int64
+	preSkip    int64
+	sampleRate int
+	channels   int
+}
+
+func (m *Metadata) Length() time.Duration    { return m.length }
+func (m *Metadata) Website() string          { return m.rawString("contact") }
+func (m *Metadata) Copyright() string        { return m.rawString("copyright") }
+func (m *Metadata) Encoding() audio.Codec    { return m.codec }
+func (m *Metadata) EncodedBy() string        { return m.rawString("encoded-by") }
+func (m *Metadata) EncodingBitrate() int     { return m.bitrate }
+func (m *Metadata) EncoderSettings() string  { return m.rawString("encoder_options") }
+func (m *Metadata) OriginalFilename() string { return "" }
+
+// SampleRate returns the sample rate of the stream in Hz. For Opus this is
+// the sample rate of the original input, since Opus always decodes at 48 kHz.
+func (m *Metadata) SampleRate() int { return m.sampleRate }
+
+// Channels returns the number of channels in the stream.
+func (m *Metadata) Channels() int { return m.channels }
+
+func (m *Metadata) rawString(key string) string {
+	if v, ok := m.Raw()[key]; ok {
+		s, _ := v.(string)
+		return s
+	}
+	return ""
+}
+
+// }}}
@@ -0,0 +1,168 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ogg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/goulash/audio"
+)
+
+// lacing returns the segment table of a page that ends with packet p.
+func lacing(p []byte) []byte {
+	return append(bytes.Repeat([]byte{255}, len(p)/255), byte(len(p)%255))
+}
+
+// oggPage returns an Ogg page of the stream serial with the segment
+// table segs and the data p.
+func oggPage(flags byte, granule int64, serial, seq uint32, segs, p []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("OggS")
+	b.WriteByte(0)
+	b.WriteByte(flags)
+	binary.Write(&b, binary.LittleEndian, granule)
+	binary.Write(&b, binary.LittleEndian, serial)
+	binary.Write(&b, binary.LittleEndian, seq)
+	binary.Write(&b, binary.LittleEndian, uint32(0)) // checksum, not verified
+	b.WriteByte(byte(len(segs)))
+	b.Write(segs)
+	b.Write(p)
+	return b.Bytes()
+}
+
+// comment returns a Vorbis comment with the vendor and the fields.
+func comment(vendor string, fields ...string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(len(vendor)))
+	b.WriteString(vendor)
+	binary.Write(&b, binary.LittleEndian, uint32(len(fields)))
+	for _, f := range fields {
+		binary.Write(&b, binary.LittleEndian, uint32(len(f)))
+		b.WriteString(f)
+	}
+	return b.Bytes()
+}
+
+func writeFile(t *testing.T, data []byte) string {
+	dir, err := ioutil.TempDir("", "ogg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "test.ogg")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadMetadataOpus(t *testing.T) {
+	head := []byte("OpusHead\x01\x02")
+	head = append(head, 0x38, 0x01)             // pre-skip of 312
+	head = append(head, 0x44, 0xac, 0x00, 0x00) // input of 44100 Hz
+	head = append(head, 0, 0, 0)                // gain, mapping family
+	tags := append([]byte("OpusTags"), comment("test", "TITLE=Song", "ARTIST=Band", "TRACKNUMBER=3")...)
+	data := make([]byte, 2000)
+
+	var b []byte
+	b = append(b, oggPage(0x02, 0, 7, 0, lacing(head), head)...)
+	b = append(b, oggPage(0x00, 0, 7, 1, lacing(tags), tags)...)
+	audioStart := len(b)
+	b = append(b, oggPage(0x00, 48000, 7, 2, lacing(data), data)...)
+	// A page of another stream must not be taken as the last page.
+	b = append(b, oggPage(0x04, 2*48000+312, 7, 3, lacing(data), data)...)
+	b = append(b, oggPage(0x04, 999999, 8, 0, lacing(data[:10]), data[:10])...)
+
+	file := writeFile(t, b)
+	defer os.RemoveAll(filepath.Dir(file))
+	m, err := ReadMetadata(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Encoding() != codec.Opus {
+		t.Errorf("codec is %s, want OPUS", codec.String(m.Encoding()))
+	}
+	if m.Length() != 2*time.Second {
+		t.Errorf("length is %s, want 2s", m.Length())
+	}
+	if want := (len(b) - audioStart) * 8 / 2000; m.EncodingBitrate() != want {
+		t.Errorf("bitrate is %d, want %d", m.EncodingBitrate(), want)
+	}
+	if m.SampleRate() != 44100 || m.Channels() != 2 {
+		t.Errorf("sample rate and channels are %d and %d, want 44100 and 2", m.SampleRate(), m.Channels())
+	}
+	if m.Title() != "Song" || m.Artist() != "Band" {
+		t.Errorf("title and artist are %q and %q, want %q and %q", m.Title(), m.Artist(), "Song", "Band")
+	}
+	if n, _ := m.Track(); n != 3 {
+		t.Errorf("track is %d, want 3", n)
+	}
+}
+
+func TestReadMetadataVorbis(t *testing.T) {
+	id := []byte("\x01vorbis")
+	id = append(id, 0, 0, 0, 0)             // version
+	id = append(id, 1)                      // channels
+	id = append(id, 0x80, 0xbb, 0x00, 0x00) // 48000 Hz
+	id = append(id, make([]byte, 12)...)    // bitrates
+	id = append(id, 0xb8, 0x01)             // block sizes, framing
+
+	// The comment header is larger than a page segment, and continues
+	// on the next page.
+	long := "DESCRIPTION=" + string(bytes.Repeat([]byte{'x'}, 400))
+	tags := append([]byte("\x03vorbis"), comment("test", "ALBUM=Record", long)...)
+	tags = append(tags, 1) // framing
+	setup := []byte("\x05vorbis")
+	data := make([]byte, 1000)
+
+	var b []byte
+	b = append(b, oggPage(0x02, 0, 1, 0, lacing(id), id)...)
+	b = append(b, oggPage(0x00, 0, 1, 1, []byte{255}, tags[:255])...)
+	rest := append(tags[255:len(tags):len(tags)], setup...)
+	b = append(b, oggPage(0x01, 0, 1, 2, append(lacing(tags[255:]), lacing(setup)...), rest)...)
+	b = append(b, oggPage(0x04, 24000, 1, 3, lacing(data), data)...)
+
+	file := writeFile(t, b)
+	defer os.RemoveAll(filepath.Dir(file))
+	m, err := ReadMetadata(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Encoding() != audio.OGG {
+		t.Errorf("codec is %s, want OGG", codec.String(m.Encoding()))
+	}
+	if m.Length() != 500*time.Millisecond {
+		t.Errorf("length is %s, want 500ms", m.Length())
+	}
+	if m.SampleRate() != 48000 || m.Channels() != 1 {
+		t.Errorf("sample rate and channels are %d and %d, want 48000 and 1", m.SampleRate(), m.Channels())
+	}
+	if m.Album() != "Record" {
+		t.Errorf("album is %q, want %q", m.Album(), "Record")
+	}
+}
+
+func TestReadMetadataInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"not ogg": []byte("RIFF\x00\x00\x00\x00WAVEfmt "),
+		"unknown": oggPage(0x02, 0, 1, 0, lacing([]byte("\x7fFLAC")), []byte("\x7fFLAC")),
+	}
+	want := map[string]error{"not ogg": ErrNotOgg, "unknown": ErrUnknownCodec}
+	for name, data := range tests {
+		file := writeFile(t, data)
+		_, err := ReadMetadata(file)
+		os.RemoveAll(filepath.Dir(file))
+		if err != want[name] {
+			t.Errorf("%s: error is %v, want %v", name, err, want[name])
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ogg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cassava/lackey/audio/tags"
+)
+
+var ErrMultiplexed = errors.New("Ogg file with multiplexed streams")
+
+// commentHeader returns the prefix of the comment packet and the number
+// of header packets for the stream whose first packet is id.
+func commentHeader(id []byte) (prefix string, n int, err error) {
+	switch {
+	case bytes.HasPrefix(id, []byte("\x01vorbis")):
+		return "\x03vorbis", 3, nil
+	case bytes.HasPrefix(id, []byte("OpusHead")):
+		return "OpusTags", 2, nil
+	}
+	return "", 0, ErrUnknownCodec
+}
+
+// ReadTags reads the comments of an Ogg Vorbis or Ogg Opus file.
+func ReadTags(file string) (tags.Tags, error) {
+	cs, err := readComments(file)
+	if err != nil {
+		return nil, err
+	}
+	return tags.FromVorbis(cs), nil
+}
+
+// ReadPictures reads the pictures in the METADATA_BLOCK_PICTURE comments
+// of an Ogg Vorbis or Ogg Opus file.
+func ReadPictures(file string) ([]*tags.Picture, error) {
+	cs, err := readComments(file)
+	if err != nil {
+		return nil, err
+	}
+	return tags.PicturesOf(cs), nil
+}
+
+// readComments reads the Vorbis comments of the file.
+func readComments(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pr := newPacketReader(bufio.NewReader(f))
+	id, err := pr.Next()
+	if err != nil {
+		if err == ErrInvalidPage {
+			return nil, ErrNotOgg
+		}
+		return nil, err
+	}
+	prefix, _, err := commentHeader(id)
+	if err != nil {
+		return nil, err
+	}
+	comment, err := pr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(comment, []byte(prefix)) {
+		return nil, ErrInvalidPage
+	}
+	_, cs, err := tags.ParseVorbisComment(comment[len(prefix):])
+	return cs, err
+}
+
+// WriteTags replaces the comments of an Ogg Vorbis or Ogg Opus file with t,
+// keeping the vendor string and any comments with pictures. The file is
+// rewritten, since the pages after the comment header are numbered anew.
+func WriteTags(file string, t tags.Tags) error {
+	return writeComments(file, func(old []string) []string {
+		comments := t.Vorbis()
+		for _, c := range old {
+			if tags.IsPictureComment(c) {
+				comments = append(comments, c)
+			}
+		}
+		return comments
+	})
+}
+
+// WritePictures replaces the pictures of an Ogg Vorbis or Ogg Opus file
+// with pics, which are written as METADATA_BLOCK_PICTURE comments.
+func WritePictures(file string, pics []*tags.Picture) error {
+	return writeComments(file, func(old []string) []string {
+		var comments []string
+		for _, c := range old {
+			if !tags.IsPictureComment(c) {
+				comments = append(comments, c)
+			}
+		}
+		for _, p := range pics {
+			comments = append(comments, p.VorbisComment())
+		}
+		return comments
+	})
+}
+
+// writeComments replaces the comments of the file with those that edit
+// returns for the old comments, and keeps the vendor string.
+func writeComments(file string, edit func(old []string) []string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+
+	// The first page contains only the identification header.
+	first, _, err := readPage(r)
+	if err != nil {
+		if err == ErrInvalidPage {
+			return ErrNotOgg
+		}
+		return err
+	}
+	if len(first.Segments) == 0 || first.Segments[len(first.Segments)-1] == 255 {
+		return ErrInvalidPage
+	}
+	prefix, n, err := commentHeader(first.Data)
+	if err != nil {
+		return err
+	}
+
+	// The other header packets end on a page of their own.
+	var (
+		packets [][]byte
+		partial []byte
+		last    uint32
+	)
+	for len(packets) < n-1 || partial != nil {
+		p, _, err := readPage(r)
+		if err == io.EOF {
+			return ErrInvalidPage
+		} else if err != nil {
+			return err
+		}
+		if p.Serial != first.Serial {
+			return ErrMultiplexed
+		}
+		last = p.Sequence
+		var i int
+		for _, s := range p.Segments {
+			partial = append(partial, p.Data[i:i+int(s)]...)
+			i += int(s)
+			if s < 255 {
+				packets = append(packets, partial)
+				partial = nil
+			}
+		}
+		if len(packets) > n-1 {
+			return ErrInvalidPage
+		}
+	}
+	if !bytes.HasPrefix(packets[0], []byte(prefix)) {
+		return ErrInvalidPage
+	}
+
+	vendor, old := "lackey", []string(nil)
+	if v, cs, err := tags.ParseVorbisComment(packets[0][len(prefix):]); err == nil {
+		vendor, old = v, cs
+	}
+	comment := append([]byte(prefix), tags.EncodeVorbisComment(vendor, edit(old))...)
+	if prefix == "\x03vorbis" {
+		comment = append(comment, 1) // framing bit
+	}
+	packets[0] = comment
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".oggtag-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	err = writePage(w, first)
+	pages := paginate(packets, first.Serial, first.Sequence+1)
+	for _, p := range pages {
+		if err == nil {
+			err = writePage(w, p)
+		}
+	}
+	delta := pages[len(pages)-1].Sequence - last
+	for err == nil {
+		var p *page
+		p, _, err = readPage(r)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			break
+		}
+		if p.Serial == first.Serial {
+			p.Sequence += delta
+		}
+		err = writePage(w, p)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(fi.Mode())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// SetOutputGain sets the output gain in the header of an Ogg Opus file,
+// which decoders apply to the audio, in units of 1/256 dB.
+func SetOutputGain(file string, gain int16) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p, n, err := readPage(bufio.NewReader(f))
+	if err != nil {
+		if err == ErrInvalidPage {
+			return ErrNotOgg
+		}
+		return err
+	}
+	if !bytes.HasPrefix(p.Data, []byte("OpusHead")) {
+		return ErrUnknownCodec
+	}
+	if len(p.Data) < 19 {
+		return ErrInvalidPage
+	}
+	binary.LittleEndian.PutUint16(p.Data[16:18], uint16(gain))
+
+	var b bytes.Buffer
+	if err := writePage(&b, p); err != nil {
+		return err
+	}
+	if int64(b.Len()) != n {
+		return ErrInvalidPage
+	}
+	if _, err := f.WriteAt(b.Bytes(), 0); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// paginate lays out the packets in pages, which start with sequence seq.
+func paginate(packets [][]byte, serial, seq uint32) []*page {
+	var (
+		pages []*page
+		p     = &page{Serial: serial, Sequence: seq}
+		ended bool
+	)
+	flush := func(continued bool) {
+		p.Granule = -1
+		if ended {
+			p.Granule = 0
+		}
+		pages = append(pages, p)
+		p = &page{Serial: serial, Sequence: p.Sequence + 1}
+		if continued {
+			p.HeaderType = 1
+		}
+		ended = false
+	}
+	for _, pk := range packets {
+		for i := 0; ; i += 255 {
+			if len(p.Segments) == 255 {
+				flush(i > 0)
+			}
+			n := len(pk) - i
+			if n > 255 {
+				n = 255
+			}
+			p.Segments = append(p.Segments, byte(n))
+			p.Data = append(p.Data, pk[i:i+n]...)
+			if n < 255 {
+				ended = true
+				break
+			}
+		}
+	}
+	flush(false)
+	return pages
+}
+
+// writePage writes the page with its checksum.
+func writePage(w io.Writer, p *page) error {
+	b := make([]byte, headerSize, headerSize+len(p.Segments)+len(p.Data))
+	copy(b, "OggS")
+	b[5] = p.HeaderType
+	binary.LittleEndian.PutUint64(b[6:14], uint64(p.Granule))
+	binary.LittleEndian.PutUint32(b[14:18], p.Serial)
+	binary.LittleEndian.PutUint32(b[18:22], p.Sequence)
+	b[26] = byte(len(p.Segments))
+	b = append(b, p.Segments...)
+	b = append(b, p.Data...)
+	binary.LittleEndian.PutUint32(b[22:26], checksum(b))
+	_, err := w.Write(b)
+	return err
+}
+
+var crcTable = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04C11DB7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return
+}()
+
+// checksum returns the CRC-32 of an Ogg page, which is not the one of
+// hash/crc32: its bits are not reflected.
+func checksum(b []byte) uint32 {
+	var crc uint32
+	for _, c := range b {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^c]
+	}
+	return crc
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package ogg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cassava/lackey/audio/tags"
+)
+
+func readAll(t *testing.T, file string) []byte {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// readPages reads all pages of the file, and checks their checksums.
+func readPages(t *testing.T, file string) []*page {
+	b := readAll(t, file)
+	var pages []*page
+	for len(b) > 0 {
+		p, n, err := readPage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("page %d: %s", len(pages), err)
+		}
+		var w bytes.Buffer
+		writePage(&w, p)
+		if !bytes.Equal(w.Bytes(), b[:n]) {
+			t.Errorf("page %d has checksum %08x, want %08x", len(pages),
+				binary.LittleEndian.Uint32(b[22:26]), binary.LittleEndian.Uint32(w.Bytes()[22:26]))
+		}
+		pages = append(pages, p)
+		b = b[n:]
+	}
+	return pages
+}
+
+func opusFile(comments ...string) []byte {
+	head := []byte("OpusHead\x01\x02\x38\x01\x44\xac\x00\x00\x00\x00\x00")
+	tags := append([]byte("OpusTags"), comment("libopus", comments...)...)
+	data := make([]byte, 2000)
+
+	var b []byte
+	b = append(b, oggPage(0x02, 0, 7, 0, lacing(head), head)...)
+	b = append(b, oggPage(0x00, 0, 7, 1, lacing(tags), tags)...)
+	b = append(b, oggPage(0x00, 48000, 7, 2, lacing(data), data)...)
+	b = append(b, oggPage(0x04, 2*48000+312, 7, 3, lacing(data), data)...)
+	return b
+}
+
+func TestWriteTagsOpus(t *testing.T) {
+	file := writeFile(t, opusFile("TITLE=Old", "METADATA_BLOCK_PICTURE=AAAA"))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	// The comment header becomes larger than a page, so that the
+	// pages after it are numbered anew.
+	long := strings.Repeat("x", 70000)
+	want := tags.Tags{"TITLE": {"Song"}, "ARTIST": {"A", "B"}, "DESCRIPTION": {long}}
+	if err := WriteTags(file, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadTags(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tags are %d keys, want %v", len(got), want.Keys())
+	}
+
+	pages := readPages(t, file)
+	if len(pages) != 5 {
+		t.Fatalf("file has %d pages, want 5", len(pages))
+	}
+	for i, p := range pages {
+		if p.Sequence != uint32(i) {
+			t.Errorf("page %d has sequence %d", i, p.Sequence)
+		}
+	}
+	if pages[2].HeaderType != 1 || pages[2].Granule != 0 || pages[1].Granule != -1 {
+		t.Errorf("comment pages have header types %d, %d and granules %d, %d, want 0, 1 and -1, 0",
+			pages[1].HeaderType, pages[2].HeaderType, pages[1].Granule, pages[2].Granule)
+	}
+	if pages[4].Granule != 2*48000+312 || pages[4].HeaderType != 0x04 {
+		t.Errorf("last page has granule %d and header type %d, want them kept", pages[4].Granule, pages[4].HeaderType)
+	}
+
+	// The vendor and the picture are kept.
+	pr := newPacketReader(bytes.NewReader(readAll(t, file)))
+	pr.Next()
+	c, err := pr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vendor, cs, err := tags.ParseVorbisComment(c[len("OpusTags"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vendor != "libopus" || cs[len(cs)-1] != "METADATA_BLOCK_PICTURE=AAAA" {
+		t.Errorf("vendor is %q and last comment is %.30q, want the vendor and picture kept", vendor, cs[len(cs)-1])
+	}
+
+	m, err := ReadMetadata(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Title() != "Song" || m.Channels() != 2 {
+		t.Errorf("title is %q with %d channels, want %q with 2", m.Title(), m.Channels(), "Song")
+	}
+}
+
+func TestWriteTagsVorbis(t *testing.T) {
+	id := []byte("\x01vorbis\x00\x00\x00\x00\x01\x80\xbb\x00\x00")
+	id = append(id, make([]byte, 12)...)
+	id = append(id, 0xb8, 0x01)
+	tags0 := append([]byte("\x03vorbis"), comment("Xiph", "ALBUM=Old")...)
+	tags0 = append(tags0, 1)
+	setup := []byte("\x05vorbis")
+	data := make([]byte, 1000)
+
+	// The comment and setup headers share a page.
+	var b []byte
+	b = append(b, oggPage(0x02, 0, 1, 0, lacing(id), id)...)
+	b = append(b, oggPage(0x00, 0, 1, 1, append(lacing(tags0), lacing(setup)...), append(tags0, setup...))...)
+	b = append(b, oggPage(0x04, 24000, 1, 2, lacing(data), data)...)
+	file := writeFile(t, b)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	want := tags.Tags{"ALBUM": {"Record"}, "TRACKNUMBER": {"2"}}
+	if err := WriteTags(file, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadTags(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tags are %v, want %v", got, want)
+	}
+
+	pr := newPacketReader(bytes.NewReader(readAll(t, file)))
+	var packets [][]byte
+	for {
+		p, err := pr.Next()
+		if err != nil {
+			break
+		}
+		packets = append(packets, p)
+	}
+	if len(packets) != 4 || !bytes.Equal(packets[2], setup) || !bytes.Equal(packets[3], data) {
+		t.Errorf("file has %d packets, want the setup header and audio kept", len(packets))
+	}
+	if c := packets[1]; c[len(c)-1] != 1 {
+		t.Errorf("comment header ends with %d, want the framing bit", c[len(c)-1])
+	}
+
+	m, err := ReadMetadata(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Album() != "Record" || m.SampleRate() != 48000 {
+		t.Errorf("album is %q at %d Hz, want %q at 48000 Hz", m.Album(), m.SampleRate(), "Record")
+	}
+}
+
+func TestWriteTagsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"not ogg", []byte("fLaC\x00\x00\x00\x22"), ErrNotOgg},
+		{"unknown", oggPage(0x02, 0, 1, 0, lacing([]byte("\x7fFLAC")), []byte("\x7fFLAC")), ErrUnknownCodec},
+		{"multiplexed", append(
+			oggPage(0x02, 0, 1, 0, lacing([]byte("OpusHead")), []byte("OpusHead")),
+			oggPage(0x02, 0, 2, 0, lacing([]byte("OpusTags")), []byte("OpusTags"))...), ErrMultiplexed},
+		{"no comment", oggPage(0x02, 0, 1, 0, lacing([]byte("OpusHead")), []byte("OpusHead")), ErrInvalidPage},
+	}
+	for _, tt := range tests {
+		file := writeFile(t, tt.data)
+		err := WriteTags(file, tags.Tags{"TITLE": {"Song"}})
+		os.RemoveAll(filepath.Dir(file))
+		if err != tt.err {
+			t.Errorf("%s: error is %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSetOutputGain(t *testing.T) {
+	file := writeFile(t, opusFile("TITLE=Song"))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	if err := SetOutputGain(file, -1280); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first page is written, with its checksum.
+	b := readAll(t, file)
+	p, n, err := readPage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w bytes.Buffer
+	writePage(&w, p)
+	if !bytes.Equal(w.Bytes(), b[:n]) {
+		t.Error("checksum of the first page is wrong")
+	}
+	if !bytes.Equal(b[n:], opusFile("TITLE=Song")[n:]) {
+		t.Error("pages after the first are changed")
+	}
+	if g := int16(binary.LittleEndian.Uint16(p.Data[16:18])); g != -1280 {
+		t.Errorf("output gain is %d, want -1280", g)
+	}
+	if m, err := ReadMetadata(file); err != nil {
+		t.Error(err)
+	} else if m.SampleRate() != 44100 || m.Title() != "Song" {
+		t.Errorf("sample rate and title are %d and %q, want them kept", m.SampleRate(), m.Title())
+	}
+
+	vorbis := writeFile(t, oggPage(0x02, 0, 1, 0, lacing([]byte("\x01vorbis")), []byte("\x01vorbis")))
+	defer os.RemoveAll(filepath.Dir(vorbis))
+	if err := SetOutputGain(vorbis, 0); err != ErrUnknownCodec {
+		t.Errorf("vorbis: error is %v, want %v", err, ErrUnknownCodec)
+	}
+}
+
+func TestWritePictures(t *testing.T) {
+	file := writeFile(t, opusFile("TITLE=Song", "METADATA_BLOCK_PICTURE=AAAA"))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	front := &tags.Picture{MIMEType: "image/jpeg", Type: tags.FrontCover, Data: []byte{0xff, 0xd8}}
+	for _, pics := range [][]*tags.Picture{{front}, nil} {
+		if err := WritePictures(file, pics); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadPictures(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, pics) {
+			t.Errorf("pictures are %v, want %v", got, pics)
+		}
+		if tt, err := ReadTags(file); err != nil || !reflect.DeepEqual(tt, tags.Tags{"TITLE": {"Song"}}) {
+			t.Errorf("tags are %v with error %v, want them kept", tt, err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package tags
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chapter is a chapter of an audiobook or another long recording, which
+// lasts from Start until the start of the next chapter.
+type Chapter struct {
+	Start time.Duration
+	Title string
+}
+
+var vorbisChapter = regexp.MustCompile(`^CHAPTER(\d+)(NAME)?$`)
+
+// Chapters returns the chapters in the fields CHAPTER001, CHAPTER001NAME,
+// and so on, which is how Vorbis comments store them, in the order of their
+// start times. Chapters whose time cannot be parsed are skipped.
+func (t Tags) Chapters() []Chapter {
+	byNumber := make(map[int]*Chapter)
+	var names []string
+	for k := range t {
+		m := vorbisChapter.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		if m[2] == "" {
+			d, err := ParseChapterTime(t.Get(k))
+			if err != nil {
+				continue
+			}
+			if byNumber[n] == nil {
+				byNumber[n] = &Chapter{}
+			}
+			byNumber[n].Start = d
+		} else {
+			names = append(names, k)
+		}
+	}
+	for _, k := range names {
+		n, _ := strconv.Atoi(vorbisChapter.FindStringSubmatch(k)[1])
+		if c := byNumber[n]; c != nil {
+			c.Title = t.Get(k)
+		}
+	}
+
+	chs := make([]Chapter, 0, len(byNumber))
+	for _, c := range byNumber {
+		chs = append(chs, *c)
+	}
+	if len(chs) == 0 {
+		return nil
+	}
+	sort.Slice(chs, func(i, j int) bool { return chs[i].Start < chs[j].Start })
+	return chs
+}
+
+// SetChapters replaces the chapter fields of t with chs, and returns
+// true if t changed.
+func (t Tags) SetChapters(chs []Chapter) bool {
+	changed := false
+	for k := range t {
+		if vorbisChapter.MatchString(k) {
+			delete(t, k)
+			changed = true
+		}
+	}
+	for i, c := range chs {
+		key := fmt.Sprintf("CHAPTER%03d", i+1)
+		t.Set(key, FormatChapterTime(c.Start))
+		t.Set(key+"NAME", c.Title)
+		changed = true
+	}
+	return changed
+}
+
+// ParseChapterTime parses a time such as 01:23:45.678, where the hours and
+// the fraction of a second are optional.
+func ParseChapterTime(s string) (time.Duration, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid chapter time %q", s)
+	}
+	sec, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil || sec < 0 {
+		return 0, fmt.Errorf("invalid chapter time %q", s)
+	}
+	// Rounding to milliseconds keeps 2.030 from becoming 2.029999999s.
+	d := time.Duration(math.Round(sec*1000)) * time.Millisecond
+	for i, unit := range []time.Duration{time.Minute, time.Hour}[:len(parts)-1] {
+		n, err := strconv.Atoi(parts[len(parts)-2-i])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid chapter time %q", s)
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
+
+// FormatChapterTime formats d as HH:MM:SS.mmm.
+func FormatChapterTime(d time.Duration) string {
+	ms := int64(d / time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
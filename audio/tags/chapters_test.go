@@ -0,0 +1,108 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package tags
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChapters(t *testing.T) {
+	tt := Tags{
+		"TITLE":           {"Book"},
+		"CHAPTER002":      {"00:10:00.500"},
+		"CHAPTER002NAME":  {"Two"},
+		"CHAPTER001":      {"00:00:00.000"},
+		"CHAPTER001NAME":  {"One"},
+		"CHAPTER010":      {"01:02:03.250"},
+		"CHAPTER003":      {"bad"},
+		"CHAPTER003NAME":  {"Skipped"},
+		"CHAPTER004NAME":  {"Without a time"},
+		"CHAPTERS":        {"not a chapter"},
+		"CHAPTER005XNAME": {"not a chapter"},
+	}
+	want := []Chapter{
+		{0, "One"},
+		{10*time.Minute + 500*time.Millisecond, "Two"},
+		{time.Hour + 2*time.Minute + 3250*time.Millisecond, ""},
+	}
+	if got := tt.Chapters(); !reflect.DeepEqual(got, want) {
+		t.Errorf("chapters are %v, want %v", got, want)
+	}
+	if got := (Tags{"TITLE": {"Song"}}).Chapters(); got != nil {
+		t.Errorf("chapters of tags without any are %v, want nil", got)
+	}
+
+	// Setting them replaces all chapter fields, and numbers them from 1.
+	// Chapters without a title have no name field.
+	if !tt.SetChapters(want[1:]) {
+		t.Error("setting chapters did not change the tags")
+	}
+	wantTags := Tags{
+		"TITLE":           {"Book"},
+		"CHAPTER001":      {"00:10:00.500"},
+		"CHAPTER001NAME":  {"Two"},
+		"CHAPTER002":      {"01:02:03.250"},
+		"CHAPTERS":        {"not a chapter"},
+		"CHAPTER005XNAME": {"not a chapter"},
+	}
+	if !reflect.DeepEqual(tt, wantTags) {
+		t.Errorf("tags are %v, want %v", tt, wantTags)
+	}
+	if got := tt.Chapters(); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("chapters read back are %v, want %v", got, want[1:])
+	}
+
+	if !tt.SetChapters(nil) || tt.Chapters() != nil || len(tt) != 3 {
+		t.Errorf("tags without chapters are %v", tt)
+	}
+	if tt.SetChapters(nil) {
+		t.Error("removing chapters of tags without any changed them")
+	}
+}
+
+func TestParseChapterTime(t *testing.T) {
+	tests := map[string]time.Duration{
+		"00:00":         0,
+		"01:30":         90 * time.Second,
+		"01:30.5":       90*time.Second + 500*time.Millisecond,
+		" 1:02:03.25 ":  time.Hour + 2*time.Minute + 3250*time.Millisecond,
+		"00:00:00.125":  125 * time.Millisecond,
+		"00:00:02.030":  2030 * time.Millisecond,
+		"100:00:00.000": 100 * time.Hour,
+		"0:75":          75 * time.Second,
+	}
+	for s, want := range tests {
+		if got, err := ParseChapterTime(s); err != nil || got != want {
+			t.Errorf("%q: time is %v with error %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "90", "1:2:3:4", "a:00", "00:-1", "-1:00", "00:00:xx"} {
+		if _, err := ParseChapterTime(s); err == nil {
+			t.Errorf("%q: parsing succeeded", s)
+		}
+	}
+}
+
+func TestFormatChapterTime(t *testing.T) {
+	tests := map[time.Duration]string{
+		0:                       "00:00:00.000",
+		1500 * time.Millisecond: "00:00:01.500",
+		2030 * time.Millisecond: "00:00:02.030",
+		time.Hour + 2*time.Minute + 3*time.Second + 4*time.Millisecond: "01:02:03.004",
+		100*time.Hour + 999*time.Microsecond:                           "100:00:00.000",
+	}
+	for d, want := range tests {
+		if got := FormatChapterTime(d); got != want {
+			t.Errorf("%v: time is %q, want %q", d, got, want)
+		}
+		if d%time.Millisecond == 0 {
+			if back, err := ParseChapterTime(want); err != nil || back != d {
+				t.Errorf("%q: time read back is %v with error %v, want %v", want, back, err, d)
+			}
+		}
+	}
+}
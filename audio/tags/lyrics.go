@@ -0,0 +1,84 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package tags
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Line is a line of synchronized lyrics, which is sung from Time onwards.
+type Line struct {
+	Time time.Duration
+	Text string
+}
+
+var (
+	lrcTime = regexp.MustCompile(`^\[(\d+):(\d+(?:[.:]\d+)?)\]`)
+	lrcTag  = regexp.MustCompile(`^\[([a-zA-Z]+):(.*)\]$`)
+	lrcWord = regexp.MustCompile(`<\d+:\d+(?:[.:]\d+)?>`)
+)
+
+// ParseLRC parses lyrics in the LRC format, where each line starts with
+// one or more times such as [01:23.45]. The lines are returned in the order
+// of their times, which are adjusted by the offset tag, if there is one.
+// Other tags and the times of words in enhanced LRC are dropped. If the
+// lyrics have no times, nil is returned.
+func ParseLRC(s string) []Line {
+	var (
+		lines  []Line
+		offset time.Duration
+	)
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if m := lrcTag.FindStringSubmatch(l); m != nil {
+			if strings.EqualFold(m[1], "offset") {
+				// A positive offset makes the lyrics appear sooner.
+				ms, _ := strconv.Atoi(strings.TrimSpace(m[2]))
+				offset = time.Duration(ms) * time.Millisecond
+			}
+			continue
+		}
+
+		var times []time.Duration
+		for {
+			m := lrcTime.FindStringSubmatch(l)
+			if m == nil {
+				break
+			}
+			min, _ := strconv.Atoi(m[1])
+			sec, _ := strconv.ParseFloat(strings.Replace(m[2], ":", ".", 1), 64)
+			// Rounding to milliseconds keeps 2.03 from becoming 2.029999999s.
+			ms := time.Duration(math.Round(sec * 1000))
+			times = append(times, time.Duration(min)*time.Minute+ms*time.Millisecond)
+			l = l[len(m[0]):]
+		}
+		text := strings.TrimSpace(lrcWord.ReplaceAllString(l, ""))
+		for _, t := range times {
+			lines = append(lines, Line{Time: t, Text: text})
+		}
+	}
+
+	for i := range lines {
+		if lines[i].Time -= offset; lines[i].Time < 0 {
+			lines[i].Time = 0
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Time < lines[j].Time })
+	return lines
+}
+
+// PlainLyrics returns the text of synchronized lyrics, one line per line.
+func PlainLyrics(lines []Line) string {
+	texts := make([]string, len(lines))
+	for i, l := range lines {
+		texts[i] = l.Text
+	}
+	return strings.Join(texts, "\n")
+}
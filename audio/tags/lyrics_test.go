@@ -0,0 +1,65 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package tags
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLRC(t *testing.T) {
+	ms := func(m, s, ms int) time.Duration {
+		return time.Duration(m)*time.Minute + time.Duration(s)*time.Second + time.Duration(ms)*time.Millisecond
+	}
+	tests := []struct {
+		name string
+		lrc  string
+		want []Line
+	}{
+		{"simple", "[00:01.00]First\n[00:05.50]Second\n", []Line{
+			{ms(0, 1, 0), "First"},
+			{ms(0, 5, 500), "Second"},
+		}},
+		{"tags and blank lines", "[ar:Artist]\n[ti:Title]\r\n\r\n[01:02.50] Line \r\n", []Line{
+			{ms(1, 2, 500), "Line"},
+		}},
+		{"repeated lines are sorted", "[00:10.00][00:30.00]Chorus\n[00:20.00]Verse\n", []Line{
+			{ms(0, 10, 0), "Chorus"},
+			{ms(0, 20, 0), "Verse"},
+			{ms(0, 30, 0), "Chorus"},
+		}},
+		{"equal times keep their order", "[00:01]B\n[00:01]A\n", []Line{
+			{ms(0, 1, 0), "B"},
+			{ms(0, 1, 0), "A"},
+		}},
+		{"colon before hundredths", "[02:03:45]Line\n", []Line{{ms(2, 3, 450), "Line"}}},
+		{"inexact hundredths", "[00:02.03]A\n[01:02.01]B\n", []Line{{ms(0, 2, 30), "A"}, {ms(1, 2, 10), "B"}}},
+		{"word times", "[00:01.00]<00:01.00>One <00:01.50>two\n", []Line{{ms(0, 1, 0), "One two"}}},
+		{"empty text", "[00:01.00]\n", []Line{{ms(0, 1, 0), ""}}},
+		{"offset", "[offset:+500]\n[00:00.20]Early\n[00:02.00]Late\n", []Line{
+			{0, "Early"},
+			{ms(0, 1, 500), "Late"},
+		}},
+		{"negative offset", "[00:01.00]Line\n[Offset: -250]\n", []Line{{ms(0, 1, 250), "Line"}}},
+		{"plain text", "Just some words\n[not a time]\n", nil},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		if got := ParseLRC(tt.lrc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: lines are %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPlainLyrics(t *testing.T) {
+	lines := []Line{{0, "One"}, {time.Second, ""}, {2 * time.Second, "Two"}}
+	if got, want := PlainLyrics(lines), "One\n\nTwo"; got != want {
+		t.Errorf("lyrics are %q, want %q", got, want)
+	}
+	if got := PlainLyrics(nil); got != "" {
+		t.Errorf("lyrics of no lines are %q", got)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package tags
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidPicture = errors.New("invalid picture block")
+
+// FrontCover is the picture type of the front cover in ID3v2 and FLAC.
+const FrontCover = 3
+
+// Picture is a picture embedded in an audio file, such as a cover.
+// Width, Height, Depth, and Colors may be 0 if they are not known.
+type Picture struct {
+	MIMEType    string
+	Type        byte
+	Description string
+	Width       int
+	Height      int
+	Depth       int
+	Colors      int
+	Data        []byte
+}
+
+// ParsePicture parses a FLAC PICTURE metadata block, which is also the
+// content of the METADATA_BLOCK_PICTURE comment of Ogg files.
+func ParsePicture(b []byte) (*Picture, error) {
+	be := binary.BigEndian
+	next := func(n int) []byte {
+		if n < 0 || len(b) < n {
+			b = nil
+			return nil
+		}
+		x := b[:n]
+		b = b[n:]
+		return x
+	}
+	number := func() int {
+		x := next(4)
+		if x == nil {
+			return -1
+		}
+		return int(be.Uint32(x))
+	}
+
+	p := new(Picture)
+	typ := number()
+	p.MIMEType = string(next(number()))
+	p.Description = string(next(number()))
+	p.Width, p.Height, p.Depth, p.Colors = number(), number(), number(), number()
+	p.Data = next(number())
+	if b == nil || typ < 0 || typ > 255 {
+		return nil, ErrInvalidPicture
+	}
+	p.Type = byte(typ)
+	return p, nil
+}
+
+// Encode returns the picture as a FLAC PICTURE metadata block.
+func (p *Picture) Encode() []byte {
+	var b []byte
+	number := func(n int) {
+		b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	number(int(p.Type))
+	number(len(p.MIMEType))
+	b = append(b, p.MIMEType...)
+	number(len(p.Description))
+	b = append(b, p.Description...)
+	number(p.Width)
+	number(p.Height)
+	number(p.Depth)
+	number(p.Colors)
+	number(len(p.Data))
+	return append(b, p.Data...)
+}
+
+// VorbisComment returns the picture as a METADATA_BLOCK_PICTURE comment.
+func (p *Picture) VorbisComment() string {
+	return "METADATA_BLOCK_PICTURE=" + base64.StdEncoding.EncodeToString(p.Encode())
+}
+
+// PicturesOf returns the pictures in the METADATA_BLOCK_PICTURE comments
+// among the Vorbis comments. Invalid pictures are skipped.
+func PicturesOf(comments []string) []*Picture {
+	var pics []*Picture
+	for _, c := range comments {
+		i := strings.IndexByte(c, '=')
+		if i < 0 || !strings.EqualFold(c[:i], "METADATA_BLOCK_PICTURE") {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(c[i+1:])
+		if err != nil {
+			continue
+		}
+		if p, err := ParsePicture(b); err == nil {
+			pics = append(pics, p)
+		}
+	}
+	return pics
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package tags
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPicture(t *testing.T) {
+	p := &Picture{
+		MIMEType:    "image/png",
+		Type:        FrontCover,
+		Description: "Cover",
+		Width:       600,
+		Height:      400,
+		Depth:       24,
+		Data:        []byte("\x89PNG"),
+	}
+	b := p.Encode()
+	if want := 8*4 + len("image/png") + len("Cover") + 4; len(b) != want {
+		t.Errorf("block has %d bytes, want %d", len(b), want)
+	}
+	got, err := ParsePicture(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("picture is %+v, want %+v", got, p)
+	}
+
+	for _, bad := range [][]byte{
+		b[:len(b)-1],
+		b[:10],
+		nil,
+		append([]byte{0, 0, 1, 0}, b[4:]...), // type above 255
+	} {
+		if _, err := ParsePicture(bad); err != ErrInvalidPicture {
+			t.Errorf("% x: error is %v, want %v", bad, err, ErrInvalidPicture)
+		}
+	}
+}
+
+func TestPicturesOf(t *testing.T) {
+	front := &Picture{MIMEType: "image/jpeg", Type: FrontCover, Data: []byte{0xff, 0xd8}}
+	back := &Picture{MIMEType: "image/png", Type: 4, Data: []byte("\x89PNG")}
+	c := front.VorbisComment()
+	if !strings.HasPrefix(c, "METADATA_BLOCK_PICTURE=") || !IsPictureComment(c) {
+		t.Errorf("comment %q is not a picture comment", c)
+	}
+
+	comments := []string{
+		"TITLE=Song",
+		c,
+		"METADATA_BLOCK_PICTURE=not base64!",
+		"METADATA_BLOCK_PICTURE=" + base64.StdEncoding.EncodeToString([]byte("short")),
+		"metadata_block_picture=" + base64.StdEncoding.EncodeToString(back.Encode()),
+	}
+	got := PicturesOf(comments)
+	if want := []*Picture{front, back}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pictures are %+v, want %+v", got, want)
+	}
+	if got := PicturesOf([]string{"TITLE=Song"}); got != nil {
+		t.Errorf("pictures of comments without any are %v", got)
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package tags provides a format-neutral representation of audio tags.
+//
+// Tags are stored with upper-case field names as they are used in Vorbis
+// comments, such as TITLE or MUSICBRAINZ_TRACKID, and every field can have
+// multiple values. The Fields table describes how these names translate
+// to the names used by other tag formats.
+package tags
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+// Tags contains the fields of a tag, indexed by their canonical name.
+type Tags map[string][]string
+
+// Get returns the first value of the field, or the empty string.
+func (t Tags) Get(key string) string {
+	if v := t[key]; len(v) != 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Join returns all the values of the field joined by sep.
+func (t Tags) Join(key, sep string) string {
+	return strings.Join(t[key], sep)
+}
+
+// Add appends the non-empty values to the field.
+func (t Tags) Add(key string, values ...string) {
+	for _, v := range values {
+		if v != "" {
+			t[key] = append(t[key], v)
+		}
+	}
+}
+
+// Set replaces the field with the non-empty values.
+func (t Tags) Set(key string, values ...string) {
+	delete(t, key)
+	t.Add(key, values...)
+}
+
+// Keys returns the names of all fields in sorted order.
+func (t Tags) Keys() []string {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Field describes how a canonical field is named in the other tag formats.
+// An empty name means that the field is stored by its canonical name: in a
+// TXXX frame in ID3v2, in an item in APEv2, or in a freeform atom in MP4.
+// RIFF INFO chunks only store the fields that have a name for them.
+//
+// ID3 names of the form TXXX:Description and UFID:Owner store a field in
+// the TXXX or UFID frame with that description or owner.
+type Field struct {
+	Name string `json:"name"`           // Vorbis comment, such as "TITLE"
+	ID3  string `json:"id3,omitempty"`  // ID3v2.3 and ID3v2.4 frame, such as "TIT2"
+	APE  string `json:"ape,omitempty"`  // APEv2 item key, such as "Title"
+	INFO string `json:"info,omitempty"` // RIFF INFO chunk, such as "INAM"
+	MP4  string `json:"mp4,omitempty"`  // MP4 atom, such as "\xa9nam"
+}
+
+// Fields lists the fields that have different names in different formats.
+// Fields that are not listed are mapped by name, such as to a TXXX frame
+// in ID3v2 or to an item with the same name in APEv2. ReadFields changes
+// and extends this table.
+var Fields = []Field{
+	{"TITLE", "TIT2", "Title", "INAM", "\xa9nam"},
+	{"ARTIST", "TPE1", "Artist", "IART", "\xa9ART"},
+	{"ALBUM", "TALB", "Album", "IPRD", "\xa9alb"},
+	{"ALBUMARTIST", "TPE2", "Album Artist", "", "aART"},
+	{"COMPOSER", "TCOM", "Composer", "", "\xa9wrt"},
+	{"DATE", "TDRC", "Year", "ICRD", "\xa9day"},
+	{"GENRE", "TCON", "Genre", "IGNR", "\xa9gen"},
+	{"TRACKNUMBER", "TRCK", "Track", "ITRK", "trkn"},
+	{"DISCNUMBER", "TPOS", "Disc", "", "disk"},
+	{"COMMENT", "COMM", "Comment", "ICMT", "\xa9cmt"},
+	{"COPYRIGHT", "TCOP", "Copyright", "ICOP", "cprt"},
+	{"CONTACT", "WOAR", "Artist URL", "", ""},
+	{"ENCODED-BY", "TENC", "Encoded By", "ITCH", ""},
+	{"ENCODER", "TSSE", "Encoder", "ISFT", "\xa9too"},
+	{"LYRICS", "USLT", "Lyrics", "", "\xa9lyr"},
+	{"GROUPING", "TIT1", "Grouping", "", "\xa9grp"},
+	{"SUBTITLE", "TIT3", "Subtitle", "", ""},
+	{"ALBUMSORT", "TSOA", "", "", "soal"},
+	{"ARTISTSORT", "TSOP", "", "", "soar"},
+	{"TITLESORT", "TSOT", "", "", "sonm"},
+	{"ALBUMARTISTSORT", "TSO2", "", "", "soaa"},
+	{"COMPOSERSORT", "TSOC", "", "", "soco"},
+	{"ORIGINALDATE", "TDOR", "", "", ""},
+	{"CONDUCTOR", "TPE3", "Conductor", "", ""},
+	{"REMIXER", "TPE4", "MixArtist", "", ""},
+	{"LYRICIST", "TEXT", "Lyricist", "", ""},
+	{"LABEL", "TPUB", "Label", "", ""},
+	{"ISRC", "TSRC", "ISRC", "", ""},
+	{"BPM", "TBPM", "BPM", "", "tmpo"},
+	{"MOOD", "TMOO", "Mood", "", ""},
+	{"MEDIA", "TMED", "Media", "", ""},
+	{"LANGUAGE", "TLAN", "Language", "", ""},
+	{"COMPILATION", "TCMP", "Compilation", "", "cpil"},
+	{"MUSICBRAINZ_TRACKID", "UFID:http://musicbrainz.org", "", "", "----:com.apple.iTunes:MusicBrainz Track Id"},
+	{"MUSICBRAINZ_RELEASETRACKID", "TXXX:MusicBrainz Release Track Id", "", "", "----:com.apple.iTunes:MusicBrainz Release Track Id"},
+	{"MUSICBRAINZ_ALBUMID", "TXXX:MusicBrainz Album Id", "", "", "----:com.apple.iTunes:MusicBrainz Album Id"},
+	{"MUSICBRAINZ_ARTISTID", "TXXX:MusicBrainz Artist Id", "", "", "----:com.apple.iTunes:MusicBrainz Artist Id"},
+	{"MUSICBRAINZ_ALBUMARTISTID", "TXXX:MusicBrainz Album Artist Id", "", "", "----:com.apple.iTunes:MusicBrainz Album Artist Id"},
+	{"MUSICBRAINZ_RELEASEGROUPID", "TXXX:MusicBrainz Release Group Id", "", "", "----:com.apple.iTunes:MusicBrainz Release Group Id"},
+	{"MUSICBRAINZ_WORKID", "TXXX:MusicBrainz Work Id", "", "", "----:com.apple.iTunes:MusicBrainz Work Id"},
+	{"RELEASETYPE", "TXXX:MusicBrainz Album Type", "", "", "----:com.apple.iTunes:MusicBrainz Album Type"},
+	{"RELEASESTATUS", "TXXX:MusicBrainz Album Status", "", "", "----:com.apple.iTunes:MusicBrainz Album Status"},
+	{"RELEASECOUNTRY", "TXXX:MusicBrainz Album Release Country", "", "", "----:com.apple.iTunes:MusicBrainz Album Release Country"},
+	{"ACOUSTID_ID", "TXXX:Acoustid Id", "", "", "----:com.apple.iTunes:Acoustid Id"},
+	{"REPLAYGAIN_TRACK_GAIN", "", "", "", "----:com.apple.iTunes:replaygain_track_gain"},
+	{"REPLAYGAIN_TRACK_PEAK", "", "", "", "----:com.apple.iTunes:replaygain_track_peak"},
+	{"REPLAYGAIN_ALBUM_GAIN", "", "", "", "----:com.apple.iTunes:replaygain_album_gain"},
+	{"REPLAYGAIN_ALBUM_PEAK", "", "", "", "----:com.apple.iTunes:replaygain_album_peak"},
+}
+
+// FileFields are the fields that describe a file rather than its song,
+// such as the encoder. They are not carried from a source to its output.
+var FileFields = map[string]bool{
+	"ENCODER":         true,
+	"ENCODED-BY":      true,
+	"ENCODER_OPTIONS": true,
+}
+
+// ReadFields reads a JSON file with a list of fields, such as:
+//
+//  [
+//    {"name": "LABEL", "id3": "TXXX:LABEL"},
+//    {"name": "WORK", "id3": "TIT1", "mp4": "\u00a9wrk"}
+//  ]
+//
+// Each field replaces the field in Fields with the same name,
+// or is added to them.
+func ReadFields(file string) error {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var fs []Field
+	if err := json.Unmarshal(bs, &fs); err != nil {
+		return fmt.Errorf("cannot read %s: %s", file, err)
+	}
+	for _, f := range fs {
+		f.Name = strings.ToUpper(f.Name)
+		if f.Name == "" {
+			return fmt.Errorf("cannot read %s: field without name", file)
+		}
+		if !strings.HasPrefix(f.MP4, "----") {
+			// Atoms are named by bytes, such as 0xA9 for the © in ©nam.
+			b := make([]byte, 0, 4)
+			for _, r := range f.MP4 {
+				b = append(b, byte(r))
+			}
+			f.MP4 = string(b)
+		}
+		if g := ByName(f.Name); g != nil {
+			*g = f
+		} else {
+			Fields = append(Fields, f)
+		}
+	}
+	return nil
+}
+
+// ByName returns the field with the canonical name, or nil if it is not listed.
+func ByName(name string) *Field {
+	return field(func(f *Field) bool { return f.Name == name })
+}
+
+// ByID3 returns the field stored in the ID3v2 frame id, or nil. The id of
+// TXXX and UFID frames includes their description or owner, as in Field.
+func ByID3(id string) *Field {
+	return field(func(f *Field) bool { return strings.EqualFold(f.ID3, id) })
+}
+
+// ByMP4 returns the field stored in the MP4 atom name, or nil. The name of
+// a freeform atom is of the form ----:mean:name.
+func ByMP4(name string) *Field {
+	return field(func(f *Field) bool { return f.MP4 == name })
+}
+
+// field returns the field for which fn returns true.
+func field(fn func(f *Field) bool) *Field {
+	for i := range Fields {
+		if fn(&Fields[i]) {
+			return &Fields[i]
+		}
+	}
+	return nil
+}
+
+// FromINFO returns the tags from RIFF INFO chunks, indexed by chunk ID.
+func FromINFO(info map[string]string) Tags {
+	t := make(Tags)
+	for id, v := range info {
+		if f := field(func(f *Field) bool { return f.INFO == id }); f != nil {
+			t.Add(f.Name, v)
+		}
+	}
+	t.splitTotal("TRACKNUMBER", "TRACKTOTAL")
+	return t
+}
+
+// FromAPE returns the tags from APEv2 text items, indexed by item key.
+// Item keys are case-insensitive.
+func FromAPE(items map[string][]string) Tags {
+	t := make(Tags)
+	for k, v := range items {
+		name := strings.ToUpper(k)
+		if f := field(func(f *Field) bool { return strings.EqualFold(f.APE, k) }); f != nil {
+			name = f.Name
+		}
+		t.Add(name, v...)
+	}
+	t.splitTotal("TRACKNUMBER", "TRACKTOTAL")
+	t.splitTotal("DISCNUMBER", "DISCTOTAL")
+	return t
+}
+
+// FromID3 returns the tags from ID3v2 frames as read by the tag package.
+func FromID3(raw map[string]interface{}) Tags {
+	t := make(Tags)
+	for k, v := range raw {
+		// The tag package appends _0, _1, ... to repeated frames.
+		id := k
+		if i := strings.IndexByte(k, '_'); i >= 0 {
+			id = k[:i]
+		}
+
+		switch v := v.(type) {
+		case string:
+			f := field(func(f *Field) bool { return f.ID3 == id })
+			if f == nil {
+				continue
+			}
+			t.Add(f.Name, v)
+		case *tag.Comm:
+			switch id {
+			case "TXXX":
+				name := strings.ToUpper(v.Description)
+				if f := ByID3("TXXX:" + v.Description); f != nil {
+					name = f.Name
+				}
+				t.Add(name, v.Text)
+			case "COMM":
+				if v.Description == "" {
+					t.Add("COMMENT", v.Text)
+				}
+			case "USLT":
+				t.Add("LYRICS", v.Text)
+			}
+		}
+	}
+	if _, ok := t["DATE"]; !ok {
+		t.Add("DATE", strings.TrimSpace(stringOf(raw["TYER"])))
+	}
+	t.splitTotal("TRACKNUMBER", "TRACKTOTAL")
+	t.splitTotal("DISCNUMBER", "DISCTOTAL")
+	return t
+}
+
+func stringOf(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// SplitTotals splits track and disc numbers such as "3/12" into separate
+// number and total fields.
+func (t Tags) SplitTotals() {
+	t.splitTotal("TRACKNUMBER", "TRACKTOTAL")
+	t.splitTotal("DISCNUMBER", "DISCTOTAL")
+}
+
+// splitTotal splits values such as "3/12" into separate number and total fields.
+func (t Tags) splitTotal(number, total string) {
+	v := t.Get(number)
+	i := strings.IndexByte(v, '/')
+	if i < 0 {
+		return
+	}
+	t.Set(number, strings.TrimSpace(v[:i]))
+	if _, ok := t[total]; !ok {
+		t.Set(total, strings.TrimSpace(v[i+1:]))
+	}
+}
+
+// Metadata {{{
+
+// Tag formats that the tag package does not define.
+const (
+	APEv2 tag.Format = "APEv2"
+	INFO  tag.Format = "RIFF INFO"
+)
+
+var _ = tag.Metadata(new(Metadata))
+
+// Metadata implements the tag-related methods of tag.Metadata and
+// audio.Metadata for Tags. It is meant to be embedded by format-specific
+// metadata types, which add the remaining methods of audio.Metadata.
+type Metadata struct {
+	Tags     Tags
+	Pictures []*tag.Picture
+
+	format   tag.Format
+	fileType tag.FileType
+}
+
+func NewMetadata(format tag.Format, fileType tag.FileType, t Tags, pics []*tag.Picture) *Metadata {
+	if t == nil {
+		t = make(Tags)
+	}
+	return &Metadata{
+		Tags:     t,
+		Pictures: pics,
+		format:   format,
+		fileType: fileType,
+	}
+}
+
+func (m *Metadata) Format() tag.Format       { return m.format }
+func (m *Metadata) FileType() tag.FileType   { return m.fileType }
+func (m *Metadata) Title() string            { return m.Tags.Join("TITLE", "/") }
+func (m *Metadata) Album() string            { return m.Tags.Join("ALBUM", "/") }
+func (m *Metadata) Artist() string           { return m.Tags.Join("ARTIST", "/") }
+func (m *Metadata) AlbumArtist() string      { return m.Tags.Join("ALBUMARTIST", "/") }
+func (m *Metadata) Composer() string         { return m.Tags.Join("COMPOSER", "/") }
+func (m *Metadata) Genre() string            { return m.Tags.Join("GENRE", "/") }
+func (m *Metadata) Year() int                { return m.year() }
+func (m *Metadata) Track() (int, int)        { return m.int("TRACKNUMBER"), m.int("TRACKTOTAL") }
+func (m *Metadata) Disc() (int, int)         { return m.int("DISCNUMBER"), m.int("DISCTOTAL") }
+func (m *Metadata) Comment() string          { return m.Tags.Join("COMMENT", "\n") }
+func (m *Metadata) Lyrics() string           { return m.Tags.Get("LYRICS") }
+func (m *Metadata) Copyright() string        { return m.Tags.Join("COPYRIGHT", "\n") }
+func (m *Metadata) Website() string          { return m.Tags.Get("CONTACT") }
+func (m *Metadata) EncodedBy() string        { return m.Tags.Get("ENCODED-BY") }
+func (m *Metadata) EncoderSettings() string  { return m.Tags.Get("ENCODER") }
+func (m *Metadata) OriginalFilename() string { return m.Tags.Get("ORIGINALFILENAME") }
+
+// CanonicalTags returns all tags, including those that audio.Metadata
+// has no method for.
+func (m *Metadata) CanonicalTags() Tags { return m.Tags }
+
+func (m *Metadata) Picture() *tag.Picture {
+	for _, p := range m.Pictures {
+		if p.Type == "Cover (front)" {
+			return p
+		}
+	}
+	if len(m.Pictures) != 0 {
+		return m.Pictures[0]
+	}
+	return nil
+}
+
+// Raw returns the tags with lower-case names, similar to the raw tags of
+// Vorbis comments in the tag package. Multiple values are joined by ";".
+func (m *Metadata) Raw() map[string]interface{} {
+	raw := make(map[string]interface{}, len(m.Tags))
+	for k, v := range m.Tags {
+		raw[strings.ToLower(k)] = strings.Join(v, ";")
+	}
+	return raw
+}
+
+func (m *Metadata) year() int {
+	d := m.Tags.Get("DATE")
+	if len(d) < 4 {
+		return 0
+	}
+	y, _ := strconv.Atoi(d[:4])
+	return y
+}
+
+func (m *Metadata) int(key string) int {
+	i, _ := strconv.Atoi(strings.TrimSpace(m.Tags.Get(key)))
+	return i
+}
+
+// }}}
@@ -0,0 +1,289 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package tags
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dhowden/tag"
+	"github.com/goulash/audio"
+)
+
+func TestFromINFO(t *testing.T) {
+	got := FromINFO(map[string]string{
+		"INAM": "Song",
+		"IART": "Band",
+		"ITRK": "3/12",
+		"IXYZ": "unknown",
+	})
+	want := Tags{
+		"TITLE":       {"Song"},
+		"ARTIST":      {"Band"},
+		"TRACKNUMBER": {"3"},
+		"TRACKTOTAL":  {"12"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FromINFO = %v, want %v", got, want)
+	}
+}
+
+func TestFromAPE(t *testing.T) {
+	got := FromAPE(map[string][]string{
+		"title":        {"Song"},
+		"Album Artist": {"Band"},
+		"Genre":        {"Rock", "Pop"},
+		"Disc":         {"2/2"},
+		"Catalog":      {"ABC-1"},
+		"Empty":        {""},
+	})
+	want := Tags{
+		"TITLE":       {"Song"},
+		"ALBUMARTIST": {"Band"},
+		"GENRE":       {"Rock", "Pop"},
+		"DISCNUMBER":  {"2"},
+		"DISCTOTAL":   {"2"},
+		"CATALOG":     {"ABC-1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FromAPE = %v, want %v", got, want)
+	}
+}
+
+func TestFromID3(t *testing.T) {
+	got := FromID3(map[string]interface{}{
+		"TIT2":   "Song",
+		"TPE1":   "Band",
+		"TYER":   "1999 ",
+		"TRCK":   "3",
+		"TPOS":   "1/2",
+		"TXXX":   &tag.Comm{Description: "MusicBrainz Album Id", Text: "abc"},
+		"COMM":   &tag.Comm{Description: "", Text: "Nice"},
+		"COMM_0": &tag.Comm{Description: "iTunNORM", Text: "ignored"},
+		"USLT":   &tag.Comm{Text: "La la la"},
+		"XXXX":   "unknown",
+	})
+	want := Tags{
+		"TITLE":               {"Song"},
+		"ARTIST":              {"Band"},
+		"DATE":                {"1999"},
+		"TRACKNUMBER":         {"3"},
+		"DISCNUMBER":          {"1"},
+		"DISCTOTAL":           {"2"},
+		"MUSICBRAINZ_ALBUMID": {"abc"},
+		"COMMENT":             {"Nice"},
+		"LYRICS":              {"La la la"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FromID3 = %v, want %v", got, want)
+	}
+
+	// TDRC wins over TYER.
+	got = FromID3(map[string]interface{}{"TDRC": "2001-05-01", "TYER": "1999"})
+	if got.Get("DATE") != "2001-05-01" {
+		t.Errorf("date is %q, want 2001-05-01", got.Get("DATE"))
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	front := &tag.Picture{Type: "Cover (front)"}
+	m := NewMetadata(APEv2, "", Tags{
+		"ARTIST":      {"A", "B"},
+		"DATE":        {"1999-01-02"},
+		"TRACKNUMBER": {" 7 "},
+		"COMMENT":     {"one", "two"},
+	}, []*tag.Picture{{Type: "Other"}, front})
+
+	if m.Artist() != "A/B" {
+		t.Errorf("artist is %q, want A/B", m.Artist())
+	}
+	if m.Year() != 1999 {
+		t.Errorf("year is %d, want 1999", m.Year())
+	}
+	if n, total := m.Track(); n != 7 || total != 0 {
+		t.Errorf("track is %d of %d, want 7 of 0", n, total)
+	}
+	if m.Comment() != "one\ntwo" {
+		t.Errorf("comment is %q, want %q", m.Comment(), "one\ntwo")
+	}
+	if m.Picture() != front {
+		t.Errorf("picture is %+v, want the front cover", m.Picture())
+	}
+	if raw := m.Raw(); raw["artist"] != "A;B" {
+		t.Errorf("raw artist is %v, want A;B", raw["artist"])
+	}
+
+	empty := NewMetadata(INFO, "", nil, nil)
+	if empty.Title() != "" || empty.Year() != 0 || empty.Picture() != nil {
+		t.Errorf("empty metadata is not empty: %+v", empty)
+	}
+}
+
+func TestTags(t *testing.T) {
+	tt := make(Tags)
+	tt.Add("GENRE", "Rock", "", "Pop")
+	tt.Add("TITLE", "")
+	if !reflect.DeepEqual(tt, Tags{"GENRE": {"Rock", "Pop"}}) {
+		t.Errorf("Add skipped the wrong values: %v", tt)
+	}
+	tt.Set("GENRE", "Jazz")
+	tt.Set("ALBUM", "Record")
+	if tt.Join("GENRE", ";") != "Jazz" || tt.Get("ALBUM") != "Record" {
+		t.Errorf("Set did not replace the values: %v", tt)
+	}
+	if keys := tt.Keys(); !reflect.DeepEqual(keys, []string{"ALBUM", "GENRE"}) {
+		t.Errorf("keys are %v, want sorted", keys)
+	}
+}
+
+func TestFields(t *testing.T) {
+	tests := []struct {
+		field *Field
+		want  string
+	}{
+		{ByName("TITLE"), "TITLE"},
+		{ByID3("TIT2"), "TITLE"},
+		{ByID3("TDRC"), "DATE"},
+		{ByID3("txxx:musicbrainz album id"), "MUSICBRAINZ_ALBUMID"},
+		{ByID3("UFID:http://musicbrainz.org"), "MUSICBRAINZ_TRACKID"},
+		{ByMP4("\xa9nam"), "TITLE"},
+		{ByMP4("trkn"), "TRACKNUMBER"},
+		{ByMP4("----:com.apple.iTunes:MusicBrainz Album Id"), "MUSICBRAINZ_ALBUMID"},
+	}
+	for i, tt := range tests {
+		if tt.field == nil || tt.field.Name != tt.want {
+			t.Errorf("%d: field is %+v, want %s", i, tt.field, tt.want)
+		}
+	}
+	if f := ByName("UNKNOWN"); f != nil {
+		t.Errorf("unknown field is %+v", f)
+	}
+	if f := ByMP4("----:com.apple.iTunes:MusicBrainz album id"); f != nil {
+		t.Errorf("MP4 names are case-sensitive, but found %+v", f)
+	}
+}
+
+func TestReadFields(t *testing.T) {
+	saved := append([]Field(nil), Fields...)
+	defer func() { Fields = saved }()
+
+	dir, err := ioutil.TempDir("", "tags-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "fields.json")
+	write := func(s string) {
+		if err := ioutil.WriteFile(file, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`[
+		{"name": "label", "id3": "TXXX:LABEL"},
+		{"name": "WORK", "id3": "TIT1", "mp4": "©wrk"},
+		{"name": "PODCAST", "mp4": "----:com.apple.iTunes:Podcast"}
+	]`)
+	if err := ReadFields(file); err != nil {
+		t.Fatal(err)
+	}
+	if f := ByName("LABEL"); f == nil || f.ID3 != "TXXX:LABEL" || f.APE != "" {
+		t.Errorf("LABEL is %+v, want it replaced", f)
+	}
+	if len(Fields) != len(saved)+2 {
+		t.Errorf("there are %d fields, want %d", len(Fields), len(saved)+2)
+	}
+	if f := ByMP4("\xa9wrk"); f == nil || f.Name != "WORK" {
+		t.Errorf("\\xa9wrk is %+v, want WORK", f)
+	}
+	if f := ByMP4("----:com.apple.iTunes:Podcast"); f == nil || f.Name != "PODCAST" {
+		t.Errorf("freeform atom is %+v, want PODCAST", f)
+	}
+
+	for _, s := range []string{`[{"id3": "TIT1"}]`, `{"name": "WORK"}`} {
+		write(s)
+		if err := ReadFields(file); err == nil {
+			t.Errorf("%s: reading the fields succeeded", s)
+		}
+	}
+	if err := ReadFields(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("reading a missing file succeeded")
+	}
+}
+
+func TestVorbisComment(t *testing.T) {
+	comments := []string{"TITLE=Song", "ARTIST=Ансамбль", "EMPTY="}
+	b := EncodeVorbisComment("lackey", comments)
+	vendor, got, err := ParseVorbisComment(append(b, 1)) // framing bit
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vendor != "lackey" || !reflect.DeepEqual(got, comments) {
+		t.Errorf("comment read back is %q %q, want %q %q", vendor, got, "lackey", comments)
+	}
+
+	for _, b := range [][]byte{nil, b[:3], b[:len(b)-1], b[:10]} {
+		if _, _, err := ParseVorbisComment(b); err != ErrInvalidComment {
+			t.Errorf("% x: error is %v, want %v", b, err, ErrInvalidComment)
+		}
+	}
+}
+
+func TestFromVorbis(t *testing.T) {
+	got := FromVorbis([]string{
+		"title=Song",
+		"ARTIST=A",
+		"Artist=B",
+		"TRACKNUMBER=3/12",
+		"METADATA_BLOCK_PICTURE=AAAA",
+		"coverart=AAAA",
+		"=nameless",
+		"invalid",
+	})
+	want := Tags{
+		"TITLE":       {"Song"},
+		"ARTIST":      {"A", "B"},
+		"TRACKNUMBER": {"3"},
+		"TRACKTOTAL":  {"12"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FromVorbis = %v, want %v", got, want)
+	}
+	cs := []string{"ARTIST=A", "ARTIST=B", "TITLE=Song", "TRACKNUMBER=3", "TRACKTOTAL=12"}
+	if got := got.Vorbis(); !reflect.DeepEqual(got, cs) {
+		t.Errorf("Vorbis = %q, want %q", got, cs)
+	}
+}
+
+// fileMetadata adds the methods of audio.Metadata that Metadata lacks.
+type fileMetadata struct{ *Metadata }
+
+func (fileMetadata) Length() time.Duration { return 0 }
+func (fileMetadata) Encoding() audio.Codec { return audio.FLAC }
+func (fileMetadata) EncodingBitrate() int  { return -1 }
+
+func TestFromMetadata(t *testing.T) {
+	m := NewMetadata(APEv2, "", Tags{
+		"TITLE":       {"Song"},
+		"DATE":        {"1999-01-02"},
+		"TRACKNUMBER": {"3"},
+		"TRACKTOTAL":  {"12"},
+		"MOOD":        {"calm"},
+	}, nil)
+	got := FromMetadata(fileMetadata{m})
+	want := Tags{
+		"TITLE":       {"Song"},
+		"DATE":        {"1999"},
+		"TRACKNUMBER": {"3"},
+		"TRACKTOTAL":  {"12"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FromMetadata = %v, want %v", got, want)
+	}
+}
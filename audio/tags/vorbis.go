@@ -0,0 +1,136 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package tags
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/goulash/audio"
+)
+
+var ErrInvalidComment = errors.New("invalid Vorbis comment")
+
+// ParseVorbisComment parses a Vorbis comment header as used by Vorbis, Opus,
+// and FLAC, without any prefix of the codec. Data after the comments,
+// such as the framing bit of Vorbis, is ignored.
+func ParseVorbisComment(b []byte) (vendor string, comments []string, err error) {
+	next := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			return "", false
+		}
+		s := string(b[4 : 4+n])
+		b = b[4+n:]
+		return s, true
+	}
+
+	vendor, ok := next()
+	if !ok || len(b) < 4 {
+		return "", nil, ErrInvalidComment
+	}
+	n := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	for i := uint32(0); i < n; i++ {
+		c, ok := next()
+		if !ok {
+			return "", nil, ErrInvalidComment
+		}
+		comments = append(comments, c)
+	}
+	return vendor, comments, nil
+}
+
+// EncodeVorbisComment encodes a Vorbis comment header with the vendor
+// and the comments, without any prefix of the codec.
+func EncodeVorbisComment(vendor string, comments []string) []byte {
+	b := make([]byte, 0, 8+len(vendor))
+	put := func(s string) {
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(s)))
+		b = append(b, s...)
+	}
+	put(vendor)
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(comments)))
+	for _, c := range comments {
+		put(c)
+	}
+	return b
+}
+
+// pictureComments are Vorbis comments that contain pictures, not tags.
+var pictureComments = map[string]bool{
+	"METADATA_BLOCK_PICTURE": true,
+	"COVERART":               true,
+	"COVERARTMIME":           true,
+}
+
+// IsPictureComment returns true if the Vorbis comment c contains a picture.
+func IsPictureComment(c string) bool {
+	i := strings.IndexByte(c, '=')
+	return i >= 0 && pictureComments[strings.ToUpper(c[:i])]
+}
+
+// FromVorbis returns the tags from Vorbis comments such as "TITLE=Song".
+// Comments that contain pictures are skipped.
+func FromVorbis(comments []string) Tags {
+	t := make(Tags)
+	for _, c := range comments {
+		i := strings.IndexByte(c, '=')
+		if i <= 0 || IsPictureComment(c) {
+			continue
+		}
+		t.Add(strings.ToUpper(c[:i]), c[i+1:])
+	}
+	t.SplitTotals()
+	return t
+}
+
+// Vorbis returns the tags as Vorbis comments, one for each value.
+func (t Tags) Vorbis() []string {
+	var cs []string
+	for _, k := range t.Keys() {
+		for _, v := range t[k] {
+			cs = append(cs, k+"="+v)
+		}
+	}
+	return cs
+}
+
+// FromMetadata returns the tags for the fields of m, for formats
+// whose tags cannot be read completely.
+func FromMetadata(m audio.Metadata) Tags {
+	itoa := func(i int) string {
+		if i == 0 {
+			return ""
+		}
+		return fmt.Sprint(i)
+	}
+	t := make(Tags)
+	t.Add("TITLE", m.Title())
+	t.Add("ARTIST", m.Artist())
+	t.Add("ALBUM", m.Album())
+	t.Add("ALBUMARTIST", m.AlbumArtist())
+	t.Add("COMPOSER", m.Composer())
+	t.Add("DATE", itoa(m.Year()))
+	t.Add("GENRE", m.Genre())
+	track, tracks := m.Track()
+	t.Add("TRACKNUMBER", itoa(track))
+	t.Add("TRACKTOTAL", itoa(tracks))
+	disc, discs := m.Disc()
+	t.Add("DISCNUMBER", itoa(disc))
+	t.Add("DISCTOTAL", itoa(discs))
+	t.Add("COMMENT", m.Comment())
+	t.Add("COPYRIGHT", m.Copyright())
+	t.Add("CONTACT", m.Website())
+	t.Add("ORIGINALFILENAME", m.OriginalFilename())
+	return t
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// WriteHeader writes a canonical 44-byte WAV header for audio data in the
+// format f, which must be little-endian. If the data is larger than what
+// the header can describe, the sizes are set to the maximum, which most
+// programs take to mean that the data extends to the end of the stream.
+func WriteHeader(w io.Writer, f *Format) error {
+	size := f.DataSize
+	if size > 0xFFFFFFFF-36 {
+		size = 0xFFFFFFFF - 36
+	}
+	bytesPerFrame := f.Channels * ((f.BitsPerSample + 7) / 8)
+
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+size))
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, uint32(16))
+	binary.Write(&b, binary.LittleEndian, f.Tag)
+	binary.Write(&b, binary.LittleEndian, uint16(f.Channels))
+	binary.Write(&b, binary.LittleEndian, uint32(f.SampleRate))
+	binary.Write(&b, binary.LittleEndian, uint32(f.SampleRate*bytesPerFrame))
+	binary.Write(&b, binary.LittleEndian, uint16(bytesPerFrame))
+	binary.Write(&b, binary.LittleEndian, uint16(f.BitsPerSample))
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(size))
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// ReadHeader reads the header of a WAV stream up to the start of the audio
+// data. It returns the format of the stream and a reader of the complete
+// stream, including the header that was read, even if the header is invalid.
+// The sizes in the header of a stream are often wrong, since the length is
+// not known in advance.
+func ReadHeader(r io.Reader) (*Format, io.Reader, error) {
+	var hdr bytes.Buffer
+	tee := io.TeeReader(r, &hdr)
+	b := make([]byte, 12)
+	if _, err := io.ReadFull(tee, b); err != nil {
+		return nil, io.MultiReader(&hdr, r), ErrNotWAV
+	}
+	if (string(b[:4]) != "RIFF" && string(b[:4]) != "RF64") || string(b[8:]) != "WAVE" {
+		return nil, io.MultiReader(&hdr, r), ErrNotWAV
+	}
+
+	le := binary.LittleEndian
+	var format *Format
+	for {
+		h := make([]byte, 8)
+		if _, err := io.ReadFull(tee, h); err != nil {
+			return nil, io.MultiReader(&hdr, r), ErrNoData
+		}
+		size := int64(le.Uint32(h[4:]))
+		if string(h[:4]) == "data" {
+			if format == nil {
+				return nil, io.MultiReader(&hdr, r), ErrInvalidWAV
+			}
+			format.DataSize = size
+			format.DataOffset = int64(hdr.Len())
+			return format, io.MultiReader(&hdr, r), nil
+		}
+
+		// Chunks are padded to an even size. Other chunks in front of the
+		// data are small, so anything else is not a stream we can read.
+		size += size & 1
+		if size > 1<<20 {
+			return nil, io.MultiReader(&hdr, r), ErrInvalidWAV
+		}
+		c := make([]byte, size)
+		if _, err := io.ReadFull(tee, c); err != nil {
+			return nil, io.MultiReader(&hdr, r), ErrInvalidWAV
+		}
+		if string(h[:4]) == "fmt " && size >= 16 {
+			format = &Format{
+				Tag:           le.Uint16(c[0:2]),
+				Channels:      int(le.Uint16(c[2:4])),
+				SampleRate:    int(le.Uint32(c[4:8])),
+				BitsPerSample: int(le.Uint16(c[14:16])),
+			}
+			if format.Tag == 0xFFFE && size >= 26 {
+				// WAVE_FORMAT_EXTENSIBLE: the actual format tag is the
+				// start of the sub-format GUID.
+				format.Tag = le.Uint16(c[24:26])
+			}
+		}
+	}
+}
+
+// NewReader returns a canonical WAV stream of the audio data in a WAV or
+// AIFF file, without any other chunks. Big-endian AIFF samples are converted
+// to little-endian, which is what programs that read WAV expect.
+func NewReader(file string) (io.ReadCloser, *Format, error) {
+	m, err := ReadMetadata(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	format := *m.AudioFormat()
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	var data io.Reader = io.NewSectionReader(f, format.DataOffset, format.DataSize)
+	if format.BigEndian {
+		data = &swapReader{r: data, width: (format.BitsPerSample + 7) / 8}
+		format.BigEndian = false
+	}
+
+	var hdr bytes.Buffer
+	if err := WriteHeader(&hdr, &format); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &reader{Reader: io.MultiReader(&hdr, data), f: f}, &format, nil
+}
+
+type reader struct {
+	io.Reader
+	f *os.File
+}
+
+func (r *reader) Close() error { return r.f.Close() }
+
+// swapReader reverses the byte order of samples that are width bytes wide.
+// 8-bit samples are converted from signed to unsigned instead.
+type swapReader struct {
+	r     io.Reader
+	width int
+	buf   []byte
+	out   []byte
+}
+
+func (s *swapReader) Read(p []byte) (int, error) {
+	if len(s.out) == 0 {
+		if s.buf == nil {
+			s.buf = make([]byte, 4096*s.width)
+		}
+		n, err := io.ReadFull(s.r, s.buf)
+		n -= n % s.width
+		if n == 0 {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		s.out = s.buf[:n]
+		for i := 0; i < n; i += s.width {
+			x := s.out[i : i+s.width]
+			if s.width == 1 {
+				x[0] ^= 0x80
+				continue
+			}
+			for j, k := 0, len(x)-1; j < k; j, k = j+1, k-1 {
+				x[j], x[k] = x[k], x[j]
+			}
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// decode returns the format and the WAV stream that NewReader returns
+// for the file data.
+func decode(t *testing.T, data []byte) (*Format, []byte) {
+	dir, err := ioutil.TempDir("", "wav-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, f, err := NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, b
+}
+
+// canonical returns a canonical WAV stream of the samples in format f.
+func canonical(f *Format, samples []byte) []byte {
+	var b bytes.Buffer
+	WriteHeader(&b, f)
+	b.Write(samples)
+	return b.Bytes()
+}
+
+func TestReaderWAV(t *testing.T) {
+	le := binary.LittleEndian
+	samples := bytes.Repeat([]byte{1, 2, 3, 4}, 8)
+	list := chunk(le, "LIST", []byte("INFO"), chunk(le, "INAM", []byte("Song")))
+	f, got := decode(t, riff(fmtChunk(2, 8000, 16), list, chunk(le, "data", samples)))
+
+	want := &Format{Tag: 1, Channels: 2, SampleRate: 8000, BitsPerSample: 16, DataSize: 32}
+	if !bytes.Equal(got, canonical(want, samples)) {
+		t.Errorf("stream is % x, want only the header and the samples", got)
+	}
+	if f.Channels != 2 || f.SampleRate != 8000 || f.BitsPerSample != 16 || f.BigEndian {
+		t.Errorf("format is %+v, want 16-bit stereo at 8 kHz", f)
+	}
+}
+
+func TestReaderAIFF(t *testing.T) {
+	be := binary.BigEndian
+	tests := []struct {
+		bits    int
+		samples []byte
+		want    []byte
+	}{
+		{8, []byte{0x00, 0x7f, 0x80, 0xff}, []byte{0x80, 0xff, 0x00, 0x7f}},
+		{16, []byte{0x12, 0x34, 0xab, 0xcd}, []byte{0x34, 0x12, 0xcd, 0xab}},
+		{24, []byte{0x12, 0x34, 0x56, 0xab, 0xcd, 0xef}, []byte{0x56, 0x34, 0x12, 0xef, 0xcd, 0xab}},
+	}
+	for _, tt := range tests {
+		// The samples are repeated for a millisecond.
+		samples := bytes.Repeat(tt.samples, 4)
+		frames := len(samples) / ((tt.bits + 7) / 8)
+		ssnd := chunk(be, "SSND", make([]byte, 8), samples)
+		f, got := decode(t, form("AIFF", commChunk(1, frames, tt.bits, 8000, ""), ssnd))
+
+		want := &Format{Tag: 1, Channels: 1, SampleRate: 8000, BitsPerSample: tt.bits, DataSize: int64(len(samples))}
+		if !bytes.Equal(got, canonical(want, bytes.Repeat(tt.want, 4))) {
+			t.Errorf("%d bits: stream is % x, want samples % x", tt.bits, got, tt.want)
+		}
+		if f.BigEndian {
+			t.Errorf("%d bits: format of the stream is big-endian", tt.bits)
+		}
+	}
+
+	// Little-endian AIFF-C samples are not swapped.
+	samples := bytes.Repeat([]byte{0x12, 0x34}, 8)
+	ssnd := chunk(be, "SSND", make([]byte, 8), samples)
+	_, got := decode(t, form("AIFC", commChunk(1, 8, 16, 8000, "sowt"), ssnd))
+	want := &Format{Tag: 1, Channels: 1, SampleRate: 8000, BitsPerSample: 16, DataSize: 16}
+	if !bytes.Equal(got, canonical(want, samples)) {
+		t.Errorf("sowt: stream is % x, want samples % x", got, samples)
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	f := &Format{Tag: 1, Channels: 2, SampleRate: 48000, BitsPerSample: 24, DataSize: 6 * 480}
+	m, err := readFile(t, canonical(f, make([]byte, f.DataSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := m.AudioFormat()
+	if got.Channels != 2 || got.SampleRate != 48000 || got.BitsPerSample != 24 || got.Frames != 480 {
+		t.Errorf("format read back is %+v, want %+v", got, f)
+	}
+
+	// Streams that are too large have the maximum size.
+	var b bytes.Buffer
+	WriteHeader(&b, &Format{Tag: 1, Channels: 2, SampleRate: 44100, BitsPerSample: 16, DataSize: 1 << 33})
+	if size := binary.LittleEndian.Uint32(b.Bytes()[4:]); size != 0xFFFFFFFF {
+		t.Errorf("RIFF size is %#x, want 0xFFFFFFFF", size)
+	}
+	if b.Len() != 44 {
+		t.Errorf("header is %d bytes, want 44", b.Len())
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	le := binary.LittleEndian
+	samples := bytes.Repeat([]byte{1, 2}, 8)
+	stream := riff(fmtChunk(1, 8000, 16), chunk(le, "LIST", []byte("INFO")), chunk(le, "data", samples))
+	// Streams often have no sizes, since their length is not known.
+	le.PutUint32(stream[4:], 0xFFFFFFFF)
+
+	f, r, err := ReadHeader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Channels != 1 || f.SampleRate != 8000 || f.BitsPerSample != 16 || f.DataSize != 16 || f.DataOffset != 56 {
+		t.Errorf("format is %+v, want 16 bytes at 56 of 16-bit mono at 8 kHz", f)
+	}
+	if b, _ := ioutil.ReadAll(r); !bytes.Equal(b, stream) {
+		t.Errorf("stream after the header is % x, want all of it", b)
+	}
+
+	// WAVE_FORMAT_EXTENSIBLE has the format tag in its sub-format GUID.
+	ext := make([]byte, 40)
+	le.PutUint16(ext[0:], 0xFFFE)
+	le.PutUint16(ext[2:], 2)
+	le.PutUint32(ext[4:], 48000)
+	le.PutUint16(ext[14:], 32)
+	le.PutUint16(ext[16:], 22)
+	le.PutUint16(ext[24:], 3)
+	f, _, err = ReadHeader(bytes.NewReader(riff(chunk(le, "fmt ", ext), chunk(le, "data", samples))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Tag != 3 || f.Channels != 2 || f.BitsPerSample != 32 {
+		t.Errorf("extensible format is %+v, want the tag 3 of 32-bit floats", f)
+	}
+
+	tests := []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"not wav", []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00"), ErrNotWAV},
+		{"no data", riff(fmtChunk(1, 8000, 16)), ErrNoData},
+		{"data first", riff(chunk(le, "data", samples), fmtChunk(1, 8000, 16)), ErrInvalidWAV},
+	}
+	for _, tt := range tests {
+		_, r, err := ReadHeader(bytes.NewReader(tt.stream))
+		if err != tt.err {
+			t.Errorf("%s: error is %v, want %v", tt.name, err, tt.err)
+		}
+		if b, _ := ioutil.ReadAll(r); !bytes.Equal(b, tt.stream) {
+			t.Errorf("%s: stream after the error is % x, want all of it", tt.name, b)
+		}
+	}
+}
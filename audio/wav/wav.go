@@ -0,0 +1,426 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package wav reads metadata from WAV and AIFF files.
+//
+// Both formats consist of chunks, and neither has a standard tag format.
+// We read ID3v2 tags from an "id3 " chunk if there is one, and fall back
+// to the RIFF INFO list or the AIFF text chunks otherwise.
+//
+// Reference
+//
+//  http://soundfile.sapp.org/doc/WaveFormat/
+//  https://tech.ebu.ch/docs/tech/tech3306v1_1.pdf (RF64)
+//  http://paulbourke.net/dataformats/audio/ (AIFF)
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/cassava/lackey/audio/bitrate"
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/dhowden/tag"
+	"github.com/goulash/audio"
+	"github.com/goulash/stat"
+)
+
+var (
+	ErrNotWAV     = errors.New("file is not a WAV or AIFF file")
+	ErrInvalidWAV = errors.New("invalid WAV or AIFF chunk")
+	ErrNoData     = errors.New("file contains no audio data")
+)
+
+// The tag package does not define these for WAV and AIFF files.
+const (
+	AIFFText tag.Format   = "AIFF"
+	WAV      tag.FileType = "WAV"
+	AIFF     tag.FileType = "AIFF"
+)
+
+var Stats struct {
+	ReadMetadata stat.Run
+}
+
+func init() {
+	reader := func(file string) (audio.Metadata, error) {
+		return ReadMetadata(file)
+	}
+	audio.MetadataReaders[audio.WAV] = reader
+	audio.MetadataReaders[codec.AIFF] = reader
+}
+
+// ReadMetadata {{{
+
+// Format describes the audio samples in a WAV or AIFF file.
+type Format struct {
+	// Tag is the WAVE format tag, such as 1 for PCM or 3 for IEEE float.
+	// For AIFF it is always 1.
+	Tag           uint16
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+	// Frames is the number of samples per channel.
+	Frames int64
+	// DataSize is the size of the audio data in bytes.
+	DataSize int64
+	// DataOffset is the offset of the audio data in the file.
+	DataOffset int64
+	// BigEndian is true for AIFF files with big-endian samples.
+	BigEndian bool
+}
+
+// Duration returns the length of the audio data.
+func (f *Format) Duration() time.Duration {
+	if f.SampleRate == 0 {
+		return 0
+	}
+	return time.Duration(f.Frames) * time.Second / time.Duration(f.SampleRate)
+}
+
+// ReadMetadata reads the tags and the audio format of a WAV or AIFF file.
+func ReadMetadata(file string) (*Metadata, error) {
+	start := time.Now()
+	defer func() { Stats.ReadMetadata.Add(float64(time.Since(start))) }()
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return nil, ErrNotWAV
+	}
+	var r chunkReader
+	switch {
+	case (string(hdr[:4]) == "RIFF" || string(hdr[:4]) == "RF64") && string(hdr[8:]) == "WAVE":
+		r = &riffReader{f: f, size: fi.Size()}
+	case string(hdr[:4]) == "FORM" && (string(hdr[8:]) == "AIFF" || string(hdr[8:]) == "AIFC"):
+		r = &aiffReader{f: f, size: fi.Size(), aifc: string(hdr[8:]) == "AIFC"}
+	default:
+		return nil, ErrNotWAV
+	}
+
+	format, md, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	if format == nil {
+		return nil, ErrNoData
+	}
+	m := &Metadata{
+		Metadata: md,
+		format:   format,
+		codec:    r.Codec(),
+	}
+	m.bitrate = bitrate.Average(format.DataSize, format.Duration())
+	return m, nil
+}
+
+type chunkReader interface {
+	Codec() audio.Codec
+	Read() (*Format, *tags.Metadata, error)
+}
+
+// readChunk reads the content of the chunk at offset.
+func readChunk(f *os.File, fsize, offset, size int64) ([]byte, error) {
+	if offset+size > fsize {
+		return nil, ErrInvalidWAV
+	}
+	b := make([]byte, size)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		return nil, ErrInvalidWAV
+	}
+	return b, nil
+}
+
+// readID3Chunk reads an ID3v2 tag stored in a chunk.
+func readID3Chunk(b []byte, fileType tag.FileType) (*tags.Metadata, error) {
+	tm, err := tag.ReadID3v2Tags(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	var pics []*tag.Picture
+	if p := tm.Picture(); p != nil {
+		pics = append(pics, p)
+	}
+	return tags.NewMetadata(tm.Format(), fileType, tags.FromID3(tm.Raw()), pics), nil
+}
+
+// }}}
+
+// RIFF {{{
+
+type riffReader struct {
+	f    *os.File
+	size int64
+}
+
+func (r *riffReader) Codec() audio.Codec { return audio.WAV }
+
+func (r *riffReader) Read() (*Format, *tags.Metadata, error) {
+	var (
+		format   Format
+		found    bool
+		dataSize int64 = -1
+		info     = make(map[string]string)
+		id3      *tags.Metadata
+	)
+
+	offset := int64(12)
+	for offset+8 <= r.size {
+		h := make([]byte, 8)
+		if _, err := r.f.ReadAt(h, offset); err != nil {
+			return nil, nil, ErrInvalidWAV
+		}
+		id := string(h[:4])
+		size := int64(binary.LittleEndian.Uint32(h[4:]))
+		offset += 8
+
+		switch id {
+		case "ds64":
+			// RF64 stores the sizes that do not fit in 32 bits here.
+			b, err := readChunk(r.f, r.size, offset, size)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(b) >= 16 {
+				dataSize = int64(binary.LittleEndian.Uint64(b[8:16]))
+			}
+		case "fmt ":
+			b, err := readChunk(r.f, r.size, offset, size)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(b) < 16 {
+				return nil, nil, ErrInvalidWAV
+			}
+			format.Tag = binary.LittleEndian.Uint16(b[0:2])
+			format.Channels = int(binary.LittleEndian.Uint16(b[2:4]))
+			format.SampleRate = int(binary.LittleEndian.Uint32(b[4:8]))
+			format.BitsPerSample = int(binary.LittleEndian.Uint16(b[14:16]))
+			if format.Tag == 0xFFFE && len(b) >= 26 {
+				// WAVE_FORMAT_EXTENSIBLE: the actual format tag is the
+				// start of the sub-format GUID.
+				format.Tag = binary.LittleEndian.Uint16(b[24:26])
+			}
+			found = true
+		case "data":
+			if size == 0xFFFFFFFF && dataSize >= 0 {
+				size = dataSize
+			}
+			if offset+size > r.size {
+				// The size is often wrong for files that were streamed.
+				size = r.size - offset
+			}
+			format.DataSize = size
+			format.DataOffset = offset
+		case "LIST":
+			b, err := readChunk(r.f, r.size, offset, size)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(b) >= 4 && string(b[:4]) == "INFO" {
+				readINFO(b[4:], info)
+			}
+		case "id3 ", "ID3 ":
+			b, err := readChunk(r.f, r.size, offset, size)
+			if err != nil {
+				return nil, nil, err
+			}
+			id3, _ = readID3Chunk(b, WAV)
+		}
+
+		// Chunks are padded to an even size.
+		offset += size + size&1
+	}
+
+	if !found {
+		return nil, nil, nil
+	}
+	if format.Channels != 0 && format.BitsPerSample != 0 {
+		format.Frames = format.DataSize / int64(format.Channels*((format.BitsPerSample+7)/8))
+	}
+	if id3 != nil {
+		return &format, id3, nil
+	}
+	return &format, tags.NewMetadata(tags.INFO, WAV, tags.FromINFO(info), nil), nil
+}
+
+// readINFO reads the sub-chunks of a LIST INFO chunk into info.
+func readINFO(b []byte, info map[string]string) {
+	for len(b) >= 8 {
+		id := string(b[:4])
+		size := int(binary.LittleEndian.Uint32(b[4:8]))
+		b = b[8:]
+		if size > len(b) {
+			return
+		}
+		info[id] = string(bytes.TrimRight(b[:size], "\x00"))
+		size += size & 1
+		if size > len(b) {
+			return
+		}
+		b = b[size:]
+	}
+}
+
+// }}}
+
+// AIFF {{{
+
+type aiffReader struct {
+	f    *os.File
+	size int64
+	aifc bool
+}
+
+func (r *aiffReader) Codec() audio.Codec { return codec.AIFF }
+
+func (r *aiffReader) Read() (*Format, *tags.Metadata, error) {
+	var (
+		format Format
+		found  bool
+		text   = make(tags.Tags)
+		id3    *tags.Metadata
+	)
+	format.Tag = 1
+	format.BigEndian = true
+
+	offset := int64(12)
+	for offset+8 <= r.size {
+		h := make([]byte, 8)
+		if _, err := r.f.ReadAt(h, offset); err != nil {
+			return nil, nil, ErrInvalidWAV
+		}
+		id := string(h[:4])
+		size := int64(binary.BigEndian.Uint32(h[4:]))
+		offset += 8
+
+		switch id {
+		case "COMM":
+			// channels(2) frames(4) bits(2) rate(10, 80-bit extended)
+			// and for AIFF-C: compression type(4) and name
+			b, err := readChunk(r.f, r.size, offset, size)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(b) < 18 {
+				return nil, nil, ErrInvalidWAV
+			}
+			format.Channels = int(binary.BigEndian.Uint16(b[0:2]))
+			format.Frames = int64(binary.BigEndian.Uint32(b[2:6]))
+			format.BitsPerSample = int(binary.BigEndian.Uint16(b[6:8]))
+			format.SampleRate = int(extended(b[8:18]))
+			if r.aifc && len(b) >= 22 {
+				switch string(b[18:22]) {
+				case "sowt":
+					format.BigEndian = false
+				case "fl32", "FL32", "fl64", "FL64":
+					format.Tag = 3
+				}
+			}
+			found = true
+		case "SSND":
+			// offset(4) blocksize(4) data
+			b, err := readChunk(r.f, r.size, offset, 8)
+			if err != nil {
+				return nil, nil, err
+			}
+			skip := int64(binary.BigEndian.Uint32(b[0:4]))
+			format.DataOffset = offset + 8 + skip
+			format.DataSize = size - 8 - skip
+			if offset+size > r.size {
+				format.DataSize = r.size - format.DataOffset
+			}
+		case "NAME", "AUTH", "(c) ", "ANNO":
+			b, err := readChunk(r.f, r.size, offset, size)
+			if err != nil {
+				return nil, nil, err
+			}
+			v := string(bytes.TrimRight(b, "\x00"))
+			switch id {
+			case "NAME":
+				text.Add("TITLE", v)
+			case "AUTH":
+				text.Add("ARTIST", v)
+			case "(c) ":
+				text.Add("COPYRIGHT", v)
+			case "ANNO":
+				text.Add("COMMENT", v)
+			}
+		case "ID3 ", "id3 ":
+			b, err := readChunk(r.f, r.size, offset, size)
+			if err != nil {
+				return nil, nil, err
+			}
+			id3, _ = readID3Chunk(b, AIFF)
+		}
+
+		offset += size + size&1
+	}
+
+	if !found {
+		return nil, nil, nil
+	}
+	if id3 != nil {
+		return &format, id3, nil
+	}
+	return &format, tags.NewMetadata(AIFFText, AIFF, text, nil), nil
+}
+
+// extended converts an 80-bit IEEE 754 extended precision number.
+func extended(b []byte) float64 {
+	exp := int(binary.BigEndian.Uint16(b[0:2]))
+	mant := binary.BigEndian.Uint64(b[2:10])
+	sign := 1.0
+	if exp&0x8000 != 0 {
+		sign = -1
+		exp &= 0x7FFF
+	}
+	if exp == 0 && mant == 0 {
+		return 0
+	}
+	return sign * math.Ldexp(float64(mant), exp-16383-63)
+}
+
+// }}}
+
+// Metadata {{{
+
+var _ = audio.Metadata(new(Metadata))
+
+type Metadata struct {
+	*tags.Metadata
+
+	codec   audio.Codec
+	format  *Format
+	bitrate int
+}
+
+func (m *Metadata) Length() time.Duration { return m.format.Duration() }
+func (m *Metadata) Encoding() audio.Codec { return m.codec }
+func (m *Metadata) EncodingBitrate() int  { return m.bitrate }
+
+// AudioFormat returns the format of the audio samples.
+func (m *Metadata) AudioFormat() *Format { return m.format }
+
+func (m *Metadata) SampleRate() int { return m.format.SampleRate }
+func (m *Metadata) BitDepth() int   { return m.format.BitsPerSample }
+func (m *Metadata) Channels() int   { return m.format.Channels }
+
+// }}}
@@ -0,0 +1,258 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/goulash/audio"
+)
+
+// chunk returns a chunk with the id and the data, padded to an even size.
+func chunk(order binary.ByteOrder, id string, data ...[]byte) []byte {
+	b := bytes.Join(data, nil)
+	h := make([]byte, 8)
+	copy(h, id)
+	order.PutUint32(h[4:], uint32(len(b)))
+	b = append(h, b...)
+	if len(b)%2 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// riff returns a WAV file of the chunks.
+func riff(chunks ...[]byte) []byte {
+	return chunk(binary.LittleEndian, "RIFF", []byte("WAVE"), bytes.Join(chunks, nil))
+}
+
+// fmtChunk returns a fmt chunk of PCM samples.
+func fmtChunk(channels, rate, bits int) []byte {
+	b := make([]byte, 16)
+	le := binary.LittleEndian
+	le.PutUint16(b[0:], 1)
+	le.PutUint16(b[2:], uint16(channels))
+	le.PutUint32(b[4:], uint32(rate))
+	le.PutUint32(b[8:], uint32(rate*channels*bits/8))
+	le.PutUint16(b[12:], uint16(channels*bits/8))
+	le.PutUint16(b[14:], uint16(bits))
+	return chunk(le, "fmt ", b)
+}
+
+// form returns an AIFF or AIFF-C file of the chunks.
+func form(typ string, chunks ...[]byte) []byte {
+	return chunk(binary.BigEndian, "FORM", []byte(typ), bytes.Join(chunks, nil))
+}
+
+// commChunk returns a COMM chunk, followed by the compression type if it
+// is not empty.
+func commChunk(channels, frames, bits, rate int, compression string) []byte {
+	b := make([]byte, 8)
+	be := binary.BigEndian
+	be.PutUint16(b[0:], uint16(channels))
+	be.PutUint32(b[2:], uint32(frames))
+	be.PutUint16(b[6:], uint16(bits))
+	b = append(b, toExtended(uint32(rate))...)
+	b = append(b, compression...)
+	return chunk(be, "COMM", b)
+}
+
+// toExtended returns x as an 80-bit IEEE 754 extended precision number.
+func toExtended(x uint32) []byte {
+	b := make([]byte, 10)
+	if x == 0 {
+		return b
+	}
+	mant := uint64(x)
+	exp := 16383 + 63
+	for mant&(1<<63) == 0 {
+		mant <<= 1
+		exp--
+	}
+	binary.BigEndian.PutUint16(b, uint16(exp))
+	binary.BigEndian.PutUint64(b[2:], mant)
+	return b
+}
+
+func readFile(t *testing.T, data []byte) (*Metadata, error) {
+	dir, err := ioutil.TempDir("", "wav-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ReadMetadata(file)
+}
+
+func TestReadMetadataWAV(t *testing.T) {
+	info := chunk(binary.LittleEndian, "LIST", []byte("INFO"),
+		chunk(binary.LittleEndian, "INAM", []byte("Song\x00")),
+		chunk(binary.LittleEndian, "IART", []byte("Band\x00")),
+		chunk(binary.LittleEndian, "ITRK", []byte("3/12\x00")))
+	m, err := readFile(t, riff(fmtChunk(2, 48000, 16), info, chunk(binary.LittleEndian, "data", make([]byte, 4800*4))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := m.AudioFormat()
+	if f.Tag != 1 || f.Channels != 2 || f.SampleRate != 48000 || f.BitsPerSample != 16 || f.Frames != 4800 || f.BigEndian {
+		t.Errorf("format is %+v, want 4800 frames of 16-bit stereo PCM at 48 kHz", f)
+	}
+	if m.Encoding() != audio.WAV {
+		t.Errorf("codec is %s, want WAV", codec.String(m.Encoding()))
+	}
+	if m.Length() != 100*time.Millisecond {
+		t.Errorf("length is %s, want 100ms", m.Length())
+	}
+	if m.EncodingBitrate() != 1536 {
+		t.Errorf("bitrate is %d, want 1536", m.EncodingBitrate())
+	}
+	if m.Title() != "Song" || m.Artist() != "Band" {
+		t.Errorf("title and artist are %q and %q, want %q and %q", m.Title(), m.Artist(), "Song", "Band")
+	}
+	if n, total := m.Track(); n != 3 || total != 12 {
+		t.Errorf("track is %d of %d, want 3 of 12", n, total)
+	}
+}
+
+func TestReadMetadataWAVFormats(t *testing.T) {
+	le := binary.LittleEndian
+
+	// WAVE_FORMAT_EXTENSIBLE with the sub-format of IEEE float.
+	ext := make([]byte, 40)
+	le.PutUint16(ext[0:], 0xFFFE)
+	le.PutUint16(ext[2:], 1)
+	le.PutUint32(ext[4:], 44100)
+	le.PutUint16(ext[14:], 32)
+	le.PutUint16(ext[24:], 3)
+	m, err := readFile(t, riff(chunk(le, "fmt ", ext), chunk(le, "data", make([]byte, 44100*4))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := m.AudioFormat(); f.Tag != 3 || f.Frames != 44100 {
+		t.Errorf("extensible: format is %+v, want 44100 frames of float", f)
+	}
+
+	// RF64 stores the size of the data in the ds64 chunk.
+	ds64 := make([]byte, 28)
+	le.PutUint64(ds64[8:], 8000)
+	data := chunk(le, "data", make([]byte, 8000))
+	le.PutUint32(data[4:], 0xFFFFFFFF)
+	b := riff(chunk(le, "ds64", ds64), fmtChunk(1, 8000, 8), data)
+	copy(b, "RF64")
+	m, err = readFile(t, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := m.AudioFormat(); f.DataSize != 8000 || m.Length() != time.Second {
+		t.Errorf("rf64: data size is %d and length %s, want 8000 and 1s", f.DataSize, m.Length())
+	}
+
+	// Streamed files often have a data size that is too large.
+	data = chunk(le, "data", make([]byte, 8000))
+	le.PutUint32(data[4:], 0x7FFFFFF0)
+	m, err = readFile(t, riff(fmtChunk(1, 8000, 8), data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := m.AudioFormat(); f.DataSize != 8000 {
+		t.Errorf("streamed: data size is %d, want 8000", f.DataSize)
+	}
+}
+
+func TestReadMetadataAIFF(t *testing.T) {
+	be := binary.BigEndian
+	ssnd := chunk(be, "SSND", make([]byte, 8), make([]byte, 22050*4))
+	name := chunk(be, "NAME", []byte("Song"))
+	auth := chunk(be, "AUTH", []byte("Band"))
+	m, err := readFile(t, form("AIFF", commChunk(2, 22050, 16, 44100, ""), name, auth, ssnd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := m.AudioFormat()
+	if f.Channels != 2 || f.SampleRate != 44100 || f.BitsPerSample != 16 || f.DataSize != 22050*4 || !f.BigEndian {
+		t.Errorf("format is %+v, want big-endian 16-bit stereo at 44.1 kHz", f)
+	}
+	if m.Encoding() != codec.AIFF {
+		t.Errorf("codec is %s, want AIFF", codec.String(m.Encoding()))
+	}
+	if m.Length() != 500*time.Millisecond {
+		t.Errorf("length is %s, want 500ms", m.Length())
+	}
+	if m.Title() != "Song" || m.Artist() != "Band" {
+		t.Errorf("title and artist are %q and %q, want %q and %q", m.Title(), m.Artist(), "Song", "Band")
+	}
+
+	// AIFF-C can store little-endian samples.
+	m, err = readFile(t, form("AIFC", commChunk(1, 100, 16, 96000, "sowt"), ssnd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := m.AudioFormat(); f.BigEndian || f.SampleRate != 96000 {
+		t.Errorf("sowt: format is %+v, want little-endian at 96 kHz", f)
+	}
+}
+
+func TestReadMetadataInvalid(t *testing.T) {
+	le := binary.LittleEndian
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrNotWAV},
+		{"not riff", []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00"), ErrNotWAV},
+		{"no fmt", riff(chunk(le, "data", make([]byte, 16))), ErrNoData},
+		{"short fmt", riff(chunk(le, "fmt ", make([]byte, 8))), ErrInvalidWAV},
+		{"truncated", riff(fmtChunk(1, 8000, 8), chunk(le, "LIST", []byte("INFO")))[:46], ErrInvalidWAV},
+	}
+	for _, tt := range tests {
+		if _, err := readFile(t, tt.data); err != tt.err {
+			t.Errorf("%s: error is %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestExtended(t *testing.T) {
+	for _, x := range []uint32{0, 8000, 22050, 44100, 48000, 2822400} {
+		if got := extended(toExtended(x)); got != float64(x) {
+			t.Errorf("extended(%d) = %g", x, got)
+		}
+	}
+	// 44100 as written by common encoders.
+	if got := extended([]byte{0x40, 0x0e, 0xac, 0x44, 0, 0, 0, 0, 0, 0}); got != 44100 {
+		t.Errorf("extended of 44100 is %g", got)
+	}
+}
+
+func TestReadMetadataShort(t *testing.T) {
+	// Four frames at 44.1 kHz last less than a millisecond.
+	files := map[string][]byte{
+		"wav":  riff(fmtChunk(2, 44100, 16), chunk(binary.LittleEndian, "data", make([]byte, 4*4))),
+		"aiff": form("AIFF", commChunk(2, 4, 16, 44100, ""), chunk(binary.BigEndian, "SSND", make([]byte, 8), make([]byte, 4*4))),
+	}
+	for name, data := range files {
+		m, err := readFile(t, data)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if m.Length() <= 0 {
+			t.Errorf("%s: length is %s, want more than 0", name, m.Length())
+		}
+		if m.EncodingBitrate() != 0 {
+			t.Errorf("%s: bitrate is %d, want 0 for less than a millisecond", name, m.EncodingBitrate())
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/cue"
+	"github.com/cassava/lackey/audio/mp3"
+	"github.com/cassava/lackey/audio/mp4"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/cassava/lackey/audio/wav"
+	"github.com/goulash/audio"
+)
+
+// ReadChapters reads the chapters of a file with the codec c: from the chpl
+// atom or the chapter track of MPEG-4 files, the CHAP frames of MP3 files,
+// and the CHAPTER comments of FLAC and Ogg files. Other files have none.
+func ReadChapters(file string, c audio.Codec) ([]tags.Chapter, error) {
+	switch c {
+	case audio.AAC, audio.ALAC, audio.M4A, audio.M4B:
+		return mp4.ReadChapters(file)
+	case audio.MP3:
+		t, err := mp3.ReadTag(file)
+		if err != nil {
+			return nil, err
+		}
+		return t.Chapters(), nil
+	case audio.FLAC, audio.OGG, codec.Opus:
+		t, err := ReadTags(file, c)
+		if err != nil {
+			return nil, err
+		}
+		return t.Chapters(), nil
+	}
+	return nil, nil
+}
+
+// WriteChapters replaces the chapters of a file with chs, according to its
+// extension: as CHAP frames and a table of contents in MP3 files, in the chpl
+// atom of MPEG-4 files, and as CHAPTER comments in FLAC and Ogg files. Other
+// files are left as they are. Chapter comments that were carried over into
+// the TXXX frames of MP3 files or the freeform items of MPEG-4 files, such
+// as by copyTags, are removed.
+func WriteChapters(ctx context.Context, file string, chs []tags.Chapter) error {
+	var c audio.Codec
+	ext := strings.ToLower(filepath.Ext(file))
+	switch ext {
+	case ".mp3":
+		c = audio.MP3
+	case ".m4a", ".m4b", ".mp4":
+		c = audio.M4A
+	case ".flac":
+		c = audio.FLAC
+	case ".ogg", ".oga", ".opus":
+		c = audio.OGG
+	default:
+		return nil
+	}
+	t, err := ReadTags(file, c)
+	if err != nil {
+		return err
+	}
+
+	switch ext {
+	case ".mp3":
+		if t.SetChapters(nil) {
+			if err := WriteTags(ctx, file, t); err != nil {
+				return err
+			}
+		}
+		tag, err := mp3.ReadTag(file)
+		if err != nil {
+			return err
+		}
+		// The last chapter ends with the file, if its length is known.
+		var length time.Duration
+		if md, err := codec.ReadMetadata(file); err == nil {
+			length = md.Length()
+		}
+		tag.SetChapters(chs, length)
+		return tag.Write(file)
+	case ".m4a", ".m4b", ".mp4":
+		if t.SetChapters(nil) {
+			if err := WriteTags(ctx, file, t); err != nil {
+				return err
+			}
+		}
+		return mp4.WriteChapters(file, chs)
+	}
+	t.SetChapters(chs)
+	return WriteTags(ctx, file, t)
+}
+
+// copyChapters writes the chapters of src, which has the codec c, to dst,
+// if it has any.
+func copyChapters(ctx context.Context, src string, c audio.Codec, dst string) error {
+	chs, err := ReadChapters(src, c)
+	if err != nil {
+		return fmt.Errorf("cannot read chapters of %s: %s", src, err)
+	}
+	if len(chs) == 0 {
+		return nil
+	}
+	return WriteChapters(ctx, dst, chs)
+}
+
+// chapterSheet returns a CUE sheet with a track for each chapter, so that
+// the source with the metadata md can be split like an image. The title of
+// the sheet is the album of the source, or else its title.
+func chapterSheet(chs []tags.Chapter, md audio.Metadata) *cue.Sheet {
+	s := &cue.Sheet{Rem: make(map[string]string)}
+	if md != nil {
+		if s.Title = md.Album(); s.Title == "" {
+			s.Title = md.Title()
+		}
+	}
+	for i, c := range chs {
+		t := &cue.Track{
+			Number: i + 1,
+			Title:  c.Title,
+			Start:  c.Start,
+			Rem:    make(map[string]string),
+		}
+		if t.Title == "" {
+			t.Title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		if i+1 < len(chs) {
+			t.End = chs[i+1].Start
+		}
+		s.Tracks = append(s.Tracks, t)
+	}
+	return s
+}
+
+// mergeTracks decodes the sources one after the other into a temporary WAV
+// file, and returns it with a chapter for each source, or the chapters of
+// a source if it has several. The sources must decode to the same format.
+func mergeTracks(ctx context.Context, srcs []string, mds []Audio) (string, []tags.Chapter, error) {
+	tmp, err := ioutil.TempFile("", "lackey-*.wav")
+	if err != nil {
+		return "", nil, err
+	}
+	var (
+		format *wav.Format
+		size   int64
+		chs    []tags.Chapter
+	)
+	for i, src := range srcs {
+		err = DefaultDecoders.Decode(ctx, src, mds[i].Encoding(), func(r io.Reader) error {
+			f, r, err := wav.ReadHeader(r)
+			if err != nil {
+				return err
+			}
+			if _, err := io.CopyN(ioutil.Discard, r, f.DataOffset); err != nil {
+				return err
+			}
+			if format == nil {
+				// The header is written again once the size is known.
+				format = f
+				if err := wav.WriteHeader(tmp, format); err != nil {
+					return err
+				}
+			} else if f.Tag != format.Tag || f.Channels != format.Channels ||
+				f.SampleRate != format.SampleRate || f.BitsPerSample != format.BitsPerSample {
+				return fmt.Errorf("cannot merge %s with %s, since their sample formats differ", src, srcs[0])
+			}
+
+			rate := float64(format.SampleRate * format.Channels * ((format.BitsPerSample + 7) / 8))
+			start := time.Duration(float64(size) / rate * float64(time.Second))
+			own, _ := ReadChapters(src, mds[i].Encoding())
+			if len(own) > 1 {
+				for _, c := range own {
+					chs = append(chs, tags.Chapter{Start: start + c.Start, Title: c.Title})
+				}
+			} else {
+				chs = append(chs, tags.Chapter{Start: start, Title: sourceTitle(src, mds[i])})
+			}
+
+			n, err := io.Copy(tmp, r)
+			size += n
+			return err
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil && format != nil {
+		format.DataSize = size
+		if _, err = tmp.Seek(0, io.SeekStart); err == nil {
+			err = wav.WriteHeader(tmp, format)
+		}
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), chs, nil
+}
+
+// sourceTitle returns the title of the source, or else its name.
+func sourceTitle(src string, md Audio) string {
+	if m := md.Metadata(); m != nil && m.Title() != "" {
+		return m.Title()
+	}
+	name := filepath.Base(src)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// Merge encodes the spoken-word sources srcs, in this order, to the single
+// file dst, with a chapter for each source, or the chapters of a source if
+// it has several. The output is given the tags of the first source, whose
+// album becomes its title, and the album gain of the directory.
+func (o *Runner) Merge(srcs []string, dst string, mds []Audio) error {
+	path := dst
+	if o.Strip {
+		dst = strings.TrimPrefix(dst, o.DstPrefix)
+	}
+	o.Color.Printf("@gmerge:@|    %s\n", dst)
+	if o.DryRun {
+		return nil
+	}
+
+	ctx := o.context()
+	track, chs, err := mergeTracks(ctx, srcs, mds)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(track)
+
+	t, err := ReadTags(srcs[0], mds[0].Encoding())
+	if err != nil {
+		t = make(tags.Tags)
+	}
+	title := t.Get("ALBUM")
+	if title == "" {
+		title = filepath.Base(filepath.Dir(srcs[0]))
+	}
+	for _, k := range []string{"TRACKNUMBER", "TRACKTOTAL", "DISCNUMBER", "DISCTOTAL", "ISRC", "LYRICS"} {
+		delete(t, k)
+	}
+	t.Set("TITLE", title)
+	t.SetChapters(nil)
+	removeGain(t)
+
+	var gain *Gain
+	if o.ReplayGain != NoReplayGain {
+		g, err := o.gain(ctx, srcs[0])
+		if err != nil {
+			return err
+		}
+		// The merged file is the whole album.
+		gain = &Gain{Track: g.Album, TrackPeak: g.AlbumPeak, Album: g.Album, AlbumPeak: g.AlbumPeak}
+	}
+	if err := o.encodeTrack(ctx, o.encoder(mds[0]), srcs[0], track, path, t, gain); err != nil {
+		return err
+	}
+	return WriteChapters(ctx, path, chs)
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/cassava/lackey/audio/wav"
+	"github.com/goulash/audio"
+	"github.com/goulash/color"
+)
+
+// bookMetadata is metadata with only an album and a title.
+type bookMetadata struct {
+	audio.Metadata
+	album, title string
+}
+
+func (m bookMetadata) Album() string { return m.album }
+func (m bookMetadata) Title() string { return m.title }
+
+// taggedAudio is a source with the metadata md.
+type taggedAudio struct {
+	*fakeAudio
+	md audio.Metadata
+}
+
+func (a taggedAudio) Metadata() audio.Metadata { return a.md }
+
+func TestWriteChapters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	chs := []tags.Chapter{
+		{Start: 0, Title: "Prologue"},
+		{Start: 90500 * time.Millisecond, Title: "Chapter 1"},
+		{Start: time.Hour, Title: "Epilogue"},
+	}
+	files := []struct {
+		name  string
+		codec audio.Codec
+		data  []byte
+	}{
+		{"book.mp3", audio.MP3, mp3File()},
+		{"book.flac", audio.FLAC, flacFile(1)},
+		{"book.m4b", audio.M4B, mp4File()},
+		{"book.opus", codec.Opus, opusFile()},
+	}
+	for _, f := range files {
+		file := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(file, f.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Chapter comments that were copied from another format are
+		// replaced by those of the format.
+		old := tags.Tags{"TITLE": {"Book"}}
+		old.SetChapters(chs[:1])
+		if err := WriteTags(ctx, file, old); err != nil {
+			t.Fatalf("%s: %s", f.name, err)
+		}
+
+		if err := WriteChapters(ctx, file, chs); err != nil {
+			t.Errorf("%s: %s", f.name, err)
+			continue
+		}
+		if got, err := ReadChapters(file, f.codec); err != nil || !reflect.DeepEqual(got, chs) {
+			t.Errorf("%s: chapters are %v with error %v, want %v", f.name, got, err, chs)
+		}
+		tt, err := ReadTags(file, f.codec)
+		if err != nil {
+			t.Errorf("%s: %s", f.name, err)
+			continue
+		}
+		if tt.Get("TITLE") != "Book" {
+			t.Errorf("%s: tags are %v, want the title kept", f.name, tt)
+		}
+		if f.codec == audio.MP3 || f.codec == audio.M4B {
+			if got := tt.Chapters(); got != nil {
+				t.Errorf("%s: chapter comments are %v, want none", f.name, got)
+			}
+		}
+
+		if err := WriteChapters(ctx, file, nil); err != nil {
+			t.Errorf("%s: %s", f.name, err)
+		}
+		if got, err := ReadChapters(file, f.codec); err != nil || got != nil {
+			t.Errorf("%s: chapters are %v with error %v, want none", f.name, got, err)
+		}
+	}
+
+	// Other files are left as they are, and have no chapters.
+	file := filepath.Join(dir, "book.wav")
+	data := wavFile(make([]byte, 16), "")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteChapters(ctx, file, chs); err != nil {
+		t.Error(err)
+	}
+	if b, _ := ioutil.ReadFile(file); !bytes.Equal(b, data) {
+		t.Error("WAV file changed")
+	}
+	if got, err := ReadChapters(file, audio.WAV); err != nil || got != nil {
+		t.Errorf("chapters of a WAV file are %v with error %v, want none", got, err)
+	}
+}
+
+func TestCopyChapters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	src := filepath.Join(dir, "src.m4b")
+	dst := filepath.Join(dir, "dst.opus")
+	for file, data := range map[string][]byte{src: mp4File(), dst: opusFile()} {
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without chapters, the output is left as it is.
+	if err := copyChapters(ctx, src, audio.M4B, dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(dst); !bytes.Equal(b, opusFile()) {
+		t.Error("output changed without any chapters")
+	}
+
+	chs := []tags.Chapter{{Start: 0, Title: "One"}, {Start: time.Minute, Title: "Two"}}
+	if err := WriteChapters(ctx, src, chs); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyChapters(ctx, src, audio.M4B, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadChapters(dst, codec.Opus); err != nil || !reflect.DeepEqual(got, chs) {
+		t.Errorf("chapters are %v with error %v, want %v", got, err, chs)
+	}
+
+	if err := copyChapters(ctx, filepath.Join(dir, "missing.m4b"), audio.M4B, dst); err == nil {
+		t.Error("copying the chapters of a missing file succeeded")
+	}
+}
+
+func TestChapterSheet(t *testing.T) {
+	chs := []tags.Chapter{
+		{Start: 0, Title: "Prologue"},
+		{Start: time.Minute},
+		{Start: time.Hour, Title: "Epilogue"},
+	}
+	s := chapterSheet(chs, bookMetadata{album: "Book", title: "Part"})
+	if s.Title != "Book" || len(s.Tracks) != 3 {
+		t.Fatalf("sheet is %+v, want Book with 3 tracks", s)
+	}
+	wants := []struct {
+		title      string
+		start, end time.Duration
+	}{
+		{"Prologue", 0, time.Minute},
+		{"Chapter 2", time.Minute, time.Hour},
+		{"Epilogue", time.Hour, 0},
+	}
+	for i, want := range wants {
+		tr := s.Tracks[i]
+		if tr.Number != i+1 || tr.Title != want.title || tr.Start != want.start || tr.End != want.end {
+			t.Errorf("track %d is %+v, want %q from %v to %v", i+1, tr, want.title, want.start, want.end)
+		}
+	}
+	if tt := s.Tags(1); tt.Get("ALBUM") != "Book" || tt.Get("TITLE") != "Chapter 2" || tt.Get("TRACKNUMBER") != "2" {
+		t.Errorf("tags of track 2 are %v", tt)
+	}
+
+	if s := chapterSheet(chs, bookMetadata{title: "Part"}); s.Title != "Part" {
+		t.Errorf("title without an album is %q, want %q", s.Title, "Part")
+	}
+	if s := chapterSheet(chs, nil); s.Title != "" || len(s.Tracks) != 3 {
+		t.Errorf("sheet without metadata is %+v", s)
+	}
+}
+
+func TestMergeTracks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	// The sources are a second and half a second of 8 kHz mono.
+	one := bytes.Repeat([]byte{1, 0}, 8000)
+	two := bytes.Repeat([]byte{2, 0}, 4000)
+	srcs := []string{filepath.Join(dir, "01 Intro.wav"), filepath.Join(dir, "02.wav")}
+	for i, data := range [][]byte{one, two} {
+		if err := ioutil.WriteFile(srcs[i], wavFile(data, ""), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wavAudio := &fakeAudio{codec.Properties{Codec: audio.WAV}}
+	mds := []Audio{untagged{wavAudio}, taggedAudio{wavAudio, bookMetadata{title: "Part Two"}}}
+
+	track, chs, err := mergeTracks(ctx, srcs, mds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(track)
+	want := []tags.Chapter{{Start: 0, Title: "01 Intro"}, {Start: time.Second, Title: "Part Two"}}
+	if !reflect.DeepEqual(chs, want) {
+		t.Errorf("chapters are %v, want %v", chs, want)
+	}
+	b, err := ioutil.ReadFile(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, r, err := wav.ReadHeader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, _ := ioutil.ReadAll(r)
+	samples = samples[f.DataOffset:]
+	if f.SampleRate != 8000 || f.Channels != 1 || f.DataSize != int64(len(one)+len(two)) {
+		t.Errorf("format is %+v, want 8 kHz mono of %d bytes", f, len(one)+len(two))
+	}
+	if !bytes.Equal(samples, append(one, two...)) {
+		t.Error("samples are not those of the sources in order")
+	}
+
+	// Sources of different formats cannot be merged.
+	var other bytes.Buffer
+	wav.WriteHeader(&other, &wav.Format{Tag: 1, Channels: 2, SampleRate: 8000, BitsPerSample: 16, DataSize: 400})
+	other.Write(make([]byte, 400))
+	if err := ioutil.WriteFile(srcs[1], other.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if track, _, err := mergeTracks(ctx, srcs, mds); err == nil {
+		os.Remove(track)
+		t.Error("merging sources of different formats succeeded")
+	}
+}
+
+func TestMergeDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var out bytes.Buffer
+	col := color.New()
+	col.SetOutput(&out)
+	o := &Runner{Color: col, DryRun: true, Strip: true, DstPrefix: dir + "/"}
+	dst := filepath.Join(dir, "Book.opus")
+	if err := o.Merge([]string{filepath.Join(dir, "missing.wav")}, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote %s", dst)
+	}
+	if got := out.String(); !strings.Contains(got, "merge:") || !strings.HasSuffix(got, " Book.opus\n") {
+		t.Errorf("output is %q, want the merge of Book.opus", got)
+	}
+}
@@ -60,6 +60,7 @@ func main() {
 	MainCmd.PersistentFlags().StringVarP(&Conf.LibraryPath, "library", "L", "", "path to primary library")
 	MainCmd.PersistentFlags().BoolVar(&Conf.LibraryReader.IgnoreHidden, "ignore-hidden", true, "ignore hidden files")
 	MainCmd.PersistentFlags().BoolVar(&Conf.LibraryReader.FollowSymlinks, "follow-symlinks", true, "follow symlinks")
+	MainCmd.PersistentFlags().BoolVar(&Conf.LibraryReader.Archives, "archives", false, "read zip and tar archives in the library as directories")
 
 	err := MainCmd.Execute()
 	if err != nil {
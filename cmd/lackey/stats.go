@@ -7,11 +7,18 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/cassava/lackey"
+	"github.com/cassava/lackey/audio/ape"
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/dsf"
 	"github.com/cassava/lackey/audio/mp3"
+	"github.com/cassava/lackey/audio/mp4"
+	"github.com/cassava/lackey/audio/ogg"
+	"github.com/cassava/lackey/audio/wav"
 	"github.com/goulash/audio"
 	"github.com/goulash/audio/flac"
 	"github.com/goulash/stat"
@@ -47,6 +54,7 @@ var statsCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		defer db.Close()
 
 		if showTree {
 			printTree(db)
@@ -82,6 +90,8 @@ func printEntry(e *lackey.Entry, level int) {
 		col.Printf("%s%s\n", prefix, e.Filename())
 	case lackey.MusicEntry:
 		col.Printf("%s@b%s@|\n", prefix, e.Filename())
+	case lackey.VideoEntry:
+		col.Printf("%s@m%s@|\n", prefix, e.Filename())
 	default:
 		col.Printf("%s@r%s@|\n", prefix, e.Filename())
 	}
@@ -97,6 +107,10 @@ func standardStats(db *lackey.Database) {
 		albumartists = make(map[string]bool)
 		genres       = make(map[string]bool)
 		composers    = make(map[string]bool)
+		codecs       = make(map[audio.Codec]int)
+		formats      = make(map[string]int)
+		lossless     int
+		hires        int
 		songs        int
 	)
 
@@ -120,6 +134,18 @@ func standardStats(db *lackey.Database) {
 		}
 
 		songs++
+		codecs[e.Encoding()]++
+		p := codec.PropertiesOf(md)
+		if p.Lossless {
+			lossless++
+		}
+		if p.IsHiRes() {
+			hires++
+		}
+		// The bitrate of lossy files varies too much to group them by it.
+		f := *p
+		f.Bitrate = 0
+		formats[f.String()]++
 		length += md.Length()
 		addto(artists, md.Artist())
 		addto(albums, md.Album())
@@ -139,9 +165,49 @@ func standardStats(db *lackey.Database) {
 	col.Printf("  @!Album artists@| %d\n", len(albumartists))
 	col.Printf("  @!Genres@|        %d\n", len(genres))
 	col.Printf("  @!Composers@|     %d\n", len(composers))
+	col.Printf("  @!Lossless@|      %d\n", lossless)
+	col.Printf("  @!High-res@|      %d\n", hires)
+	col.Printf("  @!Codecs@|\n")
+	for _, c := range sortedCodecs(codecs) {
+		col.Printf("    %-12s %d\n", codec.String(c), codecs[c])
+	}
+	col.Printf("  @!Formats@|\n")
+	for _, f := range sortedKeys(formats) {
+		col.Printf("    %-18s %d\n", f, formats[f])
+	}
 	col.Println()
 }
 
+// sortedCodecs returns the codecs in m, ordered by count and then by name.
+func sortedCodecs(m map[audio.Codec]int) []audio.Codec {
+	cs := make([]audio.Codec, 0, len(m))
+	for c := range m {
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if m[cs[i]] != m[cs[j]] {
+			return m[cs[i]] > m[cs[j]]
+		}
+		return codec.String(cs[i]) < codec.String(cs[j])
+	})
+	return cs
+}
+
+// sortedKeys returns the keys of m, ordered by count and then by name.
+func sortedKeys(m map[string]int) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		if m[ks[i]] != m[ks[j]] {
+			return m[ks[i]] > m[ks[j]]
+		}
+		return ks[i] < ks[j]
+	})
+	return ks
+}
+
 func runtimeStats() {
 	stats := func(r *stat.Run) string {
 		return fmt.Sprintf("μ=%s, σ=%s, n=%d", time.Duration(r.Mean()), time.Duration(r.Std()), r.N())
@@ -150,6 +216,10 @@ func runtimeStats() {
 	col.Printf("Runtime stats:\n")
 	col.Printf("  audio.@!Identify@|        %s\n", stats(&audio.Stats.Identify))
 	col.Printf("  audio.@!ReadMetadata@|    %s\n", stats(&audio.Stats.ReadMetadata))
+	col.Printf("  ape.@!ReadMetadata@|      %s\n", stats(&ape.Stats.ReadMetadata))
+	col.Printf("  codec.@!Identify@|        %s\n", stats(&codec.Stats.Identify))
+	col.Printf("  codec.@!ReadMetadata@|    %s\n", stats(&codec.Stats.ReadMetadata))
+	col.Printf("  dsf.@!ReadMetadata@|      %s\n", stats(&dsf.Stats.ReadMetadata))
 	col.Printf("  flac.@!Identify@|         %s\n", stats(&flac.Stats.Identify))
 	col.Printf("  flac.@!ReadFileMetadata@| %s\n", stats(&flac.Stats.ReadFileMetadata))
 	col.Printf("  flac.@!ReadMetadata@|     %s\n", stats(&flac.Stats.ReadMetadata))
@@ -159,5 +229,8 @@ func runtimeStats() {
 	col.Printf("  mp3.@!ReadMetadataBrDu@|  %s\n", stats(&mp3.Stats.ReadMetadataBrDu))
 	col.Printf("  mp3.@!ToolMP3INFO@|       %s\n", stats(&mp3.Stats.ToolMP3INFO))
 	col.Printf("  mp3.@!ToolEXIFTOOL@|      %s\n", stats(&mp3.Stats.ToolEXIFTOOL))
+	col.Printf("  mp4.@!ReadMetadata@|      %s\n", stats(&mp4.Stats.ReadMetadata))
+	col.Printf("  ogg.@!ReadMetadata@|      %s\n", stats(&ogg.Stats.ReadMetadata))
+	col.Printf("  wav.@!ReadMetadata@|      %s\n", stats(&wav.Stats.ReadMetadata))
 	col.Println()
 }
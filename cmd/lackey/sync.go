@@ -5,10 +5,19 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/cassava/lackey"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/cassava/lackey/imaging"
 	"github.com/spf13/cobra"
 )
 
@@ -20,20 +29,55 @@ var (
 	syncConcurrent     int
 	syncDataExcept     []string
 	syncCopySuffix     []string
+	syncEmbedLyrics    bool
+	syncSplitCue       bool
+	syncVideo          string
 
 	// Cover:
 	syncDownscaleCover bool
-	syncCoverSource    string
+	syncCoverSources   []string
 	syncCoverTarget    string
+	syncCoverSize      int
+	syncCoverQuality   int
+	syncCoverFormat    string
+	syncEmbedCover     bool
+	syncEmbedCoverSize int
+	syncEmbeddedArt    string
 
-	// MP3:
+	// Encoder:
+	syncEncoder          string
+	syncEncodersFile     string
 	syncBitrateThreshold int
+	syncPolicy           []string
+	syncMinSavings       string
 	syncTargetQuality    int
+	syncTargetBitrate    string
+	syncDecoders         []string
+	syncReplayGain       string
+
+	// Spoken word:
+	syncSpoken         bool
+	syncSpokenEncoder  string
+	syncSpokenBitrate  string
+	syncSpokenChannels int
+	syncSpokenGenres   []string
+	syncSpokenMarker   string
+	syncChapters       string
+
+	// MP3:
+	syncCopyAAC    bool
+	syncID3Version int
+	syncTagMap     string
 
 	// OPUS:
-	syncOPUS          bool
-	syncTargetBitrate string
-	syncUseOGG        bool
+	syncOPUS   bool
+	syncUseOGG bool
+
+	// FLAC:
+	syncFLACCompression int
+	syncFLACBitDepth    int
+	syncFLACMaxRate     int
+	syncFLACRecompress  bool
 )
 
 func init() {
@@ -45,19 +89,55 @@ func init() {
 	syncCmd.Flags().BoolVarP(&syncOnlyMusic, "only-music", "m", false, "only synchronize music")
 	syncCmd.Flags().StringSliceVarP(&syncDataExcept, "except", "e", []string{}, "data exceptions (filenames)")
 	syncCmd.Flags().StringSliceVarP(&syncCopySuffix, "copy-suffix", "c", []string{}, "audio types to copy instead of transcoding")
+	syncCmd.Flags().BoolVar(&syncEmbedLyrics, "embed-lyrics", false, "embed sidecar lyrics in copied and encoded audio without lyrics")
+	syncCmd.Flags().BoolVar(&syncSplitCue, "split-cue", false, "split album images with a CUE sheet into their tracks")
+	syncCmd.Flags().StringVar(&syncVideo, "video", "skip", "skip videos, copy them, or encode their audio (skip, copy, extract-audio)")
 
 	syncCmd.Flags().BoolVarP(&syncDownscaleCover, "downscale-cover", "s", false, "downscale album covers, see options for naming")
-	syncCmd.Flags().StringVar(&syncCoverSource, "cover-source", "cover.jpg", "filename of source cover")
+	syncCmd.Flags().StringSliceVar(&syncCoverSources, "cover-source", lackey.DefaultCoverSources, "names or glob patterns of source covers, from the most preferred")
 	syncCmd.Flags().StringVar(&syncCoverTarget, "cover-target", "cover.jpg", "filename of target cover")
+	syncCmd.Flags().IntVar(&syncCoverSize, "cover-size", 500, "maximum width and height of downscaled covers in pixels")
+	syncCmd.Flags().IntVar(&syncCoverQuality, "cover-quality", imaging.DefaultQuality, "quality of covers that are encoded as JPEG (1-100)")
+	syncCmd.Flags().StringVar(&syncCoverFormat, "cover-format", "", "format of downscaled covers: jpeg, png, or webp (default from --cover-target)")
+	syncCmd.Flags().BoolVar(&syncEmbedCover, "embed-cover", false, "embed the cover of the source or its album in every output")
+	syncCmd.Flags().IntVar(&syncEmbedCoverSize, "embed-cover-size", 500, "maximum width and height of embedded covers in pixels (0=keep)")
+	syncCmd.Flags().StringVar(&syncEmbeddedArt, "embedded-art", "keep", "keep, strip, or shrink:SIZE the pictures embedded in copied and encoded audio")
 
-	// MP3:
+	// Encoder:
+	syncCmd.Flags().StringVar(&syncEncoder, "encoder", "mp3", "output encoder (mp3, opus, aac, vorbis, flac, or from --encoders)")
+	syncCmd.Flags().StringVar(&syncEncodersFile, "encoders", "", "JSON file with additional command encoders")
+	syncCmd.Flags().StringSliceVar(&syncDecoders, "decoder", []string{}, "choose or exclude decoders, such as flac=ffmpeg, !lame, or mp3=!lame")
 	syncCmd.Flags().IntVarP(&syncBitrateThreshold, "threshold", "t", 256, "bitrate threshold at which we copy instead of transcoding")
-	syncCmd.Flags().IntVarP(&syncTargetQuality, "quality", "q", 4, "target MP3 quality (0=highest, largest; 9=lowest, smallest)")
+	syncCmd.Flags().StringVar(&syncMinSavings, "min-savings", "", "copy sources instead if transcoding saves less space, such as 20%")
+	syncCmd.Flags().StringArrayVar(&syncPolicy, "policy", []string{}, "rule whether to copy, transcode, or ignore sources, such as opus<=128k:copy (repeatable)")
+	syncCmd.Flags().IntVarP(&syncTargetQuality, "quality", "q", 4, "target quality of the encoder (see above)")
+	syncCmd.Flags().StringVarP(&syncTargetBitrate, "bitrate", "r", "96k", "target OPUS or AAC bitrate, in bps")
+	syncCmd.Flags().StringVar(&syncTagMap, "tag-map", "", "JSON file with additional or changed tag mappings")
+	syncCmd.Flags().StringVar(&syncReplayGain, "replaygain", "", "write missing gain tags (tags) or apply the album gain to encoded audio (apply)")
+
+	// Spoken word:
+	syncCmd.Flags().BoolVar(&syncSpoken, "spoken", false, "encode audiobooks and other spoken word with their own profile")
+	syncCmd.Flags().StringVar(&syncSpokenEncoder, "spoken-encoder", "opus", "encoder of spoken word (opus, aac, or from --encoders)")
+	syncCmd.Flags().StringVar(&syncSpokenBitrate, "spoken-bitrate", "32k", "target bitrate of spoken word, in bps")
+	syncCmd.Flags().IntVar(&syncSpokenChannels, "spoken-channels", 1, "mix spoken word down to this many channels (0=keep)")
+	syncCmd.Flags().StringSliceVar(&syncSpokenGenres, "spoken-genre", lackey.DefaultSpokenGenres, "genres of spoken word")
+	syncCmd.Flags().StringVar(&syncSpokenMarker, "spoken-marker", ".audiobook", "file that marks a directory and those below it as spoken word")
+	syncCmd.Flags().StringVar(&syncChapters, "chapters", "keep", "keep the chapters of spoken word, split them into files, or merge directories (keep, split, merge)")
+
+	// MP3:
+	syncCmd.Flags().BoolVar(&syncCopyAAC, "copy-aac", false, "copy AAC files below the bitrate threshold instead of transcoding them")
+	syncCmd.Flags().IntVar(&syncID3Version, "id3-version", 0, "rewrite the tags of encoded and copied MP3 files as ID3v2.3 or ID3v2.4 (3, 4, or 0=keep)")
 
 	// OPUS:
-	syncCmd.Flags().StringVarP(&syncTargetBitrate, "bitrate", "r", "96k", "target OPUS bitrate, in bps")
 	syncCmd.Flags().BoolVarP(&syncOPUS, "opus", "u", false, "output codec is OPUS not MP3")
+	syncCmd.Flags().MarkDeprecated("opus", "use --encoder=opus instead")
 	syncCmd.Flags().BoolVar(&syncUseOGG, "use-ogg-extension", false, "use the .ogg extension instead of .opus")
+
+	// FLAC:
+	syncCmd.Flags().IntVar(&syncFLACCompression, "flac-compression", 8, "FLAC compression level (0=fastest; 12=smallest)")
+	syncCmd.Flags().IntVar(&syncFLACBitDepth, "flac-bit-depth", 0, "reduce FLAC bit depth to 16 or 24 bits (0=keep)")
+	syncCmd.Flags().IntVar(&syncFLACMaxRate, "flac-max-rate", 0, "resample FLAC above this sample rate in Hz (0=keep)")
+	syncCmd.Flags().BoolVar(&syncFLACRecompress, "flac-recompress", false, "encode FLAC sources again instead of copying them")
 }
 
 var syncCmd = &cobra.Command{
@@ -82,6 +162,58 @@ var syncCmd = &cobra.Command{
     - it will delete all unexpected files in the destination (like rsync)
     - it will use the number of cores as the number of workers to use
       (e.g. --concurrent=4)
+
+  Other encoders are selected with --encoder: opus (at --bitrate), aac (at
+  --quality from 1 to 5, or --bitrate if it is 0), vorbis (at --quality from
+  -1 to 10), and flac (see the --flac options). Every encoder copies sources
+  of its own codec up to --threshold, unless a rule given with --policy
+  decides first. Rules are tried in order, for example:
+
+    --policy='opus<=128k:copy' --policy='flac,bits<=16,rate<=48k:copy'
+    --policy='wma:ignore' --policy='*:transcode'
+
+  A rule matches a codec, lossless, lossy, hires, or *, may compare the
+  bitrate (in kbps), rate (in Hz), bits, or channels, and ends in copy,
+  transcode, or ignore. Copied files keep their extension.
+
+  The destination remembers in .lackey.json which sources were copied for
+  --min-savings, and a hash of the audio of FLAC, MP3, WAV, and AIFF sources,
+  so that sources whose tags changed are only retagged.
+
+  All tags of the source are written to the output in its format, including
+  fields with several values and custom fields, as --tag-map describes.
+
+  The cover of each directory is the best match of --cover-source, or else
+  the picture embedded in its first track, and is written as --cover-target.
+  Lyrics in .lrc, .lyrics, and .txt files follow the track they are named
+  after, with or without its extension.
+
+  With --split-cue, an image of a whole album with a CUE sheet is split into
+  a file for each track. With --spoken, spoken word is encoded with its own
+  profile, which applies to M4B files, --spoken-genre, and directories with
+  a --spoken-marker file. With --archives, Album.zip is read as the directory
+  Album, and its files are only unpacked when they are read.
+
+  Sources are decoded by the first of the native (WAV, AIFF, and FLAC), flac,
+  lame, and ffmpeg decoders that supports them, which --decoder changes, such
+  as --decoder=flac=ffmpeg or --decoder=mp3=!lame.
+
+  Further encoders can be defined in a JSON file given with --encoders:
+
+    {
+      "opusenc": {
+        "extension": ".opus",
+        "command": "opusenc --bitrate {bitrate} --artist {artist} {in} {out}",
+        "decoder": "flac -c -d {in}",
+        "vars": {"bitrate": "128"},
+        "copy": {"codecs": ["opus"], "max_bitrate": 160}
+      }
+    }
+
+  With "decoder", {in} is "-"; with "stdout": true, {out} is "-"; and with
+  "tags": true, the tags of the source are written afterwards. The other
+  placeholders are {title}, {album}, {artist}, {albumartist}, {composer},
+  {genre}, {comment}, {year}, {track}, {tracktotal}, {disc}, and {disctotal}.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) != 1 {
@@ -92,33 +224,125 @@ var syncCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		defer sdb.Close()
 
+		// Archives in the destination are files like any other.
 		col.Println("@.Reading destination library (this might take a while)...")
-		ddb, err := Conf.ReadLibrary(args[0])
+		dr := Conf.LibraryReader
+		dr.Archives = false
+		ddb, err := dr.ReadLibrary(args[0])
+		if err != nil {
+			return err
+		}
+
+		e, err := newEncoder(cmd)
 		if err != nil {
 			return err
 		}
+		for _, rule := range syncDecoders {
+			if err := lackey.DefaultDecoders.ParseRule(rule); err != nil {
+				return err
+			}
+		}
 
-		var e lackey.Encoder
-		if syncOPUS {
-			ext := ".opus"
-			if syncUseOGG {
-				ext = ".ogg"
+		// An interrupt stops the running encoders, which remove their
+		// incomplete output, instead of leaving it to look up-to-date.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		defer signal.Stop(sig)
+		go func() {
+			select {
+			case <-sig:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		policy, err := lackey.ParsePolicy(syncPolicy)
+		if err != nil {
+			return err
+		}
+		minSavings, err := parsePercent(syncMinSavings)
+		if err != nil {
+			return fmt.Errorf("invalid --min-savings: %s", err)
+		}
+		if syncID3Version != 0 && syncID3Version != 3 && syncID3Version != 4 {
+			return fmt.Errorf("invalid --id3-version %d: must be 3 or 4", syncID3Version)
+		}
+		replayGain, err := lackey.ParseReplayGain(syncReplayGain)
+		if err != nil {
+			return err
+		}
+		if syncTagMap != "" {
+			if err := tags.ReadFields(syncTagMap); err != nil {
+				return err
+			}
+		}
+		if syncCoverQuality < 1 || syncCoverQuality > 100 {
+			return fmt.Errorf("invalid --cover-quality %d: must be from 1 to 100", syncCoverQuality)
+		}
+		embeddedArt, err := lackey.ParseEmbeddedArt(syncEmbeddedArt)
+		if err != nil {
+			return err
+		}
+		video, err := lackey.ParseVideoMode(syncVideo)
+		if err != nil {
+			return err
+		}
+		coverTarget, coverSize := syncCoverTarget, syncCoverSize
+		if !syncDownscaleCover {
+			coverSize = 0
+		}
+		if syncCoverFormat != "" {
+			f, err := imaging.ParseFormat(syncCoverFormat)
+			if err != nil {
+				return err
+			}
+			if coverTarget != "" {
+				coverTarget = strings.TrimSuffix(coverTarget, filepath.Ext(coverTarget)) + f.Ext()
 			}
-			e = &lackey.OPUSEncoder{
-				Extension:     ext,
-				TargetBitrate: syncTargetBitrate,
+		}
+		state, err := lackey.ReadState(ddb.Path())
+		if err != nil {
+			return err
+		}
+		var spoken *lackey.SpokenWord
+		if syncSpoken {
+			if spoken, err = newSpokenWord(); err != nil {
+				return err
+			}
+		}
+		if replayGain == lackey.ApplyReplayGain {
+			// Command encoders read the source themselves.
+			if _, ok := e.(*lackey.CommandEncoder); ok {
+				return fmt.Errorf("--replaygain=apply cannot be used with the command encoder %s", syncEncoder)
 			}
-		} else {
-			e = &lackey.MP3Encoder{
-				TargetQuality:    syncTargetQuality,
-				BitrateThreshold: syncBitrateThreshold,
+			if spoken != nil {
+				if _, ok := spoken.Encoder.(*lackey.CommandEncoder); ok {
+					return fmt.Errorf("--replaygain=apply cannot be used with the command encoder %s", syncSpokenEncoder)
+				}
 			}
 		}
 
 		op := &lackey.Runner{
 			Color:          col,
+			Context:        ctx,
 			Encoder:        e,
+			Policy:         policy,
+			Spoken:         spoken,
+			MinSavings:     minSavings,
+			State:          state,
+			ID3Version:     byte(syncID3Version),
+			ReplayGain:     replayGain,
+			EmbedCover:     syncEmbedCover,
+			EmbedCoverSize: syncEmbedCoverSize,
+			EmbeddedArt:    embeddedArt,
+			EmbedLyrics:    syncEmbedLyrics,
+			CoverSources:   syncCoverSources,
+			CoverSize:      coverSize,
+			CoverQuality:   syncCoverQuality,
 			ForceTranscode: syncForceTranscode,
 			CopyExtensions: syncCopySuffix,
 			DryRun:         syncDryRun,
@@ -127,16 +351,167 @@ var syncCmd = &cobra.Command{
 			SrcPrefix:      sdb.Path() + "/",
 			DstPrefix:      ddb.Path() + "/",
 		}
+		if dir := sdb.UnpackDir(); dir != "" {
+			op.UnpackPrefix = dir + "/"
+		}
 		p := lackey.NewPlanner(sdb, ddb, op)
 		p.IgnoreData = syncOnlyMusic
 		p.DeleteBefore = syncDeleteBefore
 		p.Concurrent = syncConcurrent
 		p.DownscaleCover = syncDownscaleCover
-		p.CoverSource = syncCoverSource
-		p.CoverTarget = syncCoverTarget
+		p.CoverSources = syncCoverSources
+		p.CoverTarget = coverTarget
+		p.SplitCue = syncSplitCue
+		p.Spoken = spoken
+		p.Video = video
 		for _, except := range syncDataExcept {
 			p.DataExcept[except] = true
 		}
-		return p.Plan()
+		err = p.Plan()
+		if !syncDryRun {
+			state.Prune(func(key string) bool { return sdb.Get(key) != nil })
+			if serr := state.Save(); err == nil {
+				err = serr
+			}
+		}
+		return err
 	},
 }
+
+// parsePercent parses a fraction such as 20% or 0.2.
+func parsePercent(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	scale := 1.0
+	if strings.HasSuffix(s, "%") {
+		s, scale = strings.TrimSuffix(s, "%"), 100
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return f / scale, nil
+}
+
+// newEncoder returns the encoder selected by --encoder.
+func newEncoder(cmd *cobra.Command) (lackey.Encoder, error) {
+	// The default quality depends on the encoder.
+	quality := func(def int) int {
+		if cmd.Flags().Changed("quality") {
+			return syncTargetQuality
+		}
+		return def
+	}
+
+	if syncOPUS {
+		syncEncoder = "opus"
+	}
+	if syncEncodersFile != "" {
+		encs, err := lackey.ReadCommandEncoders(syncEncodersFile)
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := encs[syncEncoder]; ok {
+			return e, nil
+		}
+	}
+	switch syncEncoder {
+	case "mp3":
+		return &lackey.MP3Encoder{
+			TargetQuality:    quality(4),
+			BitrateThreshold: syncBitrateThreshold,
+			CopyAAC:          syncCopyAAC,
+		}, nil
+	case "opus":
+		ext := ".opus"
+		if syncUseOGG {
+			ext = ".ogg"
+		}
+		return &lackey.OPUSEncoder{
+			Extension:        ext,
+			TargetBitrate:    syncTargetBitrate,
+			BitrateThreshold: syncBitrateThreshold,
+		}, nil
+	case "aac":
+		return &lackey.AACEncoder{
+			VBR:              quality(4),
+			TargetBitrate:    syncTargetBitrate,
+			BitrateThreshold: syncBitrateThreshold,
+		}, nil
+	case "vorbis":
+		return &lackey.VorbisEncoder{
+			Quality:          quality(5),
+			BitrateThreshold: syncBitrateThreshold,
+		}, nil
+	case "flac":
+		if syncFLACBitDepth != 0 && syncFLACBitDepth != 16 && syncFLACBitDepth != 24 {
+			return nil, fmt.Errorf("unsupported FLAC bit depth: %d", syncFLACBitDepth)
+		}
+		return &lackey.FLACEncoder{
+			CompressionLevel: syncFLACCompression,
+			BitDepth:         syncFLACBitDepth,
+			MaxSampleRate:    syncFLACMaxRate,
+			Recompress:       syncFLACRecompress,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown encoder: %s", syncEncoder)
+	}
+}
+
+// newSpokenWord returns the spoken-word profile selected by the --spoken
+// options. Its encoder copies sources that have its codec and a bitrate
+// of at most --spoken-bitrate.
+func newSpokenWord() (*lackey.SpokenWord, error) {
+	chapters, err := lackey.ParseChapterMode(syncChapters)
+	if err != nil {
+		return nil, err
+	}
+	bitrate := strings.TrimRight(syncSpokenBitrate, "kK")
+	threshold, err := strconv.Atoi(bitrate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --spoken-bitrate %q", syncSpokenBitrate)
+	}
+	if bitrate == syncSpokenBitrate {
+		threshold /= 1000
+	}
+
+	s := &lackey.SpokenWord{
+		Genres:   syncSpokenGenres,
+		Marker:   syncSpokenMarker,
+		Chapters: chapters,
+	}
+	if syncEncodersFile != "" {
+		encs, err := lackey.ReadCommandEncoders(syncEncodersFile)
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := encs[syncSpokenEncoder]; ok {
+			s.Encoder = e
+			return s, nil
+		}
+	}
+	switch syncSpokenEncoder {
+	case "opus":
+		ext := ".opus"
+		if syncUseOGG {
+			ext = ".ogg"
+		}
+		s.Encoder = &lackey.OPUSEncoder{
+			Extension:        ext,
+			TargetBitrate:    syncSpokenBitrate,
+			BitrateThreshold: threshold,
+			Channels:         syncSpokenChannels,
+		}
+	case "aac":
+		s.Encoder = &lackey.AACEncoder{
+			Extension:        ".m4b",
+			TargetBitrate:    syncSpokenBitrate,
+			BitrateThreshold: threshold,
+			Channels:         syncSpokenChannels,
+		}
+	default:
+		return nil, fmt.Errorf("unknown spoken-word encoder: %s", syncSpokenEncoder)
+	}
+	return s, nil
+}
@@ -9,8 +9,13 @@ import (
 
 	"github.com/goulash/color"
 
+	_ "github.com/cassava/lackey/audio/ape"
+	"github.com/cassava/lackey/audio/codec"
+	_ "github.com/cassava/lackey/audio/dsf"
 	_ "github.com/cassava/lackey/audio/mp3"
-	"github.com/goulash/audio"
+	_ "github.com/cassava/lackey/audio/mp4"
+	_ "github.com/cassava/lackey/audio/ogg"
+	_ "github.com/cassava/lackey/audio/wav"
 	_ "github.com/goulash/audio/flac"
 )
 
@@ -18,7 +23,7 @@ var col = color.New()
 
 func printMetadata(file string) {
 	col.Printf("@!%s\n", file)
-	m, err := audio.ReadMetadata(file)
+	m, err := codec.ReadMetadata(file)
 	if err != nil {
 		col.Printf("\t@r%s\n", err)
 		return
@@ -42,8 +47,13 @@ func printMetadata(file string) {
 	col.Println()
 	col.Printf("\tEncoded by:       %s\n", m.EncodedBy())
 	col.Printf("\tEncoder settings: %s\n", m.EncoderSettings())
-	col.Printf("\tEncoding:         %s\n", m.Encoding())
+	col.Printf("\tEncoding:         %s\n", codec.String(m.Encoding()))
 	col.Printf("\tEncoding bitrate: %d Kbps\n", m.EncodingBitrate())
+	p := codec.PropertiesOf(m)
+	col.Printf("\tSample rate:      %d Hz\n", p.SampleRate)
+	col.Printf("\tBit depth:        %d\n", p.BitDepth)
+	col.Printf("\tChannels:         %d\n", p.Channels)
+	col.Printf("\tLossless:         %t\n", p.Lossless)
 	col.Println()
 	col.Printf("\tOriginal filename: %s\n", m.OriginalFilename())
 }
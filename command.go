@@ -0,0 +1,400 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/goulash/audio"
+)
+
+// CommandEncoder is an Encoder that runs external programs, which are
+// described by command templates such as:
+//
+//  opusenc --bitrate {bitrate} --artist {artist} {in} {out}
+//
+// A template is split into arguments like a shell would, with single
+// and double quotes, but it is not run by a shell. Placeholders are
+// then replaced within each argument, so values with spaces remain a
+// single argument. The following placeholders are available:
+//
+//  {in} {out}
+//  {title} {album} {artist} {albumartist} {composer} {genre} {comment}
+//  {year} {track} {tracktotal} {disc} {disctotal}
+//
+// as well as those defined in Vars. Use {{ and }} for literal braces.
+type CommandEncoder struct {
+	// Extension is the extension of the encoded files, such as ".opus".
+	Extension string `json:"extension"`
+
+	// Command is the template of the encoder command.
+	Command string `json:"command"`
+
+	// Decoder is an optional template of a command whose standard output
+	// is piped into the standard input of the encoder, for encoders that
+	// cannot read the source format themselves. For example:
+	//
+	//  flac -c -d {in}
+	Decoder string `json:"decoder,omitempty"`
+
+	// Stdout writes the standard output of the encoder to the destination,
+	// for encoders that cannot write to a file themselves.
+	Stdout bool `json:"stdout,omitempty"`
+
+	// Tags writes all tags of the source to the encoded file once it is
+	// encoded, as WriteTags does, for encoders that cannot write them all.
+	Tags bool `json:"tags,omitempty"`
+
+	// Vars defines additional placeholders, such as {bitrate}.
+	Vars map[string]string `json:"vars,omitempty"`
+
+	// Copy describes which sources are copied instead of encoded.
+	Copy CopyRule `json:"copy"`
+}
+
+// CopyRule describes which sources an encoder copies, namely those
+// with one of Codecs and a bitrate of at most MaxBitrate kbps.
+// A MaxBitrate of zero allows any bitrate.
+type CopyRule struct {
+	Codecs     []string `json:"codecs"`
+	MaxBitrate int      `json:"max_bitrate,omitempty"`
+
+	codecs []audio.Codec
+}
+
+// ErrGainUnsupported is returned by CommandEncoder.EncodeStream for jobs
+// with a gain, since the commands read the source themselves.
+var ErrGainUnsupported = errors.New("cannot apply a gain with a command encoder")
+
+var placeholders = map[string]bool{
+	"in": true, "out": true,
+	"title": true, "album": true, "artist": true, "albumartist": true,
+	"composer": true, "genre": true, "comment": true,
+	"year": true, "track": true, "tracktotal": true, "disc": true, "disctotal": true,
+}
+
+// ReadCommandEncoders reads command encoders from a JSON file, which
+// contains an object that maps encoder names to their definition:
+//
+//  {
+//    "opusenc": {
+//      "extension": ".opus",
+//      "command": "opusenc --bitrate {bitrate} --artist {artist} {in} {out}",
+//      "vars": {"bitrate": "128"},
+//      "copy": {"codecs": ["opus"], "max_bitrate": 160}
+//    }
+//  }
+func ReadCommandEncoders(path string) (map[string]*CommandEncoder, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encs map[string]*CommandEncoder
+	if err := json.Unmarshal(bs, &encs); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s", path, err)
+	}
+	for name, e := range encs {
+		if err := e.init(); err != nil {
+			return nil, fmt.Errorf("encoder %s in %s: %s", name, path, err)
+		}
+	}
+	return encs, nil
+}
+
+// init validates the encoder and parses the codecs of the copy rule.
+func (e *CommandEncoder) init() error {
+	if e.Extension == "" {
+		return errors.New("extension missing")
+	}
+	if !strings.HasPrefix(e.Extension, ".") {
+		e.Extension = "." + e.Extension
+	}
+	if e.Command == "" {
+		return errors.New("command missing")
+	}
+	for _, tmpl := range []string{e.Command, e.Decoder} {
+		if tmpl == "" {
+			continue
+		}
+		if _, err := e.expand(tmpl, nil); err != nil {
+			return err
+		}
+	}
+	e.Copy.codecs = e.Copy.codecs[:0]
+	for _, name := range e.Copy.Codecs {
+		c, err := codec.Parse(name)
+		if err != nil {
+			return err
+		}
+		e.Copy.codecs = append(e.Copy.codecs, c)
+	}
+	return nil
+}
+
+func (e *CommandEncoder) Ext() string { return e.Extension }
+
+func (e *CommandEncoder) CanCopy(src, dst Audio) bool {
+	for _, c := range e.Copy.codecs {
+		if src.Encoding() != c {
+			continue
+		}
+		if e.Copy.MaxBitrate == 0 {
+			return true
+		}
+		return belowThreshold(src, e.Copy.MaxBitrate)
+	}
+	return false
+}
+
+func (e *CommandEncoder) Encode(src, dst string, md Audio) error {
+	return encodeFile(e, src, dst, md)
+}
+
+// EncodeStream runs the commands of the encoder, which are killed when ctx
+// is done. The commands read the source themselves, so a gain cannot be
+// applied to it, and ErrGainUnsupported is returned if the job has one.
+// Progress is only reported when the encoder is done.
+func (e *CommandEncoder) EncodeStream(ctx context.Context, job *Job) (*Settings, error) {
+	if job.Gain != 0 {
+		return nil, ErrGainUnsupported
+	}
+	src, cleanup, err := job.source()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	dst, finish, err := job.output(e.Extension)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encoders expect to create the destination themselves.
+	os.Remove(dst)
+	settings := &Settings{}
+	err = e.run(ctx, src, dst, job.Audio, settings)
+	if ctx.Err() != nil {
+		// The error of a killed process is not very helpful.
+		err = ctx.Err()
+	}
+	if err == nil && e.Tags {
+		err = copyTags(ctx, src, job.Audio.Encoding(), dst)
+	}
+	if err == nil && job.Progress != nil {
+		if md := job.Audio.Metadata(); md != nil {
+			job.Progress(md.Length())
+		}
+	}
+	return settings, finish(err)
+}
+
+// run encodes src to dst, piping the decoder into the encoder if there is
+// one, and records the commands in settings. It returns an ExecError if
+// a command fails.
+func (e *CommandEncoder) run(ctx context.Context, src, dst string, md Audio, settings *Settings) error {
+	vars := e.vars(src, dst, md.Metadata())
+
+	// The encoder reads from the decoder or writes to standard output.
+	encVars := make(map[string]string, len(vars))
+	for k, v := range vars {
+		encVars[k] = v
+	}
+	if e.Decoder != "" {
+		encVars["in"] = "-"
+	}
+	if e.Stdout {
+		encVars["out"] = "-"
+	}
+	args, err := e.expand(e.Command, encVars)
+	if err != nil {
+		return err
+	}
+	settings.Command = args
+
+	var out bytes.Buffer
+	enc := exec.CommandContext(ctx, args[0], args[1:]...)
+	enc.Stderr = &out
+	enc.Stdout = &out
+	if e.Stdout {
+		f, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		enc.Stdout = f
+	}
+
+	if e.Decoder == "" {
+		err = enc.Run()
+	} else {
+		err = e.pipe(ctx, enc, vars, &out, settings)
+	}
+	if err != nil {
+		if e.Stdout {
+			os.Remove(dst)
+		}
+		return &ExecError{
+			Err:    err,
+			Output: out.String(),
+		}
+	}
+	return nil
+}
+
+// pipe runs the decoder and pipes its output into the encoder.
+// The error output of the decoder is written to out after both exit.
+func (e *CommandEncoder) pipe(ctx context.Context, enc *exec.Cmd, vars map[string]string, out io.Writer, settings *Settings) error {
+	args, err := e.expand(e.Decoder, vars)
+	if err != nil {
+		return err
+	}
+	settings.Decoder = args[0]
+	var b bytes.Buffer
+	defer func() { out.Write(b.Bytes()) }()
+	dec := exec.CommandContext(ctx, args[0], args[1:]...)
+	dec.Stderr = &b
+	enc.Stdin, err = dec.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := enc.Start(); err != nil {
+		return err
+	}
+	if err := dec.Run(); err != nil {
+		enc.Wait()
+		return err
+	}
+	return enc.Wait()
+}
+
+// vars returns the values of all placeholders.
+func (e *CommandEncoder) vars(src, dst string, md audio.Metadata) map[string]string {
+	vars := make(map[string]string)
+	for k, v := range e.Vars {
+		vars[k] = v
+	}
+	vars["in"], vars["out"] = src, dst
+	if md == nil {
+		return vars
+	}
+
+	itoa := func(i int) string {
+		if i == 0 {
+			return ""
+		}
+		return strconv.Itoa(i)
+	}
+	vars["title"] = md.Title()
+	vars["album"] = md.Album()
+	vars["artist"] = md.Artist()
+	vars["albumartist"] = md.AlbumArtist()
+	vars["composer"] = md.Composer()
+	vars["genre"] = md.Genre()
+	vars["comment"] = md.Comment()
+	vars["year"] = itoa(md.Year())
+	track, tracks := md.Track()
+	vars["track"], vars["tracktotal"] = itoa(track), itoa(tracks)
+	disc, discs := md.Disc()
+	vars["disc"], vars["disctotal"] = itoa(disc), itoa(discs)
+	return vars
+}
+
+// expand splits the template into arguments and replaces the placeholders
+// in each argument. If vars is nil, it only checks the placeholders.
+func (e *CommandEncoder) expand(tmpl string, vars map[string]string) ([]string, error) {
+	fields, err := splitCommand(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("empty command")
+	}
+	args := make([]string, len(fields))
+	for i, f := range fields {
+		var b strings.Builder
+		for len(f) > 0 {
+			switch {
+			case strings.HasPrefix(f, "{{"):
+				b.WriteByte('{')
+				f = f[2:]
+			case strings.HasPrefix(f, "}}"):
+				b.WriteByte('}')
+				f = f[2:]
+			case f[0] == '{':
+				j := strings.IndexByte(f, '}')
+				if j < 0 {
+					return nil, fmt.Errorf("unterminated placeholder in %q", tmpl)
+				}
+				name := f[1:j]
+				if _, ok := e.Vars[name]; !ok && !placeholders[name] {
+					return nil, fmt.Errorf("unknown placeholder {%s} in %q", name, tmpl)
+				}
+				b.WriteString(vars[name])
+				f = f[j+1:]
+			default:
+				b.WriteByte(f[0])
+				f = f[1:]
+			}
+		}
+		args[i] = b.String()
+	}
+	return args, nil
+}
+
+// splitCommand splits s into fields at unquoted white space.
+// Single and double quotes group characters into one field,
+// and a backslash escapes the next character outside single quotes.
+func splitCommand(s string) ([]string, error) {
+	var (
+		fields []string
+		b      strings.Builder
+		quote  rune
+		field  bool
+		escape bool
+	)
+	for _, r := range s {
+		switch {
+		case escape:
+			b.WriteRune(r)
+			escape = false
+		case r == '\\' && quote != '\'':
+			escape, field = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				b.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, field = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if field {
+				fields = append(fields, b.String())
+				b.Reset()
+				field = false
+			}
+		default:
+			b.WriteRune(r)
+			field = true
+		}
+	}
+	if quote != 0 || escape {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if field {
+		fields = append(fields, b.String())
+	}
+	return fields, nil
+}
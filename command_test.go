@@ -0,0 +1,225 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/goulash/audio"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"opusenc {in} {out}", []string{"opusenc", "{in}", "{out}"}},
+		{"  a \t b\n c  ", []string{"a", "b", "c"}},
+		{`a "b c" 'd e'`, []string{"a", "b c", "d e"}},
+		{`a "it's" 'say "hi"'`, []string{"a", "it's", `say "hi"`}},
+		{`a b\ c \"d\"`, []string{"a", "b c", `"d"`}},
+		{`a 'b\c' "d\"e"`, []string{"a", `b\c`, `d"e`}},
+		{`a "" ''`, []string{"a", "", ""}},
+		{`a"b c"d`, []string{"ab cd"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := splitCommand(tt.in)
+		if err != nil {
+			t.Errorf("splitCommand(%q): %s", tt.in, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitCommand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{`a "b`, `a 'b`, `a b\`} {
+		if _, err := splitCommand(in); err == nil {
+			t.Errorf("splitCommand(%q) succeeded", in)
+		}
+	}
+}
+
+func TestCommandExpand(t *testing.T) {
+	e := &CommandEncoder{Vars: map[string]string{"bitrate": "128"}}
+	vars := map[string]string{
+		"in":      "/music/A Band/01 Song.flac",
+		"out":     "/out/01 Song.opus",
+		"artist":  `Guns "N" Roses`,
+		"title":   "",
+		"bitrate": "128",
+	}
+	tests := []struct {
+		tmpl string
+		want []string
+	}{
+		{"enc --bitrate {bitrate} {in} {out}", []string{"enc", "--bitrate", "128", "/music/A Band/01 Song.flac", "/out/01 Song.opus"}},
+		{"enc --artist={artist} --title {title}", []string{"enc", `--artist=Guns "N" Roses`, "--title", ""}},
+		{`enc "--comment=by {artist}"`, []string{"enc", `--comment=by Guns "N" Roses`}},
+		{"enc {{in}} {{{bitrate}}}", []string{"enc", "{in}", "{128}"}},
+		{"enc '{in}'", []string{"enc", "/music/A Band/01 Song.flac"}},
+	}
+	for _, tt := range tests {
+		got, err := e.expand(tt.tmpl, vars)
+		if err != nil {
+			t.Errorf("expand(%q): %s", tt.tmpl, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expand(%q) = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+
+	for _, tmpl := range []string{"", "  ", "enc {quality}", "enc {in", `enc "{in}`} {
+		if _, err := e.expand(tmpl, nil); err == nil {
+			t.Errorf("expand(%q) succeeded", tmpl)
+		}
+	}
+}
+
+func TestReadCommandEncoders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "encoders.json")
+	err = ioutil.WriteFile(file, []byte(`{
+		"opusenc": {
+			"extension": "opus",
+			"command": "opusenc --bitrate {bitrate} {in} {out}",
+			"vars": {"bitrate": "128"},
+			"copy": {"codecs": ["opus", "Vorbis"], "max_bitrate": 160}
+		}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encs, err := ReadCommandEncoders(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := encs["opusenc"]
+	if e == nil || e.Ext() != ".opus" {
+		t.Fatalf("encoders are %v, want opusenc with the extension .opus", encs)
+	}
+	if want := []audio.Codec{codec.Opus, audio.OGG}; !reflect.DeepEqual(e.Copy.codecs, want) {
+		t.Errorf("copied codecs are %v, want %v", e.Copy.codecs, want)
+	}
+	opus := &fakeAudio{codec.Properties{Codec: codec.Opus, Bitrate: 128}}
+	mp3 := &fakeAudio{codec.Properties{Codec: audio.MP3, Bitrate: 128}}
+	if !e.CanCopy(opus, nil) || e.CanCopy(mp3, nil) {
+		t.Errorf("opusenc copies Opus: %v, and MP3: %v", e.CanCopy(opus, nil), e.CanCopy(mp3, nil))
+	}
+
+	invalid := []string{
+		`{"x": {"command": "enc {in} {out}"}}`,
+		`{"x": {"extension": ".x"}}`,
+		`{"x": {"extension": ".x", "command": "enc {bitrate} {in} {out}"}}`,
+		`{"x": {"extension": ".x", "command": "enc {in} {out}", "copy": {"codecs": ["mp5"]}}}`,
+		`{"x": []}`,
+	}
+	for _, s := range invalid {
+		if err := ioutil.WriteFile(file, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadCommandEncoders(file); err == nil {
+			t.Errorf("reading %s succeeded", s)
+		}
+	}
+}
+
+// untagged is a source without metadata.
+type untagged struct {
+	*fakeAudio
+}
+
+func (untagged) Metadata() audio.Metadata { return nil }
+
+func TestCommandEncode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "in file.wav")
+	if err := ioutil.WriteFile(src, []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The decoder is piped into the encoder, which writes to stdout.
+	e := &CommandEncoder{Extension: ".x", Command: "cat {in}", Decoder: "cat {in}", Stdout: true}
+	if err := e.init(); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "out file.x")
+	if err := e.Encode(src, dst, untagged{&fakeAudio{}}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "audio" {
+		t.Errorf("encoded %q, %v, want %q", b, err, "audio")
+	}
+
+	e = &CommandEncoder{Extension: ".x", Command: "cat {in}", Decoder: "false", Stdout: true}
+	if err := e.Encode(src, dst, untagged{&fakeAudio{}}); err == nil {
+		t.Error("encoding with a failing decoder succeeded")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("the output of a failed encoding was not removed")
+	}
+}
+
+func TestCommandEncodeStream(t *testing.T) {
+	// The source is read from a reader, and the output written to a buffer.
+	e := &CommandEncoder{Extension: ".x", Command: `sh -c 'cat "$0" > "$1"' {in} {out}`}
+	if err := e.init(); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	job := &Job{Source: "song.wav", Reader: strings.NewReader("audio"), Audio: untagged{&fakeAudio{}}, Output: &out}
+	settings, err := e.EncodeStream(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "audio" {
+		t.Errorf("encoded %q, want %q", out.String(), "audio")
+	}
+	if len(settings.Command) != 5 || settings.Command[0] != "sh" || settings.Decoder != "" {
+		t.Errorf("settings are %+v, want the sh command without a decoder", settings)
+	}
+
+	// The gain cannot be applied to the source that the command reads.
+	job = &Job{Source: "song.wav", Reader: strings.NewReader("audio"), Audio: untagged{&fakeAudio{}}, Output: &out, Gain: -3}
+	if _, err := e.EncodeStream(context.Background(), job); err != ErrGainUnsupported {
+		t.Errorf("error with a gain is %v, want %v", err, ErrGainUnsupported)
+	}
+
+	// The decoder and the encoder are killed when the context is done.
+	e = &CommandEncoder{Extension: ".x", Command: "cat", Decoder: "sleep 10", Stdout: true}
+	if err := e.init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	job = &Job{Source: "song.wav", Reader: strings.NewReader("audio"), Audio: untagged{&fakeAudio{}}, Output: &out}
+	settings, err = e.EncodeStream(ctx, job)
+	if err != context.DeadlineExceeded {
+		t.Errorf("error is %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("encoding stopped after %v", d)
+	}
+	if settings == nil || settings.Decoder != "sleep" {
+		t.Errorf("settings are %+v, want the sleep decoder", settings)
+	}
+}
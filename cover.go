@@ -0,0 +1,322 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/flac"
+	"github.com/cassava/lackey/audio/mp3"
+	"github.com/cassava/lackey/audio/mp4"
+	"github.com/cassava/lackey/audio/ogg"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/cassava/lackey/imaging"
+	"github.com/dhowden/tag"
+	"github.com/goulash/audio"
+)
+
+var ErrNoPictureWriter = errors.New("cannot embed pictures in this format")
+
+// EmbedPictures replaces the pictures embedded in a file with pics,
+// according to its extension: APIC frames in MP3 files, PICTURE blocks
+// in FLAC files, METADATA_BLOCK_PICTURE comments in Ogg files, and the
+// covr item in MPEG-4 files.
+func EmbedPictures(file string, pics []*tags.Picture) error {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mp3":
+		t, err := mp3.ReadTag(file)
+		if err != nil {
+			return err
+		}
+		t.Remove("APIC")
+		for _, p := range pics {
+			t.AddPicture(&mp3.Picture{
+				MIMEType:    p.MIMEType,
+				Type:        p.Type,
+				Description: p.Description,
+				Data:        p.Data,
+			})
+		}
+		return t.Write(file)
+	case ".flac":
+		return flac.WritePictures(file, pics)
+	case ".ogg", ".oga", ".opus":
+		return ogg.WritePictures(file, pics)
+	case ".m4a", ".m4b", ".mp4":
+		return mp4.WritePictures(file, pics)
+	}
+	return ErrNoPictureWriter
+}
+
+// ReadPictures returns the pictures embedded in a file, according to its
+// extension, as EmbedPictures writes them. Their width and height are
+// taken from the images, if they can be decoded.
+func ReadPictures(file string) ([]*tags.Picture, error) {
+	var (
+		pics []*tags.Picture
+		err  error
+	)
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mp3":
+		t, err := mp3.ReadTag(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range t.Pictures() {
+			pics = append(pics, &tags.Picture{
+				MIMEType:    p.MIMEType,
+				Type:        p.Type,
+				Description: p.Description,
+				Data:        p.Data,
+			})
+		}
+	case ".flac":
+		pics, err = flac.ReadPictures(file)
+	case ".ogg", ".oga", ".opus":
+		pics, err = ogg.ReadPictures(file)
+	case ".m4a", ".m4b", ".mp4":
+		pics, err = mp4.ReadPictures(file)
+	default:
+		return nil, ErrNoPictureWriter
+	}
+	for _, p := range pics {
+		if c, _, err := image.DecodeConfig(bytes.NewReader(p.Data)); err == nil {
+			p.Width, p.Height = c.Width, c.Height
+		}
+	}
+	return pics, err
+}
+
+// copyPictures replaces the pictures embedded in dst with those of src, or
+// with the first picture of src if its format has no picture reader. Files
+// that cannot have pictures embedded are left as they are.
+func copyPictures(src, dst string) error {
+	pics, err := ReadPictures(src)
+	if err == ErrNoPictureWriter {
+		var p *tags.Picture
+		if p, err = embeddedPicture(src); p != nil {
+			pics = []*tags.Picture{p}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := EmbedPictures(dst, pics); err != ErrNoPictureWriter {
+		return err
+	}
+	return nil
+}
+
+// embeddedPicture returns the picture embedded in file, which is the
+// first if there are several, or nil if there is none.
+func embeddedPicture(file string) (*tags.Picture, error) {
+	if c, err := codec.Identify(file); err == nil && (c == audio.OGG || c == codec.Opus) {
+		// The tag package does not read the pictures of Ogg files.
+		pics, err := ogg.ReadPictures(file)
+		if err != nil || len(pics) == 0 {
+			return nil, err
+		}
+		return newPicture(pics[0].Data, pics[0].Description), nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		// Files without tags have no pictures either.
+		return nil, nil
+	}
+	p := m.Picture()
+	if p == nil || len(p.Data) == 0 {
+		return nil, nil
+	}
+	return newPicture(p.Data, p.Description), nil
+}
+
+// readPicture returns the image file at path as a front cover.
+func readPicture(path string) (*tags.Picture, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newPicture(bs, ""), nil
+}
+
+// newPicture returns a front cover with the image data, whose type and
+// size are taken from the data itself, if it can be decoded.
+func newPicture(data []byte, desc string) *tags.Picture {
+	p := &tags.Picture{
+		MIMEType:    http.DetectContentType(data),
+		Type:        tags.FrontCover,
+		Description: desc,
+		Data:        data,
+	}
+	if c, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		p.Width, p.Height = c.Width, c.Height
+		p.Depth = 24
+	}
+	return p
+}
+
+// scalePicture returns p, or a JPEG copy of p that is scaled down so that
+// it is at most size pixels wide and high, with the same type.
+func scalePicture(p *tags.Picture, size, quality int) (*tags.Picture, error) {
+	if size <= 0 || (p.Width != 0 && p.Width <= size && p.Height <= size) {
+		return p, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(p.Data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode picture: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, imaging.Fit(img, size), imaging.JPEG, quality); err != nil {
+		return nil, err
+	}
+	q := newPicture(buf.Bytes(), p.Description)
+	q.Type = p.Type
+	return q, nil
+}
+
+// scaleCover writes the image file src to dst, as writeCover does.
+func scaleCover(src, dst string, size, quality int) error {
+	bs, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := writeCover(bs, dst, size, quality); err != nil {
+		return fmt.Errorf("cannot write cover of %s: %s", src, err)
+	}
+	return nil
+}
+
+// writeCover writes the image data to dst, scaled down so that it is at
+// most size pixels wide and high, in the format that the extension of dst
+// names, or else in that of the data. Covers that are small enough already
+// and in that format are written as they are.
+func writeCover(data []byte, dst string, size, quality int) error {
+	format := imaging.FormatOf(dst)
+	if format == imaging.Unknown {
+		format = imaging.Detect(data)
+	}
+	c, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if imaging.Detect(data) == format && (size <= 0 || (c.Width <= size && c.Height <= size)) {
+		return ioutil.WriteFile(dst, data, 0644)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, imaging.Fit(img, size), format, quality); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, buf.Bytes(), 0644)
+}
+
+// DefaultCoverSources are the names and glob patterns of the files that
+// are taken to be the cover of an album, from the most preferred.
+var DefaultCoverSources = []string{"cover.*", "folder.*", "front.*", "album.*", "albumart*"}
+
+// coverRank returns the rank of the image file name among sources, which
+// are names or glob patterns that are matched case-insensitively, or -1
+// if it matches none of them.
+func coverRank(sources []string, name string) int {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+	default:
+		return -1
+	}
+	name = strings.ToLower(name)
+	for i, s := range sources {
+		if ok, _ := filepath.Match(strings.ToLower(s), name); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// findCover returns the name of the best ranked cover among names, the
+// first of them if several are ranked equally, or "" if there is none.
+func findCover(sources []string, names []string) string {
+	best, rank := "", -1
+	for _, name := range names {
+		if r := coverRank(sources, name); r >= 0 && (rank < 0 || r < rank) {
+			best, rank = name, r
+		}
+	}
+	return best
+}
+
+// dirCover returns the path of the best cover in dir, or "".
+func dirCover(sources []string, dir string) (string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			names = append(names, fi.Name())
+		}
+	}
+	if name := findCover(sources, names); name != "" {
+		return filepath.Join(dir, name), nil
+	}
+	return "", nil
+}
+
+// embedCover embeds the cover of src into the output at path, which is
+// the picture embedded in src or else the best of CoverSources in its
+// directory. If force is false, outputs with a picture are left alone.
+func (o *Runner) embedCover(ctx context.Context, src, path string, force bool) error {
+	if !force {
+		if p, err := embeddedPicture(path); err != nil || p != nil {
+			return err
+		}
+	}
+	p, err := embeddedPicture(src)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		cover, err := dirCover(o.CoverSources, filepath.Dir(src))
+		if err != nil || cover == "" {
+			return err
+		}
+		if p, err = readPicture(cover); err != nil {
+			return err
+		}
+	}
+	if p == nil {
+		return nil
+	}
+	if p, err = scalePicture(p, o.EmbedCoverSize, o.CoverQuality); err != nil {
+		return err
+	}
+	if err := EmbedPictures(path, []*tags.Picture{p}); err != ErrNoPictureWriter {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/cassava/lackey/imaging"
+	"github.com/goulash/color"
+)
+
+// pngImage returns a PNG image of the size.
+func pngImage(width, height int) []byte {
+	var b bytes.Buffer
+	png.Encode(&b, image.NewGray(image.Rect(0, 0, width, height)))
+	return b.Bytes()
+}
+
+func TestNewPicture(t *testing.T) {
+	p := newPicture(pngImage(3, 2), "Cover")
+	if p.MIMEType != "image/png" || p.Type != tags.FrontCover || p.Description != "Cover" {
+		t.Errorf("picture is %+v, want a PNG front cover", p)
+	}
+	if p.Width != 3 || p.Height != 2 || p.Depth != 24 {
+		t.Errorf("size is %dx%dx%d, want 3x2x24", p.Width, p.Height, p.Depth)
+	}
+
+	p = newPicture([]byte("not an image"), "")
+	if p.Width != 0 || p.Height != 0 {
+		t.Errorf("size of data that is no image is %dx%d, want it unknown", p.Width, p.Height)
+	}
+
+	// Pictures that are small enough are not scaled.
+	small := newPicture(pngImage(3, 2), "")
+	for _, size := range []int{0, 3, 500} {
+		if p, err := scalePicture(small, size, 0); err != nil || p != small {
+			t.Errorf("size %d: picture is scaled", size)
+		}
+	}
+
+	// Others are scaled down to JPEG, keeping their aspect ratio.
+	p, err := scalePicture(newPicture(pngImage(8, 4), "Cover"), 4, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MIMEType != "image/jpeg" || p.Width != 4 || p.Height != 2 || p.Description != "Cover" {
+		t.Errorf("scaled picture is %s of %dx%d named %q, want image/jpeg of 4x2", p.MIMEType, p.Width, p.Height, p.Description)
+	}
+	if _, err := scalePicture(newPicture([]byte("not an image"), ""), 4, 0); err == nil {
+		t.Error("scaling data that is no image succeeded")
+	}
+}
+
+func TestScaleCover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "cover.png")
+	data := pngImage(8, 4)
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dst    string
+		size   int
+		format imaging.Format
+		width  int
+		copied bool
+	}{
+		{"same.png", 0, imaging.PNG, 8, true},
+		{"fits.png", 8, imaging.PNG, 8, true},
+		{"small.png", 4, imaging.PNG, 4, false},
+		{"cover.jpg", 0, imaging.JPEG, 8, false},
+		{"small.jpeg", 2, imaging.JPEG, 2, false},
+		{"cover.webp", 0, imaging.WebP, 8, false},
+		{"cover.img", 0, imaging.PNG, 8, true},
+	}
+	for _, tt := range tests {
+		dst := filepath.Join(dir, tt.dst)
+		if err := scaleCover(src, dst, tt.size, 0); err != nil {
+			t.Errorf("%s: %s", tt.dst, err)
+			continue
+		}
+		bs, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f := imaging.Detect(bs); f != tt.format {
+			t.Errorf("%s: format is %v, want %v", tt.dst, f, tt.format)
+		}
+		if copied := bytes.Equal(bs, data); copied != tt.copied {
+			t.Errorf("%s: cover is copied %v, want %v", tt.dst, copied, tt.copied)
+		}
+		if tt.format == imaging.WebP {
+			continue
+		}
+		if c, _, err := image.DecodeConfig(bytes.NewReader(bs)); err != nil || c.Width != tt.width || c.Height != tt.width/2 {
+			t.Errorf("%s: size is %dx%d with error %v, want %dx%d", tt.dst, c.Width, c.Height, err, tt.width, tt.width/2)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.png")
+	if err := ioutil.WriteFile(bad, []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := scaleCover(bad, filepath.Join(dir, "out.jpg"), 4, 0); err == nil {
+		t.Error("scaling a cover that is no image succeeded")
+	}
+}
+
+func TestEmbedPictures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cover := newPicture(pngImage(3, 2), "")
+	files := map[string][]byte{
+		"song.mp3":  mp3File(),
+		"song.flac": flacFile(1),
+		"song.m4a":  mp4File(),
+		"song.opus": opusFile(),
+	}
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if p, err := embeddedPicture(file); err != nil || p != nil {
+			t.Errorf("%s: picture is %v with error %v, want none", name, p, err)
+		}
+		if err := EmbedPictures(file, []*tags.Picture{cover}); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		p, err := embeddedPicture(file)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if p == nil || !bytes.Equal(p.Data, cover.Data) {
+			t.Errorf("%s: picture is %v, want the cover", name, p)
+		} else if p.Width != 3 || p.Height != 2 {
+			t.Errorf("%s: size is %dx%d, want 3x2", name, p.Width, p.Height)
+		}
+	}
+
+	wav := filepath.Join(dir, "song.wav")
+	if err := ioutil.WriteFile(wav, wavFile(make([]byte, 16), ""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := EmbedPictures(wav, []*tags.Picture{cover}); err != ErrNoPictureWriter {
+		t.Errorf("wav: error is %v, want %v", err, ErrNoPictureWriter)
+	}
+}
+
+func TestFindCover(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"song.flac", "Folder.JPG", "cover.png"}, "cover.png"},
+		{[]string{"albumart_large.jpg", "front.gif"}, "front.gif"},
+		{[]string{"AlbumArtSmall.jpg", "back.jpg"}, "AlbumArtSmall.jpg"},
+		{[]string{"folder.png", "folder.jpg"}, "folder.png"},
+		{[]string{"cover.txt", "cover.webp", "cover", "scan.jpg"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := findCover(DefaultCoverSources, tt.names); got != tt.want {
+			t.Errorf("%v: cover is %q, want %q", tt.names, got, tt.want)
+		}
+	}
+
+	sources := []string{"scan*.jpg", "Cover.png"}
+	for name, want := range map[string]int{"scan01.jpg": 0, "COVER.PNG": 1, "cover.jpg": -1, "scan.png": -1} {
+		if r := coverRank(sources, name); r != want {
+			t.Errorf("%s: rank is %d, want %d", name, r, want)
+		}
+	}
+}
+
+func TestDirCover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if got, err := dirCover(DefaultCoverSources, dir); err != nil || got != "" {
+		t.Errorf("cover of an empty directory is %q with error %v", got, err)
+	}
+
+	// Directories are not covers, however they are named.
+	if err := os.Mkdir(filepath.Join(dir, "cover.jpg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"song.flac", "folder.jpg", "albumart.png"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := filepath.Join(dir, "folder.jpg")
+	if got, err := dirCover(DefaultCoverSources, dir); err != nil || got != want {
+		t.Errorf("cover is %q with error %v, want %q", got, err, want)
+	}
+	if _, err := dirCover(DefaultCoverSources, filepath.Join(dir, "missing")); err == nil {
+		t.Error("finding the cover of a missing directory succeeded")
+	}
+}
+
+func TestExtractCover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "song.flac")
+	if err := ioutil.WriteFile(src, flacFile(1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	col := color.New()
+	col.SetOutput(ioutil.Discard)
+	o := &Runner{Color: col, CoverSize: 4}
+
+	// Nothing is written for a track without a picture.
+	dst := filepath.Join(dir, "cover.jpg")
+	if err := o.ExtractCover(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("cover of a track without a picture exists: %v", err)
+	}
+
+	if err := EmbedPictures(src, []*tags.Picture{newPicture(pngImage(8, 4), "")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.ExtractCover(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, name, err := image.DecodeConfig(bytes.NewReader(bs)); err != nil || name != "jpeg" || c.Width != 4 || c.Height != 2 {
+		t.Errorf("cover is a %dx%d %s image with error %v, want a 4x2 jpeg", c.Width, c.Height, name, err)
+	}
+
+	o.DryRun = true
+	dry := filepath.Join(dir, "folder.png")
+	if err := o.ExtractCover(src, dry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dry); !os.IsNotExist(err) {
+		t.Errorf("cover was written in a dry run: %v", err)
+	}
+}
+
+func TestEmbedCover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src", "song.flac")
+	dst := filepath.Join(dir, "song.opus")
+	album := pngImage(4, 4)
+	if err := os.Mkdir(filepath.Dir(src), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, data := range map[string][]byte{src: flacFile(1), dst: opusFile()} {
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without a cover file, the output is left as it is.
+	o := &Runner{CoverSources: DefaultCoverSources}
+	ctx := context.Background()
+	if err := o.embedCover(ctx, src, dst, false); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := embeddedPicture(dst); p != nil {
+		t.Errorf("picture is %v, want none", p)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(src), "cover.png"), album, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.embedCover(ctx, src, dst, false); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := embeddedPicture(dst); p == nil || !bytes.Equal(p.Data, album) {
+		t.Errorf("picture is %v, want the cover of the album", p)
+	}
+
+	// The picture of the source wins over the cover file, but only
+	// replaces that of the output if force is true.
+	own := pngImage(2, 2)
+	if err := EmbedPictures(src, []*tags.Picture{newPicture(own, "")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, force := range []bool{false, true} {
+		if err := o.embedCover(ctx, src, dst, force); err != nil {
+			t.Fatal(err)
+		}
+		want := album
+		if force {
+			want = own
+		}
+		if p, _ := embeddedPicture(dst); p == nil || !bytes.Equal(p.Data, want) {
+			t.Errorf("force %v: picture is %v, want %v", force, p, want)
+		}
+	}
+}
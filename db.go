@@ -7,13 +7,22 @@ package lackey
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/facebookgo/symwalk"
 	"github.com/goulash/audio"
 
+	_ "github.com/cassava/lackey/audio/ape"
+	"github.com/cassava/lackey/audio/codec"
+	_ "github.com/cassava/lackey/audio/dsf"
 	_ "github.com/cassava/lackey/audio/mp3"
+	_ "github.com/cassava/lackey/audio/mp4"
+	_ "github.com/cassava/lackey/audio/ogg"
+	_ "github.com/cassava/lackey/audio/wav"
 	"github.com/cassava/lackey/filetype"
 	_ "github.com/goulash/audio/flac"
 )
@@ -29,6 +38,7 @@ const (
 	FileEntry
 	MusicEntry
 	IgnoreEntry
+	VideoEntry
 
 	ErrorEntry EntryType = 0
 )
@@ -39,11 +49,14 @@ type Entry struct {
 	children []*Entry
 
 	path  string // path relative to database root
+	abs   string // absolute path, if it is not below the root
 	fi    os.FileInfo
 	typ   EntryType // entry type (dir|file|music)
 	bytes int64     // cumulative size of entry
 	codec audio.Codec
 	data  interface{} // any extra data stored with this entry
+
+	member *archiveMember // file in an archive, unpacked when needed
 }
 
 func (e *Entry) Key() string {
@@ -70,6 +83,10 @@ func (e *Entry) IsIgnored() bool {
 	return e.typ == IgnoreEntry
 }
 
+func (e *Entry) IsVideo() bool {
+	return e.typ == VideoEntry
+}
+
 func (e *Entry) Parent() *Entry {
 	return e.parent
 }
@@ -87,8 +104,11 @@ func (e *Entry) Data() interface{} {
 
 	// Get this data in a lazy fashion
 	if e.typ == MusicEntry {
-		abs := filepath.Join(e.db.Path(), e.path)
-		m, err := audio.ReadMetadata(abs)
+		if err := e.unpack(); err != nil {
+			e.data = err
+			return e.data
+		}
+		m, err := codec.ReadMetadata(e.AbsPath())
 		if err != nil {
 			e.data = err
 			return e.data
@@ -100,6 +120,19 @@ func (e *Entry) Data() interface{} {
 }
 
 func (e *Entry) Encoding() audio.Codec {
+	// The codec of a file in an archive is guessed from its name,
+	// unless only its content tells.
+	if m := e.member; m != nil && m.isAudio() && !m.certain {
+		m.identify.Do(func() {
+			if e.unpack() != nil {
+				return
+			}
+			if c, err := codec.Identify(e.AbsPath()); err == nil && c != audio.Unknown {
+				m.codec = c
+			}
+		})
+		return m.codec
+	}
 	return e.codec
 }
 
@@ -112,6 +145,17 @@ func (e *Entry) Metadata() audio.Metadata {
 	return md
 }
 
+// Properties returns the technical properties of the audio stream,
+// such as the sample rate and bit depth, or nil if the metadata
+// cannot be read.
+func (e *Entry) Properties() *codec.Properties {
+	md := e.Metadata()
+	if md == nil {
+		return nil
+	}
+	return codec.PropertiesOf(md)
+}
+
 func (e *Entry) Walk(fn func(e *Entry) error) error {
 	if e.IsDir() {
 		err := fn(e)
@@ -162,7 +206,13 @@ func (e *Entry) RelPath() string {
 	return e.path
 }
 
+// AbsPath returns the absolute path of the entry, which is where it is
+// unpacked to if it is in an archive. Such files are only there once
+// unpack has been called.
 func (e *Entry) AbsPath() string {
+	if e.abs != "" {
+		return e.abs
+	}
 	return filepath.Join(e.db.Path(), e.path)
 }
 
@@ -182,7 +232,12 @@ type Database struct {
 	// Options
 	ignoreHidden   bool
 	followSymlinks bool
+	archives       bool
 	walker         func(string, filepath.WalkFunc) error
+
+	// unpackDir contains the archives that are read as directories,
+	// each unpacked at its key.
+	unpackDir string
 }
 
 func (db *Database) Path() string {
@@ -210,15 +265,64 @@ func (db *Database) Walk(fn func(e *Entry) error) error {
 	return db.root.Walk(fn)
 }
 
+// UnpackDir returns the temporary directory that the files of archives
+// are unpacked into, each archive at its key, or "" if no archive has
+// been read.
+func (db *Database) UnpackDir() string {
+	return db.unpackDir
+}
+
+// Close removes the files of archives that have been unpacked.
+func (db *Database) Close() error {
+	if db.unpackDir == "" {
+		return nil
+	}
+	err := os.RemoveAll(db.unpackDir)
+	db.unpackDir = ""
+	return err
+}
+
+// readArchive reads the index of the archive file, whose modification
+// time is mod, which is unpacked into the directory for key in the unpack
+// directory.
+func (db *Database) readArchive(file, key string, mod time.Time) (*archive, error) {
+	if db.unpackDir == "" {
+		dir, err := ioutil.TempDir("", "lackey-")
+		if err != nil {
+			return nil, err
+		}
+		db.unpackDir = dir
+	}
+	return readArchive(file, filepath.Join(db.unpackDir, key), mod)
+}
+
+// unpack unpacks the entry if it is a file in an archive, so that it can
+// be read at its AbsPath.
+func (e *Entry) unpack() error {
+	if e.member == nil {
+		return nil
+	}
+	return e.member.a.unpack(e.member, false)
+}
+
+// unpackAlbum unpacks the entry like unpack, and the other tracks of its
+// directory with it, which are read to measure the album gain.
+func (e *Entry) unpackAlbum() error {
+	if e.member == nil {
+		return nil
+	}
+	return e.member.a.unpack(e.member, true)
+}
+
 // init populates the entry with all the relevant informations.
 // It is expected that e.parent and e.db are already set.
 func (e *Entry) init(path string, fi os.FileInfo, err error) {
-	defer e.db.Set(path, e)
+	// The key of an archive is that of the directory it is read as.
+	defer func() { e.db.Set(e.path, e) }()
 
-	root := e.db.Path()
-	abs := filepath.Join(root, path)
 	e.path = path
 	e.fi = fi
+	abs := e.AbsPath()
 
 	if err != nil {
 		e.typ = ErrorEntry
@@ -227,41 +331,21 @@ func (e *Entry) init(path string, fi os.FileInfo, err error) {
 	}
 
 	if fi.IsDir() {
-		e.typ = DirEntry
-		e.db.walker(abs, func(path string, fi os.FileInfo, err error) error {
-			if path == abs {
-				return nil
-			}
-
-			// Ignore hidden files if requested
-			if e.db.ignoreHidden && filepath.HasPrefix(filepath.Base(path), ".") {
-				return nil
-			}
-
-			path, _ = filepath.Rel(root, path)
-			v := &Entry{
-				db:     e.db,
-				parent: e,
-			}
-			v.init(path, fi, err)
-			e.children = append(e.children, v)
-			e.bytes += v.bytes
-
-			// filepath.Walk should not recurse, because v.init does that already.
-			if fi != nil && fi.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		})
+		e.initDir(abs)
+		return
+	}
+	if e.db.archives && e.initArchive(abs) {
 		return
 	}
 
 	e.bytes = fi.Size()
-	e.codec, err = audio.Identify(abs)
+	e.codec, err = codec.Identify(abs)
 	if e.codec == audio.Unknown {
 		ft := filetype.Identify(abs)
 		if ft == filetype.Text || ft == filetype.Image {
 			e.typ = FileEntry
+		} else if ft == filetype.Video {
+			e.typ = VideoEntry
 		} else {
 			e.typ = IgnoreEntry
 		}
@@ -272,9 +356,126 @@ func (e *Entry) init(path string, fi os.FileInfo, err error) {
 	}
 }
 
+// initDir reads the children of the directory entry, which is at abs.
+func (e *Entry) initDir(abs string) {
+	e.typ = DirEntry
+	e.db.walker(abs, func(path string, fi os.FileInfo, err error) error {
+		if path == abs {
+			return nil
+		}
+
+		// Ignore hidden files if requested
+		if e.db.ignoreHidden && filepath.HasPrefix(filepath.Base(path), ".") {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(abs, path)
+		v := &Entry{
+			db:     e.db,
+			parent: e,
+		}
+		v.init(filepath.Join(e.path, rel), fi, err)
+		e.children = append(e.children, v)
+		e.bytes += v.bytes
+
+		// filepath.Walk should not recurse, because v.init does that already.
+		if fi != nil && fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// initArchive reads the archive at abs as a directory, whose name is that
+// of the archive without its extension, and whose children are the files
+// listed in the index of the archive. It returns false if it is not such
+// an archive, if it cannot be read, or if another entry has that name
+// already, such as the archive unpacked by hand.
+func (e *Entry) initArchive(abs string) bool {
+	name, ok := archiveName(e.fi.Name())
+	if !ok {
+		return false
+	}
+	key := filepath.Join(filepath.Dir(e.path), name)
+	if e.db.Get(key) != nil {
+		return false
+	}
+	a, err := e.db.readArchive(abs, key, e.fi.ModTime())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", e.Key(), err)
+		return false
+	}
+
+	e.path, e.abs = key, a.dir
+	e.fi = &archiveInfo{FileInfo: e.fi, name: name}
+	e.initMembers(a, "")
+	return true
+}
+
+// initMembers reads the members of the archive a that are in the directory
+// dir of the archive as the children of the directory entry. Files in
+// archives are identified by their names, since they are not unpacked yet.
+// Archives in archives are not read.
+func (e *Entry) initMembers(a *archive, dir string) {
+	e.typ = DirEntry
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	var last string
+	for _, m := range a.members {
+		if !strings.HasPrefix(m.rel, prefix) {
+			continue
+		}
+		name := m.rel[len(prefix):]
+		sub := ""
+		if i := strings.Index(name, "/"); i >= 0 {
+			name, sub = name[:i], name[i+1:]
+		}
+		if name == last || e.db.ignoreHidden && strings.HasPrefix(name, ".") {
+			continue
+		}
+		last = name
+
+		v := &Entry{
+			db:     e.db,
+			parent: e,
+			path:   filepath.Join(e.path, filepath.FromSlash(name)),
+			abs:    filepath.Join(e.abs, filepath.FromSlash(name)),
+		}
+		if sub != "" {
+			v.fi = &archiveInfo{FileInfo: e.fi, name: name}
+			v.initMembers(a, prefix+name)
+		} else {
+			v.fi, v.member = m.info, m
+			v.bytes = m.info.Size()
+			v.codec = m.codec
+			switch ft := filetype.IdentifyName(name); {
+			case m.isAudio():
+				v.typ = MusicEntry
+			case ft == filetype.Text || ft == filetype.Image:
+				v.typ = FileEntry
+			case ft == filetype.Video:
+				v.typ = VideoEntry
+			default:
+				v.typ = IgnoreEntry
+			}
+		}
+		e.db.Set(v.path, v)
+		e.children = append(e.children, v)
+		e.bytes += v.bytes
+	}
+}
+
 type LibraryReader struct {
 	FollowSymlinks bool
 	IgnoreHidden   bool
+
+	// Archives reads zip and tar archives as directories, as if they were
+	// unpacked where they are. Their files are listed from their index, and
+	// only unpacked into a temporary directory when they are read, which
+	// Database.Close removes.
+	Archives bool
 }
 
 func (r LibraryReader) ReadLibrary(path string) (*Database, error) {
@@ -295,6 +496,7 @@ func (r LibraryReader) ReadLibrary(path string) (*Database, error) {
 		entries:        make(map[string]*Entry),
 		followSymlinks: r.FollowSymlinks,
 		ignoreHidden:   r.IgnoreHidden,
+		archives:       r.Archives,
 		walker:         filepath.Walk,
 	}
 	if r.FollowSymlinks {
@@ -0,0 +1,253 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/flac"
+	"github.com/cassava/lackey/audio/wav"
+	"github.com/goulash/audio"
+)
+
+// Decoder decodes audio files to a WAV stream, which any encoder can read.
+type Decoder interface {
+	// Name is used to choose or exclude a decoder, such as "ffmpeg".
+	Name() string
+
+	// CanDecode returns true if the decoder can decode the codec.
+	CanDecode(c audio.Codec) bool
+
+	// Decode returns a WAV stream of the audio in src. Close must be called
+	// on the stream, which returns any error that occurred while decoding.
+	// Decoding stops when ctx is done.
+	Decode(ctx context.Context, src string) (io.ReadCloser, error)
+}
+
+// CommandDecoder is a Decoder that runs an external program, which writes
+// a WAV stream to standard output. The placeholder {in} in Args is replaced
+// by the source file.
+type CommandDecoder struct {
+	Program string
+	Args    []string
+
+	// Codecs are the codecs the program can decode; if it is empty,
+	// the program can decode all codecs.
+	Codecs []audio.Codec
+}
+
+func (d *CommandDecoder) Name() string { return d.Program }
+
+func (d *CommandDecoder) CanDecode(c audio.Codec) bool {
+	if len(d.Codecs) == 0 {
+		return true
+	}
+	for _, x := range d.Codecs {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *CommandDecoder) Decode(ctx context.Context, src string) (io.ReadCloser, error) {
+	args := make([]string, len(d.Args))
+	for i, a := range d.Args {
+		args[i] = strings.Replace(a, "{in}", src, -1)
+	}
+	cmd := exec.CommandContext(ctx, d.Program, args...)
+	r := &commandReader{cmd: cmd}
+	cmd.Stderr = &r.stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	r.ReadCloser = out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// commandReader reads the standard output of a command.
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+// Close closes the pipe and waits for the command to exit. If the stream
+// has not been read to the end, the command exits with a broken pipe.
+func (r *commandReader) Close() error {
+	r.ReadCloser.Close()
+	if err := r.cmd.Wait(); err != nil {
+		return &ExecError{
+			Err:    fmt.Errorf("%s: %s", r.cmd.Path, err),
+			Output: r.stderr.String(),
+		}
+	}
+	return nil
+}
+
+// NativeDecoder decodes files in Go, without any external program.
+// At the moment it reads WAV, AIFF, and FLAC files.
+type NativeDecoder struct{}
+
+func (NativeDecoder) Name() string { return "native" }
+
+func (NativeDecoder) CanDecode(c audio.Codec) bool {
+	return c == audio.WAV || c == codec.AIFF || c == audio.FLAC
+}
+
+func (NativeDecoder) Decode(ctx context.Context, src string) (io.ReadCloser, error) {
+	c, err := codec.Identify(src)
+	if err != nil {
+		return nil, err
+	}
+	if c == audio.FLAC {
+		r, _, err := flac.NewReader(src)
+		return r, err
+	}
+	r, _, err := wav.NewReader(src)
+	return r, err
+}
+
+// Decoders chooses a decoder for each codec from a list of decoders.
+type Decoders struct {
+	// List contains the decoders in order of preference.
+	List []Decoder
+
+	// Prefer maps codecs to the name of the decoder to use for them,
+	// regardless of the order in List.
+	Prefer map[audio.Codec]string
+
+	// Exclude maps codecs to the names of decoders that must not be used
+	// for them. Decoders excluded for audio.Unknown are not used at all.
+	Exclude map[audio.Codec][]string
+}
+
+// NewDecoders returns the default decoders, which are in order of preference:
+// native, flac, lame, and ffmpeg. Since the native decoder reads FLAC files,
+// the flac program is only used if it is preferred with a rule.
+func NewDecoders() *Decoders {
+	return &Decoders{
+		List: []Decoder{
+			NativeDecoder{},
+			&CommandDecoder{
+				Program: "flac",
+				Args:    []string{"-c", "-d", "-s", "{in}"},
+				Codecs:  []audio.Codec{audio.FLAC},
+			},
+			&CommandDecoder{
+				Program: "lame",
+				Args:    []string{"--decode", "--quiet", "{in}", "-"},
+				Codecs:  []audio.Codec{audio.MP3},
+			},
+			&CommandDecoder{
+				Program: "ffmpeg",
+				Args:    []string{"-v", "error", "-i", "{in}", "-map", "0:a:0", "-f", "wav", "-"},
+			},
+		},
+		Prefer:  make(map[audio.Codec]string),
+		Exclude: make(map[audio.Codec][]string),
+	}
+}
+
+// DefaultDecoders is used by encoders that are not given any decoders.
+var DefaultDecoders = NewDecoders()
+
+func (ds *Decoders) excluded(c audio.Codec, name string) bool {
+	for _, x := range [...]audio.Codec{audio.Unknown, c} {
+		for _, n := range ds.Exclude[x] {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// For returns the decoder to use for the codec.
+func (ds *Decoders) For(c audio.Codec) (Decoder, error) {
+	if name, ok := ds.Prefer[c]; ok {
+		for _, d := range ds.List {
+			if d.Name() == name && d.CanDecode(c) {
+				return d, nil
+			}
+		}
+		return nil, fmt.Errorf("preferred decoder %s cannot decode %s", name, codec.String(c))
+	}
+	for _, d := range ds.List {
+		if d.CanDecode(c) && !ds.excluded(c, d.Name()) {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("no decoder available for %s", codec.String(c))
+}
+
+// Decode decodes src, which is of the codec c, and calls fn with the WAV
+// stream. It returns the error of fn, or otherwise that of the decoder.
+func (ds *Decoders) Decode(ctx context.Context, src string, c audio.Codec, fn func(r io.Reader) error) error {
+	d, err := ds.For(c)
+	if err != nil {
+		return err
+	}
+	return decodeWith(ctx, d, src, fn)
+}
+
+// decodeWith decodes src with d and calls fn with the WAV stream.
+func decodeWith(ctx context.Context, d Decoder, src string, fn func(r io.Reader) error) error {
+	r, err := d.Decode(ctx, src)
+	if err != nil {
+		return err
+	}
+	err = fn(r)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ParseRule parses a rule such as "flac=ffmpeg", which prefers ffmpeg
+// for FLAC files, or "!lame" and "mp3=!lame", which exclude lame for all
+// codecs or for MP3 files.
+func (ds *Decoders) ParseRule(rule string) error {
+	c := audio.Unknown
+	name := rule
+	if i := strings.IndexByte(rule, '='); i >= 0 {
+		var err error
+		c, err = codec.Parse(rule[:i])
+		if err != nil {
+			return err
+		}
+		name = rule[i+1:]
+	}
+
+	exclude := strings.HasPrefix(name, "!")
+	name = strings.TrimPrefix(name, "!")
+	known := false
+	for _, d := range ds.List {
+		known = known || d.Name() == name
+	}
+	if !known {
+		return fmt.Errorf("unknown decoder: %s", name)
+	}
+
+	switch {
+	case exclude:
+		ds.Exclude[c] = append(ds.Exclude[c], name)
+	case c == audio.Unknown:
+		return fmt.Errorf("decoder rule %q needs a codec, such as flac=%s", rule, name)
+	default:
+		ds.Prefer[c] = name
+	}
+	return nil
+}
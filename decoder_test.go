@@ -0,0 +1,119 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/goulash/audio"
+)
+
+func TestDecodersParseRule(t *testing.T) {
+	tests := []struct {
+		rules []string
+		codec audio.Codec
+		want  string
+	}{
+		{nil, audio.WAV, "native"},
+		{nil, audio.FLAC, "native"},
+		{[]string{"flac=flac"}, audio.FLAC, "flac"},
+		{nil, audio.MP3, "lame"},
+		{nil, codec.Opus, "ffmpeg"},
+		{[]string{"flac=ffmpeg"}, audio.FLAC, "ffmpeg"},
+		{[]string{"FLAC=ffmpeg"}, audio.MP3, "lame"},
+		{[]string{"!lame"}, audio.MP3, "ffmpeg"},
+		{[]string{"mp3=!lame"}, audio.MP3, "ffmpeg"},
+		{[]string{"flac=!lame"}, audio.MP3, "lame"},
+		{[]string{"wav=!native", "aiff=ffmpeg"}, audio.WAV, "ffmpeg"},
+	}
+	for _, tt := range tests {
+		ds := NewDecoders()
+		for _, r := range tt.rules {
+			if err := ds.ParseRule(r); err != nil {
+				t.Fatalf("ParseRule(%q): %s", r, err)
+			}
+		}
+		d, err := ds.For(tt.codec)
+		if err != nil {
+			t.Errorf("%v: decoder for %s: %s", tt.rules, codec.String(tt.codec), err)
+		} else if d.Name() != tt.want {
+			t.Errorf("%v: decoder for %s is %s, want %s", tt.rules, codec.String(tt.codec), d.Name(), tt.want)
+		}
+	}
+
+	for _, r := range []string{"ffmpeg", "flac=sox", "mp5=lame", "!sox"} {
+		if err := NewDecoders().ParseRule(r); err == nil {
+			t.Errorf("ParseRule(%q) succeeded", r)
+		}
+	}
+
+	ds := NewDecoders()
+	ds.ParseRule("mp3=flac")
+	if _, err := ds.For(audio.MP3); err == nil {
+		t.Error("preferring a decoder that cannot decode MP3 succeeded")
+	}
+	ds = NewDecoders()
+	ds.ParseRule("!ffmpeg")
+	if _, err := ds.For(codec.Opus); err == nil {
+		t.Error("found a decoder for Opus without ffmpeg")
+	}
+}
+
+func TestDecodersDecode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "track one.wav")
+	if err := ioutil.WriteFile(src, []byte("RIFF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := &Decoders{List: []Decoder{
+		&CommandDecoder{Program: "cat", Args: []string{"{in}"}, Codecs: []audio.Codec{audio.WAV}},
+		&CommandDecoder{Program: "false"},
+	}}
+	var got []byte
+	err = ds.Decode(context.Background(), src, audio.WAV, func(r io.Reader) error {
+		got, err = ioutil.ReadAll(r)
+		return err
+	})
+	if err != nil || string(got) != "RIFF" {
+		t.Errorf("decoded %q, %v, want %q", got, err, "RIFF")
+	}
+
+	err = ds.Decode(context.Background(), src, audio.MP3, func(r io.Reader) error {
+		_, err := ioutil.ReadAll(r)
+		return err
+	})
+	if _, ok := err.(*ExecError); !ok {
+		t.Errorf("error of a failing decoder is %v, want an ExecError", err)
+	}
+}
+
+func TestCommandDecoderCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	d := &CommandDecoder{Program: "sleep", Args: []string{"10"}}
+	start := time.Now()
+	err := decodeWith(ctx, d, "", func(r io.Reader) error {
+		_, err := ioutil.ReadAll(r)
+		return err
+	})
+	if err == nil {
+		t.Error("decoding succeeded after the context was done")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("decoder was not stopped when the context was done")
+	}
+}
@@ -0,0 +1,576 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/loudness"
+	"github.com/cassava/lackey/audio/mp3"
+	"github.com/cassava/lackey/audio/wav"
+	"github.com/goulash/audio"
+)
+
+// StreamEncoder is an Encoder that is not bound to files: it reads the
+// source from a path or a reader, writes to any writer, stops when its
+// context is done, and reports its progress. Use NewStreamEncoder to
+// use an Encoder where a StreamEncoder is expected.
+type StreamEncoder interface {
+	Ext() string
+	// CanCopy returns true if src should be copied instead of transcoded.
+	// The destination dst may be nil if it is not known yet.
+	CanCopy(src, dst Audio) bool
+	// EncodeStream encodes the source of the job to its output,
+	// and returns the settings that were used.
+	EncodeStream(ctx context.Context, job *Job) (*Settings, error)
+}
+
+// Job describes the source and the output of an encoding.
+type Job struct {
+	// Source is the path of the source file. If Reader is not nil, the
+	// source is read from Reader instead, and Source only provides the
+	// extension of the source.
+	Source string
+	Reader io.Reader
+
+	// Audio is the metadata of the source, which determines the decoder
+	// and the tags of the output.
+	Audio Audio
+
+	// Output receives the encoded file. If it is an empty regular file,
+	// encoders may write to its path directly instead.
+	Output io.Writer
+
+	// Progress is called with the length of the audio that has been
+	// decoded so far, if it is not nil.
+	Progress func(decoded time.Duration)
+
+	// Gain is applied to the decoded audio, in dB. Encoders adapted with
+	// NewStreamEncoder ignore it, and CommandEncoder does not support it.
+	Gain float64
+}
+
+// Settings describes how a file was encoded.
+type Settings struct {
+	// Decoder is the name of the decoder, if one was used.
+	Decoder string
+	// Command is the encoder command with all of its arguments.
+	Command []string
+}
+
+func (s *Settings) String() string {
+	args := make([]string, len(s.Command))
+	for i, a := range s.Command {
+		if a == "" || strings.ContainsAny(a, " \t'\"") {
+			a = strconv.Quote(a)
+		}
+		args[i] = a
+	}
+	cmd := strings.Join(args, " ")
+	if s.Decoder == "" {
+		return cmd
+	}
+	return s.Decoder + " | " + cmd
+}
+
+// NewStreamEncoder returns e if it is a StreamEncoder already, and otherwise
+// adapts it, using temporary files for sources that are read from a reader
+// and for outputs that are not files. The adapted encoder only reports
+// progress when it is done, and cannot be stopped while it is encoding.
+func NewStreamEncoder(e Encoder) StreamEncoder {
+	if se, ok := e.(StreamEncoder); ok {
+		return se
+	}
+	return &encoderAdapter{e}
+}
+
+type encoderAdapter struct {
+	Encoder
+}
+
+func (a *encoderAdapter) EncodeStream(ctx context.Context, job *Job) (*Settings, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	src, cleanup, err := job.source()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	dst, finish, err := job.output(a.Ext())
+	if err != nil {
+		return nil, err
+	}
+
+	// Encoders expect to create the destination themselves.
+	os.Remove(dst)
+	err = a.Encode(src, dst, job.Audio)
+	if err == nil && job.Progress != nil {
+		if md := job.Audio.Metadata(); md != nil {
+			job.Progress(md.Length())
+		}
+	}
+	return &Settings{}, finish(err)
+}
+
+// encodeFile encodes src to the file dst, which is how the stream
+// encoders implement Encoder.
+func encodeFile(e StreamEncoder, src, dst string, md Audio) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = e.EncodeStream(context.Background(), &Job{Source: src, Audio: md, Output: f})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// runTagged is like runThen, but then writes all tags of the source to
+// the output, since encoders only carry some of them.
+func (j *Job) runTagged(ctx context.Context, ext string, cmd func(src, dst string) *exec.Cmd) (*Settings, error) {
+	return j.runThen(ctx, ext, cmd, func(src, dst string) error {
+		return copyTags(ctx, src, j.Audio.Encoding(), dst)
+	})
+}
+
+// runThen decodes the source of the job and pipes it into the command
+// returned by cmd, which reads from src and writes to dst, and calls then
+// once the command succeeded. It returns an ExecError if the command fails.
+func (j *Job) runThen(ctx context.Context, ext string, cmd func(src, dst string) *exec.Cmd, then func(src, dst string) error) (*Settings, error) {
+	d, err := DefaultDecoders.For(j.Audio.Encoding())
+	if err != nil {
+		return nil, err
+	}
+	src, cleanup, err := j.source()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	dst, finish, err := j.output(ext)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &Settings{Decoder: d.Name()}
+	err = decodeWith(ctx, d, src, func(r io.Reader) error {
+		if j.Gain != 0 {
+			var err error
+			if r, err = loudness.Amplify(r, j.Gain); err != nil {
+				return err
+			}
+		}
+		c := cmd(src, dst)
+		c.Stdin = j.progress(r)
+		settings.Command = c.Args
+		bs, err := c.CombinedOutput()
+		if err != nil {
+			return &ExecError{
+				Err:    err,
+				Output: string(bs),
+			}
+		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		// The error of a killed process is not very helpful.
+		err = ctx.Err()
+	}
+	if err == nil && then != nil {
+		err = then(src, dst)
+	}
+	return settings, finish(err)
+}
+
+// source returns the path of the source file. If the source is read from
+// a reader, it is written to a temporary file, which cleanup removes.
+func (j *Job) source() (path string, cleanup func(), err error) {
+	if j.Reader == nil {
+		return j.Source, func() {}, nil
+	}
+	f, err := ioutil.TempFile("", "lackey-*"+filepath.Ext(j.Source))
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.Remove(f.Name()) }
+	_, err = io.Copy(f, j.Reader)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return f.Name(), cleanup, nil
+}
+
+// output returns the path that the encoder writes to, which is the output
+// itself if it is an empty regular file, and a temporary file otherwise.
+// Once the encoder is done, finish is called with its error, which copies
+// the temporary file to the output and removes it.
+func (j *Job) output(ext string) (path string, finish func(error) error, err error) {
+	if f, ok := j.Output.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() && fi.Size() == 0 {
+			return f.Name(), func(err error) error { return err }, nil
+		}
+	}
+
+	f, err := ioutil.TempFile("", "lackey-*"+ext)
+	if err != nil {
+		return "", nil, err
+	}
+	f.Close()
+	finish = func(err error) error {
+		defer os.Remove(f.Name())
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(f.Name())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(j.Output, f)
+		return err
+	}
+	return f.Name(), finish, nil
+}
+
+// progress returns a reader of the WAV stream r that reports progress.
+func (j *Job) progress(r io.Reader) io.Reader {
+	if j.Progress == nil {
+		return r
+	}
+	format, r, err := wav.ReadHeader(r)
+	if err != nil {
+		return r
+	}
+	rate := int64(format.SampleRate * format.Channels * ((format.BitsPerSample + 7) / 8))
+	if rate == 0 {
+		return r
+	}
+	return &progressReader{r: r, rate: rate, header: format.DataOffset, fn: j.Progress}
+}
+
+// progressReader reports the length of the audio read from a WAV stream,
+// whenever another second has been read and at the end of the stream.
+type progressReader struct {
+	r      io.Reader
+	rate   int64 // bytes per second
+	header int64
+	n      int64
+	last   time.Duration
+	fn     func(time.Duration)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	var d time.Duration
+	if p.n > p.header {
+		d = time.Duration(float64(p.n-p.header) / float64(p.rate) * float64(time.Second))
+	}
+	if d-p.last >= time.Second || (err == io.EOF && d != p.last) {
+		p.last = d
+		p.fn(d)
+	}
+	return n, err
+}
+
+type MP3Encoder struct {
+	TargetQuality    int
+	BitrateThreshold int
+
+	// CopyAAC copies AAC files with a bitrate below the threshold,
+	// instead of transcoding them to MP3.
+	CopyAAC bool
+}
+
+func (e *MP3Encoder) Ext() string { return ".mp3" }
+
+func (e *MP3Encoder) CanCopy(src, dst Audio) bool {
+	if e.CopyAAC && src.Encoding() == audio.AAC {
+		return belowThreshold(src, e.BitrateThreshold)
+	}
+	return src.Encoding() == audio.MP3 && belowThreshold(src, e.BitrateThreshold)
+}
+
+func (e *MP3Encoder) Encode(src, dst string, md Audio) error {
+	return encodeFile(e, src, dst, md)
+}
+
+func (e *MP3Encoder) EncodeStream(ctx context.Context, job *Job) (*Settings, error) {
+	// We are much more reliable using lame directly than over ffmpeg,
+	// which is why we only use ffmpeg to decode, if at all.
+	enc := mp3.NewEncoder()
+	enc.Quality = e.TargetQuality
+	return job.runTagged(ctx, e.Ext(), func(src, dst string) *exec.Cmd {
+		return enc.Command(ctx, dst, job.Audio.Metadata())
+	})
+}
+
+type OPUSEncoder struct {
+	Extension        string
+	TargetBitrate    string
+	BitrateThreshold int
+
+	// Channels is the number of channels that sources with more channels
+	// are mixed down to, such as 1 for speech, or 0 to keep them all.
+	Channels int
+}
+
+func (e *OPUSEncoder) Ext() string {
+	if e.Extension == "" {
+		return ".opus"
+	}
+	return e.Extension
+}
+
+func (e *OPUSEncoder) CanCopy(src, dst Audio) bool {
+	return src.Encoding() == codec.Opus && belowThreshold(src, e.BitrateThreshold)
+}
+
+func (e *OPUSEncoder) Encode(src, dst string, md Audio) error {
+	return encodeFile(e, src, dst, md)
+}
+
+func (e *OPUSEncoder) EncodeStream(ctx context.Context, job *Job) (*Settings, error) {
+	return job.runTagged(ctx, e.Ext(), func(src, dst string) *exec.Cmd {
+		args := append(downmix(job.Audio, e.Channels), "-acodec", "libopus", "-vbr", "on",
+			"-compression_level", "10", "-b:a", e.TargetBitrate, dst)
+		return ffmpegFrom(ctx, src, args...)
+	})
+}
+
+// downmix returns the ffmpeg arguments that mix the source down to the
+// number of channels, if it has more and channels is not 0.
+func downmix(src Audio, channels int) []string {
+	if channels <= 0 {
+		return nil
+	}
+	if p := src.Properties(); p != nil && p.Channels != 0 && p.Channels <= channels {
+		return nil
+	}
+	return []string{"-ac", strconv.Itoa(channels)}
+}
+
+// AACEncoder encodes to AAC in an MPEG-4 container, including tags and cover.
+type AACEncoder struct {
+	// Extension is the extension of the outputs, which is .m4a if it is
+	// empty, or .m4b for audiobooks.
+	Extension string
+
+	// VBR is the variable bitrate mode from 1 (lowest) to 5 (highest),
+	// as defined by libfdk_aac. If it is 0, TargetBitrate is used instead.
+	VBR              int
+	TargetBitrate    string
+	BitrateThreshold int
+
+	// Channels is the number of channels that sources with more channels
+	// are mixed down to, or 0 to keep them all.
+	Channels int
+}
+
+func (e *AACEncoder) Ext() string {
+	if e.Extension == "" {
+		return ".m4a"
+	}
+	return e.Extension
+}
+
+// CanCopy returns true for AAC sources below the threshold, which include
+// audiobooks (M4B).
+func (e *AACEncoder) CanCopy(src, dst Audio) bool {
+	c := src.Encoding()
+	return (c == audio.AAC || c == audio.M4B) && belowThreshold(src, e.BitrateThreshold)
+}
+
+func (e *AACEncoder) Encode(src, dst string, md Audio) error {
+	return encodeFile(e, src, dst, md)
+}
+
+func (e *AACEncoder) EncodeStream(ctx context.Context, job *Job) (*Settings, error) {
+	args := []string{"-map", "1:v:0?", "-c:v", "copy", "-disposition:v:0", "attached_pic"}
+	args = append(args, downmix(job.Audio, e.Channels)...)
+	switch {
+	case e.VBR == 0:
+		args = append(args, "-c:a", "aac", "-b:a", e.TargetBitrate)
+	case hasFFmpegEncoder("libfdk_aac"):
+		args = append(args, "-c:a", "libfdk_aac", "-vbr", strconv.Itoa(e.VBR))
+	default:
+		// The native encoder has a quality scale from 0.1 to 2,
+		// which we map the modes of libfdk_aac onto.
+		q := strconv.FormatFloat(0.4*float64(e.VBR), 'f', 1, 64)
+		args = append(args, "-c:a", "aac", "-q:a", q)
+	}
+	args = append(args, "-movflags", "+faststart")
+	return job.runTagged(ctx, e.Ext(), func(src, dst string) *exec.Cmd {
+		return ffmpegFrom(ctx, src, append(args, dst)...)
+	})
+}
+
+// VorbisEncoder encodes to Ogg Vorbis.
+type VorbisEncoder struct {
+	// Quality is the Vorbis quality from -1 (lowest) to 10 (highest).
+	Quality          int
+	BitrateThreshold int
+}
+
+func (e *VorbisEncoder) Ext() string { return ".ogg" }
+
+func (e *VorbisEncoder) CanCopy(src, dst Audio) bool {
+	return src.Encoding() == audio.OGG && belowThreshold(src, e.BitrateThreshold)
+}
+
+func (e *VorbisEncoder) Encode(src, dst string, md Audio) error {
+	return encodeFile(e, src, dst, md)
+}
+
+func (e *VorbisEncoder) EncodeStream(ctx context.Context, job *Job) (*Settings, error) {
+	return job.runTagged(ctx, e.Ext(), func(src, dst string) *exec.Cmd {
+		return ffmpegFrom(ctx, src, "-c:a", "libvorbis", "-q:a", strconv.Itoa(e.Quality), dst)
+	})
+}
+
+// FLACEncoder encodes lossless sources to FLAC, which is useful for
+// compressing FLAC files more or reducing their bit depth and sample rate.
+// Lossy sources are always copied, since encoding them to FLAC only makes
+// them larger.
+type FLACEncoder struct {
+	// CompressionLevel is from 0 (fastest) to 12 (smallest).
+	CompressionLevel int
+	// BitDepth is the maximum bits per sample, either 16 or 24.
+	// If it is 0, the bit depth of the source is kept.
+	BitDepth int
+	// MaxSampleRate is the maximum sample rate in Hz. Sources above it
+	// are resampled, see ResampleRate. If it is 0, the rate is kept.
+	MaxSampleRate int
+	// Recompress encodes FLAC sources again instead of copying them.
+	Recompress bool
+}
+
+func (e *FLACEncoder) Ext() string { return ".flac" }
+
+func (e *FLACEncoder) CanCopy(src, dst Audio) bool {
+	p := src.Properties()
+	if p == nil {
+		return false
+	}
+	if !p.Lossless {
+		return true
+	}
+	if src.Encoding() != audio.FLAC || e.Recompress {
+		return false
+	}
+	return !e.reduceDepth(p) && !e.reduceRate(p)
+}
+
+func (e *FLACEncoder) reduceDepth(p *codec.Properties) bool {
+	return e.BitDepth != 0 && (p.BitDepth == 0 || p.BitDepth > e.BitDepth)
+}
+
+func (e *FLACEncoder) reduceRate(p *codec.Properties) bool {
+	return e.MaxSampleRate != 0 && p.SampleRate > e.MaxSampleRate
+}
+
+func (e *FLACEncoder) Encode(src, dst string, md Audio) error {
+	return encodeFile(e, src, dst, md)
+}
+
+func (e *FLACEncoder) EncodeStream(ctx context.Context, job *Job) (*Settings, error) {
+	// All pictures are kept, not only the cover.
+	args := []string{"-map", "1:v?", "-c:v", "copy",
+		"-c:a", "flac", "-compression_level", strconv.Itoa(e.CompressionLevel)}
+	if p := job.Audio.Properties(); p != nil {
+		var opts []string
+		if e.reduceRate(p) {
+			opts = append(opts, "osr="+strconv.Itoa(ResampleRate(p.SampleRate, e.MaxSampleRate)))
+		}
+		if e.reduceDepth(p) {
+			switch e.BitDepth {
+			case 16:
+				opts = append(opts, "osf=s16", "dither_method=triangular")
+			case 24:
+				args = append(args, "-sample_fmt", "s32", "-bits_per_raw_sample", "24")
+			}
+		}
+		if len(opts) != 0 {
+			args = append(args, "-af", "aresample="+strings.Join(opts, ":"))
+		}
+	}
+	return job.runTagged(ctx, e.Ext(), func(src, dst string) *exec.Cmd {
+		return ffmpegFrom(ctx, src, append(args, dst)...)
+	})
+}
+
+// ResampleRate returns the rate at which audio sampled at rate is stored,
+// if it may be sampled at max Hz at most. Halving the rate is preferred,
+// as from 88200 to 44100 Hz, if it does not fall more than a quarter
+// below max. Otherwise the rate is max, as from 96000 to 44100 Hz.
+func ResampleRate(rate, max int) int {
+	if rate <= max {
+		return rate
+	}
+	r := rate
+	for r > max && r%2 == 0 {
+		r /= 2
+	}
+	if r <= max && r >= max-max/4 {
+		return r
+	}
+	return max
+}
+
+// belowThreshold returns true if the bitrate of src is at most threshold kbps.
+func belowThreshold(src Audio, threshold int) bool {
+	md := src.Metadata()
+	return md != nil && md.EncodingBitrate() <= threshold
+}
+
+// ffmpegFrom returns an ffmpeg command with the decoded audio on stdin as
+// the first input, and src itself as the second input, from which the tags
+// are taken. The arguments may map other streams from the second input,
+// such as 1:v for the cover. The output file is overwritten, since it
+// may have been created by the caller.
+func ffmpegFrom(ctx context.Context, src string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, "ffmpeg", append([]string{
+		"-y", "-f", "wav", "-i", "pipe:0", "-i", src,
+		"-map", "0:a", "-map_metadata", "1",
+	}, args...)...)
+}
+
+var ffmpegEncoders struct {
+	sync.Once
+	list string
+}
+
+// hasFFmpegEncoder returns true if ffmpeg supports the encoder.
+func hasFFmpegEncoder(name string) bool {
+	ffmpegEncoders.Do(func() {
+		bs, _ := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+		ffmpegEncoders.list = string(bs)
+	})
+	for _, line := range strings.Split(ffmpegEncoders.list, "\n") {
+		fs := strings.Fields(line)
+		if len(fs) >= 2 && fs[1] == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/wav"
+	"github.com/goulash/audio"
+)
+
+// fakeMetadata is the metadata of a fakeAudio.
+type fakeMetadata struct {
+	audio.Metadata
+	p *codec.Properties
+}
+
+func (m fakeMetadata) EncodingBitrate() int  { return m.p.Bitrate }
+func (m fakeMetadata) Length() time.Duration { return m.p.Length }
+
+// fakeAudio is a source with the properties p, which is never read.
+type fakeAudio struct {
+	p codec.Properties
+}
+
+func (a *fakeAudio) IsExists() bool                { return true }
+func (a *fakeAudio) AbsPath() string               { return "" }
+func (a *fakeAudio) FileInfo() os.FileInfo         { return nil }
+func (a *fakeAudio) Encoding() audio.Codec         { return a.p.Codec }
+func (a *fakeAudio) Metadata() audio.Metadata      { return fakeMetadata{p: &a.p} }
+func (a *fakeAudio) Properties() *codec.Properties { return &a.p }
+
+func TestEncoderCanCopy(t *testing.T) {
+	var (
+		mp3     = &fakeAudio{codec.Properties{Codec: audio.MP3, Bitrate: 192}}
+		mp3High = &fakeAudio{codec.Properties{Codec: audio.MP3, Bitrate: 320}}
+		aac     = &fakeAudio{codec.Properties{Codec: audio.AAC, Bitrate: 128}}
+		vorbis  = &fakeAudio{codec.Properties{Codec: audio.OGG, Bitrate: 160}}
+		opus    = &fakeAudio{codec.Properties{Codec: codec.Opus, Bitrate: 96}}
+		flac16  = &fakeAudio{codec.Properties{Codec: audio.FLAC, BitDepth: 16, Lossless: true}}
+		flac24  = &fakeAudio{codec.Properties{Codec: audio.FLAC, BitDepth: 24, Lossless: true}}
+		flac96  = &fakeAudio{codec.Properties{Codec: audio.FLAC, BitDepth: 24, SampleRate: 96000, Lossless: true}}
+		alac    = &fakeAudio{codec.Properties{Codec: audio.ALAC, BitDepth: 16, Lossless: true}}
+	)
+	tests := []struct {
+		name string
+		enc  Encoder
+		src  Audio
+		want bool
+	}{
+		{"mp3 below threshold", &MP3Encoder{BitrateThreshold: 256}, mp3, true},
+		{"mp3 above threshold", &MP3Encoder{BitrateThreshold: 256}, mp3High, false},
+		{"aac to mp3", &MP3Encoder{BitrateThreshold: 256}, aac, false},
+		{"aac kept for mp3", &MP3Encoder{BitrateThreshold: 256, CopyAAC: true}, aac, true},
+		{"opus", &OPUSEncoder{BitrateThreshold: 128}, opus, true},
+		{"mp3 to opus", &OPUSEncoder{BitrateThreshold: 256}, mp3, false},
+		{"aac", &AACEncoder{BitrateThreshold: 128}, aac, true},
+		{"vorbis", &VorbisEncoder{BitrateThreshold: 128}, vorbis, false},
+		{"lossy to flac", &FLACEncoder{}, mp3, true},
+		{"flac", &FLACEncoder{}, flac24, true},
+		{"flac recompressed", &FLACEncoder{Recompress: true}, flac16, false},
+		{"flac reduced", &FLACEncoder{BitDepth: 16}, flac24, false},
+		{"flac within depth", &FLACEncoder{BitDepth: 16}, flac16, true},
+		{"flac resampled", &FLACEncoder{MaxSampleRate: 48000}, flac96, false},
+		{"flac within rate", &FLACEncoder{MaxSampleRate: 96000}, flac96, true},
+		{"alac to flac", &FLACEncoder{}, alac, false},
+	}
+	for _, tt := range tests {
+		if got := tt.enc.CanCopy(tt.src, nil); got != tt.want {
+			t.Errorf("%s: CanCopy is %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResampleRate(t *testing.T) {
+	tests := []struct {
+		rate, max, want int
+	}{
+		{44100, 48000, 44100},
+		{96000, 96000, 96000},
+		{88200, 48000, 44100},
+		{96000, 48000, 48000},
+		{192000, 48000, 48000},
+		{176400, 48000, 44100},
+		{96000, 44100, 44100},
+		{352800, 44100, 44100},
+		{192000, 32000, 24000},
+		{192000, 40000, 40000},
+	}
+	for _, tt := range tests {
+		if got := ResampleRate(tt.rate, tt.max); got != tt.want {
+			t.Errorf("ResampleRate(%d, %d) = %d, want %d", tt.rate, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestSettingsString(t *testing.T) {
+	tests := []struct {
+		s    Settings
+		want string
+	}{
+		{Settings{Command: []string{"lame", "-V4", "-", "out.mp3"}}, "lame -V4 - out.mp3"},
+		{Settings{Decoder: "flac", Command: []string{"lame", "--tt", "A Song", "--ta", ""}}, `flac | lame --tt "A Song" --ta ""`},
+		{Settings{Command: []string{"enc", `it's`}}, `enc "it's"`},
+	}
+	for _, tt := range tests {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("String of %v = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+// copyEncoder is an Encoder that copies the source to the destination.
+type copyEncoder struct {
+	fakeEncoder
+	src string
+}
+
+func (e *copyEncoder) Encode(src, dst string, md Audio) error {
+	e.src = src
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, b, 0644)
+}
+
+// fakeEncoder implements the methods of an Encoder other than Encode.
+type fakeEncoder struct{}
+
+func (fakeEncoder) Ext() string                 { return ".x" }
+func (fakeEncoder) CanCopy(src, dst Audio) bool { return false }
+
+func TestEncoderAdapter(t *testing.T) {
+	enc := &copyEncoder{}
+	se := NewStreamEncoder(enc)
+	if _, ok := se.(*encoderAdapter); !ok {
+		t.Fatalf("NewStreamEncoder returned %T, want an adapter", se)
+	}
+	if se, ok := NewStreamEncoder(&MP3Encoder{}).(*MP3Encoder); !ok {
+		t.Errorf("NewStreamEncoder returned %T for a stream encoder, want it as it is", se)
+	}
+
+	// Sources from a reader and outputs that are not files go through
+	// temporary files.
+	var out bytes.Buffer
+	var decoded time.Duration
+	job := &Job{
+		Source:   "track.flac",
+		Reader:   strings.NewReader("audio"),
+		Audio:    &fakeAudio{codec.Properties{Codec: audio.FLAC, Length: time.Minute}},
+		Output:   &out,
+		Progress: func(d time.Duration) { decoded = d },
+	}
+	if _, err := se.EncodeStream(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "audio" {
+		t.Errorf("output is %q, want %q", out.String(), "audio")
+	}
+	if filepath.Ext(enc.src) != ".flac" {
+		t.Errorf("source was read from %s, want a file with the extension .flac", enc.src)
+	}
+	if _, err := os.Stat(enc.src); !os.IsNotExist(err) {
+		t.Errorf("temporary source %s was not removed", enc.src)
+	}
+	if decoded != time.Minute {
+		t.Errorf("progress is %s when done, want the length of 1m0s", decoded)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := se.EncodeStream(ctx, job); err != context.Canceled {
+		t.Errorf("error after cancelling is %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestJobProgress(t *testing.T) {
+	var b bytes.Buffer
+	f := &wav.Format{Tag: 1, Channels: 1, SampleRate: 8000, BitsPerSample: 16, DataSize: 2 * 8000 * 5 / 2}
+	wav.WriteHeader(&b, f)
+	b.Write(make([]byte, f.DataSize))
+
+	var got []time.Duration
+	job := &Job{Progress: func(d time.Duration) { got = append(got, d) }}
+	r := job.progress(&b)
+	buf := make([]byte, 4000)
+	for {
+		if _, err := r.Read(buf); err != nil {
+			break
+		}
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 2500 * time.Millisecond}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("progress is %v, want %v", got, want)
+	}
+
+	// Streams that are not WAV are read as they are.
+	r = job.progress(strings.NewReader("not a WAV stream"))
+	if bs, _ := ioutil.ReadAll(r); string(bs) != "not a WAV stream" {
+		t.Errorf("read %q from a stream that is not WAV", bs)
+	}
+}
+
+func TestJobGain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "track.wav")
+	if err := ioutil.WriteFile(src, wavFile(bytes.Repeat([]byte{0x00, 0x01, 0x00, 0xff}, 8), ""), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command copies the amplified stream to the output.
+	var out bytes.Buffer
+	job := &Job{
+		Source: src,
+		Audio:  &fakeAudio{codec.Properties{Codec: audio.WAV}},
+		Output: &out,
+		Gain:   20 * math.Log10(2),
+	}
+	_, err = job.runThen(context.Background(), ".wav", func(src, dst string) *exec.Cmd {
+		return exec.Command("sh", "-c", `cat > "$1"`, "sh", dst)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Repeat([]byte{0x00, 0x02, 0x00, 0xfe}, 8); !bytes.HasSuffix(out.Bytes(), want) {
+		t.Errorf("output is % x, want it to end with the doubled samples", out.Bytes())
+	}
+}
@@ -3,7 +3,7 @@
 # Variables:
 export LACKEY_LIBRARY_DIR="${LACKEY_LIBRARY_DIR-/mnt/hifi}"
 export LACKEY_OUTPUT_DIR="${LACKEY_OUTPUT_DIR-/mnt/lofi}"
-export LACKEY_SYNC_ARGS="${LACKEY_SYNC_ARGS-"-s -m -d -r 192k --opus --threshold 192"}"
+export LACKEY_SYNC_ARGS="${LACKEY_SYNC_ARGS-"-s -m -d -r 192k --encoder opus --threshold 192"}"
 export LACKEY_LOG_FILE="${LACKEY_LOG_FILE-/tmp/lackey.log}"
 
 main() {
@@ -12,6 +12,7 @@
 //   flac   -> Audio
 //   htm    -> Text
 //   jpg    -> Image
+//   lrc    -> Text
 //   lyrics -> Text
 //   m4a    -> Audio
 //   mkv    -> Video
@@ -27,6 +28,7 @@ package filetype
 
 import (
 	"path/filepath"
+	"strings"
 
 	"github.com/goulash/osutil"
 )
@@ -55,6 +57,7 @@ var types = map[string]Type{
 	".md":       Text,
 	".markdown": Text,
 	".lyrics":   Text,
+	".lrc":      Text,
 	".pdf":      Text,
 	".chords":   Text,
 	".chr":      Text,
@@ -137,7 +140,12 @@ var types = map[string]Type{
 
 	".aax":  Audio,
 	".aac":  Audio,
+	".aif":  Audio,
+	".aifc": Audio,
+	".aiff": Audio,
+	".ape":  Audio,
 	".au":   Audio,
+	".dsf":  Audio,
 	".flac": Audio,
 	".mid":  Audio,
 	".midi": Audio,
@@ -150,6 +158,7 @@ var types = map[string]Type{
 	".opus": Audio,
 	".ra":   Audio,
 	".wav":  Audio,
+	".wv":   Audio,
 
 	".d":     SourceCode,
 	".c":     SourceCode,
@@ -203,7 +212,16 @@ func Identify(path string) Type {
 	} else if ex, _ := osutil.DirExists(path); ex {
 		return Directory
 	}
+	return IdentifyName(path)
+}
 
-	ext := filepath.Ext(path)
-	return types[ext]
+// IdentifyName returns the type of a file with the given name, judging by
+// its extension alone, without checking that it exists.
+func IdentifyName(name string) Type {
+	// Extensions such as .JPG are matched case-insensitively.
+	ext := filepath.Ext(name)
+	if t, ok := types[ext]; ok {
+		return t
+	}
+	return types[strings.ToLower(ext)]
 }
@@ -0,0 +1,299 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/loudness"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/cassava/lackey/filetype"
+	"github.com/goulash/audio"
+)
+
+// ReplayGain selects how the loudness of the outputs is normalized.
+type ReplayGain int
+
+const (
+	// NoReplayGain leaves the loudness of the outputs as it is.
+	NoReplayGain ReplayGain = iota
+	// TagReplayGain writes the track and album gain to the tags of
+	// outputs whose sources have none.
+	TagReplayGain
+	// ApplyReplayGain applies the album gain to the audio of encoded files,
+	// which are thus not given any gain tags. Opus files are given the gain
+	// in their header instead.
+	ApplyReplayGain
+)
+
+// ParseReplayGain parses the mode "tags" or "apply", or the empty string.
+func ParseReplayGain(s string) (ReplayGain, error) {
+	switch s {
+	case "":
+		return NoReplayGain, nil
+	case "tags":
+		return TagReplayGain, nil
+	case "apply":
+		return ApplyReplayGain, nil
+	}
+	return NoReplayGain, fmt.Errorf("unknown ReplayGain mode %q: must be tags or apply", s)
+}
+
+// Gain is the ReplayGain of a track and of its album in dB, which brings
+// them to a loudness of -18 LUFS, and their sample peaks, where 1 is full
+// scale. A peak of 0 is not known.
+type Gain struct {
+	Track, TrackPeak float64
+	Album, AlbumPeak float64
+}
+
+// Applied returns the album gain, reduced so that the album does not clip.
+func (g *Gain) Applied() float64 {
+	if g.AlbumPeak > 0 {
+		return math.Min(g.Album, -20*math.Log10(g.AlbumPeak))
+	}
+	return g.Album
+}
+
+// r128Offset is added to a ReplayGain to get the R128 gain of Opus files.
+const r128Offset = loudness.R128Reference - loudness.ReplayGainReference
+
+// gainFields are the tags that contain gains, which are R128 gains in
+// Opus files and ReplayGain in all others.
+var gainFields = []string{
+	"REPLAYGAIN_TRACK_GAIN", "REPLAYGAIN_TRACK_PEAK",
+	"REPLAYGAIN_ALBUM_GAIN", "REPLAYGAIN_ALBUM_PEAK",
+	"R128_TRACK_GAIN", "R128_ALBUM_GAIN",
+}
+
+// gainOfTags returns the gain in t, if it has both a track and album gain.
+func gainOfTags(t tags.Tags) (*Gain, bool) {
+	parse := func(key string) (float64, bool) {
+		v := strings.TrimSpace(t.Get(key))
+		v = strings.TrimSpace(strings.TrimSuffix(v, "dB"))
+		x, err := strconv.ParseFloat(v, 64)
+		return x, err == nil
+	}
+
+	var g Gain
+	var track, album bool
+	if g.Track, track = parse("REPLAYGAIN_TRACK_GAIN"); track {
+		if g.Album, album = parse("REPLAYGAIN_ALBUM_GAIN"); album {
+			g.TrackPeak, _ = parse("REPLAYGAIN_TRACK_PEAK")
+			g.AlbumPeak, _ = parse("REPLAYGAIN_ALBUM_PEAK")
+			return &g, true
+		}
+	}
+
+	// R128 gains are integers in units of 1/256 dB.
+	tr, err := strconv.Atoi(t.Get("R128_TRACK_GAIN"))
+	if err != nil {
+		return nil, false
+	}
+	al, err := strconv.Atoi(t.Get("R128_ALBUM_GAIN"))
+	if err != nil {
+		return nil, false
+	}
+	return &Gain{
+		Track: float64(tr)/256 - r128Offset,
+		Album: float64(al)/256 - r128Offset,
+	}, true
+}
+
+// setTags replaces the gain tags in t with g, which are R128 gains if
+// opus is true.
+func (g *Gain) setTags(t tags.Tags, opus bool) {
+	removeGain(t)
+	if opus {
+		t.Set("R128_TRACK_GAIN", strconv.Itoa(int(q78(g.Track+r128Offset))))
+		t.Set("R128_ALBUM_GAIN", strconv.Itoa(int(q78(g.Album+r128Offset))))
+		return
+	}
+	t.Set("REPLAYGAIN_TRACK_GAIN", fmt.Sprintf("%.2f dB", g.Track))
+	t.Set("REPLAYGAIN_ALBUM_GAIN", fmt.Sprintf("%.2f dB", g.Album))
+	if g.TrackPeak > 0 {
+		t.Set("REPLAYGAIN_TRACK_PEAK", fmt.Sprintf("%.6f", g.TrackPeak))
+	}
+	if g.AlbumPeak > 0 {
+		t.Set("REPLAYGAIN_ALBUM_PEAK", fmt.Sprintf("%.6f", g.AlbumPeak))
+	}
+}
+
+// removeGain removes all gain tags from t, and returns true if it had any.
+func removeGain(t tags.Tags) bool {
+	var found bool
+	for _, k := range gainFields {
+		if _, ok := t[k]; ok {
+			delete(t, k)
+			found = true
+		}
+	}
+	return found
+}
+
+// q78 returns the gain in dB in units of 1/256 dB, as used by Opus.
+func q78(gain float64) int16 {
+	return int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(gain*256))))
+}
+
+// replayGain returns the gain that brings audio with the loudness in LUFS
+// to the ReplayGain reference. Silent audio is not amplified.
+func replayGain(lufs float64) float64 {
+	if math.IsInf(lufs, 0) {
+		return 0
+	}
+	return loudness.ReplayGainReference - lufs
+}
+
+// albumGains are the gains of the tracks in an album directory, by name.
+type albumGains struct {
+	once  sync.Once
+	gains map[string]*Gain
+	err   error
+}
+
+// measureAlbum measures the loudness of every audio file in dir, which
+// is an album, and returns the gains of its tracks by name.
+func measureAlbum(ctx context.Context, dir string) (map[string]*Gain, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		names  []string
+		meters []*loudness.Meter
+	)
+	for _, fi := range fis {
+		path := filepath.Join(dir, fi.Name())
+		if !fi.Mode().IsRegular() || filetype.Identify(path) != filetype.Audio {
+			continue
+		}
+		c, err := codec.Identify(path)
+		if err != nil || c == audio.Unknown {
+			continue
+		}
+		var m *loudness.Meter
+		err = DefaultDecoders.Decode(ctx, path, c, func(r io.Reader) error {
+			var err error
+			m, err = loudness.Measure(r)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot measure loudness of %s: %s", path, err)
+		}
+		names = append(names, fi.Name())
+		meters = append(meters, m)
+	}
+
+	album := replayGain(loudness.Loudness(meters...))
+	peak := loudness.Peak(meters...)
+	gains := make(map[string]*Gain, len(names))
+	for i, m := range meters {
+		gains[names[i]] = &Gain{
+			Track:     replayGain(m.Loudness()),
+			TrackPeak: m.Peak(),
+			Album:     album,
+			AlbumPeak: peak,
+		}
+	}
+	return gains, nil
+}
+
+// gain returns the gain of src, whose album is the directory it is in.
+// All tracks of an album are measured when the first of them is needed.
+func (o *Runner) gain(ctx context.Context, src string) (*Gain, error) {
+	dir := filepath.Dir(src)
+	o.albumsMu.Lock()
+	if o.albums == nil {
+		o.albums = make(map[string]*albumGains)
+	}
+	a, ok := o.albums[dir]
+	if !ok {
+		a = new(albumGains)
+		o.albums[dir] = a
+	}
+	o.albumsMu.Unlock()
+
+	a.once.Do(func() { a.gains, a.err = measureAlbum(ctx, dir) })
+	if a.err != nil {
+		return nil, a.err
+	}
+	if g, ok := a.gains[filepath.Base(src)]; ok {
+		return g, nil
+	}
+	return nil, fmt.Errorf("cannot measure loudness of %s", src)
+}
+
+// appliesGain returns true if the album gain is applied to files encoded
+// by e, which the stream encoders of this package support. Command encoders
+// fail with ErrGainUnsupported instead.
+func (o *Runner) appliesGain(e Encoder) bool {
+	_, ok := e.(StreamEncoder)
+	return o.ReplayGain == ApplyReplayGain && ok
+}
+
+// encodesOpus returns true if e encodes to Opus.
+func encodesOpus(e Encoder) bool {
+	_, ok := e.(*OPUSEncoder)
+	return ok
+}
+
+// tagGain writes the gain of src to the tags of the output at path.
+// The gain is that of the output already, or else prev, or else it
+// is measured.
+func (o *Runner) tagGain(ctx context.Context, src, path string, prev *Gain) error {
+	c, t, err := o.outputTags(path)
+	if err != nil {
+		return err
+	}
+	g, ok := gainOfTags(t)
+	if !ok {
+		g = prev
+	}
+	if g == nil {
+		if g, err = o.gain(ctx, src); err != nil {
+			return err
+		}
+	}
+	g.setTags(t, c == codec.Opus)
+	return WriteTags(ctx, path, t)
+}
+
+// outputGain returns the gain in the tags of the output at path, or nil.
+func (o *Runner) outputGain(path string) *Gain {
+	_, t, err := o.outputTags(path)
+	if err != nil {
+		return nil
+	}
+	g, _ := gainOfTags(t)
+	return g
+}
+
+// removeGain removes the gain tags of the output at path.
+func (o *Runner) removeGain(ctx context.Context, path string) error {
+	_, t, err := o.outputTags(path)
+	if err != nil || !removeGain(t) {
+		return err
+	}
+	return WriteTags(ctx, path, t)
+}
+
+func (o *Runner) outputTags(path string) (audio.Codec, tags.Tags, error) {
+	c, err := codec.Identify(path)
+	if err != nil {
+		return c, nil, err
+	}
+	t, err := ReadTags(path, c)
+	return c, t, err
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cassava/lackey/audio/loudness"
+	"github.com/cassava/lackey/audio/tags"
+)
+
+func TestParseReplayGain(t *testing.T) {
+	tests := map[string]ReplayGain{"": NoReplayGain, "tags": TagReplayGain, "apply": ApplyReplayGain}
+	for s, want := range tests {
+		if got, err := ParseReplayGain(s); err != nil || got != want {
+			t.Errorf("%q: mode is %v with error %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseReplayGain("album"); err == nil {
+		t.Error("parsing an unknown mode succeeded")
+	}
+}
+
+func TestGainOfTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags tags.Tags
+		want *Gain
+	}{
+		{"replaygain", tags.Tags{
+			"REPLAYGAIN_TRACK_GAIN": {"-6.50 dB"},
+			"REPLAYGAIN_TRACK_PEAK": {"0.988"},
+			"REPLAYGAIN_ALBUM_GAIN": {" -7dB"},
+		}, &Gain{Track: -6.5, TrackPeak: 0.988, Album: -7}},
+		{"r128", tags.Tags{"R128_TRACK_GAIN": {"-1280"}, "R128_ALBUM_GAIN": {"256"}}, &Gain{Track: 0, Album: 6}},
+		{"no album", tags.Tags{"REPLAYGAIN_TRACK_GAIN": {"-6.50 dB"}}, nil},
+		{"invalid", tags.Tags{"REPLAYGAIN_TRACK_GAIN": {"loud"}, "REPLAYGAIN_ALBUM_GAIN": {"-1 dB"}}, nil},
+		{"none", tags.Tags{"TITLE": {"Song"}}, nil},
+	}
+	for _, tt := range tests {
+		g, ok := gainOfTags(tt.tags)
+		if ok != (tt.want != nil) || ok && *g != *tt.want {
+			t.Errorf("%s: gain is %+v, want %+v", tt.name, g, tt.want)
+		}
+	}
+}
+
+func TestGainSetTags(t *testing.T) {
+	g := &Gain{Track: -6.5, TrackPeak: 0.5, Album: -7.25}
+	tt := tags.Tags{"TITLE": {"Song"}, "R128_TRACK_GAIN": {"0"}, "REPLAYGAIN_ALBUM_PEAK": {"1.0"}}
+	g.setTags(tt, false)
+	want := tags.Tags{
+		"TITLE":                 {"Song"},
+		"REPLAYGAIN_TRACK_GAIN": {"-6.50 dB"},
+		"REPLAYGAIN_TRACK_PEAK": {"0.500000"},
+		"REPLAYGAIN_ALBUM_GAIN": {"-7.25 dB"},
+	}
+	if !reflect.DeepEqual(tt, want) {
+		t.Errorf("tags are %v, want %v", tt, want)
+	}
+
+	// Opus files have R128 gains relative to -23 LUFS.
+	g.setTags(tt, true)
+	want = tags.Tags{
+		"TITLE":           {"Song"},
+		"R128_TRACK_GAIN": {"-2944"},
+		"R128_ALBUM_GAIN": {"-3136"},
+	}
+	if !reflect.DeepEqual(tt, want) {
+		t.Errorf("opus tags are %v, want %v", tt, want)
+	}
+	if back, ok := gainOfTags(tt); !ok || back.Track != g.Track || back.Album != g.Album {
+		t.Errorf("gain of the opus tags is %+v, want %+v", back, g)
+	}
+
+	if !removeGain(tt) || len(tt) != 1 {
+		t.Errorf("tags without gain are %v, want only the title", tt)
+	}
+	if removeGain(tt) {
+		t.Error("removing the gain of tags without any found some")
+	}
+}
+
+func TestGainApplied(t *testing.T) {
+	tests := []struct {
+		gain Gain
+		want float64
+	}{
+		{Gain{Album: 3}, 3},
+		{Gain{Album: 3, AlbumPeak: 0.5}, 3},
+		{Gain{Album: 3, AlbumPeak: 0.9}, -20 * math.Log10(0.9)},
+		{Gain{Album: -3, AlbumPeak: 1}, -3},
+	}
+	for _, tt := range tests {
+		if got := tt.gain.Applied(); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("applied gain of %+v is %f, want %f", tt.gain, got, tt.want)
+		}
+	}
+
+	if q := q78(1000); q != math.MaxInt16 {
+		t.Errorf("gain of 1000 dB is %d, want it clipped", q)
+	}
+	if g := replayGain(math.Inf(-1)); g != 0 {
+		t.Errorf("gain of silence is %f, want 0", g)
+	}
+	if g := replayGain(-23); g != 5 {
+		t.Errorf("gain of -23 LUFS is %f, want 5", g)
+	}
+}
+
+// sineWAV returns a WAV file of a sine at 8 kHz with the amplitude.
+func sineWAV(amp float64) []byte {
+	var b bytes.Buffer
+	for i := 0; i < 8000*2; i++ {
+		x := int16(amp * 32767 * math.Sin(2*math.Pi*440*float64(i)/8000))
+		binary.Write(&b, binary.LittleEndian, x)
+	}
+	return wavFile(b.Bytes(), "")
+}
+
+func TestMeasureAlbum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string][]byte{
+		"01.wav":    sineWAV(0.5),
+		"02.wav":    sineWAV(0.1),
+		"cover.txt": []byte("not audio"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var meters []*loudness.Meter
+	for _, name := range []string{"01.wav", "02.wav"} {
+		m, err := loudness.Measure(bytes.NewReader(files[name]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		meters = append(meters, m)
+	}
+
+	o := &Runner{}
+	for i, name := range []string{"01.wav", "02.wav"} {
+		g, err := o.gain(context.Background(), filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Gain{
+			Track:     replayGain(meters[i].Loudness()),
+			TrackPeak: meters[i].Peak(),
+			Album:     replayGain(loudness.Loudness(meters...)),
+			AlbumPeak: meters[0].Peak(),
+		}
+		if *g != want {
+			t.Errorf("%s: gain is %+v, want %+v", name, *g, want)
+		}
+	}
+	if len(o.albums) != 1 {
+		t.Errorf("runner measured %d albums, want 1", len(o.albums))
+	}
+	if _, err := o.gain(context.Background(), filepath.Join(dir, "cover.txt")); err == nil {
+		t.Error("gain of a file that is not audio was found")
+	}
+}
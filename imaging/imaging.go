@@ -0,0 +1,232 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+// Package imaging scales covers down with a Lanczos filter and encodes
+// them as JPEG, PNG, or lossless WebP, without any external programs.
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+
+	_ "image/gif"
+)
+
+// DefaultQuality is the quality of JPEG covers, unless another is given.
+const DefaultQuality = 60
+
+// Format is an image format that covers can be encoded in.
+type Format int
+
+const (
+	Unknown Format = iota
+	JPEG
+	PNG
+	WebP
+)
+
+// ParseFormat parses the format "jpeg", "jpg", "png", or "webp".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "jpeg", "jpg":
+		return JPEG, nil
+	case "png":
+		return PNG, nil
+	case "webp":
+		return WebP, nil
+	}
+	return Unknown, fmt.Errorf("unknown image format %q: must be jpeg, png, or webp", s)
+}
+
+// FormatOf returns the format of the file name according to its extension.
+func FormatOf(name string) Format {
+	f, err := ParseFormat(strings.TrimPrefix(filepath.Ext(name), "."))
+	if err != nil {
+		return Unknown
+	}
+	return f
+}
+
+// Detect returns the format of the image data according to its signature.
+func Detect(data []byte) Format {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return JPEG
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return PNG
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return WebP
+	}
+	return Unknown
+}
+
+func (f Format) String() string {
+	switch f {
+	case JPEG:
+		return "jpeg"
+	case PNG:
+		return "png"
+	case WebP:
+		return "webp"
+	}
+	return "unknown"
+}
+
+// Ext returns the file extension of the format, such as ".jpg".
+func (f Format) Ext() string {
+	switch f {
+	case JPEG:
+		return ".jpg"
+	case PNG:
+		return ".png"
+	case WebP:
+		return ".webp"
+	}
+	return ""
+}
+
+// Encode writes img to w in the format f. The quality, from 1 to 100 or 0
+// for DefaultQuality, only applies to JPEG; PNG and WebP are lossless.
+func Encode(w io.Writer, img image.Image, f Format, quality int) error {
+	switch f {
+	case JPEG:
+		if quality <= 0 {
+			quality = DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case PNG:
+		e := png.Encoder{CompressionLevel: png.BestCompression}
+		return e.Encode(w, img)
+	case WebP:
+		return EncodeWebP(w, img)
+	}
+	return fmt.Errorf("cannot encode images as %s", f)
+}
+
+// Fit returns img scaled down so that it is at most size pixels wide and
+// high, keeping its aspect ratio. Images that fit already are returned as
+// they are.
+func Fit(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if size <= 0 || (w <= size && h <= size) {
+		return img
+	}
+	if w >= h {
+		w, h = size, int(math.Max(1, math.Round(float64(h)*float64(size)/float64(w))))
+	} else {
+		w, h = int(math.Max(1, math.Round(float64(w)*float64(size)/float64(h)))), size
+	}
+	return Resize(img, w, h)
+}
+
+// Resize returns img resampled to w by h pixels with a Lanczos filter of
+// three lobes, which is applied to the rows and then to the columns.
+func Resize(img image.Image, w, h int) *image.RGBA {
+	b := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+	}
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+
+	// The samples are premultiplied by alpha, so that transparent
+	// pixels do not bleed their color into their neighbours.
+	cols := lanczos(sw, w)
+	tmp := make([]float64, 4*w*sh)
+	for y := 0; y < sh; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, c := range cols {
+			var px [4]float64
+			for i, weight := range c.weights {
+				p := row[4*(c.start+i):]
+				px[0] += weight * float64(p[0])
+				px[1] += weight * float64(p[1])
+				px[2] += weight * float64(p[2])
+				px[3] += weight * float64(p[3])
+			}
+			copy(tmp[4*(y*w+x):], px[:])
+		}
+	}
+
+	rows := lanczos(sh, h)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y, c := range rows {
+		for x := 0; x < w; x++ {
+			var px [4]float64
+			for i, weight := range c.weights {
+				p := tmp[4*((c.start+i)*w+x):]
+				px[0] += weight * p[0]
+				px[1] += weight * p[1]
+				px[2] += weight * p[2]
+				px[3] += weight * p[3]
+			}
+			q := dst.Pix[y*dst.Stride+4*x:]
+			q[3] = clamp(px[3], 255)
+			q[0] = clamp(px[0], float64(q[3]))
+			q[1] = clamp(px[1], float64(q[3]))
+			q[2] = clamp(px[2], float64(q[3]))
+		}
+	}
+	return dst
+}
+
+// contribution is the weights of the source samples from start onwards
+// that make up a sample of the output.
+type contribution struct {
+	start   int
+	weights []float64
+}
+
+// lanczos returns the contributions to n samples resampled from m.
+func lanczos(m, n int) []contribution {
+	const lobes = 3
+	scale := float64(m) / float64(n)
+	stretch := math.Max(scale, 1)
+	support := lobes * stretch
+
+	cs := make([]contribution, n)
+	for i := range cs {
+		center := (float64(i) + 0.5) * scale
+		start := int(math.Max(0, math.Floor(center-support)))
+		end := int(math.Min(float64(m), math.Ceil(center+support)))
+		weights := make([]float64, end-start)
+		var sum float64
+		for j := range weights {
+			x := (float64(start+j) + 0.5 - center) / stretch
+			weights[j] = sinc(x) * sinc(x/lobes)
+			if math.Abs(x) >= lobes {
+				weights[j] = 0
+			}
+			sum += weights[j]
+		}
+		for j := range weights {
+			weights[j] /= sum
+		}
+		cs[i] = contribution{start, weights}
+	}
+	return cs
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+// clamp rounds x to a byte of at most max.
+func clamp(x, max float64) uint8 {
+	return uint8(math.Max(0, math.Min(max, math.Round(x))))
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Format
+		ext  string
+	}{
+		{"jpeg", JPEG, ".jpg"},
+		{"JPG", JPEG, ".jpg"},
+		{"png", PNG, ".png"},
+		{"WebP", WebP, ".webp"},
+	}
+	for _, tt := range tests {
+		f, err := ParseFormat(tt.s)
+		if err != nil || f != tt.want {
+			t.Errorf("%q: format is %v with error %v, want %v", tt.s, f, err, tt.want)
+		}
+		if f.Ext() != tt.ext {
+			t.Errorf("%q: extension is %q, want %q", tt.s, f.Ext(), tt.ext)
+		}
+		if g, err := ParseFormat(f.String()); err != nil || g != f {
+			t.Errorf("%q: format of its name %q is %v", tt.s, f.String(), g)
+		}
+		if g := FormatOf("dir.png/cover" + tt.ext); g != f {
+			t.Errorf("%q: format of a file is %v, want %v", tt.s, g, f)
+		}
+	}
+	if f, err := ParseFormat("gif"); err == nil || f != Unknown {
+		t.Errorf("parsing an unknown format gave %v", f)
+	}
+	for _, name := range []string{"cover.gif", "cover", "png"} {
+		if f := FormatOf(name); f != Unknown {
+			t.Errorf("%s: format is %v, want %v", name, f, Unknown)
+		}
+	}
+	if Unknown.Ext() != "" || Unknown.String() != "unknown" {
+		t.Errorf("unknown format is %q with extension %q", Unknown, Unknown.Ext())
+	}
+}
+
+func TestEncode(t *testing.T) {
+	img := testImage(10, 6, false)
+	for _, f := range []Format{JPEG, PNG, WebP} {
+		var b bytes.Buffer
+		if err := Encode(&b, img, f, 0); err != nil {
+			t.Errorf("%v: %s", f, err)
+			continue
+		}
+		if got := Detect(b.Bytes()); got != f {
+			t.Errorf("%v: format of the output is %v", f, got)
+		}
+		if f == WebP {
+			continue
+		}
+		c, name, err := image.DecodeConfig(&b)
+		if err != nil || name != f.String() || c.Width != 10 || c.Height != 6 {
+			t.Errorf("%v: output is a %dx%d %s image with error %v", f, c.Width, c.Height, name, err)
+		}
+	}
+
+	// The quality only matters to JPEG.
+	var low, high bytes.Buffer
+	Encode(&low, img, JPEG, 1)
+	Encode(&high, img, JPEG, 100)
+	if low.Len() >= high.Len() {
+		t.Errorf("JPEG of quality 1 has %d bytes, of quality 100 %d", low.Len(), high.Len())
+	}
+
+	if err := Encode(&bytes.Buffer{}, img, Unknown, 0); err == nil {
+		t.Error("encoding in an unknown format succeeded")
+	}
+	if f := Detect([]byte("GIF89a")); f != Unknown {
+		t.Errorf("format of a GIF is %v, want %v", f, Unknown)
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		w, h, size int
+		want       image.Point
+	}{
+		{800, 600, 300, image.Pt(300, 225)},
+		{600, 800, 300, image.Pt(225, 300)},
+		{500, 500, 100, image.Pt(100, 100)},
+		{1000, 1, 100, image.Pt(100, 1)},
+		{200, 100, 200, image.Pt(200, 100)},
+		{200, 100, 0, image.Pt(200, 100)},
+	}
+	for _, tt := range tests {
+		img := image.NewGray(image.Rect(0, 0, tt.w, tt.h))
+		got := Fit(img, tt.size)
+		if s := got.Bounds().Size(); s != tt.want {
+			t.Errorf("%dx%d in %d: size is %v, want %v", tt.w, tt.h, tt.size, s, tt.want)
+		}
+		if tt.want == image.Pt(tt.w, tt.h) && got != image.Image(img) {
+			t.Errorf("%dx%d in %d: image that fits is not returned as it is", tt.w, tt.h, tt.size)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	// A uniform color stays as it is, also from an offset image.
+	c := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+	img := image.NewNRGBA(image.Rect(3, 3, 40, 30))
+	for y := 3; y < 30; y++ {
+		for x := 3; x < 40; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	for _, size := range []image.Point{{10, 7}, {80, 60}, {1, 1}} {
+		got := Resize(img, size.X, size.Y)
+		if got.Bounds() != (image.Rectangle{Max: size}) {
+			t.Errorf("%v: bounds are %v", size, got.Bounds())
+			continue
+		}
+		for y := 0; y < size.Y; y++ {
+			for x := 0; x < size.X; x++ {
+				if p := color.NRGBAModel.Convert(got.At(x, y)); p != c {
+					t.Errorf("%v: pixel at %d,%d is %v, want %v", size, x, y, p, c)
+				}
+			}
+		}
+	}
+
+	// Transparent pixels do not darken the opaque ones next to them.
+	half := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 8; x++ {
+			half.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	got := Resize(half, 8, 8)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			p := color.NRGBAModel.Convert(got.At(x, y)).(color.NRGBA)
+			if p.A > 16 && (p.R < 250 || p.G != 0 || p.B != 0) {
+				t.Errorf("pixel at %d,%d is %v, want red", x, y, p)
+			}
+			if x < 3 && p.A < 250 || x > 4 && p.A > 5 {
+				t.Errorf("alpha at %d,%d is %d", x, y, p.A)
+			}
+		}
+	}
+}
@@ -0,0 +1,475 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package imaging
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// ErrTooLarge is returned for images that WebP cannot hold.
+var ErrTooLarge = errors.New("image too large for WebP")
+
+// EncodeWebP writes img to w as a lossless WebP image. The encoder uses the
+// subtract green and predictor transforms and prefix codes, but neither
+// backward references nor a color cache, which keeps it simple at the
+// expense of some compression.
+//
+// Reference
+//
+//	https://datatracker.ietf.org/doc/html/rfc9649
+func EncodeWebP(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return ErrTooLarge
+	}
+
+	// Pixels are ARGB, with the channels in this order from the high byte.
+	pix := make([]uint32, width*height)
+	alpha := false
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			pix[y*width+x] = uint32(c.A)<<24 | uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+			alpha = alpha || c.A != 0xff
+		}
+	}
+
+	var bw bitWriter
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3)
+
+	// The transforms are written in the order in which they are applied,
+	// and the decoder inverts them in the opposite order.
+	bw.write(1, 1)
+	bw.write(transformSubtractGreen, 2)
+	for i, p := range pix {
+		g := p >> 8 & 0xff
+		pix[i] = p&0xff00ff00 | (p>>16-g)&0xff<<16 | (p-g)&0xff
+	}
+	bw.write(1, 1)
+	bw.write(transformPredictor, 2)
+	bw.write(predictorBits-2, 3)
+	modes := choosePredictors(pix, width, height)
+	writeImage(&bw, modes, false)
+	bw.write(0, 1)
+	writeImage(&bw, predict(pix, width, height, modes), true)
+
+	payload := bw.bytes()
+	size := len(payload)
+	if size%2 == 1 {
+		payload = append(payload, 0)
+	}
+	hdr := make([]byte, 20)
+	copy(hdr, "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(12+len(payload)))
+	copy(hdr[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(size))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+const (
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+
+	// predictorBits is the log2 of the size of the blocks that share a
+	// predictor.
+	predictorBits = 4
+)
+
+// predictors are the predictors that the encoder chooses from for each
+// block, by their mode.
+var predictors = map[uint32]func(l, t, tl uint32) uint32{
+	1: func(l, t, tl uint32) uint32 { return l },
+	2: func(l, t, tl uint32) uint32 { return t },
+	7: func(l, t, tl uint32) uint32 {
+		return perChannel(func(l, t, tl uint32) uint32 { return (l + t) / 2 }, l, t, tl)
+	},
+	11: func(l, t, tl uint32) uint32 {
+		var pl, pt int
+		for s := uint(0); s < 32; s += 8 {
+			pt += abs(int(l>>s&0xff) - int(tl>>s&0xff))
+			pl += abs(int(t>>s&0xff) - int(tl>>s&0xff))
+		}
+		if pl < pt {
+			return l
+		}
+		return t
+	},
+	12: func(l, t, tl uint32) uint32 {
+		return perChannel(func(l, t, tl uint32) uint32 {
+			x := int(l) + int(t) - int(tl)
+			if x < 0 {
+				return 0
+			} else if x > 255 {
+				return 255
+			}
+			return uint32(x)
+		}, l, t, tl)
+	},
+}
+
+func perChannel(f func(l, t, tl uint32) uint32, l, t, tl uint32) uint32 {
+	var p uint32
+	for s := uint(0); s < 32; s += 8 {
+		p |= f(l>>s&0xff, t>>s&0xff, tl>>s&0xff) << s
+	}
+	return p
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// sub subtracts the channels of q from those of p, each modulo 256.
+func sub(p, q uint32) uint32 {
+	return ((p|0x00ff00ff)-(q&0xff00ff00))&0xff00ff00 | ((p|0xff00ff00)-(q&0x00ff00ff))&0x00ff00ff
+}
+
+// prediction returns the prediction of the pixel at x and y by mode.
+// The first row is predicted from the left, the first column from the
+// top, and the first pixel by opaque black, whatever the mode.
+func prediction(pix []uint32, width, x, y int, mode uint32) uint32 {
+	i := y*width + x
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return pix[i-1]
+	case x == 0:
+		return pix[i-width]
+	}
+	return predictors[mode](pix[i-1], pix[i-width], pix[i-width-1])
+}
+
+// choosePredictors returns, for each block of pixels, the mode of the
+// predictor that leaves the smallest residuals, in the green channel of
+// a pixel of the predictor image.
+func choosePredictors(pix []uint32, width, height int) []uint32 {
+	bw := (width + 1<<predictorBits - 1) >> predictorBits
+	bh := (height + 1<<predictorBits - 1) >> predictorBits
+	modes := make([]uint32, bw*bh)
+	for by := 0; by < bh; by++ {
+		for bx := 0; bx < bw; bx++ {
+			best, bestCost := uint32(1), -1
+			for mode := range predictors {
+				cost := 0
+				for y := by << predictorBits; y < (by+1)<<predictorBits && y < height; y++ {
+					for x := bx << predictorBits; x < (bx+1)<<predictorBits && x < width; x++ {
+						r := sub(pix[y*width+x], prediction(pix, width, x, y, mode))
+						for s := uint(0); s < 32; s += 8 {
+							cost += abs(int(int8(r >> s)))
+						}
+					}
+				}
+				if bestCost < 0 || cost < bestCost || (cost == bestCost && mode < best) {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[by*bw+bx] = 0xff000000 | best<<8
+		}
+	}
+	return modes
+}
+
+// predict returns the residuals of the pixels after the predictors.
+func predict(pix []uint32, width, height int, modes []uint32) []uint32 {
+	bw := (width + 1<<predictorBits - 1) >> predictorBits
+	res := make([]uint32, len(pix))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			mode := modes[(y>>predictorBits)*bw+x>>predictorBits] >> 8 & 0xff
+			res[y*width+x] = sub(pix[y*width+x], prediction(pix, width, x, y, mode))
+		}
+	}
+	return res
+}
+
+// writeImage writes the entropy-coded image of pixels with a single group
+// of prefix codes. The main image also says that it has no meta prefix
+// codes.
+func writeImage(bw *bitWriter, pix []uint32, main bool) {
+	bw.write(0, 1) // no color cache
+	if main {
+		bw.write(0, 1) // no meta prefix codes
+	}
+
+	// The alphabet of green also holds the backward reference lengths,
+	// which are not used, and the distance code is never read.
+	green := make([]int, 256+24)
+	red := make([]int, 256)
+	blue := make([]int, 256)
+	alpha := make([]int, 256)
+	for _, p := range pix {
+		alpha[p>>24]++
+		red[p>>16&0xff]++
+		green[p>>8&0xff]++
+		blue[p&0xff]++
+	}
+	codes := []*prefixCode{
+		writeCode(bw, green),
+		writeCode(bw, red),
+		writeCode(bw, blue),
+		writeCode(bw, alpha),
+		writeCode(bw, []int{1}),
+	}
+	for _, p := range pix {
+		codes[0].write(bw, int(p>>8&0xff))
+		codes[1].write(bw, int(p>>16&0xff))
+		codes[2].write(bw, int(p&0xff))
+		codes[3].write(bw, int(p>>24))
+	}
+}
+
+// prefixCode is a canonical prefix code, whose codes are reversed so that
+// they can be written from the least significant bit.
+type prefixCode struct {
+	lengths []int
+	codes   []uint32
+}
+
+func (c *prefixCode) write(bw *bitWriter, sym int) {
+	bw.write(c.codes[sym], uint(c.lengths[sym]))
+}
+
+// newPrefixCode returns the prefix code for the histogram, with codes of at
+// most limit bits. A code of a single symbol has no bits.
+func newPrefixCode(hist []int, limit int) *prefixCode {
+	c := &prefixCode{
+		lengths: codeLengths(hist, limit),
+		codes:   make([]uint32, len(hist)),
+	}
+	var count [16]uint32
+	used := 0
+	for _, n := range c.lengths {
+		if n > 0 {
+			count[n]++
+			used++
+		}
+	}
+	if used == 1 {
+		for i := range c.lengths {
+			c.lengths[i] = 0
+		}
+		return c
+	}
+	var next [16]uint32
+	var code uint32
+	for n := 1; n < len(next); n++ {
+		code = (code + count[n-1]) << 1
+		next[n] = code
+	}
+	for i, n := range c.lengths {
+		if n > 0 {
+			c.codes[i] = reverse(next[n], n)
+			next[n]++
+		}
+	}
+	return c
+}
+
+func reverse(code uint32, n int) uint32 {
+	var r uint32
+	for i := 0; i < n; i++ {
+		r = r<<1 | code>>uint(i)&1
+	}
+	return r
+}
+
+// codeLengthOrder is the order in which the lengths of the codes of the
+// code lengths are written.
+var codeLengthOrder = []int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// writeCode writes the prefix code for the histogram and returns it.
+// Codes of one or two symbols below 256 are written as simple codes, and
+// others as the lengths of their codes, which are themselves prefix coded
+// with zero runs.
+func writeCode(bw *bitWriter, hist []int) *prefixCode {
+	var syms []int
+	for s, n := range hist {
+		if n > 0 {
+			syms = append(syms, s)
+		}
+	}
+	if len(syms) <= 2 && syms[len(syms)-1] < 256 {
+		bw.write(1, 1)
+		bw.write(uint32(len(syms)-1), 1)
+		if syms[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(syms[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(syms[0]), 8)
+		}
+		if len(syms) == 2 {
+			bw.write(uint32(syms[1]), 8)
+		}
+		lengths := make([]int, len(hist))
+		for _, s := range syms {
+			lengths[s] = 1
+		}
+		return newPrefixCode(lengths, 1)
+	}
+
+	c := newPrefixCode(hist, 15)
+	type token struct{ sym, extra, bits int }
+	var tokens []token
+	for i := 0; i < len(c.lengths); {
+		if c.lengths[i] != 0 {
+			tokens = append(tokens, token{c.lengths[i], 0, 0})
+			i++
+			continue
+		}
+		run := 1
+		for i+run < len(c.lengths) && c.lengths[i+run] == 0 && run < 138 {
+			run++
+		}
+		switch {
+		case run < 3:
+			tokens = append(tokens, token{0, 0, 0})
+			run = 1
+		case run <= 10:
+			tokens = append(tokens, token{17, run - 3, 3})
+		default:
+			tokens = append(tokens, token{18, run - 11, 7})
+		}
+		i += run
+	}
+	hist = make([]int, len(codeLengthOrder))
+	for _, t := range tokens {
+		hist[t.sym]++
+	}
+	lc := newPrefixCode(hist, 7)
+	lengths := codeLengths(hist, 7)
+
+	n := len(codeLengthOrder)
+	for n > 4 && lengths[codeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	bw.write(0, 1)
+	bw.write(uint32(n-4), 4)
+	for _, s := range codeLengthOrder[:n] {
+		bw.write(uint32(lengths[s]), 3)
+	}
+	bw.write(0, 1) // the lengths of all symbols follow
+	for _, t := range tokens {
+		lc.write(bw, t.sym)
+		bw.write(uint32(t.extra), uint(t.bits))
+	}
+	return c
+}
+
+// codeLengths returns the lengths of the Huffman codes for the histogram,
+// which are at most limit. If they are too long, rare symbols are counted
+// as more frequent until they are not.
+func codeLengths(hist []int, limit int) []int {
+	lengths := make([]int, len(hist))
+	for min := 1; ; min *= 2 {
+		h := &nodeHeap{}
+		for s, n := range hist {
+			if n > 0 {
+				if n < min {
+					n = min
+				}
+				h.nodes = append(h.nodes, node{count: n, sym: s, left: -1, right: -1})
+				h.queue = append(h.queue, len(h.nodes)-1)
+			}
+		}
+		if len(h.queue) == 1 {
+			lengths[h.nodes[0].sym] = 1
+			return lengths
+		}
+		heap.Init(h)
+		for h.Len() > 1 {
+			a, b := heap.Pop(h).(int), heap.Pop(h).(int)
+			h.nodes = append(h.nodes, node{count: h.nodes[a].count + h.nodes[b].count, left: a, right: b})
+			heap.Push(h, len(h.nodes)-1)
+		}
+
+		max := 0
+		var walk func(i, depth int)
+		walk = func(i, depth int) {
+			if n := h.nodes[i]; n.left < 0 {
+				lengths[n.sym] = depth
+				if depth > max {
+					max = depth
+				}
+			} else {
+				walk(n.left, depth+1)
+				walk(n.right, depth+1)
+			}
+		}
+		walk(len(h.nodes)-1, 0)
+		if max <= limit {
+			return lengths
+		}
+	}
+}
+
+type node struct {
+	count       int
+	sym         int
+	left, right int
+}
+
+// nodeHeap is a queue of the indices of nodes by their count.
+type nodeHeap struct {
+	nodes []node
+	queue []int
+}
+
+func (h *nodeHeap) Len() int           { return len(h.queue) }
+func (h *nodeHeap) Less(i, j int) bool { return h.nodes[h.queue[i]].count < h.nodes[h.queue[j]].count }
+func (h *nodeHeap) Swap(i, j int)      { h.queue[i], h.queue[j] = h.queue[j], h.queue[i] }
+func (h *nodeHeap) Push(x interface{}) { h.queue = append(h.queue, x.(int)) }
+func (h *nodeHeap) Pop() interface{} {
+	x := h.queue[len(h.queue)-1]
+	h.queue = h.queue[:len(h.queue)-1]
+	return x
+}
+
+// bitWriter writes bits from the least significant bit of each byte.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (w *bitWriter) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nacc
+	w.nacc += n
+	for w.nacc >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nacc -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nacc > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nacc = 0, 0
+	}
+	return w.buf
+}
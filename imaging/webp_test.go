@@ -0,0 +1,437 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// The decoder below reads the subset of lossless WebP that EncodeWebP
+// writes, following RFC 9649 rather than the encoder, so that the tests
+// check that the output can be decoded as the format says.
+
+var errUnsupported = errors.New("feature not supported by the test decoder")
+
+type bitReader struct {
+	b   []byte
+	pos uint
+}
+
+func (r *bitReader) read(n uint) uint32 {
+	var v uint32
+	for i := uint(0); i < n; i++ {
+		if r.pos/8 < uint(len(r.b)) {
+			v |= uint32(r.b[r.pos/8]>>(r.pos%8)&1) << i
+		}
+		r.pos++
+	}
+	return v
+}
+
+// huffman is a canonical prefix code, decoded bit by bit.
+type huffman struct {
+	single int // symbol of a code without bits, or -1
+	codes  map[[2]int]int
+}
+
+func newHuffman(lengths []int) *huffman {
+	h := &huffman{single: -1, codes: make(map[[2]int]int)}
+	var used []int
+	for s, n := range lengths {
+		if n > 0 {
+			used = append(used, s)
+		}
+	}
+	if len(used) == 1 {
+		h.single = used[0]
+		return h
+	}
+	var count [16]int
+	for _, n := range lengths {
+		count[n]++
+	}
+	count[0] = 0
+	var next [16]int
+	code := 0
+	for n := 1; n < 16; n++ {
+		code = (code + count[n-1]) << 1
+		next[n] = code
+	}
+	for s, n := range lengths {
+		if n > 0 {
+			h.codes[[2]int{n, next[n]}] = s
+			next[n]++
+		}
+	}
+	return h
+}
+
+func (h *huffman) read(r *bitReader) (int, error) {
+	if h.single >= 0 {
+		return h.single, nil
+	}
+	code := 0
+	for n := 1; n < 16; n++ {
+		code = code<<1 | int(r.read(1))
+		if s, ok := h.codes[[2]int{n, code}]; ok {
+			return s, nil
+		}
+	}
+	return 0, errors.New("invalid prefix code")
+}
+
+func readCode(r *bitReader, size int) (*huffman, error) {
+	lengths := make([]int, size)
+	if r.read(1) == 1 {
+		n := r.read(1) + 1
+		first := r.read(1)
+		lengths[r.read(1+7*uint(first))] = 1
+		if n == 2 {
+			lengths[r.read(8)] = 1
+		}
+		return newHuffman(lengths), nil
+	}
+
+	order := []int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	clLengths := make([]int, 19)
+	n := int(r.read(4)) + 4
+	for i := 0; i < n; i++ {
+		clLengths[order[i]] = int(r.read(3))
+	}
+	cl := newHuffman(clLengths)
+	max := size
+	if r.read(1) == 1 {
+		max = 2 + int(r.read(2+2*uint(r.read(3))))
+	}
+	prev := 8
+	for s := 0; s < size && max > 0; max-- {
+		c, err := cl.read(r)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c < 16:
+			lengths[s] = c
+			s++
+			if c != 0 {
+				prev = c
+			}
+		case c == 16:
+			for n := 3 + int(r.read(2)); n > 0 && s < size; n-- {
+				lengths[s] = prev
+				s++
+			}
+		default:
+			if c == 17 {
+				s += 3 + int(r.read(3))
+			} else {
+				s += 11 + int(r.read(7))
+			}
+		}
+	}
+	return newHuffman(lengths), nil
+}
+
+func readImage(r *bitReader, width, height int, main bool) ([]uint32, error) {
+	if r.read(1) == 1 {
+		return nil, errUnsupported // color cache
+	}
+	if main && r.read(1) == 1 {
+		return nil, errUnsupported // meta prefix codes
+	}
+	var codes [5]*huffman
+	for i, size := range []int{256 + 24, 256, 256, 256, 40} {
+		var err error
+		if codes[i], err = readCode(r, size); err != nil {
+			return nil, err
+		}
+	}
+	pix := make([]uint32, width*height)
+	for i := range pix {
+		var v [4]int
+		for j := range v {
+			s, err := codes[j].read(r)
+			if err != nil {
+				return nil, err
+			}
+			if s >= 256 {
+				return nil, errUnsupported // backward reference
+			}
+			v[j] = s
+		}
+		pix[i] = uint32(v[3])<<24 | uint32(v[1])<<16 | uint32(v[0])<<8 | uint32(v[2])
+	}
+	return pix, nil
+}
+
+// add adds the channels of p and q, each modulo 256.
+func add(p, q uint32) uint32 {
+	var x uint32
+	for s := uint(0); s < 32; s += 8 {
+		x |= (p>>s + q>>s) & 0xff << s
+	}
+	return x
+}
+
+func channels(f func(a, b, c int) int, a, b, c uint32) uint32 {
+	var x uint32
+	for s := uint(0); s < 32; s += 8 {
+		x |= uint32(f(int(a>>s&0xff), int(b>>s&0xff), int(c>>s&0xff))&0xff) << s
+	}
+	return x
+}
+
+func avg(a, b uint32) uint32 {
+	return channels(func(a, b, _ int) int { return (a + b) / 2 }, a, b, 0)
+}
+
+func clampByte(x int) int {
+	if x < 0 {
+		return 0
+	} else if x > 255 {
+		return 255
+	}
+	return x
+}
+
+func predictWebP(mode uint32, l, t, tr, tl uint32) uint32 {
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return avg(avg(l, tr), t)
+	case 6:
+		return avg(l, tl)
+	case 7:
+		return avg(l, t)
+	case 8:
+		return avg(tl, t)
+	case 9:
+		return avg(t, tr)
+	case 10:
+		return avg(avg(l, tl), avg(t, tr))
+	case 11:
+		var pl, pt int
+		for s := uint(0); s < 32; s += 8 {
+			p := int(l>>s&0xff) + int(t>>s&0xff) - int(tl>>s&0xff)
+			pl += abs(p - int(l>>s&0xff))
+			pt += abs(p - int(t>>s&0xff))
+		}
+		if pl < pt {
+			return l
+		}
+		return t
+	case 12:
+		return channels(func(l, t, tl int) int { return clampByte(l + t - tl) }, l, t, tl)
+	default:
+		return channels(func(l, t, tl int) int { a := (l + t) / 2; return clampByte(a + (a-tl)/2) }, l, t, tl)
+	}
+}
+
+// decodeWebP decodes a lossless WebP image to ARGB pixels.
+func decodeWebP(data []byte) (width, height int, pix []uint32, err error) {
+	if len(data) < 21 || string(data[:4]) != "RIFF" || string(data[8:16]) != "WEBPVP8L" {
+		return 0, 0, nil, errors.New("not a lossless WebP image")
+	}
+	if int(binary.LittleEndian.Uint32(data[4:])) != len(data)-8 {
+		return 0, 0, nil, errors.New("wrong RIFF size")
+	}
+	size := int(binary.LittleEndian.Uint32(data[16:]))
+	if size+size%2 != len(data)-20 {
+		return 0, 0, nil, errors.New("wrong chunk size")
+	}
+	r := &bitReader{b: data[20 : 20+size]}
+	if r.read(8) != 0x2f {
+		return 0, 0, nil, errors.New("wrong signature")
+	}
+	width, height = int(r.read(14))+1, int(r.read(14))+1
+	r.read(1) // alpha hint
+	if r.read(3) != 0 {
+		return 0, 0, nil, errors.New("wrong version")
+	}
+
+	var (
+		transforms []uint32
+		bits       uint
+		modes      []uint32
+	)
+	for r.read(1) == 1 {
+		t := r.read(2)
+		transforms = append(transforms, t)
+		switch t {
+		case 0:
+			bits = uint(r.read(3)) + 2
+			bw := (width + 1<<bits - 1) >> bits
+			bh := (height + 1<<bits - 1) >> bits
+			if modes, err = readImage(r, bw, bh, false); err != nil {
+				return 0, 0, nil, err
+			}
+		case 2:
+		default:
+			return 0, 0, nil, errUnsupported
+		}
+	}
+	if pix, err = readImage(r, width, height, true); err != nil {
+		return 0, 0, nil, err
+	}
+
+	for i := len(transforms) - 1; i >= 0; i-- {
+		switch transforms[i] {
+		case 0:
+			bw := (width + 1<<bits - 1) >> bits
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					i := y*width + x
+					var p uint32
+					switch {
+					case x == 0 && y == 0:
+						p = 0xff000000
+					case y == 0:
+						p = pix[i-1]
+					case x == 0:
+						p = pix[i-width]
+					default:
+						tr := pix[i-width+1]
+						if x == width-1 {
+							tr = pix[y*width] // leftmost pixel of the current row
+						}
+						mode := modes[(y>>bits)*bw+x>>bits] >> 8 & 0xff
+						p = predictWebP(mode, pix[i-1], pix[i-width], tr, pix[i-width-1])
+					}
+					pix[i] = add(pix[i], p)
+				}
+			}
+		case 2:
+			for i, p := range pix {
+				g := p >> 8 & 0xff
+				pix[i] = p&0xff00ff00 | (p>>16+g)&0xff<<16 | (p+g)&0xff
+			}
+		}
+	}
+	return width, height, pix, nil
+}
+
+// testImage returns an image of a gradient with some noise, and with
+// transparent pixels if alpha is true.
+func testImage(width, height int, alpha bool) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{
+				R: uint8(x * 255 / width),
+				G: uint8(y * 255 / height),
+				B: uint8(rnd.Intn(256)),
+				A: 255,
+			}
+			if alpha {
+				c.A = uint8(rnd.Intn(256))
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestEncodeWebP(t *testing.T) {
+	uniform := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for i := range uniform.Pix {
+		uniform.Pix[i] = 0x80
+	}
+	two := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	copy(two.Pix, []byte{1, 2, 3, 255, 200, 100, 50, 255})
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"gradient", testImage(37, 21, false)},
+		{"alpha", testImage(16, 16, true)},
+		{"uniform", uniform},
+		{"two pixels", two},
+		{"one pixel", image.NewNRGBA(image.Rect(0, 0, 1, 1))},
+		{"gray", image.NewGray(image.Rect(5, 5, 20, 9))},
+		{"large", testImage(300, 200, false)},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := EncodeWebP(&b, tt.img); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if Detect(b.Bytes()) != WebP {
+			t.Errorf("%s: output is not detected as WebP", tt.name)
+		}
+		width, height, pix, err := decodeWebP(b.Bytes())
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		bounds := tt.img.Bounds()
+		if width != bounds.Dx() || height != bounds.Dy() {
+			t.Errorf("%s: size is %dx%d, want %dx%d", tt.name, width, height, bounds.Dx(), bounds.Dy())
+			continue
+		}
+	pixels:
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				c := color.NRGBAModel.Convert(tt.img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+				want := uint32(c.A)<<24 | uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+				if got := pix[y*width+x]; got != want {
+					t.Errorf("%s: pixel at %d,%d is %08x, want %08x", tt.name, x, y, got, want)
+					break pixels
+				}
+			}
+		}
+	}
+
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 10), image.Rect(0, 0, 1<<14+1, 1)} {
+		if err := EncodeWebP(&bytes.Buffer{}, image.NewGray(r)); err != ErrTooLarge {
+			t.Errorf("%v: error is %v, want %v", r, err, ErrTooLarge)
+		}
+	}
+}
+
+func TestCodeLengths(t *testing.T) {
+	// A Fibonacci histogram gives a tree as deep as it has symbols,
+	// which must be limited.
+	hist := make([]int, 20)
+	a, b := 1, 1
+	for i := range hist {
+		hist[i] = a
+		a, b = b, a+b
+	}
+	for _, limit := range []int{7, 15} {
+		lengths := codeLengths(hist, limit)
+		var kraft float64
+		for s, n := range lengths {
+			if n < 1 || n > limit {
+				t.Errorf("limit %d: length of symbol %d is %d", limit, s, n)
+			}
+			kraft += 1 / float64(int(1)<<uint(n))
+		}
+		if kraft > 1 {
+			t.Errorf("limit %d: lengths %v are no prefix code", limit, lengths)
+		}
+	}
+
+	if l := codeLengths([]int{0, 5, 0}, 15); l[1] != 1 || l[0] != 0 || l[2] != 0 {
+		t.Errorf("lengths of a single symbol are %v, want [0 1 0]", l)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/cassava/lackey/audio/mp3"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/goulash/osutil"
+)
+
+// lyricsExts are the extensions of sidecar lyrics, from the most preferred.
+var lyricsExts = []string{".lrc", ".lyrics", ".txt"}
+
+// lyricsStem returns the name of the sidecar lyrics file name without its
+// extension, which is the name of its track with or without the extension,
+// or "" if name is not a lyrics file.
+func lyricsStem(name string) string {
+	ext := filepath.Ext(name)
+	for _, x := range lyricsExts {
+		if strings.EqualFold(ext, x) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return ""
+}
+
+// sidecarLyrics returns the path of the lyrics of the audio file track,
+// which share its name with or without its extension, or "" if there are
+// none. Synchronized lyrics are preferred.
+func sidecarLyrics(track string) (string, error) {
+	dir, name := filepath.Split(track)
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, ext := range lyricsExts {
+		for _, stem := range []string{name, base} {
+			path := filepath.Join(dir, stem+ext)
+			if ex, err := osutil.FileExists(path); err != nil || ex {
+				return path, err
+			}
+		}
+	}
+	return "", nil
+}
+
+// embedLyrics embeds the sidecar lyrics of src in the output at path,
+// unless it has lyrics already. Synchronized lyrics are written to the
+// SYLT frame of MP3 files, along with their text in the USLT frame, and
+// as they are to the LYRICS field of all other formats.
+func (o *Runner) embedLyrics(ctx context.Context, src, path string) error {
+	file, err := sidecarLyrics(src)
+	if err != nil || file == "" {
+		return err
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	text := strings.TrimPrefix(string(bs), "\ufeff")
+	text = strings.TrimSpace(strings.Replace(text, "\r\n", "\n", -1))
+	if text == "" {
+		return nil
+	}
+
+	_, t, err := o.outputTags(path)
+	if err != nil {
+		return err
+	}
+	if t.Get("LYRICS") != "" || t.Get("UNSYNCEDLYRICS") != "" {
+		return nil
+	}
+	if !isMP3(path) {
+		t.Set("LYRICS", text)
+		return WriteTags(ctx, path, t)
+	}
+
+	mt, err := mp3.ReadTag(path)
+	if err != nil {
+		return err
+	}
+	if lines := tags.ParseLRC(text); lines != nil {
+		mt.SetLyrics("eng", "", tags.PlainLyrics(lines))
+		mt.SetSyncedLyrics("eng", "", lines)
+	} else {
+		mt.SetLyrics("eng", "", text)
+	}
+	return mt.Write(path)
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cassava/lackey/audio/flac"
+	"github.com/cassava/lackey/audio/mp3"
+	"github.com/cassava/lackey/audio/tags"
+)
+
+func TestLyricsStem(t *testing.T) {
+	tests := map[string]string{
+		"01 Song.lrc":      "01 Song",
+		"01 Song.flac.LRC": "01 Song.flac",
+		"01 Song.lyrics":   "01 Song",
+		"notes.txt":        "notes",
+		"cover.jpg":        "",
+		"lrc":              "",
+	}
+	for name, want := range tests {
+		if got := lyricsStem(name); got != want {
+			t.Errorf("%s: stem is %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSidecarLyrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	track := filepath.Join(dir, "song.flac")
+	if got, err := sidecarLyrics(track); err != nil || got != "" {
+		t.Errorf("lyrics are %q with error %v, want none", got, err)
+	}
+
+	// Synchronized lyrics are preferred, and then the full name.
+	for _, name := range []string{"song.txt", "song.flac.txt", "song.flac.lyrics", "song.lrc"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := sidecarLyrics(track); err != nil || got != path {
+			t.Errorf("%s: lyrics are %q with error %v, want %q", name, got, err, path)
+		}
+	}
+}
+
+func TestEmbedLyrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src", "song.flac")
+	if err := os.Mkdir(filepath.Dir(src), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(file string, data []byte) {
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := &Runner{}
+	ctx := context.Background()
+
+	// Without a sidecar, the output is left as it is.
+	dst := filepath.Join(dir, "song.flac")
+	write(dst, flacFile(1))
+	if err := o.embedLyrics(ctx, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if tt, _ := flac.ReadTags(dst); tt.Get("LYRICS") != "" {
+		t.Errorf("lyrics are %q, want none", tt.Get("LYRICS"))
+	}
+
+	// Synchronized lyrics are written as they are to the LYRICS field.
+	lrc := "\ufeff[ti:Song]\r\n[00:01.00]One\r\n[00:02.00]Two\r\n"
+	write(filepath.Join(filepath.Dir(src), "song.lrc"), []byte(lrc))
+	if err := o.embedLyrics(ctx, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	want := "[ti:Song]\n[00:01.00]One\n[00:02.00]Two"
+	if tt, err := flac.ReadTags(dst); err != nil || tt.Get("LYRICS") != want {
+		t.Errorf("lyrics are %q with error %v, want %q", tt.Get("LYRICS"), err, want)
+	}
+
+	// MP3 files get them in SYLT, and their text in USLT. Files without a
+	// tag cannot be identified as MP3, so they are given a title.
+	mp3Dst := filepath.Join(dir, "song.mp3")
+	writeMP3 := func() {
+		write(mp3Dst, mp3File())
+		if err := WriteTags(ctx, mp3Dst, tags.Tags{"TITLE": {"Song"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMP3()
+	if err := o.embedLyrics(ctx, src, mp3Dst); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := mp3.ReadTag(mp3Dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tag.Tags().Get("LYRICS"); got != "One\nTwo" {
+		t.Errorf("USLT lyrics are %q, want %q", got, "One\nTwo")
+	}
+	want3 := mp3.NewTag(tag.Version)
+	want3.SetSyncedLyrics("eng", "", []tags.Line{{Time: time.Second, Text: "One"}, {Time: 2 * time.Second, Text: "Two"}})
+	if f := tag.Frame("SYLT"); f == nil || !reflect.DeepEqual(f.Data, want3.Frame("SYLT").Data) {
+		t.Errorf("SYLT frame is %v, want %v", f, want3.Frame("SYLT"))
+	}
+
+	// Plain lyrics are only written to USLT, and lyrics that are embedded
+	// already are kept.
+	writeMP3()
+	write(filepath.Join(filepath.Dir(src), "song.lrc"), []byte("One\nTwo\n"))
+	if err := o.embedLyrics(ctx, src, mp3Dst); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(filepath.Dir(src), "song.lrc"), []byte("Three"))
+	if err := o.embedLyrics(ctx, src, mp3Dst); err != nil {
+		t.Fatal(err)
+	}
+	if tag, err = mp3.ReadTag(mp3Dst); err != nil {
+		t.Fatal(err)
+	}
+	if got := tag.Tags().Get("LYRICS"); got != "One\nTwo" || tag.Frame("SYLT") != nil {
+		t.Errorf("lyrics are %q with SYLT %v, want only USLT %q", got, tag.Frame("SYLT"), "One\nTwo")
+	}
+}
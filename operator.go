@@ -7,6 +7,8 @@ package lackey
 import (
 	"os"
 
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/cue"
 	"github.com/goulash/audio"
 )
 
@@ -18,13 +20,16 @@ const (
 	TranscodeAudio
 	UpdateAudio
 	CopyAudio
+	RetagAudio
 )
 
 type Audio interface {
 	IsExists() bool
+	AbsPath() string
 	FileInfo() os.FileInfo
 	Encoding() audio.Codec
 	Metadata() audio.Metadata
+	Properties() *codec.Properties
 }
 
 type Operator interface {
@@ -48,6 +53,7 @@ type Operator interface {
 	// - If IgnoreAudio is returned, then Operator.Ignore is called.
 	// - If UpdateAudio is returned, then Operator.Update is called.
 	// - If CopyAudio is returned, then Operator.CopyFile is called.
+	// - If RetagAudio is returned, then Operator.Retag is called.
 	Which(src, dst Audio) AudioOperation
 
 	// Feedback
@@ -66,5 +72,30 @@ type Operator interface {
 	CopyFile(src, dst string) error
 	Transcode(src, dst string, md Audio) error
 	Update(src, dst string, md Audio) error
+
+	// Retag replaces the tags and pictures of dst with those of src,
+	// whose audio has probably not changed. It is checked by Retag.
+	Retag(src, dst string, md Audio) error
 	DownscaleCover(src, dst string) error
+
+	// ExtractCover writes the picture embedded in the audio file src to
+	// dst, as the cover of an album that has no cover file.
+	ExtractCover(src, dst string) error
+
+	// Split encodes the tracks of the image src, as the CUE sheet
+	// describes them, to the files dsts, one for each track.
+	Split(src string, dsts []string, md Audio, sheet *cue.Sheet) error
+
+	// Merge encodes the spoken-word sources srcs, in this order, to the
+	// single file dst, with a chapter for each of them.
+	Merge(srcs []string, dst string, mds []Audio) error
+
+	// AudioExt returns the extension of the audio that is extracted
+	// from videos, such as ".mp3".
+	AudioExt() string
+
+	// ExtractAudio encodes the audio stream of the video src to dst. It is
+	// given the tags of the video, on top of those of album, another track
+	// in its directory, which may be nil.
+	ExtractAudio(src, dst string, album Audio) error
 }
@@ -9,10 +9,15 @@ import (
 	"fmt"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Jeffail/tunny"
+	"github.com/cassava/lackey/audio/cue"
+	"github.com/cassava/lackey/audio/flac"
+	"github.com/goulash/audio"
 	"github.com/goulash/osutil"
 )
 
@@ -24,9 +29,35 @@ type Planner struct {
 	TranscodeAll bool
 	Concurrent   int
 
+	// CoverSources are the names and glob patterns of cover files, from
+	// the most preferred, which are matched case-insensitively. The best
+	// cover in each directory is written as CoverTarget, if it is not
+	// empty, or else keeps its name. Albums without a cover file are given
+	// the picture embedded in their first track as CoverTarget.
 	DownscaleCover bool
-	CoverSource    string
+	CoverSources   []string
 	CoverTarget    string
+	covers         map[*Entry]*albumCover
+
+	// SplitCue splits images of whole albums with a CUE sheet, either in
+	// a .cue file next to them or embedded in FLAC files, into a file for
+	// each track. The tracks replace the image in the destination.
+	SplitCue bool
+	images   map[*Entry]*cueImage
+
+	// Spoken is the profile of spoken-word sources, whose chapters are
+	// split like images or which are merged into a file for each
+	// directory, as its Chapters selects.
+	Spoken *SpokenWord
+	books  map[*Entry]*book
+
+	// Video selects whether videos are ignored, copied, or whether their
+	// audio is extracted, which is then named like an encoded track.
+	Video VideoMode
+
+	// lyrics maps sidecar lyrics to their tracks, whose destination names
+	// they follow.
+	lyrics map[*Entry]*Entry
 
 	op  Operator
 	src *Database
@@ -42,6 +73,10 @@ func NewPlanner(src, dst *Database, op Operator) *Planner {
 	return &Planner{
 		DataExcept: make(map[string]bool),
 		Concurrent: runtime.NumCPU(),
+		covers:     make(map[*Entry]*albumCover),
+		lyrics:     make(map[*Entry]*Entry),
+		images:     make(map[*Entry]*cueImage),
+		books:      make(map[*Entry]*book),
 
 		op:  op,
 		src: src,
@@ -88,15 +123,37 @@ func (p *Planner) Plan() error {
 
 func (p *Planner) planDir(src, dst *Entry) error {
 	// We know that both src and dst are directories, or dst doesn't exist.
+	cover := p.albumCover(src)
+	p.covers[src] = cover
+	p.findLyrics(src)
+	for _, err := range p.findImages(src) {
+		if err := p.op.Warn(err); err != nil {
+			return err
+		}
+	}
+	p.findBook(src)
 	if dst != nil && p.DeleteBefore {
 		// Delete extra files on destination first, if dst exists.
 		expect := make(map[string]bool)
 		for _, e := range src.Children() {
+			if img := p.images[e]; img != nil {
+				for _, key := range img.keys {
+					expect[key] = true
+				}
+				continue
+			}
+			if b := p.books[e]; b != nil {
+				expect[b.key] = true
+				continue
+			}
 			expect[p.dkey(e)] = true
 		}
+		if cover != nil {
+			expect[cover.key] = true
+		}
 
 		for _, e := range dst.Children() {
-			if !expect[e.Key()] {
+			if !expect[e.Key()] && e.Key() != StateFile {
 				p.remove(e)
 			}
 		}
@@ -122,10 +179,15 @@ func (p *Planner) planDir(src, dst *Entry) error {
 			return p.quit
 		}
 
-		d := p.dst.Get(p.dkey(s))
+		// Images are written as their tracks instead, and the sources
+		// of a book as a single file.
+		var d *Entry
+		if p.images[s] == nil && p.books[s] == nil {
+			d = p.dst.Get(p.dkey(s))
+		}
 
 		// Eliminate the possibility of a mismatch
-		if d != nil && (s.IsDir() != d.IsDir() || s.IsMusic() != d.IsMusic()) {
+		if d != nil && (s.IsDir() != d.IsDir() || p.isMusic(s) != d.IsMusic()) {
 			err := p.remove(d)
 			if err != nil {
 				return err
@@ -134,7 +196,13 @@ func (p *Planner) planDir(src, dst *Entry) error {
 		}
 
 		var err error
-		if s.IsDir() {
+		if img := p.images[s]; img != nil {
+			err = p.planSplit(s, img)
+		} else if b := p.books[s]; b != nil {
+			if s == b.tracks[0] {
+				err = p.planMerge(b)
+			}
+		} else if s.IsDir() {
 			err = p.planDir(s, d)
 		} else {
 			err = p.planFile(s, d)
@@ -147,9 +215,371 @@ func (p *Planner) planDir(src, dst *Entry) error {
 		}
 	}
 
+	if cover != nil && cover.track != nil {
+		if err := p.planExtract(cover); err != nil {
+			return p.op.Warn(err)
+		}
+	}
 	return nil
 }
 
+// albumCover is the cover of a directory in the destination, which is
+// either the file src or else the picture embedded in track.
+type albumCover struct {
+	src   *Entry
+	track *Entry
+	key   string
+}
+
+// albumCover returns the cover of the directory dir, or nil if it has none.
+func (p *Planner) albumCover(dir *Entry) *albumCover {
+	var (
+		track *Entry
+		files = make(map[string]*Entry)
+		names []string
+	)
+	for _, e := range dir.Children() {
+		if e.IsMusic() && track == nil {
+			track = e
+		} else if !e.IsDir() && !e.IsMusic() {
+			files[e.Filename()] = e
+			names = append(names, e.Filename())
+		}
+	}
+
+	if name := findCover(p.CoverSources, names); name != "" {
+		e := files[name]
+		key := e.Key()
+		if p.CoverTarget != "" {
+			target := p.CoverTarget
+			if !p.DownscaleCover {
+				// Covers that are copied keep their format.
+				target = strings.TrimSuffix(target, filepath.Ext(target)) + strings.ToLower(filepath.Ext(name))
+			}
+			key = filepath.Join(dir.Key(), target)
+		}
+		return &albumCover{src: e, key: key}
+	}
+	if track == nil || p.CoverTarget == "" {
+		return nil
+	}
+	key := filepath.Join(dir.Key(), p.CoverTarget)
+	for _, e := range dir.Children() {
+		if p.dkey(e) == key {
+			// Another file is written there already.
+			return nil
+		}
+	}
+	return &albumCover{track: track, key: key}
+}
+
+// findLyrics maps the sidecar lyrics in the directory dir to their tracks,
+// which they are named after, with or without the extension of the track.
+func (p *Planner) findLyrics(dir *Entry) {
+	tracks := make(map[string]*Entry)
+	for _, e := range dir.Children() {
+		if e.IsMusic() {
+			name, ext := e.FilenameExt()
+			if _, ok := tracks[name]; !ok {
+				tracks[name] = e
+			}
+			tracks[name+ext] = e
+		}
+	}
+	for _, e := range dir.Children() {
+		if e.IsDir() || e.IsMusic() {
+			continue
+		}
+		if t := tracks[lyricsStem(e.Filename())]; t != nil {
+			p.lyrics[e] = t
+		}
+	}
+}
+
+// cueImage is an image of a whole album, which is split into its tracks.
+type cueImage struct {
+	sheet   *cue.Sheet
+	keys    []string
+	modTime time.Time
+}
+
+// findImages finds the images in the directory dir, which are audio files
+// that have a CUE sheet of several tracks, and their tracks in the
+// destination. The sheet of an image is the .cue file with its name, with
+// or without its extension, or else one whose FILE names it, or else the
+// sheet embedded in FLAC files. Spoken-word sources with several chapters
+// are images as well, if their chapters are split. If a directory has
+// several images, their tracks are prefixed with the name of the image.
+// Sheets that cannot be read are skipped, and their errors returned.
+func (p *Planner) findImages(dir *Entry) []error {
+	splitChapters := p.Spoken != nil && p.Spoken.Chapters == SplitChapters
+	if !p.SplitCue && !splitChapters {
+		return nil
+	}
+	var (
+		tracks []*Entry
+		cues   []*Entry
+		sheets = make(map[*Entry]*cue.Sheet)
+		errs   []error
+	)
+	for _, e := range dir.Children() {
+		if e.IsMusic() {
+			tracks = append(tracks, e)
+		} else if p.SplitCue && !e.IsDir() && strings.EqualFold(filepath.Ext(e.Filename()), ".cue") {
+			// Sheets of several files, one for each track, are not images.
+			if err := e.unpack(); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			s, err := cue.ReadFile(e.AbsPath())
+			if err == cue.ErrMultipleFiles {
+				continue
+			} else if err != nil {
+				errs = append(errs, fmt.Errorf("cannot read CUE sheet %s: %s", e.AbsPath(), err))
+				continue
+			}
+			cues = append(cues, e)
+			sheets[e] = s
+		}
+	}
+
+	var images []*Entry
+	for _, t := range tracks {
+		name, ext := t.FilenameExt()
+		var (
+			sheet *cue.Sheet
+			mod   = t.FileInfo().ModTime()
+			match *Entry
+		)
+		for _, e := range cues {
+			stem := strings.TrimSuffix(e.Filename(), filepath.Ext(e.Filename()))
+			if stem == name || stem == name+ext {
+				match = e
+				break
+			}
+		}
+		for _, e := range cues {
+			if match != nil {
+				break
+			}
+			// Sheets often name a WAV file, which was compressed later.
+			file := filepath.Base(strings.Replace(sheets[e].File, "\\", "/", -1))
+			if strings.TrimSuffix(file, filepath.Ext(file)) == name {
+				match = e
+			}
+		}
+		if match != nil {
+			sheet = sheets[match]
+			if match.FileInfo().ModTime().After(mod) {
+				mod = match.FileInfo().ModTime()
+			}
+		} else if p.SplitCue && t.Encoding() == audio.FLAC {
+			var err error
+			if err = t.unpack(); err != nil {
+				errs = append(errs, err)
+			} else if sheet, err = flac.ReadCueSheet(t.AbsPath()); err != nil {
+				errs = append(errs, fmt.Errorf("cannot read CUE sheet of %s: %s", t.AbsPath(), err))
+			}
+		}
+		if sheet == nil && splitChapters && p.Spoken.Is(t) {
+			if err := t.unpack(); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			chs, err := ReadChapters(t.AbsPath(), t.Encoding())
+			if err != nil {
+				errs = append(errs, fmt.Errorf("cannot read chapters of %s: %s", t.AbsPath(), err))
+			} else if len(chs) > 1 {
+				sheet = chapterSheet(chs, t.Metadata())
+			}
+		}
+		if sheet != nil && len(sheet.Tracks) > 1 {
+			p.images[t] = &cueImage{sheet: sheet, modTime: mod}
+			images = append(images, t)
+		}
+	}
+
+	for _, e := range images {
+		img := p.images[e]
+		prefix := ""
+		if len(images) > 1 {
+			name, _ := e.FilenameExt()
+			prefix = name + " - "
+		}
+		ext := p.op.WhichExt(e)
+		if ext == "" {
+			_, ext = e.FilenameExt()
+		}
+		for _, t := range img.sheet.Tracks {
+			img.keys = append(img.keys, filepath.Join(dir.Key(), prefix+trackName(t)+ext))
+		}
+	}
+	return errs
+}
+
+// planSplit synchronizes the tracks of the image src. If any of them is
+// missing or older than the image or its sheet, they are all split again.
+func (p *Planner) planSplit(src *Entry, img *cueImage) error {
+	paths := make([]string, len(img.keys))
+	current := true
+	var first *Entry
+	for i, key := range img.keys {
+		paths[i] = p.dpath(key)
+		d := p.dst.Get(key)
+		if i == 0 {
+			first = d
+		}
+		if d == nil || d.IsDir() || !d.FileInfo().ModTime().After(img.modTime) {
+			current = false
+		}
+	}
+
+	switch p.op.Which(src, first) {
+	case IgnoreAudio:
+		for _, path := range paths {
+			if err := p.op.Ignore(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	case SkipAudio:
+		if current {
+			for _, path := range paths {
+				if err := p.op.Ok(path); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	if err := src.unpack(); err != nil {
+		return err
+	}
+	p.wg.Add(1)
+	p.pool.SendWorkAsync(func() {
+		err := p.op.Split(src.AbsPath(), paths, src, img.sheet)
+		if err != nil {
+			p.errs <- err
+		}
+		p.wg.Done()
+	}, nil)
+	return nil
+}
+
+// book is a directory of spoken-word sources, which are merged into the
+// single file key in the destination.
+type book struct {
+	dir    *Entry
+	tracks []*Entry
+	key    string
+}
+
+// findBook finds the spoken-word sources in the directory dir that are
+// merged, if there are at least two of them, in the order of their disc
+// and track numbers, or else their names. The file they are merged into
+// is named after the directory.
+func (p *Planner) findBook(dir *Entry) {
+	if p.Spoken == nil || p.Spoken.Chapters != MergeChapters {
+		return
+	}
+	b := &book{dir: dir}
+	for _, e := range dir.Children() {
+		if e.IsMusic() && p.images[e] == nil && p.Spoken.Is(e) {
+			b.tracks = append(b.tracks, e)
+		}
+	}
+	if len(b.tracks) < 2 {
+		return
+	}
+	number := func(e *Entry) (int, int) {
+		md := e.Metadata()
+		if md == nil {
+			return 0, 0
+		}
+		disc, _ := md.Disc()
+		track, _ := md.Track()
+		return disc, track
+	}
+	sort.SliceStable(b.tracks, func(i, j int) bool {
+		di, ti := number(b.tracks[i])
+		dj, tj := number(b.tracks[j])
+		return di < dj || di == dj && ti < tj
+	})
+	b.key = filepath.Join(dir.Key(), filepath.Base(dir.AbsPath())+p.Spoken.Encoder.Ext())
+	for _, e := range b.tracks {
+		p.books[e] = b
+	}
+}
+
+// planMerge synchronizes the file that the sources of the book b are merged
+// into. If it is missing or older than any of them or their directory,
+// which changes when sources are added or removed, they are merged again.
+func (p *Planner) planMerge(b *book) error {
+	path := p.dpath(b.key)
+	d := p.dst.Get(b.key)
+	current := d != nil && !d.IsDir() && d.FileInfo().ModTime().After(b.dir.FileInfo().ModTime())
+	srcs := make([]string, len(b.tracks))
+	mds := make([]Audio, len(b.tracks))
+	for i, t := range b.tracks {
+		srcs[i], mds[i] = t.AbsPath(), t
+		if current && !d.FileInfo().ModTime().After(t.FileInfo().ModTime()) {
+			current = false
+		}
+	}
+
+	switch p.op.Which(b.tracks[0], d) {
+	case IgnoreAudio:
+		return p.op.Ignore(path)
+	case SkipAudio:
+		if current {
+			return p.op.Ok(path)
+		}
+	}
+
+	for _, t := range b.tracks {
+		if err := t.unpack(); err != nil {
+			return err
+		}
+	}
+	p.wg.Add(1)
+	p.pool.SendWorkAsync(func() {
+		err := p.op.Merge(srcs, path, mds)
+		if err != nil {
+			p.errs <- err
+		}
+		p.wg.Done()
+	}, nil)
+	return nil
+}
+
+// planCover synchronizes the cover file src to dst, which may be nil.
+func (p *Planner) planCover(src, dst *Entry, path string) error {
+	if dst != nil && dst.FileInfo().ModTime().After(src.FileInfo().ModTime()) {
+		return p.op.Ok(path)
+	}
+	if err := src.unpack(); err != nil {
+		return err
+	}
+	if p.DownscaleCover {
+		return p.op.DownscaleCover(src.AbsPath(), path)
+	}
+	return p.op.CopyFile(src.AbsPath(), path)
+}
+
+// planExtract synchronizes the cover that is extracted from a track.
+func (p *Planner) planExtract(c *albumCover) error {
+	path := p.dpath(c.key)
+	dst := p.dst.Get(c.key)
+	if dst != nil && dst.FileInfo().ModTime().After(c.track.FileInfo().ModTime()) {
+		return p.op.Ok(path)
+	}
+	if err := c.track.unpack(); err != nil {
+		return err
+	}
+	return p.op.ExtractCover(c.track.AbsPath(), path)
+}
+
 // planFile synchronizes src to dst, which may be nil.
 func (p *Planner) planFile(src, dst *Entry) error {
 	path := p.dpath(p.dkey(src))
@@ -159,9 +589,17 @@ func (p *Planner) planFile(src, dst *Entry) error {
 	}
 
 	if src.IsMusic() {
-		switch p.op.Which(src, dst) {
+		op := p.op.Which(src, dst)
+		switch op {
 		case SkipAudio:
 			return p.op.Ok(path)
+		case IgnoreAudio:
+			return p.op.Ignore(path)
+		}
+		if err := src.unpackAlbum(); err != nil {
+			return err
+		}
+		switch op {
 		case CopyAudio:
 			return p.op.CopyFile(src.AbsPath(), path)
 		case TranscodeAudio:
@@ -177,22 +615,50 @@ func (p *Planner) planFile(src, dst *Entry) error {
 		case UpdateAudio:
 			p.wg.Add(1)
 			p.pool.SendWorkAsync(func() {
-				err := p.op.Update(src.AbsPath(), path, dst)
+				err := p.op.Update(src.AbsPath(), path, src)
+				if err != nil {
+					p.errs <- err
+				}
+				p.wg.Done()
+			}, nil)
+			return nil
+		case RetagAudio:
+			p.wg.Add(1)
+			p.pool.SendWorkAsync(func() {
+				err := p.op.Retag(src.AbsPath(), path, src)
 				if err != nil {
 					p.errs <- err
 				}
 				p.wg.Done()
 			}, nil)
 			return nil
-		case IgnoreAudio:
-			return p.op.Ignore(path)
 		default:
 			panic("unknown audio operation")
 		}
+	}
+	if src.IsVideo() {
+		return p.planVideo(src, dst, path)
+	}
+
+	cover := p.covers[src.Parent()]
+	if cover != nil && cover.src == src {
+		return p.planCover(src, dst, path)
+	} else if cover != nil && path == p.dpath(cover.key) {
+		// The cover is written there instead.
+		return p.op.Ignore(path)
+	} else if p.lyrics[src] != nil {
+		// Lyrics follow their track, even if data is ignored.
+		if dst != nil && dst.FileInfo().ModTime().After(src.FileInfo().ModTime()) {
+			return p.op.Ok(path)
+		}
+		if err := src.unpack(); err != nil {
+			return err
+		}
+		return p.op.CopyFile(src.AbsPath(), path)
 	} else if src.IsIgnored() {
 		return p.op.Ignore(path)
 	} else {
-		if p.IgnoreData != p.DataExcept[src.Filename()] && src.Filename() != p.CoverSource {
+		if p.IgnoreData != p.DataExcept[src.Filename()] {
 			// We land in here when:
 			// - Ignore all data (true) and there is no exception (false)
 			// - Do not ignore all data (false) and there is an exception (true)
@@ -202,12 +668,61 @@ func (p *Planner) planFile(src, dst *Entry) error {
 		if dst != nil && dst.FileInfo().ModTime().After(src.FileInfo().ModTime()) {
 			return p.op.Ok(path)
 		}
+		if err := src.unpack(); err != nil {
+			return err
+		}
+		return p.op.CopyFile(src.AbsPath(), path)
+	}
+}
 
-		if p.DownscaleCover && src.Filename() == p.CoverSource {
-			return p.op.DownscaleCover(src.AbsPath(), path)
+// planVideo synchronizes the video src to dst, which may be nil, as Video
+// selects. The audio of a video is extracted with the tags of the first
+// track in its directory.
+func (p *Planner) planVideo(src, dst *Entry, path string) error {
+	current := dst != nil && dst.FileInfo().ModTime().After(src.FileInfo().ModTime())
+	switch p.Video {
+	case CopyVideo:
+		if current {
+			return p.op.Ok(path)
+		}
+		if err := src.unpack(); err != nil {
+			return err
 		}
 		return p.op.CopyFile(src.AbsPath(), path)
+	case ExtractVideoAudio:
+		if current {
+			return p.op.Ok(path)
+		}
+		if err := src.unpack(); err != nil {
+			return err
+		}
+		var album Audio
+		for _, e := range src.Parent().Children() {
+			if e.IsMusic() {
+				if err := e.unpackAlbum(); err != nil {
+					return err
+				}
+				album = e
+				break
+			}
+		}
+		p.wg.Add(1)
+		p.pool.SendWorkAsync(func() {
+			err := p.op.ExtractAudio(src.AbsPath(), path, album)
+			if err != nil {
+				p.errs <- err
+			}
+			p.wg.Done()
+		}, nil)
+		return nil
 	}
+	return p.op.Ignore(path)
+}
+
+// isMusic returns true if src is written as music to the destination,
+// which videos are if their audio is extracted.
+func (p *Planner) isMusic(src *Entry) bool {
+	return src.IsMusic() || src.IsVideo() && p.Video == ExtractVideoAudio
 }
 
 // dpath returns the absolute destination path, given the key.
@@ -218,14 +733,24 @@ func (p *Planner) dpath(key string) string {
 // dkey returns the destination key, which also takes into account whether the
 // file should be transcoded or not.
 func (p *Planner) dkey(src *Entry) string {
-	if src.Filename() == p.CoverSource && p.CoverSource != p.CoverTarget {
-		if p.CoverTarget == "" {
-			return src.Key()
+	if c := p.covers[src.Parent()]; c != nil && c.src == src {
+		return c.key
+	}
+	if t := p.lyrics[src]; t != nil {
+		// Lyrics are renamed along with their track.
+		ext := filepath.Ext(src.Filename())
+		key := p.dkey(t)
+		if lyricsStem(src.Filename()) != t.Filename() {
+			key = strings.TrimSuffix(key, filepath.Ext(key))
 		}
-		return strings.Replace(src.Key(), p.CoverSource, p.CoverTarget, 1)
+		return key + ext
 	}
 
 	if !src.IsMusic() {
+		if p.isMusic(src) {
+			key := src.Key()
+			return strings.TrimSuffix(key, filepath.Ext(key)) + p.op.AudioExt()
+		}
 		return src.Key()
 	}
 
@@ -0,0 +1,127 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/goulash/color"
+)
+
+// oggPage returns an Ogg page that contains the single packet p.
+func oggPage(flags byte, granule int64, seq uint32, p []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("OggS")
+	b.WriteByte(0)
+	b.WriteByte(flags)
+	binary.Write(&b, binary.LittleEndian, granule)
+	binary.Write(&b, binary.LittleEndian, uint32(1)) // serial
+	binary.Write(&b, binary.LittleEndian, seq)
+	binary.Write(&b, binary.LittleEndian, uint32(0)) // checksum
+	lacing := bytes.Repeat([]byte{255}, len(p)/255)
+	lacing = append(lacing, byte(len(p)%255))
+	b.WriteByte(byte(len(lacing)))
+	b.Write(lacing)
+	b.Write(p)
+
+	page := b.Bytes()
+	var crc uint32
+	for _, c := range page {
+		crc ^= uint32(c) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+	return page
+}
+
+// writeOpus writes an Opus file of one second, whose audio is not valid
+// but which is identified and read like any other.
+func writeOpus(t *testing.T, file string) {
+	head := []byte("OpusHead\x01\x02")
+	head = append(head, 0x38, 0x01)             // pre-skip of 312
+	head = append(head, 0x80, 0xbb, 0x00, 0x00) // 48000 Hz
+	head = append(head, 0, 0, 0)                // gain, mapping family
+	tags := []byte("OpusTags\x04\x00\x00\x00test\x00\x00\x00\x00")
+
+	var b []byte
+	b = append(b, oggPage(0x02, 0, 0, head)...)
+	b = append(b, oggPage(0x00, 0, 1, tags)...)
+	b = append(b, oggPage(0x04, 48312, 2, make([]byte, 100))...)
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recorder records the audio operation of each source by name.
+type recorder struct {
+	*Runner
+	mu  sync.Mutex
+	ops map[string]AudioOperation
+}
+
+func (r *recorder) Which(src, dst Audio) AudioOperation {
+	op := r.Runner.Which(src, dst)
+	r.mu.Lock()
+	r.ops[filepath.Base(src.AbsPath())] = op
+	r.mu.Unlock()
+	return op
+}
+
+func TestPlanOpusTranscoded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, d := range []string{src, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeOpus(t, filepath.Join(src, "track.opus"))
+	if c, err := codec.Identify(filepath.Join(src, "track.opus")); c != codec.Opus {
+		t.Fatalf("identified test file as %s (%v), want Opus", codec.String(c), err)
+	}
+
+	for _, force := range []bool{false, true} {
+		sdb, err := ReadLibrary(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ddb, err := ReadLibrary(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := &recorder{
+			Runner: &Runner{
+				Color:          color.New(),
+				Encoder:        &MP3Encoder{TargetQuality: 4, BitrateThreshold: 256},
+				ForceTranscode: force,
+				DryRun:         true,
+			},
+			ops: make(map[string]AudioOperation),
+		}
+		if err := NewPlanner(sdb, ddb, op).Plan(); err != nil {
+			t.Fatal(err)
+		}
+		if got := op.ops["track.opus"]; got != TranscodeAudio {
+			t.Errorf("force=%v: operation of Opus source is %d, want TranscodeAudio", force, got)
+		}
+	}
+}
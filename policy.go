@@ -0,0 +1,225 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/goulash/audio"
+)
+
+// Policy is an ordered list of rules that decide whether a source is copied,
+// transcoded, or ignored. The first rule that matches a source decides;
+// if none does, the encoder decides.
+type Policy []*Rule
+
+// Rule matches sources by codec or kind, and by conditions on their
+// bitrate and technical properties. It is written as:
+//
+//  MATCH[OP VALUE][,KEY OP VALUE...]:ACTION
+//
+// where MATCH is a codec such as mp3 or flac, or one of lossless, lossy,
+// hires, or * for any source; OP is one of <, <=, =, >=, or >; KEY is one
+// of bitrate (in kbps), rate (in Hz), bits, or channels; and ACTION is
+// one of copy, transcode, or ignore. A comparison right after MATCH is
+// on the bitrate. Values may have a k suffix, so that 128k is a bitrate
+// of 128 kbps and 44.1k a rate of 44100 Hz. For example:
+//
+//  opus<=128k:copy
+//  flac,bits<=16,rate<=48k:copy
+//  lossless:transcode
+//  *:transcode
+type Rule struct {
+	Match  string
+	Conds  []Condition
+	Action AudioOperation
+
+	codec audio.Codec
+	text  string
+}
+
+// Condition compares a property of a source with a value.
+type Condition struct {
+	Key   string
+	Op    string
+	Value int
+}
+
+var ruleActions = map[string]AudioOperation{
+	"copy":      CopyAudio,
+	"transcode": TranscodeAudio,
+	"ignore":    IgnoreAudio,
+}
+
+// ParsePolicy parses the rules of a policy in order.
+func ParsePolicy(rules []string) (Policy, error) {
+	p := make(Policy, 0, len(rules))
+	for _, s := range rules {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, r)
+	}
+	return p, nil
+}
+
+// ParseRule parses a rule such as "mp3<=192k:copy".
+func ParseRule(s string) (*Rule, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("rule %q has no action, such as :copy", s)
+	}
+	action, ok := ruleActions[strings.ToLower(s[i+1:])]
+	if !ok {
+		return nil, fmt.Errorf("rule %q has unknown action %q", s, s[i+1:])
+	}
+	r := &Rule{Action: action, text: s}
+
+	fields := strings.Split(s[:i], ",")
+	match := fields[0]
+	if j := strings.IndexAny(match, "<=>"); j >= 0 {
+		fields[0] = "bitrate" + match[j:]
+		match = match[:j]
+	} else {
+		fields = fields[1:]
+	}
+	r.Match = strings.ToLower(strings.TrimSpace(match))
+	switch r.Match {
+	case "*", "lossless", "lossy", "hires":
+	default:
+		c, err := codec.Parse(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %s", s, err)
+		}
+		r.codec = c
+	}
+
+	for _, f := range fields {
+		c, err := parseCondition(f)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %s", s, err)
+		}
+		r.Conds = append(r.Conds, c)
+	}
+	return r, nil
+}
+
+func parseCondition(s string) (Condition, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, "<=>")
+	if i < 0 {
+		return Condition{}, fmt.Errorf("condition %q has no comparison", s)
+	}
+	c := Condition{Key: strings.ToLower(s[:i])}
+	v := s[i:]
+	for _, op := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(v, op) {
+			c.Op, v = op, v[len(op):]
+			break
+		}
+	}
+
+	scale := 1.0
+	if strings.HasSuffix(v, "k") || strings.HasSuffix(v, "K") {
+		v = v[:len(v)-1]
+		if c.Key == "rate" {
+			scale = 1000
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return Condition{}, fmt.Errorf("condition %q has invalid value", s)
+	}
+	c.Value = int(f*scale + 0.5)
+
+	switch c.Key {
+	case "bitrate", "rate", "bits", "channels":
+	default:
+		return Condition{}, fmt.Errorf("condition %q has unknown key %q", s, c.Key)
+	}
+	return c, nil
+}
+
+func (r *Rule) String() string { return r.text }
+
+// Matches returns true if src matches the rule and all of its conditions.
+func (r *Rule) Matches(src Audio) bool {
+	p := src.Properties()
+	switch r.Match {
+	case "*":
+	case "lossless", "lossy":
+		lossless := codec.IsLossless(src.Encoding())
+		if p != nil {
+			lossless = p.Lossless
+		}
+		if lossless != (r.Match == "lossless") {
+			return false
+		}
+	case "hires":
+		if p == nil || !p.IsHiRes() {
+			return false
+		}
+	default:
+		if src.Encoding() != r.codec {
+			return false
+		}
+	}
+
+	for _, c := range r.Conds {
+		if c.Key == "bitrate" {
+			md := src.Metadata()
+			if md == nil || !c.compare(md.EncodingBitrate()) {
+				return false
+			}
+			continue
+		}
+		if p == nil {
+			return false
+		}
+		var x int
+		switch c.Key {
+		case "rate":
+			x = p.SampleRate
+		case "bits":
+			x = p.BitDepth
+		case "channels":
+			x = p.Channels
+		}
+		if !c.compare(x) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Condition) compare(x int) bool {
+	switch c.Op {
+	case "<":
+		return x < c.Value
+	case "<=":
+		return x <= c.Value
+	case ">":
+		return x > c.Value
+	case ">=":
+		return x >= c.Value
+	default:
+		return x == c.Value
+	}
+}
+
+// Decide returns the action of the first rule that matches src,
+// or false if no rule matches.
+func (p Policy) Decide(src Audio) (AudioOperation, bool) {
+	for _, r := range p {
+		if r.Matches(src) {
+			return r.Action, true
+		}
+	}
+	return SkipAudio, false
+}
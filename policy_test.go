@@ -0,0 +1,151 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/goulash/audio"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		rule   string
+		match  string
+		conds  []Condition
+		action AudioOperation
+	}{
+		{"*:transcode", "*", nil, TranscodeAudio},
+		{"lossless:ignore", "lossless", nil, IgnoreAudio},
+		{"MP3:Copy", "mp3", nil, CopyAudio},
+		{"mp3<192:copy", "mp3", []Condition{{"bitrate", "<", 192}}, CopyAudio},
+		{"mp3<=192k:copy", "mp3", []Condition{{"bitrate", "<=", 192}}, CopyAudio},
+		{"mp3=192:copy", "mp3", []Condition{{"bitrate", "=", 192}}, CopyAudio},
+		{"mp3>=192:copy", "mp3", []Condition{{"bitrate", ">=", 192}}, CopyAudio},
+		{"mp3>192:copy", "mp3", []Condition{{"bitrate", ">", 192}}, CopyAudio},
+		{"hires,rate>44.1k:transcode", "hires", []Condition{{"rate", ">", 44100}}, TranscodeAudio},
+		{"flac,bits<=16,rate<=48k,channels=2:copy", "flac", []Condition{
+			{"bits", "<=", 16},
+			{"rate", "<=", 48000},
+			{"channels", "=", 2},
+		}, CopyAudio},
+		{"opus<=128k, bitrate>64:copy", "opus", []Condition{
+			{"bitrate", "<=", 128},
+			{"bitrate", ">", 64},
+		}, CopyAudio},
+	}
+	for _, tt := range tests {
+		r, err := ParseRule(tt.rule)
+		if err != nil {
+			t.Errorf("%s: %s", tt.rule, err)
+			continue
+		}
+		if r.Match != tt.match || !reflect.DeepEqual(r.Conds, tt.conds) || r.Action != tt.action {
+			t.Errorf("%s: rule is %s %v %v, want %s %v %v", tt.rule, r.Match, r.Conds, r.Action, tt.match, tt.conds, tt.action)
+		}
+		if r.String() != tt.rule {
+			t.Errorf("%s: string is %q", tt.rule, r.String())
+		}
+	}
+
+	for _, s := range []string{
+		"mp3<=192",             // missing action
+		"mp3<=192:keep",        // unknown action
+		"mp5:copy",             // unknown codec
+		"flac,depth<=16:copy",  // unknown key
+		"flac,bits<=:copy",     // empty value
+		"flac,bits:copy",       // no comparison
+		"flac,rate<=fast:copy", // invalid value
+		":copy",                // empty match
+		"bits<=16:copy",        // no match
+	} {
+		if r, err := ParseRule(s); err == nil {
+			t.Errorf("%s: rule is %v, want an error", s, r)
+		}
+	}
+
+	if _, err := ParsePolicy([]string{"mp3:copy", "flac"}); err == nil {
+		t.Error("policy with an invalid rule has no error")
+	}
+}
+
+func TestPolicyDecide(t *testing.T) {
+	var (
+		mp3    = &fakeAudio{codec.Properties{Codec: audio.MP3, Bitrate: 192}}
+		opus   = &fakeAudio{codec.Properties{Codec: codec.Opus, Bitrate: 96}}
+		flac16 = &fakeAudio{codec.Properties{Codec: audio.FLAC, BitDepth: 16, SampleRate: 44100, Channels: 2, Lossless: true}}
+		flac24 = &fakeAudio{codec.Properties{Codec: audio.FLAC, BitDepth: 24, SampleRate: 96000, Channels: 2, Lossless: true}}
+	)
+	tests := []struct {
+		rules []string
+		src   Audio
+		want  AudioOperation
+		ok    bool
+	}{
+		{nil, mp3, SkipAudio, false},
+		{[]string{"*:transcode"}, mp3, TranscodeAudio, true},
+		{[]string{"mp3<192:copy"}, mp3, SkipAudio, false},
+		{[]string{"mp3<=192:copy"}, mp3, CopyAudio, true},
+		{[]string{"mp3=192:copy"}, mp3, CopyAudio, true},
+		{[]string{"mp3>=192:copy"}, mp3, CopyAudio, true},
+		{[]string{"mp3>192:copy"}, mp3, SkipAudio, false},
+		{[]string{"opus:copy"}, mp3, SkipAudio, false},
+		{[]string{"lossy:ignore", "*:copy"}, opus, IgnoreAudio, true},
+		{[]string{"lossless:ignore", "*:copy"}, opus, CopyAudio, true},
+		{[]string{"flac,bits<=16,rate<=48k:copy", "flac:transcode"}, flac16, CopyAudio, true},
+		{[]string{"flac,bits<=16,rate<=48k:copy", "flac:transcode"}, flac24, TranscodeAudio, true},
+		{[]string{"hires:transcode", "*:copy"}, flac16, CopyAudio, true},
+		{[]string{"hires:transcode", "*:copy"}, flac24, TranscodeAudio, true},
+		{[]string{"flac,channels>2:ignore"}, flac16, SkipAudio, false},
+	}
+	for _, tt := range tests {
+		p, err := ParsePolicy(tt.rules)
+		if err != nil {
+			t.Fatalf("%v: %s", tt.rules, err)
+		}
+		got, ok := p.Decide(tt.src)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%v: decision for %s is %v, %v, want %v, %v", tt.rules, tt.src.Properties(), got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestPolicyThreshold(t *testing.T) {
+	var (
+		mp3     = &fakeAudio{codec.Properties{Codec: audio.MP3, Bitrate: 192}}
+		mp3High = &fakeAudio{codec.Properties{Codec: audio.MP3, Bitrate: 320}}
+	)
+	tests := []struct {
+		rules []string
+		src   Audio
+		want  bool
+	}{
+		// Without rules, --threshold 256 decides.
+		{nil, mp3, true},
+		{nil, mp3High, false},
+		// A rule that matches takes precedence over the threshold.
+		{[]string{"mp3:transcode"}, mp3, false},
+		{[]string{"mp3>=320k:copy"}, mp3High, true},
+		{[]string{"opus:transcode"}, mp3, true},
+	}
+	for _, tt := range tests {
+		p, err := ParsePolicy(tt.rules)
+		if err != nil {
+			t.Fatalf("%v: %s", tt.rules, err)
+		}
+		o := &Runner{Encoder: &MP3Encoder{BitrateThreshold: 256}, Policy: p}
+		if got := o.canCopy(tt.src, nil); got != tt.want {
+			t.Errorf("%v: copying %s is %v, want %v", tt.rules, tt.src.Properties(), got, tt.want)
+		}
+	}
+
+	p, _ := ParsePolicy([]string{"mp3:ignore"})
+	o := &Runner{Encoder: &MP3Encoder{BitrateThreshold: 256}, Policy: p}
+	if !o.ignore(mp3) {
+		t.Error("mp3 is not ignored by the rule mp3:ignore")
+	}
+}
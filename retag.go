@@ -0,0 +1,65 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/flac"
+	"github.com/cassava/lackey/audio/mp3"
+	"github.com/cassava/lackey/audio/wav"
+	"github.com/goulash/audio"
+)
+
+// AudioHash returns a hash of the audio in a file, which does not change
+// when only its tags or pictures do. For FLAC files this is the MD5
+// signature of the samples, and for MP3, WAV, and AIFF files a hash of the
+// audio frames or samples. For other files, it returns "".
+func AudioHash(file string, c audio.Codec) (string, error) {
+	switch c {
+	case audio.FLAC:
+		si, err := flac.ReadStreamInfo(file)
+		if err != nil || si.MD5 == [16]byte{} {
+			return "", err
+		}
+		return "flac-md5:" + hex.EncodeToString(si.MD5[:]), nil
+	case audio.MP3:
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r, err := mp3.AudioSection(f)
+		if err != nil {
+			return "", err
+		}
+		return hashReader(r)
+	case audio.WAV, codec.AIFF:
+		m, err := wav.ReadMetadata(file)
+		if err != nil {
+			return "", err
+		}
+		format := m.AudioFormat()
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return hashReader(io.NewSectionReader(f, format.DataOffset, format.DataSize))
+	}
+	return "", nil
+}
+
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
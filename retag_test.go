@@ -0,0 +1,104 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cassava/lackey/audio/wav"
+	"github.com/goulash/audio"
+)
+
+// wavFile returns a WAV file of the samples, followed by a LIST chunk
+// with info, if it is not empty.
+func wavFile(samples []byte, info string) []byte {
+	var b bytes.Buffer
+	wav.WriteHeader(&b, &wav.Format{Tag: 1, Channels: 1, SampleRate: 8000, BitsPerSample: 16, DataSize: int64(len(samples))})
+	b.Write(samples)
+	if info != "" {
+		list := append([]byte("INFO"), info...)
+		b.WriteString("LIST")
+		binary.Write(&b, binary.LittleEndian, uint32(len(list)))
+		b.Write(list)
+	}
+	bs := b.Bytes()
+	binary.LittleEndian.PutUint32(bs[4:], uint32(len(bs)-8))
+	return bs
+}
+
+// flacFile returns the metadata of a FLAC file with the MD5 signature.
+func flacFile(md5 byte) []byte {
+	b := make([]byte, 34)
+	binary.BigEndian.PutUint64(b[10:], 44100<<44|1<<41|15<<36|8000)
+	for i := 18; i < 34; i++ {
+		b[i] = md5
+	}
+	return append([]byte("fLaC\x80\x00\x00\x22"), b...)
+}
+
+func TestAudioHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	frames := bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x64}, 64)
+	id3 := func(size int) []byte {
+		return append([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, byte(size)}, make([]byte, size)...)
+	}
+	samples := bytes.Repeat([]byte{1, 2, 3, 4}, 16)
+
+	tests := []struct {
+		name  string
+		codec audio.Codec
+		a, b  []byte
+		same  bool
+	}{
+		{"mp3 tags", audio.MP3, append(id3(10), frames...), append(append(id3(40), frames...), "TAG"+strings.Repeat(" ", 125)...), true},
+		{"mp3 audio", audio.MP3, append(id3(10), frames...), append(id3(10), frames[4:]...), false},
+		{"wav tags", audio.WAV, wavFile(samples, ""), wavFile(samples, "INAM\x05\x00\x00\x00Song\x00\x00"), true},
+		{"wav audio", audio.WAV, wavFile(samples, ""), wavFile(samples[4:], ""), false},
+		{"flac", audio.FLAC, flacFile(1), flacFile(1), true},
+		{"flac audio", audio.FLAC, flacFile(1), flacFile(2), false},
+	}
+	for _, tt := range tests {
+		var hashes []string
+		for i, data := range [][]byte{tt.a, tt.b} {
+			file := filepath.Join(dir, fmt.Sprintf("%s %d", tt.name, i))
+			if err := ioutil.WriteFile(file, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			h, err := AudioHash(file, tt.codec)
+			if err != nil || h == "" {
+				t.Errorf("%s: hash is %q, %v", tt.name, h, err)
+			}
+			hashes = append(hashes, h)
+		}
+		if same := hashes[0] == hashes[1]; same != tt.same {
+			t.Errorf("%s: hashes %q and %q are equal: %v, want %v", tt.name, hashes[0], hashes[1], same, tt.same)
+		}
+	}
+
+	// FLAC files without an MD5 signature and other files have no hash.
+	file := filepath.Join(dir, "none")
+	ioutil.WriteFile(file, flacFile(0), 0644)
+	if h, err := AudioHash(file, audio.FLAC); h != "" || err != nil {
+		t.Errorf("hash of a FLAC file without MD5 is %q, %v, want none", h, err)
+	}
+	if h, err := AudioHash(file, audio.OGG); h != "" || err != nil {
+		t.Errorf("hash of an Ogg file is %q, %v, want none", h, err)
+	}
+	if _, err := AudioHash(filepath.Join(dir, "missing"), audio.MP3); err == nil {
+		t.Error("hash of a missing file has no error")
+	}
+}
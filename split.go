@@ -0,0 +1,294 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/cue"
+	"github.com/cassava/lackey/audio/loudness"
+	"github.com/cassava/lackey/audio/ogg"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/cassava/lackey/audio/wav"
+	"github.com/goulash/audio"
+)
+
+// trackName returns the name of a track of an image, without extension,
+// such as "01 - Title". Characters that are not allowed in file names on
+// some systems are replaced.
+func trackName(t *cue.Track) string {
+	name := fmt.Sprintf("%02d", t.Number)
+	if title := strings.TrimRight(t.Title, ". "); title != "" {
+		name += " - " + title
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// splitImage decodes the image src, which is of the codec c, and calls fn
+// with the format and a WAV stream of each track of the sheet in turn.
+// The stream of the last track may not know its size in advance.
+func splitImage(ctx context.Context, src string, c audio.Codec, sheet *cue.Sheet, fn func(i int, f *wav.Format, r io.Reader) error) error {
+	return DefaultDecoders.Decode(ctx, src, c, func(r io.Reader) error {
+		format, r, err := wav.ReadHeader(r)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, format.DataOffset); err != nil {
+			return err
+		}
+		frame := int64(format.Channels * ((format.BitsPerSample + 7) / 8))
+		offset := func(t time.Duration) int64 {
+			return frame * int64(math.Round(t.Seconds()*float64(format.SampleRate)))
+		}
+
+		var pos int64
+		for i, t := range sheet.Tracks {
+			start := offset(t.Start)
+			n, err := io.CopyN(ioutil.Discard, r, start-pos)
+			if pos += n; err != nil {
+				return fmt.Errorf("track %d starts after the end of %s", t.Number, src)
+			}
+
+			f := *format
+			f.DataSize = format.DataSize - start
+			if f.DataSize < 0 {
+				f.DataSize = 0
+			}
+			data := &countReader{r: r}
+			if t.End > 0 {
+				f.DataSize = offset(t.End) - start
+				data.r = io.LimitReader(r, f.DataSize)
+			}
+			var hdr bytes.Buffer
+			if err := wav.WriteHeader(&hdr, &f); err != nil {
+				return err
+			}
+			if err := fn(i, &f, io.MultiReader(&hdr, data)); err != nil {
+				return err
+			}
+			// The rest of the track is skipped, if it has not been read.
+			_, err = io.Copy(ioutil.Discard, data)
+			if pos += data.n; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// countReader counts the bytes that are read from r.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// measureImage measures the loudness of the tracks of the image src, and
+// returns their gains, of which the album is the image.
+func measureImage(ctx context.Context, src string, c audio.Codec, sheet *cue.Sheet) ([]*Gain, error) {
+	meters := make([]*loudness.Meter, len(sheet.Tracks))
+	err := splitImage(ctx, src, c, sheet, func(i int, _ *wav.Format, r io.Reader) error {
+		var err error
+		meters[i], err = loudness.Measure(r)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot measure loudness of %s: %s", src, err)
+	}
+
+	album := replayGain(loudness.Loudness(meters...))
+	peak := loudness.Peak(meters...)
+	gains := make([]*Gain, len(meters))
+	for i, m := range meters {
+		gains[i] = &Gain{
+			Track:     replayGain(m.Loudness()),
+			TrackPeak: m.Peak(),
+			Album:     album,
+			AlbumPeak: peak,
+		}
+	}
+	return gains, nil
+}
+
+// splitTrack is a track of an image that has been written to a WAV file,
+// which is encoded like any other source.
+type splitTrack struct {
+	path string
+	fi   os.FileInfo
+	md   audio.Metadata
+}
+
+func newSplitTrack(path string) (*splitTrack, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	md, err := codec.ReadMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+	return &splitTrack{path: path, fi: fi, md: md}, nil
+}
+
+func (t *splitTrack) IsExists() bool                { return true }
+func (t *splitTrack) AbsPath() string               { return t.path }
+func (t *splitTrack) FileInfo() os.FileInfo         { return t.fi }
+func (t *splitTrack) Encoding() audio.Codec         { return audio.WAV }
+func (t *splitTrack) Metadata() audio.Metadata      { return t.md }
+func (t *splitTrack) Properties() *codec.Properties { return codec.PropertiesOf(t.md) }
+
+// writeTrack writes the WAV stream r of a track in the format f to a
+// temporary file, whose header is corrected once the size is known.
+func writeTrack(f *wav.Format, r io.Reader) (string, error) {
+	tmp, err := ioutil.TempFile("", "lackey-*.wav")
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		size := *f
+		size.DataSize = n - 44
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err == nil {
+			err = wav.WriteHeader(tmp, &size)
+		}
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// Split encodes the tracks of the image src, as the CUE sheet describes
+// them, to the files dsts. The tracks are given the tags of the image and
+// those of the sheet, and the gain that they have as part of the image.
+func (o *Runner) Split(src string, dsts []string, md Audio, sheet *cue.Sheet) error {
+	for _, dst := range dsts {
+		if o.Strip {
+			dst = strings.TrimPrefix(dst, o.DstPrefix)
+		}
+		o.Color.Printf("@gsplit:@|    %s\n", dst)
+	}
+	if o.DryRun {
+		return nil
+	}
+
+	ctx := o.context()
+	e := o.encoder(md)
+	var gains []*Gain
+	if o.ReplayGain != NoReplayGain {
+		var err error
+		if gains, err = measureImage(ctx, src, md.Encoding(), sheet); err != nil {
+			return err
+		}
+	}
+	album, err := ReadTags(src, md.Encoding())
+	if err != nil {
+		album = make(tags.Tags)
+	}
+	for _, k := range []string{"CUESHEET", "TITLE", "TRACKNUMBER", "TRACKTOTAL", "ISRC", "LYRICS"} {
+		delete(album, k)
+	}
+	removeGain(album)
+	album.SetChapters(nil)
+
+	return splitImage(ctx, src, md.Encoding(), sheet, func(i int, f *wav.Format, r io.Reader) error {
+		t := make(tags.Tags)
+		for k, v := range album {
+			t[k] = v
+		}
+		for k, v := range sheet.Tags(i) {
+			t[k] = v
+		}
+		var gain *Gain
+		if gains != nil {
+			gain = gains[i]
+		}
+		track, err := writeTrack(f, r)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(track)
+		return o.encodeTrack(ctx, e, src, track, dsts[i], t, gain)
+	})
+}
+
+// encodeTrack encodes the track of the image src, which is in the WAV file
+// track, to path with e, and gives it the tags t and the gain, if it is
+// not nil.
+func (o *Runner) encodeTrack(ctx context.Context, e Encoder, src, track, path string, t tags.Tags, gain *Gain) error {
+	md, err := newSplitTrack(track)
+	if err != nil {
+		return err
+	}
+	job := &Job{
+		Source: track,
+		Audio:  md,
+	}
+	if gain != nil && o.appliesGain(e) && !encodesOpus(e) {
+		job.Gain = gain.Applied()
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	job.Output = f
+	_, err = NewStreamEncoder(e).EncodeStream(ctx, job)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if o.ID3Version != 0 && isMP3(path) {
+		if err := o.convertID3(path); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case gain == nil:
+	case !o.appliesGain(e):
+		gain.setTags(t, encodesOpus(e))
+	case encodesOpus(e):
+		if err := ogg.SetOutputGain(path, q78(gain.Applied())); err != nil {
+			return err
+		}
+	}
+	if err := WriteTags(ctx, path, t); err != nil {
+		return err
+	}
+	if err := o.applyArt(path); err != nil {
+		return err
+	}
+	if o.EmbedCover {
+		return o.embedCover(ctx, src, path, true)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cassava/lackey/audio/cue"
+	"github.com/cassava/lackey/audio/wav"
+	"github.com/goulash/audio"
+)
+
+func TestTrackName(t *testing.T) {
+	tests := []struct {
+		track cue.Track
+		want  string
+	}{
+		{cue.Track{Number: 1, Title: "Song"}, "01 - Song"},
+		{cue.Track{Number: 12}, "12"},
+		{cue.Track{Number: 3, Title: "AC/DC: What?"}, "03 - AC_DC_ What_"},
+		{cue.Track{Number: 4, Title: "Ends with dots..."}, "04 - Ends with dots"},
+		{cue.Track{Number: 100, Title: "Tab\there"}, "100 - Tab_here"},
+	}
+	for _, tt := range tests {
+		if got := trackName(&tt.track); got != tt.want {
+			t.Errorf("%q: name is %q, want %q", tt.track.Title, got, tt.want)
+		}
+	}
+}
+
+// countingImage returns a WAV image of 16-bit stereo samples, whose
+// channels hold the low and the high half of the number of the sample.
+func countingImage(rate, samples int) []byte {
+	var b bytes.Buffer
+	wav.WriteHeader(&b, &wav.Format{Tag: 1, Channels: 2, SampleRate: rate, BitsPerSample: 16, DataSize: int64(4 * samples)})
+	for i := 0; i < samples; i++ {
+		binary.Write(&b, binary.LittleEndian, [2]uint16{uint16(i), uint16(i >> 16)})
+	}
+	return b.Bytes()
+}
+
+func TestSplitImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Tracks start at 0, 37, and 76 CD frames, which are 588 samples each
+	// at 44.1 kHz, 640 at 48 kHz, and 1280 at 96 kHz.
+	sheet, err := cue.Parse([]byte("FILE image.wav WAVE\n" +
+		"TRACK 01 AUDIO\nINDEX 01 00:00:00\n" +
+		"TRACK 02 AUDIO\nINDEX 00 00:00:20\nINDEX 01 00:00:37\n" +
+		"TRACK 03 AUDIO\nINDEX 01 00:01:01\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rate := range []int{44100, 48000, 96000} {
+		perFrame := rate / cue.FramesPerSecond
+		total := 80*perFrame + 123
+		starts := []int{0, 37 * perFrame, 76 * perFrame, total}
+		image := filepath.Join(dir, fmt.Sprintf("image-%d.wav", rate))
+		if err := ioutil.WriteFile(image, countingImage(rate, total), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tracks := 0
+		err := splitImage(context.Background(), image, audio.WAV, sheet, func(i int, f *wav.Format, r io.Reader) error {
+			tracks++
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			format, data, err := wav.ReadHeader(bytes.NewReader(b))
+			if err != nil {
+				return err
+			}
+			samples, _ := ioutil.ReadAll(data)
+			samples = samples[format.DataOffset:]
+			want := starts[i+1] - starts[i]
+			if format.DataSize != int64(4*want) || len(samples) != 4*want {
+				t.Errorf("%d Hz: track %d has %d bytes of size %d, want %d", rate, i+1, len(samples), format.DataSize, 4*want)
+				return nil
+			}
+			first := int(binary.LittleEndian.Uint16(samples)) | int(binary.LittleEndian.Uint16(samples[2:]))<<16
+			last := int(binary.LittleEndian.Uint16(samples[len(samples)-4:])) | int(binary.LittleEndian.Uint16(samples[len(samples)-2:]))<<16
+			if first != starts[i] || last != starts[i+1]-1 {
+				t.Errorf("%d Hz: track %d has samples %d to %d, want %d to %d", rate, i+1, first, last, starts[i], starts[i+1]-1)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%d Hz: %s", rate, err)
+		} else if tracks != 3 {
+			t.Errorf("%d Hz: %d tracks, want 3", rate, tracks)
+		}
+	}
+
+	// Tracks after the end of the image are an error.
+	short := filepath.Join(dir, "short.wav")
+	if err := ioutil.WriteFile(short, countingImage(44100, 588*50), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = splitImage(context.Background(), short, audio.WAV, sheet, func(int, *wav.Format, io.Reader) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "track 3") {
+		t.Errorf("error is %v, want that track 3 starts after the end", err)
+	}
+}
+
+func TestWriteTrack(t *testing.T) {
+	// The stream of the last track may not know its size.
+	f := &wav.Format{Tag: 1, Channels: 1, SampleRate: 8000, BitsPerSample: 16, DataSize: 1 << 20}
+	var b bytes.Buffer
+	wav.WriteHeader(&b, f)
+	b.Write(make([]byte, 160))
+	file, err := writeTrack(f, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+
+	tr, err := newSplitTrack(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Encoding() != audio.WAV || tr.AbsPath() != file || tr.FileInfo().Size() != 44+160 {
+		t.Errorf("track is %s of %d bytes, want WAV of 204", tr.AbsPath(), tr.FileInfo().Size())
+	}
+	if p := tr.Properties(); p.SampleRate != 8000 || p.Channels != 1 {
+		t.Errorf("properties are %+v, want 8 kHz mono", p)
+	}
+}
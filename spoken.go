@@ -0,0 +1,122 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/goulash/audio"
+)
+
+// ChapterMode selects what happens to spoken-word sources with chapters.
+type ChapterMode int
+
+const (
+	// KeepChapters encodes each source as it is, keeping its chapters.
+	KeepChapters ChapterMode = iota
+	// SplitChapters encodes each chapter of a source to its own file.
+	SplitChapters
+	// MergeChapters encodes all spoken-word sources in a directory to a
+	// single file, with a chapter for each of them.
+	MergeChapters
+)
+
+// ParseChapterMode parses the mode "keep", "split", or "merge".
+func ParseChapterMode(s string) (ChapterMode, error) {
+	switch s {
+	case "", "keep":
+		return KeepChapters, nil
+	case "split":
+		return SplitChapters, nil
+	case "merge":
+		return MergeChapters, nil
+	}
+	return KeepChapters, fmt.Errorf("unknown chapter mode %q: must be keep, split, or merge", s)
+}
+
+// DefaultSpokenGenres are the genres of spoken-word sources by default.
+var DefaultSpokenGenres = []string{"Audiobook", "Audiobooks", "Audio Book", "Spoken Word", "Speech", "Podcast"}
+
+// SpokenWord is the profile of spoken-word sources, such as audiobooks,
+// which need far less than music and are encoded with their own encoder,
+// such as mono Opus at 32 kbps. Sources are spoken word if they are M4B
+// files, have one of Genres, or are in a directory with a Marker file or
+// below one.
+type SpokenWord struct {
+	// Encoder encodes spoken-word sources, and decides alone whether they
+	// are copied; the policy of the Runner only applies to music, except
+	// for rules that ignore sources.
+	Encoder Encoder
+
+	Genres []string
+	Marker string
+
+	// Chapters selects whether sources are encoded as they are, split
+	// into their chapters, or merged into a file for each directory.
+	Chapters ChapterMode
+
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+// Is returns true if src is spoken word. A nil profile has no sources.
+func (s *SpokenWord) Is(src Audio) bool {
+	if s == nil {
+		return false
+	}
+	if src.Encoding() == audio.M4B || strings.EqualFold(filepath.Ext(src.AbsPath()), ".m4b") {
+		return true
+	}
+	if md := src.Metadata(); md != nil && md.Genre() != "" {
+		genres := append(strings.Split(md.Genre(), "/"), md.Genre())
+		for _, g := range genres {
+			for _, sg := range s.Genres {
+				if strings.EqualFold(strings.TrimSpace(g), sg) {
+					return true
+				}
+			}
+		}
+	}
+	return s.marked(filepath.Dir(src.AbsPath()))
+}
+
+// marked returns true if the directory or one above it has a marker.
+func (s *SpokenWord) marked(dir string) bool {
+	if s.Marker == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.markedLocked(dir)
+}
+
+func (s *SpokenWord) markedLocked(dir string) bool {
+	if m, ok := s.dirs[dir]; ok {
+		return m
+	}
+	_, err := os.Stat(filepath.Join(dir, s.Marker))
+	m := err == nil
+	if parent := filepath.Dir(dir); !m && parent != dir {
+		m = s.markedLocked(parent)
+	}
+	if s.dirs == nil {
+		s.dirs = make(map[string]bool)
+	}
+	s.dirs[dir] = m
+	return m
+}
+
+// encoder returns the encoder of src, which is that of the spoken-word
+// profile for spoken-word sources.
+func (o *Runner) encoder(src Audio) Encoder {
+	if o.Spoken.Is(src) {
+		return o.Spoken.Encoder
+	}
+	return o.Encoder
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/goulash/audio"
+)
+
+// genreMetadata is metadata with only a genre.
+type genreMetadata struct {
+	audio.Metadata
+	genre string
+}
+
+func (m genreMetadata) Genre() string { return m.genre }
+
+// spokenAudio is a source at path with the genre.
+type spokenAudio struct {
+	*fakeAudio
+	path, genre string
+}
+
+func (a spokenAudio) AbsPath() string          { return a.path }
+func (a spokenAudio) Metadata() audio.Metadata { return genreMetadata{genre: a.genre} }
+
+func TestParseChapterMode(t *testing.T) {
+	tests := map[string]ChapterMode{
+		"":      KeepChapters,
+		"keep":  KeepChapters,
+		"split": SplitChapters,
+		"merge": MergeChapters,
+	}
+	for s, want := range tests {
+		if got, err := ParseChapterMode(s); err != nil || got != want {
+			t.Errorf("%q: mode is %v with error %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"Keep", "join", "splits"} {
+		if _, err := ParseChapterMode(s); err == nil {
+			t.Errorf("%q: parsing succeeded", s)
+		}
+	}
+}
+
+func TestSpokenWordIs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	books := filepath.Join(dir, "Books")
+	if err := os.MkdirAll(filepath.Join(books, "Author", "Title"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "Music"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(books, ".spoken"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mp3 := &fakeAudio{codec.Properties{Codec: audio.MP3}}
+	m4b := &fakeAudio{codec.Properties{Codec: audio.M4B}}
+	song := filepath.Join(dir, "Music", "song.mp3")
+	tests := []struct {
+		name string
+		src  Audio
+		want bool
+	}{
+		{"music", spokenAudio{mp3, song, "Rock"}, false},
+		{"no genre", spokenAudio{mp3, song, ""}, false},
+		{"m4b codec", spokenAudio{m4b, song, ""}, true},
+		{"m4b extension", spokenAudio{mp3, filepath.Join(dir, "Music", "book.M4B"), ""}, true},
+		{"genre", spokenAudio{mp3, song, "Audiobook"}, true},
+		{"genre case", spokenAudio{mp3, song, "spoken word"}, true},
+		{"genre in list", spokenAudio{mp3, song, "Comedy/ Podcast"}, true},
+		{"genre prefix", spokenAudio{mp3, song, "Podcasts and More"}, false},
+		{"marker", spokenAudio{mp3, filepath.Join(books, "book.mp3"), "Rock"}, true},
+		{"below marker", spokenAudio{mp3, filepath.Join(books, "Author", "Title", "01.mp3"), ""}, true},
+	}
+	s := &SpokenWord{Genres: DefaultSpokenGenres, Marker: ".spoken"}
+	for _, tt := range tests {
+		if got := s.Is(tt.src); got != tt.want {
+			t.Errorf("%s: spoken word is %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Markers are only looked for once in each directory.
+	if err := os.Remove(filepath.Join(books, ".spoken")); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Is(spokenAudio{mp3, filepath.Join(books, "Author", "Title", "02.mp3"), ""}) {
+		t.Error("marker is looked for again")
+	}
+
+	// Without a marker, only genres and M4B files count.
+	s = &SpokenWord{Genres: DefaultSpokenGenres}
+	if s.Is(spokenAudio{mp3, filepath.Join(books, "book.mp3"), ""}) {
+		t.Error("source is spoken word without a marker")
+	}
+	var none *SpokenWord
+	if none.Is(spokenAudio{m4b, song, "Audiobook"}) {
+		t.Error("source is spoken word without a profile")
+	}
+}
+
+func TestRunnerEncoder(t *testing.T) {
+	music, spoken := &MP3Encoder{}, &OPUSEncoder{}
+	o := &Runner{Encoder: music}
+	src := spokenAudio{&fakeAudio{codec.Properties{Codec: audio.MP3}}, "/book.mp3", "Audiobook"}
+	if e := o.encoder(src); e != music {
+		t.Errorf("encoder without a profile is %T, want the music encoder", e)
+	}
+	o.Spoken = &SpokenWord{Encoder: spoken, Genres: DefaultSpokenGenres}
+	if e := o.encoder(src); e != spoken {
+		t.Errorf("encoder of spoken word is %T, want the spoken-word encoder", e)
+	}
+	src.genre = "Rock"
+	if e := o.encoder(src); e != music {
+		t.Errorf("encoder of music is %T, want the music encoder", e)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// StateFile is the name of the file in the root of a destination library,
+// in which the State of the destination is stored.
+const StateFile = ".lackey.json"
+
+// State is what a Runner remembers about a destination between syncs.
+type State struct {
+	// Kept contains the sources that were copied instead of transcoded,
+	// because transcoding them did not save enough space. The keys are
+	// relative to the source library.
+	Kept map[string]*KeptSource `json:"kept"`
+
+	// Hashes contains the AudioHash of sources when they were transcoded,
+	// so that a source whose tags changed is only retagged.
+	Hashes map[string]string `json:"hashes"`
+
+	path  string
+	mu    sync.Mutex
+	dirty bool
+}
+
+// KeptSource describes a source when it was kept, so that it is only
+// transcoded again if it changes, or if the encoder does.
+type KeptSource struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+	// Ext is the extension of the encoder that was tried.
+	Ext string `json:"ext"`
+	// Savings is the fraction of the size that transcoding saved.
+	Savings float64 `json:"savings"`
+}
+
+// ReadState reads the state of the destination library at dir.
+// If there is no state yet, an empty one is returned.
+func ReadState(dir string) (*State, error) {
+	s := &State{
+		Kept:   make(map[string]*KeptSource),
+		Hashes: make(map[string]string),
+		path:   filepath.Join(dir, StateFile),
+	}
+	bs, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bs, s); err != nil {
+		return nil, err
+	}
+	if s.Kept == nil {
+		s.Kept = make(map[string]*KeptSource)
+	}
+	if s.Hashes == nil {
+		s.Hashes = make(map[string]string)
+	}
+	return s, nil
+}
+
+// Save writes the state back to the destination, if it has changed.
+func (s *State) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	bs, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path, append(bs, '\n'), 0644); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// IsKept returns true if the source with key was kept by an encoder with
+// the extension ext, and has not changed since.
+func (s *State) IsKept(key string, fi os.FileInfo, ext string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.Kept[key]
+	return ok && k.Ext == ext && k.Size == fi.Size() && k.ModTime.Equal(fi.ModTime())
+}
+
+// Keep remembers that the source with key was kept.
+func (s *State) Keep(key string, k *KeptSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Kept[key] = k
+	s.dirty = true
+}
+
+// Forget forgets that the source with key was kept, if it was.
+func (s *State) Forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Kept[key]; ok {
+		delete(s.Kept, key)
+		s.dirty = true
+	}
+}
+
+// Prune forgets the sources for which exists returns false, such as those
+// that were removed from the source library.
+func (s *State) Prune(exists func(key string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.Kept {
+		if !exists(key) {
+			delete(s.Kept, key)
+			s.dirty = true
+		}
+	}
+	for key := range s.Hashes {
+		if !exists(key) {
+			delete(s.Hashes, key)
+			s.dirty = true
+		}
+	}
+}
+
+// Hash returns the audio hash of the source with key, or "" if unknown.
+func (s *State) Hash(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Hashes[key]
+}
+
+// SetHash remembers the audio hash of the source with key.
+func (s *State) SetHash(key, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Hashes[key] != hash {
+		s.Hashes[key] = hash
+		s.dirty = true
+	}
+}
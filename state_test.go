@@ -0,0 +1,180 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goulash/color"
+)
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "song.flac")
+	if err := ioutil.WriteFile(file, []byte("fLaC"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ReadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Kept) != 0 {
+		t.Errorf("new state keeps %v", s.Kept)
+	}
+	// An unchanged state is not written.
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, StateFile)); !os.IsNotExist(err) {
+		t.Errorf("unchanged state was saved: %v", err)
+	}
+
+	s.Keep("song.flac", &KeptSource{Size: fi.Size(), ModTime: fi.ModTime(), Ext: ".mp3", Savings: 0.05})
+	s.Keep("other.flac", &KeptSource{Size: 1, Ext: ".mp3"})
+	s.Forget("other.flac")
+	s.Forget("missing.flac")
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = ReadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Kept) != 1 {
+		t.Errorf("state read back keeps %d sources, want 1", len(s.Kept))
+	}
+	if !s.IsKept("song.flac", fi, ".mp3") {
+		t.Error("song.flac is not kept after reading the state")
+	}
+	if s.IsKept("song.flac", fi, ".opus") {
+		t.Error("song.flac is kept for another encoder")
+	}
+	if s.IsKept("other.flac", fi, ".mp3") {
+		t.Error("other.flac is kept after it was forgotten")
+	}
+
+	// A source that changes is transcoded again.
+	later := fi.ModTime().Add(time.Second)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ = os.Stat(file); s.IsKept("song.flac", fi, ".mp3") {
+		t.Error("song.flac is kept after it changed")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, StateFile), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadState(dir); err == nil {
+		t.Error("reading an invalid state succeeded")
+	}
+}
+
+func TestRunnerCheckSavings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src", "song.flac")
+	dst := filepath.Join(dir, "dst", "song.mp3")
+	os.Mkdir(filepath.Dir(src), 0755)
+	os.Mkdir(filepath.Dir(dst), 0755)
+	if err := ioutil.WriteFile(src, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := ReadState(filepath.Dir(dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	col := color.New()
+	col.SetOutput(ioutil.Discard)
+	o := &Runner{
+		Color:      col,
+		Encoder:    &MP3Encoder{},
+		MinSavings: 0.2,
+		State:      state,
+		SrcPrefix:  filepath.Dir(src) + "/",
+	}
+
+	// Saving 30% is enough.
+	if err := ioutil.WriteFile(dst, make([]byte, 70), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.checkSavings(src, dst, "song.mp3", o.Encoder); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst); err != nil {
+		t.Errorf("transcoded file was removed: %s", err)
+	}
+	if len(state.Kept) != 0 {
+		t.Errorf("state keeps %v", state.Kept)
+	}
+
+	// Saving 10% is not, and the source is copied instead.
+	if err := ioutil.WriteFile(dst, make([]byte, 90), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.checkSavings(src, dst, "song.mp3", o.Encoder); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("transcoded file was not removed: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "dst", "song.flac")); err != nil || fi.Size() != 100 {
+		t.Errorf("source was not copied: %v", err)
+	}
+	k := state.Kept["song.flac"]
+	if k == nil || k.Ext != ".mp3" || k.Size != 100 || k.Savings < 0.09 || k.Savings > 0.11 {
+		t.Errorf("state keeps %+v, want song.flac for .mp3 saving 10%%", k)
+	}
+}
+
+func TestStateHashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := ReadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := s.Hash("song.flac"); h != "" {
+		t.Errorf("hash of an unknown source is %q", h)
+	}
+	s.SetHash("song.flac", "flac-md5:00")
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = ReadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := s.Hash("song.flac"); h != "flac-md5:00" {
+		t.Errorf("hash read back is %q, want %q", h, "flac-md5:00")
+	}
+	// Setting the same hash again does not change the state.
+	s.SetHash("song.flac", "flac-md5:00")
+	if s.dirty {
+		t.Error("state changed by setting the same hash")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/flac"
+	"github.com/cassava/lackey/audio/mp3"
+	"github.com/cassava/lackey/audio/mp4"
+	"github.com/cassava/lackey/audio/ogg"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/goulash/audio"
+)
+
+var ErrNoTagReader = errors.New("cannot read the tags of this format")
+
+// ReadTags reads all tags of a file with the codec c, with the canonical
+// names of tags.Fields. The tags of FLAC, Ogg, MP3, and MPEG-4 files are
+// read completely; for other formats they are what their metadata has.
+func ReadTags(file string, c audio.Codec) (tags.Tags, error) {
+	switch c {
+	case audio.FLAC:
+		return flac.ReadTags(file)
+	case audio.OGG, codec.Opus:
+		return ogg.ReadTags(file)
+	case audio.MP3:
+		t, err := mp3.ReadTag(file)
+		if err != nil {
+			return nil, err
+		}
+		return t.Tags(), nil
+	case audio.AAC, audio.ALAC, audio.M4A, audio.M4B:
+		return mp4.ReadTags(file)
+	}
+
+	read, ok := audio.MetadataReaders[c]
+	if !ok {
+		return nil, ErrNoTagReader
+	}
+	md, err := read(file)
+	if err != nil {
+		return nil, err
+	}
+	if ct, ok := md.(interface{ CanonicalTags() tags.Tags }); ok {
+		return ct.CanonicalTags(), nil
+	}
+	return tags.FromMetadata(md), nil
+}
+
+// WriteTags replaces the tags of a file with t, according to its extension.
+// MP3, FLAC, Ogg, and MPEG-4 files are written natively, with all fields;
+// other files are remuxed by ffmpeg, which writes the fields it knows.
+// The fields in tags.FileFields are not written.
+func WriteTags(ctx context.Context, file string, t tags.Tags) error {
+	song := make(tags.Tags, len(t))
+	for k, v := range t {
+		if !tags.FileFields[k] {
+			song[k] = v
+		}
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mp3":
+		tag, err := mp3.ReadTag(file)
+		if err != nil {
+			return err
+		}
+		tag.SetTags(song)
+		return tag.Write(file)
+	case ".flac":
+		return flac.WriteTags(file, song)
+	case ".ogg", ".oga", ".opus":
+		return ogg.WriteTags(file, song)
+	case ".m4a", ".m4b", ".mp4":
+		return mp4.WriteTags(file, song)
+	}
+	return writeTagsFFmpeg(ctx, file, song)
+}
+
+// copyTags writes the tags of src, which has the codec c, to dst.
+// If the tags of src cannot be read, dst is left as it is.
+func copyTags(ctx context.Context, src string, c audio.Codec, dst string) error {
+	t, err := ReadTags(src, c)
+	if err == ErrNoTagReader {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return WriteTags(ctx, dst, t)
+}
+
+// ffmpegNames are the names of the ffmpeg metadata keys that differ
+// from the lower-case canonical names.
+var ffmpegNames = map[string]string{
+	"ALBUMARTIST":     "album_artist",
+	"TRACKNUMBER":     "track",
+	"DISCNUMBER":      "disc",
+	"ALBUMSORT":       "sort_album",
+	"ARTISTSORT":      "sort_artist",
+	"TITLESORT":       "sort_name",
+	"ALBUMARTISTSORT": "sort_album_artist",
+	"COMPOSERSORT":    "sort_composer",
+}
+
+// ffmpegTags returns the arguments that set the metadata of the output
+// of ffmpeg to t. Multiple values are joined by semicolons, since ffmpeg
+// keeps only one value for each key.
+func ffmpegTags(t tags.Tags) []string {
+	args := []string{"-map_metadata", "-1"}
+	for _, k := range t.Keys() {
+		v := strings.Join(t[k], ";")
+		switch k {
+		case "TRACKTOTAL", "DISCTOTAL":
+			continue
+		case "TRACKNUMBER", "DISCNUMBER":
+			if total := t.Get(strings.Replace(k, "NUMBER", "TOTAL", 1)); total != "" {
+				v += "/" + total
+			}
+		}
+		name, ok := ffmpegNames[k]
+		if !ok {
+			name = strings.ToLower(k)
+		}
+		args = append(args, "-metadata", name+"="+v)
+	}
+	return args
+}
+
+// writeTagsFFmpeg replaces the tags of file by copying its streams without
+// encoding them into a new file with the tags t, which replaces file.
+func writeTagsFFmpeg(ctx context.Context, file string, t tags.Tags) error {
+	tmp := filepath.Join(filepath.Dir(file), ".retag-"+filepath.Base(file))
+	args := []string{"-v", "error", "-y", "-i", file, "-map", "0", "-c", "copy"}
+	args = append(args, ffmpegTags(t)...)
+	bs, err := exec.CommandContext(ctx, "ffmpeg", append(args, tmp)...).CombinedOutput()
+	if err != nil {
+		os.Remove(tmp)
+		return &ExecError{
+			Err:    err,
+			Output: string(bs),
+		}
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cassava/lackey/audio/codec"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/goulash/audio"
+)
+
+// atom returns an MPEG-4 atom with the name and the children.
+func atom(name string, children ...[]byte) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(8+len(bytes.Join(children, nil))))
+	copy(b[4:], name)
+	return append(b, bytes.Join(children, nil)...)
+}
+
+// opusPage returns an Ogg page of stream 1 with the packet p.
+func opusPage(flags byte, granule int64, seq uint32, p []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("OggS\x00")
+	b.WriteByte(flags)
+	binary.Write(&b, binary.LittleEndian, granule)
+	binary.Write(&b, binary.LittleEndian, uint32(1))
+	binary.Write(&b, binary.LittleEndian, seq)
+	binary.Write(&b, binary.LittleEndian, uint32(0))
+	b.WriteByte(1)
+	b.WriteByte(byte(len(p)))
+	b.Write(p)
+	return b.Bytes()
+}
+
+// mp3File returns MP3 frames without a tag.
+func mp3File() []byte {
+	return bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x64}, 64)
+}
+
+// mp4File returns an MPEG-4 file with an empty moov atom.
+func mp4File() []byte {
+	return append(atom("ftyp", []byte("M4A \x00\x00\x00\x00")), atom("moov")...)
+}
+
+// opusFile returns an Ogg Opus file with the vendor "opusenc" and no
+// comments.
+func opusFile() []byte {
+	var b []byte
+	b = append(b, opusPage(0x02, 0, 0, []byte("OpusHead\x01\x02\x38\x01\x80\xbb\x00\x00\x00\x00\x00"))...)
+	b = append(b, opusPage(0, 0, 1, []byte("OpusTags\x07\x00\x00\x00opusenc\x00\x00\x00\x00"))...)
+	return append(b, opusPage(0x04, 48000, 2, make([]byte, 100))...)
+}
+
+func TestCopyTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []struct {
+		name  string
+		codec audio.Codec
+		data  []byte
+	}{
+		{"song.mp3", audio.MP3, mp3File()},
+		{"song.flac", audio.FLAC, flacFile(1)},
+		{"song.m4a", audio.AAC, mp4File()},
+		{"song.opus", codec.Opus, opusFile()},
+	}
+	for i := range files {
+		files[i].name = filepath.Join(dir, files[i].name)
+		if err := ioutil.WriteFile(files[i].name, files[i].data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := tags.Tags{
+		"TITLE":                 {"Song"},
+		"ARTIST":                {"A", "B"},
+		"ALBUM":                 {"Record"},
+		"DATE":                  {"2001"},
+		"TRACKNUMBER":           {"3"},
+		"TRACKTOTAL":            {"12"},
+		"DISCNUMBER":            {"1"},
+		"COMMENT":               {"Nice"},
+		"MUSICBRAINZ_ALBUMID":   {"abc"},
+		"REPLAYGAIN_ALBUM_GAIN": {"-3.20 dB"},
+		"ENCODER":               {"LAME"},
+	}
+	want := make(tags.Tags)
+	for k, v := range src {
+		if k != "ENCODER" {
+			want[k] = v
+		}
+	}
+
+	ctx := context.Background()
+	if err := WriteTags(ctx, files[0].name, src); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(files); i++ {
+		from, to := files[i-1], files[i]
+		if err := copyTags(ctx, from.name, from.codec, to.name); err != nil {
+			t.Fatalf("%s: %s", filepath.Base(to.name), err)
+		}
+	}
+	for _, f := range files {
+		got, err := ReadTags(f.name, f.codec)
+		if err != nil {
+			t.Errorf("%s: %s", filepath.Base(f.name), err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: tags are %v, want %v", filepath.Base(f.name), got, want)
+		}
+	}
+
+	// The audio of the MP3 file is kept behind the new tag.
+	b, err := ioutil.ReadFile(files[0].name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(b, files[0].data) || !bytes.HasPrefix(b, []byte("ID3\x04")) {
+		t.Error("mp3: file is not the audio after an ID3v2.4 tag")
+	}
+}
+
+func TestFFmpegTags(t *testing.T) {
+	got := ffmpegTags(tags.Tags{
+		"TITLE":       {"Song"},
+		"ARTIST":      {"A", "B"},
+		"ALBUMARTIST": {"X"},
+		"TRACKNUMBER": {"3"},
+		"TRACKTOTAL":  {"12"},
+		"DISCNUMBER":  {"1"},
+	})
+	want := []string{
+		"-map_metadata", "-1",
+		"-metadata", "album_artist=X",
+		"-metadata", "artist=A;B",
+		"-metadata", "disc=1",
+		"-metadata", "title=Song",
+		"-metadata", "track=3/12",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("arguments are %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cassava/lackey/audio/loudness"
+	"github.com/cassava/lackey/audio/mp4"
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/cassava/lackey/audio/wav"
+	"github.com/goulash/audio"
+)
+
+// VideoMode selects what happens to videos, such as music videos and
+// recordings of concerts in the directories of albums.
+type VideoMode int
+
+const (
+	// SkipVideo ignores videos.
+	SkipVideo VideoMode = iota
+	// CopyVideo copies videos as they are.
+	CopyVideo
+	// ExtractVideoAudio encodes the audio stream of videos with the
+	// encoder of the Runner.
+	ExtractVideoAudio
+)
+
+// ParseVideoMode parses the mode "skip", "copy", or "extract-audio".
+func ParseVideoMode(s string) (VideoMode, error) {
+	switch s {
+	case "", "skip":
+		return SkipVideo, nil
+	case "copy":
+		return CopyVideo, nil
+	case "extract-audio":
+		return ExtractVideoAudio, nil
+	}
+	return SkipVideo, fmt.Errorf("unknown video mode %q: must be skip, copy, or extract-audio", s)
+}
+
+// videoNames maps the names of the metadata keys that ffprobe reports to
+// their canonical names, where they differ from the upper-case name.
+var videoNames = map[string]string{
+	"ALBUM_ARTIST":      "ALBUMARTIST",
+	"TRACK":             "TRACKNUMBER",
+	"DISC":              "DISCNUMBER",
+	"SORT_ALBUM":        "ALBUMSORT",
+	"SORT_ARTIST":       "ARTISTSORT",
+	"SORT_NAME":         "TITLESORT",
+	"SORT_ALBUM_ARTIST": "ALBUMARTISTSORT",
+	"SORT_COMPOSER":     "COMPOSERSORT",
+	"DATE_RELEASED":     "DATE",
+}
+
+// videoIgnored are the metadata keys of containers that describe the
+// file rather than its content.
+var videoIgnored = map[string]bool{
+	"MAJOR_BRAND":       true,
+	"MINOR_VERSION":     true,
+	"COMPATIBLE_BRANDS": true,
+	"CREATION_TIME":     true,
+	"ENCODER":           true,
+	"HANDLER_NAME":      true,
+	"DURATION":          true,
+}
+
+// ReadVideoTags reads the tags of the video file: natively from MPEG-4
+// files, and with ffprobe from all others, such as Matroska and WebM.
+func ReadVideoTags(ctx context.Context, file string) (tags.Tags, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mp4", ".m4v", ".mov":
+		if t, err := mp4.ReadTags(file); err == nil {
+			return t, nil
+		}
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format_tags", "-of", "json", file)
+	cmd.Stderr = &stderr
+	bs, err := cmd.Output()
+	if err != nil {
+		return nil, &ExecError{
+			Err:    fmt.Errorf("ffprobe: %s", err),
+			Output: stderr.String(),
+		}
+	}
+	var probe struct {
+		Format struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(bs, &probe); err != nil {
+		return nil, fmt.Errorf("cannot read the output of ffprobe: %s", err)
+	}
+
+	t := make(tags.Tags)
+	for k, v := range probe.Format.Tags {
+		name := strings.ToUpper(k)
+		if videoIgnored[name] {
+			continue
+		}
+		if n, ok := videoNames[name]; ok {
+			name = n
+		}
+		t.Add(name, v)
+	}
+	t.SplitTotals()
+	return t, nil
+}
+
+// decodeVideo decodes the audio stream of the video src into a temporary
+// WAV file.
+func decodeVideo(ctx context.Context, src string) (string, error) {
+	var track string
+	// Only ffmpeg decodes videos, which have no codec of their own.
+	err := DefaultDecoders.Decode(ctx, src, audio.Unknown, func(r io.Reader) error {
+		f, r, err := wav.ReadHeader(r)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, f.DataOffset); err != nil {
+			return err
+		}
+		var hdr bytes.Buffer
+		if err := wav.WriteHeader(&hdr, f); err != nil {
+			return err
+		}
+		track, err = writeTrack(f, io.MultiReader(&hdr, r))
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot decode the audio of %s: %s", src, err)
+	}
+	return track, nil
+}
+
+// AudioExt returns the extension of the encoder, which encodes the audio
+// that is extracted from videos.
+func (o *Runner) AudioExt() string {
+	return o.Encoder.Ext()
+}
+
+// ExtractAudio encodes the audio stream of the video src to dst with the
+// encoder. It is given the tags of album, except for those of its track,
+// and the tags of the video on top, and is titled after the video if it
+// has no title. Its track gain is measured, and its album gain is that of
+// the directory of album, if it is not nil.
+func (o *Runner) ExtractAudio(src, dst string, album Audio) error {
+	path := dst
+	if o.Strip {
+		dst = strings.TrimPrefix(dst, o.DstPrefix)
+	}
+	o.Color.Printf("@gdemux:@|    %s\n", dst)
+	if o.DryRun {
+		return nil
+	}
+
+	ctx := o.context()
+	track, err := decodeVideo(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(track)
+
+	t := make(tags.Tags)
+	if album != nil {
+		if at, err := ReadTags(album.AbsPath(), album.Encoding()); err == nil {
+			t = at
+		}
+		for _, k := range []string{"TITLE", "TRACKNUMBER", "TRACKTOTAL", "ISRC", "LYRICS", "CUESHEET"} {
+			delete(t, k)
+		}
+		removeGain(t)
+		t.SetChapters(nil)
+	}
+	if vt, err := ReadVideoTags(ctx, src); err == nil {
+		for k, v := range vt {
+			t[k] = v
+		}
+	}
+	if t.Get("TITLE") == "" {
+		name := filepath.Base(src)
+		t.Set("TITLE", strings.TrimSuffix(name, filepath.Ext(name)))
+	}
+
+	var gain *Gain
+	if o.ReplayGain != NoReplayGain {
+		var m *loudness.Meter
+		err := DefaultDecoders.Decode(ctx, track, audio.WAV, func(r io.Reader) error {
+			var err error
+			m, err = loudness.Measure(r)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("cannot measure loudness of %s: %s", src, err)
+		}
+		gain = &Gain{
+			Track:     replayGain(m.Loudness()),
+			TrackPeak: m.Peak(),
+			Album:     replayGain(m.Loudness()),
+			AlbumPeak: m.Peak(),
+		}
+		if album != nil {
+			if g, err := o.gain(ctx, album.AbsPath()); err == nil {
+				gain.Album, gain.AlbumPeak = g.Album, g.AlbumPeak
+			}
+		}
+	}
+	return o.encodeTrack(ctx, o.Encoder, src, track, path, t, gain)
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2016, Ben Morgan. All rights reserved.
+// Use of this source code is governed by an MIT license
+// that can be found in the LICENSE file.
+
+package lackey
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cassava/lackey/audio/tags"
+	"github.com/cassava/lackey/audio/wav"
+	"github.com/goulash/color"
+)
+
+// fakeProgram puts a shell script with the name and the body first in the
+// PATH, and returns a function that restores the PATH.
+func fakeProgram(t *testing.T, dir, name, body string) func() {
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	return func() { os.Setenv("PATH", path) }
+}
+
+func TestParseVideoMode(t *testing.T) {
+	tests := map[string]VideoMode{
+		"":              SkipVideo,
+		"skip":          SkipVideo,
+		"copy":          CopyVideo,
+		"extract-audio": ExtractVideoAudio,
+	}
+	for s, want := range tests {
+		if got, err := ParseVideoMode(s); err != nil || got != want {
+			t.Errorf("%q: mode is %v with error %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"extract", "Copy", "audio"} {
+		if _, err := ParseVideoMode(s); err == nil {
+			t.Errorf("%q: parsing succeeded", s)
+		}
+	}
+}
+
+func TestReadVideoTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	// MPEG-4 videos are read natively.
+	mp4 := filepath.Join(dir, "clip.mp4")
+	if err := ioutil.WriteFile(mp4, mp4File(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := tags.Tags{"TITLE": {"Clip"}, "ARTIST": {"Band"}}
+	if err := WriteTags(ctx, mp4, want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadVideoTags(ctx, mp4); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("tags are %v with error %v, want %v", got, err, want)
+	}
+
+	// Other videos are read with ffprobe, whose names are made canonical,
+	// and whose fields that describe the container are dropped.
+	mkv := filepath.Join(dir, "concert.mkv")
+	if err := ioutil.WriteFile(mkv, []byte("not a video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restore := fakeProgram(t, dir, "ffprobe", `cat <<'EOF'
+{
+    "format": {
+        "tags": {
+            "title": "Live",
+            "ALBUM_ARTIST": "Band",
+            "track": "3/12",
+            "DATE_RELEASED": "2001",
+            "major_brand": "isom",
+            "ENCODER": "Lavf58.29.100",
+            "DURATION": "00:03:25.000000000"
+        }
+    }
+}
+EOF`)
+	defer restore()
+	want = tags.Tags{
+		"TITLE":       {"Live"},
+		"ALBUMARTIST": {"Band"},
+		"TRACKNUMBER": {"3"},
+		"TRACKTOTAL":  {"12"},
+		"DATE":        {"2001"},
+	}
+	if got, err := ReadVideoTags(ctx, mkv); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("tags are %v with error %v, want %v", got, err, want)
+	}
+
+	defer fakeProgram(t, dir, "ffprobe", "echo '{\"format\": '")()
+	if _, err := ReadVideoTags(ctx, mkv); err == nil {
+		t.Error("reading invalid output succeeded")
+	}
+	defer fakeProgram(t, dir, "ffprobe", "echo 'Invalid data found' >&2; exit 1")()
+	_, err = ReadVideoTags(ctx, mkv)
+	if e, ok := err.(*ExecError); !ok || e.Output != "Invalid data found\n" {
+		t.Errorf("error is %#v, want one with the output of ffprobe", err)
+	}
+}
+
+func TestDecodeVideo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake ffmpeg decodes the video, which is a WAV file already, by
+	// writing it out as it is.
+	samples := bytes.Repeat([]byte{1, 2}, 800)
+	video := filepath.Join(dir, "clip.webm")
+	if err := ioutil.WriteFile(video, wavFile(samples, ""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer fakeProgram(t, dir, "ffmpeg", `cat "$4"`)()
+
+	track, err := decodeVideo(context.Background(), video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(track)
+	b, err := ioutil.ReadFile(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, r, err := wav.ReadHeader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	data = data[f.DataOffset:]
+	if f.SampleRate != 8000 || f.DataSize != int64(len(samples)) || !bytes.Equal(data, samples) {
+		t.Errorf("track is %+v with %d bytes, want the %d samples of the video", f, len(data), len(samples))
+	}
+
+	if _, err := decodeVideo(context.Background(), filepath.Join(dir, "missing.webm")); err == nil {
+		t.Error("decoding a missing video succeeded")
+	}
+}
+
+func TestExtractAudioDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lackey-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var out bytes.Buffer
+	col := color.New()
+	col.SetOutput(&out)
+	o := &Runner{Color: col, Encoder: &MP3Encoder{}, DryRun: true}
+	if ext := o.AudioExt(); ext != ".mp3" {
+		t.Errorf("extension is %q, want %q", ext, ".mp3")
+	}
+	dst := filepath.Join(dir, "clip.mp3")
+	if err := o.ExtractAudio(filepath.Join(dir, "missing.mkv"), dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote %s", dst)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("demux:")) {
+		t.Errorf("output is %q, want the demuxed file", out.String())
+	}
+}